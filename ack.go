@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// ackHeader carries the ids of the commands an agent received since its
+// last poll, so the server can tell a command an agent never saw from one
+// it is still running. Agents sign it with the poll, and the server ignores
+// it on polls that are not signed.
+const ackHeader = "X-Captain-Ack"
+
+// maxAcks is the most ids acknowledged in a poll. Others wait for the next.
+const maxAcks = 100
+
+// ack queues the acknowledgment of c for the next poll.
+func (ag *agent) ack(c *cmd) {
+	ag.mu.Lock()
+	defer ag.mu.Unlock()
+	ag.acks = append(ag.acks, c.ID)
+}
+
+// takeAcks returns the acknowledgments to send with a poll.
+func (ag *agent) takeAcks() []string {
+	ag.mu.Lock()
+	defer ag.mu.Unlock()
+	n := min(len(ag.acks), maxAcks)
+	acks := ag.acks[:n:n]
+	ag.acks = ag.acks[n:]
+	return acks
+}
+
+// requeueAcks puts back the acknowledgments of a poll that failed.
+func (ag *agent) requeueAcks(acks []string) {
+	ag.mu.Lock()
+	defer ag.mu.Unlock()
+	ag.acks = append(acks, ag.acks...)
+}
+
+// acked records the commands agent acknowledged in a poll. Ids of unknown
+// commands, or of commands not targeting agent, are ignored. The caller
+// holds a.mu.
+func (a *app) acked(agent, header string) {
+	if header == "" {
+		return
+	}
+	ids := strings.Split(header, ",")
+	if len(ids) > maxAcks {
+		ids = ids[:maxAcks]
+	}
+	cmds, err := a.store.cmds()
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	now := time.Now()
+	for _, id := range ids {
+		id = strings.TrimSpace(id)
+		for _, c := range cmds {
+			if c.ID != id || !c.targets(agent) {
+				continue
+			}
+			if err = a.store.addDelivery(c.ID, agent, now); err != nil {
+				fmt.Println(err)
+			}
+			break
+		}
+	}
+}
+
+// withDeliveries returns copies of cmds with the agents that received
+// them. The caller holds a.mu.
+func (a *app) withDeliveries(cmds []*cmd) ([]*cmd, error) {
+	out := make([]*cmd, len(cmds))
+	for i, c := range cmds {
+		delivered, err := a.store.deliveries(c.ID)
+		if err != nil {
+			return nil, err
+		}
+		cp := *c
+		if len(delivered) > 0 {
+			cp.Delivered = delivered
+		}
+		out[i] = &cp
+	}
+	return out, nil
+}
@@ -0,0 +1,513 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdh"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os/exec"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"lukechampine.com/blake3"
+)
+
+var signals = map[string]syscall.Signal{
+	"HUP":  syscall.SIGHUP,
+	"INT":  syscall.SIGINT,
+	"KILL": syscall.SIGKILL,
+	"TERM": syscall.SIGTERM,
+}
+
+type agent struct {
+	id, target string
+	poll       time.Duration
+	pollMin    time.Duration // bounds of the polling intervals hinted by the server,
+	pollMax    time.Duration // which are ignored if pollMax is 0
+	hint       time.Duration // the polling interval hinted by the server
+	slept      time.Duration // between the last two polls
+	catchUp    time.Duration
+	key        []byte
+	credential bool // key is a credential issued on enrollment
+	identity   *ecdh.PrivateKey
+	workers    int
+	once       bool
+	natsURL    string
+	cosigners  *cosigners
+	delegates  *delegates
+	channel    string
+	nats       *natsConn
+	redactor   *redactor
+	queue      *queue
+	running    map[string]*exec.Cmd
+	supervisor *supervisor // nil for simulated agents
+	executors  map[string]executor
+	state      *state         // nil for simulated agents
+	quiet      bool           // simulated agents do not log commands
+	served     time.Time      // server time of the last poll response
+	config     *agentConfig   // pushed by the server
+	cache      *artifactCache // nil for simulated agents
+	acks       []string       // ids of received commands, sent with the next poll
+	mu         sync.Mutex
+}
+
+func (ag *agent) hasher() *blake3.Hasher {
+	return blake3.New(32, ag.key)
+}
+
+// obey polls the server and executes new commands, starting immediately.
+// In once mode, it polls a single time, and returns when the commands have
+// been executed.
+func (ag *agent) obey() error {
+	var before map[string]bool
+	if ag.state != nil {
+		before = ag.state.executedBefore()
+	}
+	ag.queue = newQueue(before)
+	wg := &sync.WaitGroup{}
+	for i := 0; i < ag.workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ag.work()
+		}()
+	}
+	if ag.state != nil {
+		ag.reportReboot()
+		ag.restoreSupervised()
+	}
+	h := ag.hasher()
+	if ag.natsURL != "" {
+		return ag.obeyNATS(h)
+	}
+	seen := make(map[string]bool)
+	published := false
+	started := time.Now()
+	for first := true; ; first = false {
+		if !first {
+			ag.slept = ag.interval()
+			time.Sleep(ag.slept)
+		}
+		cmds, err := ag.fetchCmds(h)
+		if err == nil && ag.state != nil {
+			ag.flushOutbox()
+		}
+		if !published {
+			if err := ag.publishKey(); err != nil {
+				fmt.Println(err)
+			} else {
+				published = true
+			}
+		}
+		if err != nil && ag.once {
+			return err
+		}
+		if err != nil {
+			fmt.Println(err)
+			continue
+		}
+		debugf("polled %d commands\n", len(cmds))
+		current := make(map[string]bool, len(cmds))
+		for _, c := range cmds {
+			current[c.Sum] = true
+			if !seen[c.Sum] {
+				ag.handle(c, h, started)
+			}
+		}
+		seen = current
+		if ag.once {
+			ag.queue.close()
+			wg.Wait()
+			return nil
+		}
+	}
+}
+
+// obeyNATS receives commands over NATS, reconnecting every poll interval
+// while the connection is down.
+func (ag *agent) obeyNATS(h *blake3.Hasher) error {
+	started := time.Now()
+	for {
+		if err := ag.publishKey(); err != nil {
+			fmt.Println(err)
+		}
+		if ag.state != nil {
+			ag.flushOutbox()
+		}
+		fmt.Println(ag.subscribe(ag.natsURL, h, started))
+		time.Sleep(ag.effective().Poll)
+	}
+}
+
+// handle verifies c and dispatches it. Commands issued before the agent
+// started are executed if issued within the catch-up window, or if their
+// window opens after the agent started, and skipped silently otherwise.
+func (ag *agent) handle(c *cmd, h *blake3.Hasher, started time.Time) {
+	// A command may be a whole poll interval old when it is fetched, plus
+	// the time taken to fetch it.
+	ttl := 2 * max(ag.effective().Poll, ag.slept)
+	windowed := !c.NotBefore.IsZero() || !c.NotAfter.IsZero() || c.LocalHours != ""
+	// At-least-once commands received before a restart are run again,
+	// however old, as the signature is checked against what was received.
+	pending := c.Delivery == deliveryAtLeastOnce && ag.state != nil && ag.state.wasPending(c.ID)
+	if c.Created.Before(started) {
+		if started.Sub(c.Created) > ag.catchUp && !c.opensAfter(started) && !pending {
+			debugf("%s: skipped, issued before the agent started, beyond -catch-up\n", c.ref())
+			return
+		}
+		ttl = time.Since(started) + ag.catchUp
+	}
+	// The signed window replaces the age limit.
+	if windowed || pending {
+		ttl = 0
+	}
+	if err := checkVersion(c.Version); err != nil {
+		logf("%s: %s\n", c.ref(), err)
+		return
+	}
+	// An enrolled agent does not hold the key commands are signed with:
+	// the poll response, signed with its credential, vouches for them.
+	ch := h
+	if ag.credential {
+		ch = nil
+	}
+	if err := verifyCmd(c, ch, ttl); err != nil {
+		logf("%s: %s\n", c.ref(), err)
+		return
+	}
+	// Commands the server derived are checked against their origin, which
+	// operators and cosigners signed.
+	switch {
+	case c.Delegation != nil && ag.delegates != nil:
+		if err := ag.delegates.check(c, ch, ag.cosigners); err != nil {
+			fmt.Printf("%s: delegation: %s\n", c.ref(), err)
+			return
+		}
+	case ag.cosigners != nil:
+		if err := ag.cosigners.check(c); err != nil {
+			fmt.Printf("%s: %s\n", c.ref(), err)
+			return
+		}
+	}
+	if !c.targets(ag.id) || !ag.inChannel(c) {
+		debugf("%s: skipped, not targeting this agent or its channel\n", c.ref())
+		return
+	}
+	if ag.state != nil && ag.state.wasExecuted(c.ID) {
+		debugf("%s: skipped, executed before\n", c.ref())
+		return
+	}
+	c.received = time.Now()
+	if c.Type != pingType {
+		ag.ack(c)
+	}
+	switch {
+	case c.Delivery == deliveryAtMostOnce && c.Created.Before(started) && !c.opensAfter(started):
+		err := errors.New("skipped at-most-once command issued before the agent started")
+		fmt.Printf("%s: %s\n", c.ref(), err)
+		ag.report(c, newResult(c, ag.id, nil, err))
+		// Skipped once, not again after every restart.
+		if ag.state != nil {
+			if err = ag.state.markExecuted(c.ID); err != nil {
+				fmt.Printf("%s: %s\n", c.ref(), err)
+			}
+		}
+		return
+	case c.Delivery == deliveryAtLeastOnce && ag.state != nil:
+		if err := ag.state.markPending(c.ID); err != nil {
+			fmt.Printf("%s: %s\n", c.ref(), err)
+		}
+	}
+	if now := time.Now(); windowed {
+		due := c.NotBefore
+		if c.LocalHours != "" {
+			start := now
+			if c.NotBefore.After(now) {
+				start = c.NotBefore
+			}
+			due = nextOpen(c.LocalHours, start.Local())
+		}
+		switch {
+		case !c.NotAfter.IsZero() && now.After(c.NotAfter):
+			logf("%s: window closed at %s\n", c.ref(), c.NotAfter)
+			return
+		case !c.NotAfter.IsZero() && due.After(c.NotAfter):
+			logf("%s: local hours %s do not open before the window closes at %s\n", c.ref(), c.LocalHours, c.NotAfter)
+			return
+		case now.Before(due) && ag.once:
+			logf("%s: not due until %s\n", c.ref(), due)
+			return
+		case now.Before(due):
+			logf("%s: waiting until %s\n", c.ref(), due)
+			time.AfterFunc(due.Sub(now), func() { ag.dispatch(c) })
+			return
+		}
+	}
+	ag.dispatch(c)
+}
+
+// dispatch signals a running command, or queues c for a worker.
+func (ag *agent) dispatch(c *cmd) {
+	if c.Signal != "" {
+		ag.signal(c)
+		return
+	}
+	if err := ag.queue.push(c); err != nil {
+		ag.report(c, newResult(c, ag.id, nil, err))
+	}
+}
+
+func (ag *agent) work() {
+	for {
+		c, err := ag.queue.pop()
+		if c == nil {
+			return
+		}
+		if err != nil {
+			fmt.Printf("%s: %s\n", c.ref(), err)
+			ag.report(c, newResult(c, ag.id, nil, err))
+		} else {
+			ag.execute(c)
+		}
+		ag.queue.done()
+	}
+}
+
+func (ag *agent) execute(c *cmd) {
+	// The journal keeps what the server sent, so sealed args stay sealed.
+	sent := c
+	if c.Type == sealedType {
+		open, err := ag.unseal(c)
+		if err != nil {
+			fmt.Printf("%s: %s\n", c.ref(), err)
+			ag.report(c, newResult(c, ag.id, nil, err))
+			return
+		}
+		c = open
+	}
+	if !ag.allows(c) {
+		err := fmt.Errorf("%s is not allowed by the agent config", c.Name)
+		fmt.Printf("%s: %s\n", c.ref(), err)
+		ag.report(sent, newResult(c, ag.id, nil, err))
+		return
+	}
+	if c.Lock != "" {
+		err := errNoLockServer
+		if ag.target != "" {
+			err = ag.waitLease(c)
+		}
+		if err != nil {
+			fmt.Printf("%s: %s\n", c.ref(), err)
+			ag.report(sent, newResult(c, ag.id, nil, err))
+			return
+		}
+		defer ag.renewLease(c)()
+	}
+	if c.Type != pingType && ag.target != "" {
+		if err := ag.waitSlot(c); err != nil {
+			fmt.Printf("%s: %s\n", c.ref(), err)
+			ag.report(sent, newResult(c, ag.id, nil, err))
+			return
+		}
+	}
+	if !ag.quiet {
+		logf("will execute: %+v\n", c)
+	}
+	// Commands are marked before they run, so a crash does not run them
+	// twice, unless they must run at least once.
+	if ag.state != nil && sent.Delivery != deliveryAtLeastOnce {
+		if err := ag.state.markExecuted(c.ID); err != nil {
+			fmt.Printf("%s: %s\n", c.ref(), err)
+			if sent.Delivery == deliveryAtMostOnce {
+				ag.report(sent, newResult(c, ag.id, nil, fmt.Errorf("not executed, as it could not be recorded: %w", err)))
+				return
+			}
+		}
+	}
+	start := time.Now()
+	res := ag.run(c)
+	res.Duration = time.Since(start)
+	res.Timing = &timing{Enqueued: c.Created, Received: sent.received, Started: start, Finished: start.Add(res.Duration)}
+	if c.Type == rebootType && res.Error == "" && ag.state != nil {
+		res.State = stateRebooting
+	}
+	if c.JSON && len(res.Data) == 0 {
+		// Redact before parsing, as the data is not redacted when reported.
+		res.Output = ag.redactor.redact(res.Output)
+		res.captureJSON()
+	}
+	if c.Verify != nil && res.Error == "" {
+		res.Check = c.Verify.run()
+		logf("verification %s\n", res.Check)
+	}
+	if c.Expect != nil {
+		res.Assert = c.Expect.assert(res)
+	}
+	ag.report(sent, res)
+	if ag.state != nil && sent.Delivery == deliveryAtLeastOnce {
+		if err := ag.state.markExecuted(c.ID); err != nil {
+			fmt.Printf("%s: %s\n", c.ref(), err)
+		}
+	}
+}
+
+func (ag *agent) run(c *cmd) *result {
+	ex, ok := ag.executors[c.Type]
+	if !ok {
+		return newResult(c, ag.id, nil, fmt.Errorf("unsupported command type %s", c.Type))
+	}
+	env, err := ag.secretEnv()
+	if err != nil {
+		fmt.Printf("%s: %s\n", c.ref(), err)
+		return newResult(c, ag.id, nil, err)
+	}
+	ctx := context.Background()
+	if c.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.Timeout)
+		defer cancel()
+	}
+	out, data, err := ex.execute(ctx, c, env)
+	if err != nil {
+		fmt.Printf("%s: %s\n", c.ref(), err)
+	}
+	res := newResult(c, ag.id, out, err)
+	if err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		res.State, res.Signal = stateTimedOut, ""
+	}
+	res.Data = data
+	return res
+}
+
+func (ag *agent) signal(c *cmd) {
+	sig, ok := signals[strings.ToUpper(c.Signal)]
+	if !ok {
+		ag.report(c, newResult(c, ag.id, nil, fmt.Errorf("unsupported signal %s", c.Signal)))
+		return
+	}
+	ag.mu.Lock()
+	oscmd := ag.running[c.Ref]
+	ag.mu.Unlock()
+	if oscmd == nil {
+		ag.report(c, newResult(c, ag.id, nil, fmt.Errorf("%s is not running", c.Ref)))
+		return
+	}
+	fmt.Printf("%s: sending %s to %s\n", c.ref(), c.Signal, c.Ref)
+	err := oscmd.Process.Signal(sig)
+	ag.report(c, newResult(c, ag.id, []byte("sent "+c.Signal+" to "+c.Ref), err))
+}
+
+// report posts the result of c, and records both in the journal.
+func (ag *agent) report(c *cmd, res *result) {
+	res.Output = ag.redactor.redact(res.Output)
+	res.Error = ag.redactor.redact(res.Error)
+	res.Created = time.Now()
+	if ag.queue != nil {
+		ag.queue.finished(c.ID, !res.failed())
+	}
+	posted := ag.deliver(res)
+	if ag.state != nil && c.Type != pingType {
+		if err := ag.state.journal(newJournalEntry(c, res, posted)); err != nil {
+			fmt.Printf("%s: journal: %s\n", res.ref(), err)
+		}
+	}
+}
+
+// deliver publishes or posts res, keeping it in the outbox if the server is
+// unreachable. It reports whether res reached the server.
+func (ag *agent) deliver(res *result) bool {
+	ag.mu.Lock()
+	nc := ag.nats
+	ag.mu.Unlock()
+	if nc != nil {
+		if err := publishResult(nc, res, ag.hasher()); err == nil {
+			return true
+		}
+	}
+	if err := postResult(res, ag.hasher(), ag.target); err != nil {
+		fmt.Printf("%s: %s\n", res.ref(), err)
+		if ag.state != nil && unreachable(err) {
+			if err = ag.state.keep(res); err != nil {
+				fmt.Printf("%s: %s\n", res.ref(), err)
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// fetchCmds polls the queue, and verifies the response is signed by the
+// server, and newer than the last one.
+func (ag *agent) fetchCmds(h *blake3.Hasher) ([]*cmd, error) {
+	req, err := http.NewRequest("GET", ag.target, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set(agentHeader, ag.id)
+	req.Header.Set(pollHeader, ag.interval().String())
+	req.Header.Set(configHeader, ag.configHeader())
+	if h := ag.supervisor.header(); h != "" {
+		req.Header.Set(supervisedHeader, h)
+	}
+	acks := ag.takeAcks()
+	if len(acks) > 0 {
+		req.Header.Set(ackHeader, strings.Join(acks, ","))
+	}
+	ag.signPollHeaders(req, h)
+	resp, err := client.Do(req)
+	if err != nil {
+		ag.requeueAcks(acks)
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if err = headerVersion(resp.Header); err != nil {
+		ag.requeueAcks(acks)
+		return nil, fmt.Errorf("server: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNoContent {
+		ag.requeueAcks(acks)
+		return nil, fmt.Errorf("server: %w", responseError(resp))
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	served, err := verifyPoll(resp.Header, body, h, ag.served)
+	if err != nil {
+		return nil, fmt.Errorf("server: %w", err)
+	}
+	ag.served = served
+	ag.hinted(resp.Header.Get(hintHeader))
+	if ag.state != nil {
+		if err = ag.state.markServed(served); err != nil {
+			return nil, err
+		}
+	}
+	if err = ag.applyConfig(resp.Header.Get(configHeader), h); err != nil {
+		fmt.Printf("config: %s\n", err)
+	}
+	cmds := make([]*cmd, 0)
+	if len(body) == 0 {
+		// The queue is empty.
+		return cmds, nil
+	}
+	err = json.Unmarshal(body, &cmds)
+	return cmds, err
+}
+
+func (c *cmd) targets(agent string) bool {
+	if len(c.Agents) == 0 {
+		return true
+	}
+	for _, a := range c.Agents {
+		if a == agent {
+			return true
+		}
+	}
+	return false
+}
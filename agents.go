@@ -0,0 +1,216 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// pollHeader announces the polling interval of an agent, so the server
+	// can tell how many polls it missed.
+	pollHeader   = "X-Captain-Poll"
+	offlineEvery = 10 * time.Second
+	statusOnline = "online"
+	statusOff    = "offline"
+)
+
+type agentStatus struct {
+	Agent, Status string
+	Poll          time.Duration `json:",omitempty"`
+	LastSeen      time.Time
+	Config        *agentConfig        `json:",omitempty"` // as reported by the agent
+	Drift         bool                `json:",omitempty"`
+	Reboot        string              `json:",omitempty"` // rebooting, or lost if it did not come back
+	Supervised    []*supervisedStatus `json:",omitempty"` // as reported by the agent
+}
+
+// presence is posted to the offline callback when an agent goes offline,
+// or comes back. Text is shown by chat webhooks.
+type presence struct {
+	Agent, Status     string
+	LastSeen, Created time.Time
+	Text              string `json:"text"`
+}
+
+// polled records the polling interval announced by agent, and reports it
+// back online if it was offline. The caller holds a.mu.
+func (a *app) polled(agent, interval string) {
+	if a.polls == nil {
+		return
+	}
+	if d, err := time.ParseDuration(interval); err == nil && d > 0 {
+		a.polls[agent] = d
+	}
+	if a.offline[agent] {
+		delete(a.offline, agent)
+		a.notifyPresence(agent, statusOnline, time.Now())
+	}
+}
+
+// status is offline for agents that missed a.missed polls. The caller holds
+// a.mu.
+func (a *app) status(agent string, now time.Time) *agentStatus {
+	s := &agentStatus{Agent: agent, Status: statusOnline, Poll: a.polls[agent], LastSeen: a.lastSeen[agent]}
+	s.Config, s.Drift, s.Supervised = a.configs[agent], a.drifted[agent], a.supervised[agent]
+	if w := a.reboots[agent]; w != nil {
+		s.Reboot = stateRebooting
+		if w.Lost {
+			s.Reboot = statusLost
+		}
+	}
+	poll := s.Poll
+	if poll == 0 {
+		poll = defaultPoll
+	}
+	if a.missed > 0 && now.Sub(s.LastSeen) > time.Duration(a.missed)*poll {
+		s.Status = statusOff
+	}
+	return s
+}
+
+// detectOffline marks agents offline once they missed a.missed polls.
+func (a *app) detectOffline() {
+	for now := range time.Tick(offlineEvery) {
+		a.mu.Lock()
+		for agent := range a.lastSeen {
+			if a.offline[agent] || a.status(agent, now).Status != statusOff {
+				continue
+			}
+			a.offline[agent] = true
+			a.notifyPresence(agent, statusOff, now)
+		}
+		a.mu.Unlock()
+	}
+}
+
+// notifyPresence logs a change of the status of agent, forwards it to the
+// log sinks, and posts it to the offline callback. The caller holds a.mu.
+func (a *app) notifyPresence(agent, status string, now time.Time) {
+	p := &presence{Agent: agent, Status: status, LastSeen: a.lastSeen[agent], Created: now.Round(0)}
+	p.Text = fmt.Sprintf("captain: agent %s is %s, last seen %s", agent, status, p.LastSeen.Format(time.RFC3339))
+	fmt.Printf("%s: agent %s is %s\n", p.Created, agent, status)
+	a.forward(&entry{Kind: status, Agent: agent, Msg: p.Text, Time: p.Created})
+	if a.offlineHook == "" {
+		return
+	}
+	body, err := json.Marshal(p)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	sig := a.signHook(body)
+	go func() {
+		if err := postHook(a.offlineHook, body, sig); err != nil {
+			fmt.Printf("agent %s: offline callback: %s\n", agent, err)
+		}
+	}()
+}
+
+// handleGetAgents lists the agents the server heard from, filtered by a
+// status=online or status=offline parameter.
+func (a *app) handleGetAgents(w http.ResponseWriter, r *http.Request) {
+	if !a.viewer(w, r, "agents") {
+		return
+	}
+	want := r.URL.Query().Get("status")
+	if want != "" && want != statusOnline && want != statusOff {
+		httpError(w, "status must be online or offline", http.StatusBadRequest)
+		return
+	}
+	now := time.Now()
+	found := make([]*agentStatus, 0)
+	a.mu.Lock()
+	for agent := range a.lastSeen {
+		if s := a.status(agent, now); want == "" || s.Status == want {
+			found = append(found, s)
+		}
+	}
+	a.mu.Unlock()
+	sort.Slice(found, func(i, j int) bool { return found[i].Agent < found[j].Agent })
+	payload, err := json.Marshal(found)
+	if err != nil {
+		httpError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write(payload)
+}
+
+func getAgents(status, target string) ([]*agentStatus, error) {
+	resp, err := client.Get(target + "/agents?status=" + status)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, responseError(resp)
+	}
+	agents := make([]*agentStatus, 0)
+	err = json.NewDecoder(resp.Body).Decode(&agents)
+	return agents, err
+}
+
+// printAgents prints agents in columns on a terminal, and a line each
+// otherwise.
+func printAgents(agents []*agentStatus) {
+	if !stdoutTerminal {
+		for _, s := range agents {
+			printAgent(s)
+		}
+		return
+	}
+	rows := make([][]string, len(agents))
+	for i, s := range agents {
+		poll, tags, notes := "-", "-", make([]string, 0)
+		if s.Poll > 0 {
+			poll = s.Poll.String()
+		}
+		if s.Config != nil && len(s.Config.Tags) > 0 {
+			tags = fmt.Sprint(s.Config.Tags)
+		}
+		if s.Drift {
+			notes = append(notes, "config drifted")
+		}
+		if s.Reboot != "" {
+			notes = append(notes, "reboot "+s.Reboot)
+		}
+		for _, p := range s.Supervised {
+			notes = append(notes, "supervising "+p.String())
+		}
+		rows[i] = []string{s.Agent, s.Status, s.LastSeen.Format(time.RFC3339), poll, tags, strings.Join(notes, ", ")}
+	}
+	printTable([]string{"AGENT", "STATUS", "LAST SEEN", "POLL", "TAGS", "NOTES"}, rows, func(row, col int) string {
+		switch {
+		case col == 1 && agents[row].Status == statusOnline:
+			return colorGreen
+		case col == 1:
+			return colorRed
+		case col == 5:
+			return colorYellow
+		}
+		return ""
+	})
+}
+
+func printAgent(s *agentStatus) {
+	fmt.Printf("%s: %s, last seen %s", s.Agent, s.Status, s.LastSeen.Format(time.RFC3339))
+	if s.Poll > 0 {
+		fmt.Printf(", polls every %s", s.Poll)
+	}
+	if s.Config != nil && len(s.Config.Tags) > 0 {
+		fmt.Printf(", tags %v", s.Config.Tags)
+	}
+	if s.Drift {
+		fmt.Print(", config drifted")
+	}
+	if s.Reboot != "" {
+		fmt.Print(", reboot " + s.Reboot)
+	}
+	for _, p := range s.Supervised {
+		fmt.Print(", supervising " + p.String())
+	}
+	fmt.Println()
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// allowRule restricts requests by method and path prefix to networks.
+type allowRule struct {
+	method, prefix string
+	nets           []*net.IPNet
+}
+
+// parseAllow parses "[METHOD ]/path=cidr,cidr". Plain addresses are
+// accepted as single-host networks.
+func parseAllow(spec string) (*allowRule, error) {
+	route, cidrs, ok := strings.Cut(spec, "=")
+	if !ok {
+		return nil, fmt.Errorf("invalid allow rule %q, want [METHOD ]/path=cidr,...", spec)
+	}
+	rule := &allowRule{prefix: strings.TrimSpace(route)}
+	if method, prefix, ok := strings.Cut(rule.prefix, " "); ok {
+		rule.method, rule.prefix = strings.ToUpper(method), strings.TrimSpace(prefix)
+	}
+	if !strings.HasPrefix(rule.prefix, "/") {
+		return nil, fmt.Errorf("invalid allow rule %q, path must start with /", spec)
+	}
+	nets, err := parseNets(cidrs)
+	if err != nil {
+		return nil, fmt.Errorf("invalid allow rule %q: %w", spec, err)
+	}
+	rule.nets = nets
+	return rule, nil
+}
+
+// parseNets parses comma-separated networks. Plain addresses are accepted
+// as single-host networks.
+func parseNets(cidrs string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0)
+	for _, cidr := range strings.Split(cidrs, ",") {
+		cidr = strings.TrimSpace(cidr)
+		if !strings.Contains(cidr, "/") {
+			if ip := net.ParseIP(cidr); ip.To4() != nil {
+				cidr += "/32"
+			} else {
+				cidr += "/128"
+			}
+		}
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if ip != nil && n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowed applies the most specific rule matching r: the longest path
+// prefix, preferring rules for its method. Requests matching no rule are
+// allowed.
+func (a *app) allowed(r *http.Request) bool {
+	var match *allowRule
+	for _, rule := range a.allow {
+		if rule.method != "" && rule.method != r.Method || !strings.HasPrefix(r.URL.Path, rule.prefix) {
+			continue
+		}
+		if match == nil || len(rule.prefix) > len(match.prefix) ||
+			len(rule.prefix) == len(match.prefix) && rule.method != "" {
+			match = rule
+		}
+	}
+	if match == nil {
+		return true
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return containsIP(match.nets, net.ParseIP(host))
+}
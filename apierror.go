@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// requestIDHeader identifies a request in error responses, taken from the
+// request if a proxy set it.
+const requestIDHeader = "X-Request-Id"
+
+// apiError is the body of every error response of the server. Code is the
+// status in snake case, such as not_found, and Retryable hints that the
+// same request may succeed later.
+type apiError struct {
+	Code      string `json:"code"`
+	Message   string `json:"message"`
+	RequestID string `json:"request_id,omitempty"`
+	Retryable bool   `json:"retryable"`
+}
+
+// httpError replies to a request with msg and status, as http.Error does,
+// in an apiError envelope.
+func httpError(w http.ResponseWriter, msg string, status int) {
+	h := w.Header()
+	h.Del("Content-Length")
+	h.Set("Content-Type", "application/json")
+	h.Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(&apiError{
+		Code:      strings.ReplaceAll(strings.ToLower(http.StatusText(status)), " ", "_"),
+		Message:   strings.TrimSpace(msg),
+		RequestID: h.Get(requestIDHeader),
+		Retryable: retryableStatus(status),
+	})
+}
+
+func retryableStatus(status int) bool {
+	switch status {
+	case http.StatusRequestTimeout, http.StatusTooManyRequests, http.StatusBadGateway,
+		http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// requestID returns the id a proxy gave the request, if it is sane, or a
+// new one.
+func requestID(r *http.Request) string {
+	id := r.Header.Get(requestIDHeader)
+	if id == "" || len(id) > 64 || strings.ContainsFunc(id, func(c rune) bool { return c <= ' ' || c > '~' }) {
+		return newID()
+	}
+	return id
+}
+
+// statusError is a non-ok response of a server to a client.
+type statusError struct {
+	Status int
+	apiError
+}
+
+func (e *statusError) Error() string {
+	msg := fmt.Sprintf("got non-ok status code: %d", e.Status)
+	if e.Message != "" {
+		msg += " " + e.Message
+	}
+	if e.RequestID != "" {
+		msg += " (request " + e.RequestID + ")"
+	}
+	return msg
+}
+
+// responseError reads the error of a non-ok response. Servers that predate
+// the envelope reply with plain text, taken as the message.
+func responseError(resp *http.Response) error {
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	e := &statusError{Status: resp.StatusCode}
+	if json.Unmarshal(body, &e.apiError) != nil || e.Code == "" {
+		e.apiError = apiError{Message: strings.TrimSpace(string(body)), Retryable: retryableStatus(resp.StatusCode)}
+	}
+	return e
+}
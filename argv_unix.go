@@ -0,0 +1,13 @@
+//go:build unix
+
+package main
+
+import (
+	"context"
+	"os/exec"
+)
+
+// command prepares name with args as os/exec does.
+func command(ctx context.Context, name string, args []string) (*exec.Cmd, error) {
+	return exec.CommandContext(ctx, name, args...), nil
+}
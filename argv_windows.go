@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// command prepares name with args, as split by operators on any platform,
+// for a Windows agent. Slashes in name become backslashes, and a name
+// without extension is resolved with PATHEXT. Windows passes a process a
+// single command line: os/exec quotes args with the rules of the C runtime,
+// which most programs parse it with, but batch files are run by cmd.exe,
+// which has its own.
+func command(ctx context.Context, name string, args []string) (*exec.Cmd, error) {
+	path, err := exec.LookPath(filepath.FromSlash(name))
+	if err != nil {
+		return nil, err
+	}
+	c := exec.CommandContext(ctx, path, args...)
+	if ext := strings.ToLower(filepath.Ext(path)); ext != ".bat" && ext != ".cmd" {
+		return c, nil
+	}
+	line, err := batchCmdLine(path, args)
+	if err != nil {
+		return nil, err
+	}
+	c.Path = os.Getenv("ComSpec")
+	if c.Path == "" {
+		c.Path = filepath.Join(os.Getenv("SystemRoot"), "System32", "cmd.exe")
+	}
+	c.SysProcAttr = &syscall.SysProcAttr{CmdLine: line}
+	return c, nil
+}
+
+// batchCmdLine runs the batch file path with args through cmd.exe, without
+// AutoRun commands or delayed expansion. /s strips the outer quotes only.
+func batchCmdLine(path string, args []string) (string, error) {
+	b := &strings.Builder{}
+	b.WriteString(`cmd.exe /d /v:off /s /c "`)
+	for i, arg := range append([]string{path}, args...) {
+		quoted, err := batchArg(arg)
+		if err != nil {
+			return "", err
+		}
+		if i > 0 {
+			b.WriteByte(' ')
+		}
+		b.WriteString(quoted)
+	}
+	b.WriteByte('"')
+	return b.String(), nil
+}
+
+// batchArg quotes s for cmd.exe, which takes its metacharacters literally
+// between double quotes, where a double quote is doubled. Variables expand
+// even there, and line breaks end the command, so those are refused.
+func batchArg(s string) (string, error) {
+	if strings.ContainsAny(s, "%\r\n\x00") {
+		return "", fmt.Errorf("argument %q cannot be passed to a batch file safely", s)
+	}
+	if s != "" && !strings.ContainsAny(s, " \t\"&|<>^(),;=!") {
+		return s, nil
+	}
+	return `"` + strings.ReplaceAll(s, `"`, `""`) + `"`, nil
+}
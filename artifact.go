@@ -0,0 +1,405 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"lukechampine.com/blake3"
+)
+
+// artifactType executes a binary or script downloaded by the agent from
+// the command's Artifact url, or the server's artifact store without one,
+// if its BLAKE3 digest matches the signed Digest. Large files need not pass
+// through the server.
+const artifactType = "artifact"
+
+const (
+	artifactTimeHeader = "X-Captain-Time"
+	artifactSumHeader  = "X-Captain-Sum"
+	// artifactGrace keeps unreferenced artifacts for the commands that will
+	// reference them once they are uploaded.
+	artifactGrace   = time.Hour
+	artifactGCEvery = 10 * time.Minute
+)
+
+// artifactInfo describes a stored artifact, and how many stored commands
+// reference it.
+type artifactInfo struct {
+	Hash    string
+	Name    string `json:",omitempty"`
+	Size    int64
+	Created time.Time
+	Refs    int
+}
+
+func validArtifact(rawurl, digest string) error {
+	u, err := url.Parse(rawurl)
+	if rawurl != "" && (err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "") {
+		return fmt.Errorf("invalid artifact url %q", rawurl)
+	}
+	if sum, err := hex.DecodeString(digest); err != nil || len(sum) != 32 {
+		return errors.New("artifact digest must be 64 hex characters")
+	}
+	return nil
+}
+
+// downloadArtifact streams rawurl to w, returning its hex BLAKE3 digest.
+func downloadArtifact(ctx context.Context, hc *http.Client, rawurl string, w io.Writer) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", rawurl, nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := hc.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("artifact: got status code %d", resp.StatusCode)
+	}
+	h := blake3.New(32, nil)
+	if _, err = io.Copy(io.MultiWriter(w, h), resp.Body); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// fetchArtifact returns the artifact of c as an executable file, from the
+// cache of ag if it holds it, or downloaded, from the server without an
+// artifact url, and kept in the cache. A file outside the cache is removed
+// by the caller after use, and removed unless the digest matches.
+func (ag *agent) fetchArtifact(ctx context.Context, c *cmd) (string, bool, error) {
+	dir := ""
+	if ag.cache != nil {
+		if name, ok := ag.cache.get(c.Digest); ok {
+			return name, false, nil
+		}
+		if err := os.MkdirAll(ag.cache.dir, 0700); err != nil {
+			return "", false, err
+		}
+		dir = ag.cache.dir
+	}
+	f, err := os.CreateTemp(dir, "captain-artifact-*")
+	if err != nil {
+		return "", false, err
+	}
+	var digest string
+	if c.Artifact != "" {
+		digest, err = downloadArtifact(ctx, http.DefaultClient, c.Artifact, f)
+	} else if ag.cache == nil {
+		digest, err = downloadArtifact(ctx, client, ag.target+"/artifacts/"+c.Digest, f)
+	} else {
+		var req *http.Request
+		h := blake3.New(32, nil)
+		if req, err = http.NewRequestWithContext(ctx, "GET", ag.target+"/artifacts/"+c.Digest, nil); err == nil {
+			err = ag.fetchDelta(req, io.MultiWriter(f, h))
+		}
+		digest = hex.EncodeToString(h.Sum(nil))
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil && digest != c.Digest {
+		err = fmt.Errorf("artifact digest mismatch: got %s", digest)
+	}
+	if err == nil {
+		err = os.Chmod(f.Name(), 0700)
+	}
+	if err == nil && ag.cache != nil {
+		var name string
+		var cached bool
+		if name, cached, err = ag.cache.put(f.Name(), c.Digest); err == nil {
+			return name, !cached, nil
+		}
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", false, err
+	}
+	return f.Name(), true, nil
+}
+
+func hashFile(name string) (string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := blake3.New(32, nil)
+	if _, err = io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func signArtifact(hash string, t time.Time, h *blake3.Hasher) []byte {
+	h.Reset()
+	h.Write(ttb(t))
+	h.Write(stb(hash))
+	return h.Sum(nil)
+}
+
+func (a *app) handleArtifacts(w http.ResponseWriter, r *http.Request) {
+	hash := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/artifacts"), "/")
+	switch {
+	case hash == "" && r.Method == "GET":
+		a.handleListArtifacts(w, r)
+	case validArtifact("", hash) != nil:
+		httpError(w, "invalid artifact hash", http.StatusBadRequest)
+	case r.Method == "GET" || r.Method == "HEAD":
+		// Large artifacts, and deltas computed first, take longer than
+		// -write-timeout to serve.
+		http.NewResponseController(w).SetWriteDeadline(time.Time{})
+		// Agents check the digest, as they do for artifact urls.
+		if have := r.Header.Get(haveHeader); have != "" && r.Method == "GET" {
+			if base := a.deltaBase(hash, strings.Split(have, ",")); base != "" && a.serveDelta(w, r, hash, base) {
+				return
+			}
+		}
+		http.ServeFile(w, r, filepath.Join(a.artifactDir, hash))
+	case r.Method == "PUT":
+		a.handlePutArtifact(w, r, hash)
+	default:
+		httpError(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handlePutArtifact stores the body if its digest is hash. Operators sign
+// the hash and time with the key, or authenticate with the send permission.
+func (a *app) handlePutArtifact(w http.ResponseWriter, r *http.Request, hash string) {
+	op, err := a.operator(r)
+	if err != nil {
+		httpError(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	if op != nil && !a.rbac.can(op, permSend) {
+		httpError(w, op.Name+" may not upload artifacts", http.StatusForbidden)
+		return
+	}
+	if op == nil {
+		t, err := time.Parse(time.RFC3339Nano, r.Header.Get(artifactTimeHeader))
+		sum, herr := hex.DecodeString(r.Header.Get(artifactSumHeader))
+		a.mu.Lock()
+		valid := err == nil && herr == nil && bytes.Equal(signArtifact(hash, t, a.hasher), sum)
+		a.mu.Unlock()
+		if !valid {
+			httpError(w, "invalid checksum", http.StatusUnauthorized)
+			return
+		}
+		// Uploads are idempotent, the window only limits reuse of a leaked signature.
+		if d := time.Since(t); d > clockSkew || d < -clockSkew {
+			httpError(w, "payload expired", http.StatusUnauthorized)
+			return
+		}
+	}
+	if a.maxArtifact > 0 {
+		r.Body = http.MaxBytesReader(w, r.Body, a.maxArtifact)
+	}
+	// Large artifacts take longer than -read-timeout to upload.
+	http.NewResponseController(w).SetReadDeadline(time.Time{})
+	// The name relates versions of an artifact, as bases for deltas.
+	name := r.URL.Query().Get("name")
+	if len(name) > 255 || strings.ContainsAny(name, `/\`) || name == "." || name == ".." {
+		httpError(w, "invalid artifact name", http.StatusBadRequest)
+		return
+	}
+	path := filepath.Join(a.artifactDir, hash)
+	if _, err = os.Stat(path); err == nil {
+		a.nameArtifact(hash, name)
+		w.Write([]byte("ok"))
+		return
+	}
+	f, err := os.CreateTemp(a.artifactDir, "upload-*")
+	if err != nil {
+		httpError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer os.Remove(f.Name())
+	h := blake3.New(32, nil)
+	_, err = io.Copy(io.MultiWriter(f, h), r.Body)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		httpError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if digest := hex.EncodeToString(h.Sum(nil)); digest != hash {
+		httpError(w, "artifact digest mismatch: got "+digest, http.StatusBadRequest)
+		return
+	}
+	if err = os.Rename(f.Name(), path); err != nil {
+		httpError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	a.nameArtifact(hash, name)
+	fmt.Printf("%s: stored artifact %s\n", time.Now(), hash)
+	w.Write([]byte("ok"))
+}
+
+// nameArtifact records the name hash was first uploaded as.
+func (a *app) nameArtifact(hash, name string) {
+	if name == "" || a.artifactName(hash) != "" {
+		return
+	}
+	if err := os.WriteFile(filepath.Join(a.artifactDir, hash+".name"), []byte(name), 0600); err != nil {
+		fmt.Printf("artifact %s: %s\n", hash, err)
+	}
+}
+
+func (a *app) handleListArtifacts(w http.ResponseWriter, r *http.Request) {
+	if !a.viewer(w, r, "artifacts") {
+		return
+	}
+	a.mu.Lock()
+	artifacts, err := a.artifacts()
+	a.mu.Unlock()
+	if err != nil {
+		httpError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	payload, err := json.Marshal(artifacts)
+	if err != nil {
+		httpError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write(payload)
+}
+
+// artifacts lists the stored artifacts, counting the stored, held and
+// cosigning commands referencing them. The caller holds a.mu.
+func (a *app) artifacts() ([]*artifactInfo, error) {
+	entries, err := os.ReadDir(a.artifactDir)
+	if err != nil {
+		return nil, err
+	}
+	cmds, err := a.store.cmds()
+	if err != nil {
+		return nil, err
+	}
+	refs := make(map[string]int)
+	for _, c := range cmds {
+		refs[c.Digest]++
+	}
+	for _, c := range a.held {
+		refs[c.Digest]++
+	}
+	for _, c := range a.cosigning {
+		refs[c.Digest]++
+	}
+	artifacts := make([]*artifactInfo, 0, len(entries))
+	for _, e := range entries {
+		info, err := e.Info()
+		if err != nil || validArtifact("", e.Name()) != nil {
+			// Uploads in progress, names and deltas.
+			continue
+		}
+		artifacts = append(artifacts, &artifactInfo{Hash: e.Name(), Name: a.artifactName(e.Name()), Size: info.Size(), Created: info.ModTime(), Refs: refs[e.Name()]})
+	}
+	return artifacts, nil
+}
+
+// collectArtifacts removes the artifacts no stored command references, once
+// older than artifactGrace.
+func (a *app) collectArtifacts() {
+	for range time.Tick(artifactGCEvery) {
+		a.mu.Lock()
+		artifacts, err := a.artifacts()
+		a.mu.Unlock()
+		if err != nil {
+			fmt.Println(err)
+			continue
+		}
+		for _, art := range artifacts {
+			if art.Refs > 0 || time.Since(art.Created) < artifactGrace {
+				continue
+			}
+			if err = os.Remove(filepath.Join(a.artifactDir, art.Hash)); err != nil {
+				fmt.Println(err)
+				continue
+			}
+			// Its name and deltas to and from it.
+			sidecars, _ := filepath.Glob(filepath.Join(a.artifactDir, art.Hash+".*"))
+			deltas, _ := filepath.Glob(filepath.Join(a.artifactDir, "*.delta-"+art.Hash))
+			for _, path := range append(sidecars, deltas...) {
+				os.Remove(path)
+			}
+			fmt.Printf("%s: collected artifact %s\n", time.Now(), art.Hash)
+		}
+	}
+}
+
+// uploadArtifact stores the file at path on the server, unless it holds it
+// already, returning its hash.
+func uploadArtifact(path string, h *blake3.Hasher, target string) (string, error) {
+	hash, err := hashFile(path)
+	if err != nil {
+		return "", err
+	}
+	resp, err := client.Head(target + "/artifacts/" + hash)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	// Stored artifacts are named with an empty upload.
+	var body io.Reader = http.NoBody
+	if resp.StatusCode != http.StatusOK {
+		f, err := os.Open(path)
+		if err != nil {
+			return "", err
+		}
+		defer f.Close()
+		body = f
+	}
+	req, err := http.NewRequest("PUT", target+"/artifacts/"+hash+"?name="+url.QueryEscape(filepath.Base(path)), body)
+	if err != nil {
+		return "", err
+	}
+	if h != nil {
+		t := time.Now()
+		req.Header.Set(artifactTimeHeader, t.Format(time.RFC3339Nano))
+		req.Header.Set(artifactSumHeader, hex.EncodeToString(signArtifact(hash, t, h)))
+	}
+	if resp, err = client.Do(req); err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", responseError(resp)
+	}
+	return hash, nil
+}
+
+func getArtifacts(target string) ([]*artifactInfo, error) {
+	resp, err := client.Get(target + "/artifacts")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, responseError(resp)
+	}
+	artifacts := make([]*artifactInfo, 0)
+	err = json.NewDecoder(resp.Body).Decode(&artifacts)
+	return artifacts, err
+}
+
+func printArtifact(art *artifactInfo) {
+	if art.Name != "" {
+		fmt.Printf("%s (%s)", art.Hash, art.Name)
+	} else {
+		fmt.Print(art.Hash)
+	}
+	fmt.Printf(": %d bytes, stored %s, %d commands\n", art.Size, art.Created.Format(time.RFC3339), art.Refs)
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// expect holds assertions on the outcome of a command, evaluated by the
+// agent: the exit Code, Match against the output, and JSON, mapping dotted
+// paths into the structured data (or the output, if the command returns
+// none) to expected values.
+type expect struct {
+	Code  int
+	Match string            `json:",omitempty"`
+	JSON  map[string]string `json:",omitempty"`
+}
+
+// parseExpectJSON reads path=value assertions.
+func parseExpectJSON(pairs []string) (map[string]string, error) {
+	m := make(map[string]string, len(pairs))
+	for _, p := range pairs {
+		path, value, ok := strings.Cut(p, "=")
+		if !ok || path == "" {
+			return nil, fmt.Errorf("invalid JSON assertion %q, want path=value", p)
+		}
+		m[path] = value
+	}
+	return m, nil
+}
+
+func (e *expect) validate() error {
+	if e.Match != "" {
+		if _, err := regexp.Compile(e.Match); err != nil {
+			return fmt.Errorf("expect: %w", err)
+		}
+	}
+	for path := range e.JSON {
+		if path == "" || len(path) > 256 {
+			return fmt.Errorf("expect: invalid JSON path %q", path)
+		}
+	}
+	return nil
+}
+
+// assert evaluates e against res, returning "passed" or "failed: " and
+// every failed assertion.
+func (e *expect) assert(res *result) string {
+	failures := make([]string, 0)
+	if res.ExitCode != e.Code {
+		failures = append(failures, fmt.Sprintf("got exit code %d, want %d", res.ExitCode, e.Code))
+	}
+	if e.Match != "" {
+		if re, err := regexp.Compile(e.Match); err != nil {
+			failures = append(failures, err.Error())
+		} else if !re.MatchString(strings.TrimSpace(res.Output)) {
+			failures = append(failures, fmt.Sprintf("output does not match %q", e.Match))
+		}
+	}
+	if len(e.JSON) > 0 {
+		src := []byte(res.Data)
+		if len(src) == 0 {
+			src = []byte(res.Output)
+		}
+		var doc any
+		dec := json.NewDecoder(bytes.NewReader(src))
+		dec.UseNumber()
+		if err := dec.Decode(&doc); err != nil {
+			failures = append(failures, "no JSON to assert on")
+		} else {
+			paths := make([]string, 0, len(e.JSON))
+			for path := range e.JSON {
+				paths = append(paths, path)
+			}
+			sort.Strings(paths)
+			for _, path := range paths {
+				got, ok := jsonPath(doc, path)
+				if !ok {
+					failures = append(failures, path+" not found")
+				} else if got != e.JSON[path] {
+					failures = append(failures, fmt.Sprintf("%s is %q, want %q", path, got, e.JSON[path]))
+				}
+			}
+		}
+	}
+	if len(failures) > 0 {
+		return "failed: " + strings.Join(failures, "; ")
+	}
+	return "passed"
+}
+
+// jsonPath looks up a dotted path, with array indexes, in doc, and renders
+// the value found: strings as is, anything else as JSON.
+func jsonPath(doc any, path string) (string, bool) {
+	for _, key := range strings.Split(path, ".") {
+		switch v := doc.(type) {
+		case map[string]any:
+			var ok bool
+			if doc, ok = v[key]; !ok {
+				return "", false
+			}
+		case []any:
+			i, err := strconv.Atoi(key)
+			if err != nil || i < 0 || i >= len(v) {
+				return "", false
+			}
+			doc = v[i]
+		default:
+			return "", false
+		}
+	}
+	if s, ok := doc.(string); ok {
+		return s, true
+	}
+	b, err := json.Marshal(doc)
+	return string(b), err == nil
+}
+
+// printAssertions summarizes the assertions of c over its results.
+func printAssertions(c *cmd, results []*result) {
+	passed := 0
+	for _, res := range results {
+		if res.Assert == "passed" {
+			passed++
+		}
+	}
+	fmt.Printf("%s: assertions passed on %d and failed on %d agents", c.ID, passed, len(results)-passed)
+	if len(c.Agents) > len(results) {
+		fmt.Printf(", %d did not report", len(c.Agents)-len(results))
+	}
+	fmt.Println()
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// auditEntry records a decision about a command.
+type auditEntry struct {
+	Time                       time.Time
+	Event, Cmd, Name, Operator string
+	Rule, Reason, Trace        string `json:",omitempty"`
+	Agents                     []string
+	Labels                     map[string]string `json:",omitempty"`
+}
+
+// openAudit opens the audit log for appending, or stdout for "-".
+func openAudit(file string) (io.Writer, error) {
+	if file == "-" {
+		return os.Stdout, nil
+	}
+	return os.OpenFile(file, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+}
+
+// audit appends a JSON line to the audit log, if any. It is called with
+// the app's mutex held.
+func (a *app) audit(event string, c *cmd, rule string, reason error) {
+	if a.auditLog == nil {
+		return
+	}
+	e := &auditEntry{
+		Time:     time.Now(),
+		Event:    event,
+		Cmd:      c.ID,
+		Name:     c.Name,
+		Operator: c.Operator,
+		Rule:     rule,
+		Agents:   c.Agents,
+		Trace:    c.Trace,
+		Labels:   c.Labels,
+	}
+	if c.Type != "" {
+		e.Name = c.Type
+	}
+	if reason != nil {
+		e.Reason = reason.Error()
+	}
+	line, err := json.Marshal(e)
+	if err == nil {
+		_, err = a.auditLog.Write(append(line, '\n'))
+	}
+	if err != nil {
+		fmt.Println(err)
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"lukechampine.com/blake3"
+)
+
+// sumHeader carries the signature of a read signed with the key, dated by
+// timeHeader.
+const sumHeader = "X-Captain-Sum"
+
+// operator is a person or job authenticated by a token. Its permissions
+// are granted by rbac, or limited to the scopes of an API token.
+type operator struct {
+	Name   string
+	Groups []string
+	scopes []*role
+}
+
+// operator authenticates the bearer token of r. It returns nil if r has
+// no token.
+func (a *app) operator(r *http.Request) (*operator, error) {
+	auth := r.Header.Get("Authorization")
+	if auth == "" {
+		return nil, nil
+	}
+	token, ok := strings.CutPrefix(auth, "Bearer ")
+	if !ok {
+		return nil, errors.New("unsupported authorization scheme")
+	}
+	if strings.HasPrefix(token, tokenPrefix) {
+		return a.tokenOperator(token)
+	}
+	if a.oidc == nil {
+		return nil, errors.New("oidc is not enabled")
+	}
+	return a.oidc.verify(token)
+}
+
+// bearerTransport authenticates requests with a token.
+type bearerTransport struct {
+	token string
+	http.RoundTripper
+}
+
+func (t bearerTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	r = r.Clone(r.Context())
+	r.Header.Set("Authorization", "Bearer "+t.token)
+	return t.RoundTripper.RoundTrip(r)
+}
+
+// viewer authorizes r to read what: an operator allowed to view, or once
+// rbac restricts the server, a request signed with the key. It reports
+// whether r may proceed.
+func (a *app) viewer(w http.ResponseWriter, r *http.Request, what string) bool {
+	op, err := a.operator(r)
+	switch {
+	case err != nil:
+		httpError(w, err.Error(), http.StatusUnauthorized)
+		return false
+	case op != nil && !a.rbac.can(op, permView):
+		httpError(w, op.Name+" may not view "+what, http.StatusForbidden)
+		return false
+	case op == nil && a.rbac.restricted && !a.keySigned(r):
+		httpError(w, "viewing "+what+" needs a token or the key", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+// keySigned reports whether r was signed with the key, recently.
+func (a *app) keySigned(r *http.Request) bool {
+	t, sum, ok := signedHeaders(r)
+	if !ok {
+		return false
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return bytes.Equal(signRead(r.Method, r.URL.Path, t, a.hasher), sum)
+}
+
+// signedHeaders returns the time and signature r was sent with, if the
+// time is within clockSkew.
+func signedHeaders(r *http.Request) (time.Time, []byte, bool) {
+	t, err := time.Parse(time.RFC3339Nano, r.Header.Get(timeHeader))
+	sum, herr := hex.DecodeString(r.Header.Get(sumHeader))
+	if err != nil || herr != nil {
+		return time.Time{}, nil, false
+	}
+	if d := time.Since(t); d > clockSkew || d < -clockSkew {
+		return time.Time{}, nil, false
+	}
+	return t, sum, true
+}
+
+func signRead(method, path string, t time.Time, h *blake3.Hasher) []byte {
+	h.Reset()
+	h.Write(ttb(t))
+	h.Write(stb(method))
+	h.Write(stb(path))
+	return h.Sum(nil)
+}
+
+// keyTransport signs reads with the key, for servers restricting them to
+// operators. Paths are signed below the target urls, as the server sees
+// them under -base-path.
+type keyTransport struct {
+	key     []byte
+	targets []string
+	http.RoundTripper
+}
+
+func (t keyTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	if r.Method != "GET" && r.Method != "HEAD" || r.Header.Get(sumHeader) != "" {
+		return t.RoundTripper.RoundTrip(r)
+	}
+	path := r.URL.Path
+	for _, target := range t.targets {
+		if u, err := url.Parse(target); err == nil && u.Host == r.URL.Host && strings.HasPrefix(path, u.Path) {
+			path = strings.TrimPrefix(path, u.Path)
+			break
+		}
+	}
+	now := time.Now()
+	r = r.Clone(r.Context())
+	r.Header.Set(timeHeader, now.UTC().Format(time.RFC3339Nano))
+	r.Header.Set(sumHeader, hex.EncodeToString(signRead(r.Method, path, now, blake3.New(32, t.key))))
+	return t.RoundTripper.RoundTrip(r)
+}
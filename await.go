@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+// awaited tells whether the commands c awaits succeeded on every agent they
+// target, and if one failed, why c must not be queued. A command targeting
+// every agent must have succeeded on the agents it was delivered to, and
+// one that is no longer queued, on the agents that reported it. The caller
+// holds a.mu.
+func (a *app) awaited(c *cmd) (bool, error) {
+	cmds, err := a.store.cmds()
+	if err == nil {
+		cmds, err = a.withDeliveries(cmds)
+	}
+	if err != nil {
+		return false, err
+	}
+	queued := make(map[string]*cmd)
+	for _, q := range cmds {
+		queued[q.ID] = q
+	}
+	done := true
+	for _, id := range c.Await {
+		if a.held[id] != nil || a.cosigning[id] != nil || a.awaiting[id] != nil {
+			done = false
+			continue
+		}
+		results, err := a.store.results(id)
+		if err != nil {
+			return false, err
+		}
+		final := make(map[string]bool)
+		for _, res := range results {
+			switch {
+			case res.Flag != "":
+			case res.State == stateRebooting:
+				delete(final, res.Agent)
+			case res.failed():
+				return true, fmt.Errorf("not queued, as command %s failed on %s", id, res.Agent)
+			default:
+				final[res.Agent] = true
+			}
+		}
+		agents := make([]string, 0)
+		if q := queued[id]; q != nil && len(q.Agents) > 0 {
+			agents = q.Agents
+		} else if q != nil {
+			for agent := range q.Delivered {
+				agents = append(agents, agent)
+			}
+		}
+		if len(final) == 0 && queued[id] == nil {
+			return true, fmt.Errorf("not queued, as command %s is unknown", id)
+		}
+		for _, agent := range agents {
+			if !final[agent] {
+				done = false
+			}
+		}
+		if len(final) == 0 {
+			done = false
+		}
+	}
+	return done, nil
+}
+
+// await holds c until the commands it awaits succeeded on all their agents.
+// It reports whether c was held, or refused as one of them failed.
+func (a *app) await(w http.ResponseWriter, c *cmd, rule string) bool {
+	if len(c.Await) == 0 {
+		return false
+	}
+	done, err := a.awaited(c)
+	switch {
+	case err != nil:
+		a.audit("rejected", c, rule, err)
+		httpError(w, err.Error(), http.StatusConflict)
+		return true
+	case done:
+		return false
+	case len(a.awaiting) >= maxPending:
+		httpError(w, "too many commands awaiting others", http.StatusServiceUnavailable)
+		return true
+	}
+	a.awaiting[c.ID] = c
+	a.audit("held", c, rule, nil)
+	w.WriteHeader(http.StatusAccepted)
+	w.Write([]byte(c.ID))
+	fmt.Printf("%s: %s awaiting %s\n", c.Created, c.ref(), strings.Join(c.Await, ","))
+	return true
+}
+
+// awaitResult queues the commands awaiting the command of res once those
+// they await succeeded, dated and signed again by the server, and drops
+// them if one failed. The caller holds a.mu.
+func (a *app) awaitResult(res *result) {
+	for id, c := range a.awaiting {
+		if !slices.Contains(c.Await, res.Cmd) {
+			continue
+		}
+		done, err := a.awaited(c)
+		if err == nil && !done {
+			continue
+		}
+		delete(a.awaiting, id)
+		if err != nil {
+			a.audit("rejected", c, "", err)
+			fmt.Printf("%s: %s %s\n", time.Now(), c.ref(), err)
+			continue
+		}
+		c.Created = time.Now()
+		c.Sum = hex.EncodeToString(signCmd(c, a.hasher))
+		if err = a.enqueue(c); err != nil {
+			fmt.Printf("%s: %s %s\n", c.Created, c.ref(), err)
+			continue
+		}
+		a.audit("accepted", c, "", nil)
+		fmt.Printf("%s: %s queued, the commands it awaits succeeded\n", c.Created, c.ref())
+	}
+}
+
+func (a *app) handleGetAwaiting(w http.ResponseWriter, r *http.Request) {
+	if !a.viewer(w, r, "commands") {
+		return
+	}
+	a.mu.Lock()
+	cmds := make([]*cmd, 0, len(a.awaiting))
+	for _, c := range a.awaiting {
+		cmds = append(cmds, c)
+	}
+	a.mu.Unlock()
+	sort.Slice(cmds, func(i, j int) bool { return cmds[i].Created.Before(cmds[j].Created) })
+	payload, err := json.Marshal(cmds)
+	if err != nil {
+		httpError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write(payload)
+}
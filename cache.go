@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// artifactCache keeps the artifacts an agent downloaded by digest, evicting
+// the least recently used once they exceed size bytes. Hits are verified,
+// so a corrupted or tampered file is downloaded again.
+type artifactCache struct {
+	dir  string
+	size int64
+	mu   sync.Mutex
+}
+
+// get returns the cached artifact with digest, marking it used.
+func (ac *artifactCache) get(digest string) (string, bool) {
+	name := filepath.Join(ac.dir, digest)
+	if got, err := hashFile(name); err != nil || got != digest {
+		return "", false
+	}
+	now := time.Now()
+	os.Chtimes(name, now, now)
+	return name, true
+}
+
+// put moves the verified download tmp into the cache, and evicts the least
+// recently used artifacts but digest over the size. Artifacts larger than
+// the cache are not kept, and put reports false.
+func (ac *artifactCache) put(tmp, digest string) (string, bool, error) {
+	info, err := os.Stat(tmp)
+	if err != nil {
+		return "", false, err
+	}
+	if info.Size() > ac.size {
+		return tmp, false, nil
+	}
+	name := filepath.Join(ac.dir, digest)
+	if err = os.Rename(tmp, name); err != nil {
+		return "", false, err
+	}
+	ac.evict(digest)
+	return name, true, nil
+}
+
+// list returns the digests of up to n cached artifacts, most recently used
+// first.
+func (ac *artifactCache) list(n int) []string {
+	infos := ac.infos()
+	sort.Slice(infos, func(i, j int) bool { return infos[i].ModTime().After(infos[j].ModTime()) })
+	digests := make([]string, 0, n)
+	for _, info := range infos {
+		if len(digests) == n {
+			break
+		}
+		digests = append(digests, info.Name())
+	}
+	return digests
+}
+
+// infos describes the cached artifacts, and removes downloads left behind
+// by a crash.
+func (ac *artifactCache) infos() []os.FileInfo {
+	entries, err := os.ReadDir(ac.dir)
+	if err != nil && !os.IsNotExist(err) {
+		fmt.Printf("artifact cache: %s\n", err)
+	}
+	infos := make([]os.FileInfo, 0, len(entries))
+	for _, e := range entries {
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		if validArtifact("", e.Name()) != nil {
+			if time.Since(info.ModTime()) > artifactGrace {
+				os.Remove(filepath.Join(ac.dir, e.Name()))
+			}
+			continue
+		}
+		infos = append(infos, info)
+	}
+	return infos
+}
+
+func (ac *artifactCache) evict(keep string) {
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+	infos := ac.infos()
+	var total int64
+	for _, info := range infos {
+		total += info.Size()
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].ModTime().Before(infos[j].ModTime()) })
+	for _, info := range infos {
+		if total <= ac.size {
+			return
+		}
+		if info.Name() == keep {
+			continue
+		}
+		// Running commands keep their executable open where the OS allows.
+		if err := os.Remove(filepath.Join(ac.dir, info.Name())); err != nil {
+			fmt.Printf("artifact cache: %s\n", err)
+			continue
+		}
+		total -= info.Size()
+		fmt.Printf("artifact cache: evicted %s\n", info.Name())
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+const stableChannel = "stable"
+
+// inChannel reports whether ag subscribes to the channel of c. Commands
+// without a channel are for every agent.
+func (ag *agent) inChannel(c *cmd) bool {
+	channel := ag.channel
+	if channel == "" {
+		channel = stableChannel
+	}
+	return c.Channel == "" || c.Channel == channel
+}
+
+// promote returns the command id, which went to another channel, for the
+// agents on channel, under a new id and trace, to be signed again.
+func promote(id, channel, trace, target string) (*cmd, error) {
+	cmds, err := getCommands(nil, target)
+	if err != nil {
+		return nil, err
+	}
+	var orig *cmd
+	for _, c := range cmds {
+		if c.ID == id {
+			orig = c
+		}
+	}
+	switch {
+	case orig == nil:
+		return nil, fmt.Errorf("%s is no longer stored, send it again", id)
+	case orig.Channel == "":
+		return nil, fmt.Errorf("%s went to every channel", id)
+	case orig.Channel == channel:
+		return nil, fmt.Errorf("%s went to %s already", id, channel)
+	case orig.Type == sealedType:
+		return nil, errors.New("sealed commands are bound to their id, seal and send it again")
+	}
+	c := redispatch(orig, trace)
+	c.Channel = channel
+	return c, nil
+}
+
+// redispatch returns a copy of orig promoted under a new id and trace, to
+// be signed again.
+func redispatch(orig *cmd, trace string) *cmd {
+	c := *orig
+	c.ID, c.Promoted, c.Trace = newID(), orig.ID, trace
+	c.Operator, c.Approver, c.Cosigs, c.Delegation, c.Delivered = "", "", nil, nil, nil
+	c.NotBefore, c.NotAfter = time.Time{}, time.Time{}
+	c.Created = time.Now()
+	return &c
+}
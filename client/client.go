@@ -0,0 +1,385 @@
+// Package client calls the API of a captain server from Go, so services
+// can dispatch commands and follow their results without shelling out to
+// the captain CLI. Commands are signed with the shared key, or the server
+// signs them for an operator authenticated with a token.
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/intob/captain/internal/httpclient"
+	"lukechampine.com/blake3"
+)
+
+// ProtocolVersion is the version of the wire format the client speaks.
+const ProtocolVersion = 2
+
+// ErrHeld is returned by SubmitCommand for a command the server accepted,
+// but holds until an approver approves it, cosigners sign it, or the
+// commands it awaits succeed.
+var ErrHeld = errors.New("held by the server")
+
+// Client calls a captain server. Its methods are safe for concurrent use.
+type Client struct {
+	// Target is the url of the server, with -base-path if any.
+	Target string
+	// Token authenticates as an operator, instead of or as well as the key.
+	Token string
+	// HTTP sends the requests. By default, transient failures are retried.
+	HTTP *http.Client
+	// Poll is how often WaitForResults and StreamLogs poll the server,
+	// every second by default.
+	Poll time.Duration
+
+	mu     sync.Mutex
+	hasher *blake3.Hasher
+}
+
+// New returns a client of the server at target, signing with key. Key may
+// be empty if Token is set.
+func New(target, key string) *Client {
+	c := &Client{
+		Target: strings.TrimSuffix(target, "/"),
+		HTTP:   &http.Client{Transport: httpclient.New(http.DefaultTransport)},
+		Poll:   time.Second,
+	}
+	if key != "" {
+		sum := blake3.Sum256([]byte(key))
+		c.hasher = blake3.New(32, sum[:])
+	}
+	return c
+}
+
+// Command is a command for agents. Fields left empty are filled in by
+// SubmitCommand.
+type Command struct {
+	ID, Type, Name      string
+	Args, Agents, Env   []string // Agents is every agent if empty
+	Timeout             time.Duration
+	NotBefore, NotAfter time.Time         // the window to execute in, if any
+	Trace, Channel      string            `json:",omitempty"`
+	Labels              map[string]string `json:",omitempty"`
+	JSON                bool              `json:",omitempty"` // the output is the data of the result
+	Delivery            string            `json:",omitempty"` // at-most-once or at-least-once
+	LocalHours          string            `json:",omitempty"` // daily, 15:04-15:04 in the agent's time zone
+	Priority            int               `json:",omitempty"` // higher runs first on a busy agent
+	After               []string          `json:",omitempty"` // ids of commands that must succeed first on the agent
+	Await               []string          `json:",omitempty"` // ids of commands that must succeed first on all their agents
+	Lock                string            `json:",omitempty"` // held on the server while an agent runs it
+	Operator            string            `json:",omitempty"` // set by the server
+	Version             int
+	Sum                 string
+	Created             time.Time
+}
+
+// Result is the report of an agent on a command.
+type Result struct {
+	Cmd, Agent, Output, Error, Check string
+	ExitCode                         int
+	State, Signal, Trace, Assert     string
+	Flag                             string
+	Duration                         time.Duration
+	Data                             json.RawMessage
+	Timing                           *Timing
+	Created                          time.Time
+}
+
+// Timing tells where the time of a command went: waiting to be polled
+// between Enqueued and Received, waiting on the agent until Started, and
+// running until Finished.
+type Timing struct {
+	Enqueued, Received, Started, Finished time.Time
+}
+
+// Agent is an agent the server heard from.
+type Agent struct {
+	Agent    string
+	Status   string // online or offline
+	Poll     time.Duration
+	LastSeen time.Time
+	Drift    bool   // the agent does not run with its configuration
+	Reboot   string // rebooting, or lost if it did not come back from a reboot
+}
+
+// Log is a message logged to the server.
+type Log struct {
+	Msg     string
+	Created time.Time
+}
+
+// Error is an error response of the server.
+type Error struct {
+	Status    int
+	Code      string `json:"code"`
+	Message   string `json:"message"`
+	RequestID string `json:"request_id"`
+	Retryable bool   `json:"retryable"`
+}
+
+func (e *Error) Error() string {
+	msg := fmt.Sprintf("got non-ok status code: %d", e.Status)
+	if e.Message != "" {
+		msg += " " + e.Message
+	}
+	if e.RequestID != "" {
+		msg += " (request " + e.RequestID + ")"
+	}
+	return msg
+}
+
+// SubmitCommand queues cmd, filling in its ID, Version and Created time if
+// unset, and signs it with the key of the client.
+func (c *Client) SubmitCommand(ctx context.Context, cmd *Command) error {
+	if cmd.ID == "" {
+		id := make([]byte, 8)
+		if _, err := rand.Read(id); err != nil {
+			return err
+		}
+		cmd.ID = hex.EncodeToString(id)
+	}
+	if cmd.Version == 0 {
+		cmd.Version = ProtocolVersion
+	}
+	if cmd.Created.IsZero() {
+		cmd.Created = time.Now()
+	}
+	for _, s := range []*[]string{&cmd.Args, &cmd.Agents, &cmd.Env} {
+		if *s == nil {
+			*s = make([]string, 0)
+		}
+	}
+	if c.hasher != nil {
+		cmd.Sum = hex.EncodeToString(c.sign(cmd))
+	}
+	payload, err := json.Marshal(cmd)
+	if err != nil {
+		return err
+	}
+	resp, err := c.do(ctx, "POST", "/cmd", bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusAccepted {
+		return ErrHeld
+	}
+	return nil
+}
+
+// WaitForResults polls the results of cmd until every agent it targets has
+// reported, and returns them by agent id. If ctx is done first, it returns
+// the results so far with the error of ctx, which is always the case for a
+// command targeting every agent.
+func (c *Client) WaitForResults(ctx context.Context, cmd *Command) ([]*Result, error) {
+	tick := time.NewTicker(c.poll())
+	defer tick.Stop()
+	byAgent := make(map[string]*Result)
+poll:
+	for {
+		got := make([]*Result, 0)
+		err := c.get(ctx, "/commands/"+url.PathEscape(cmd.ID)+"/results", &got)
+		if err != nil && ctx.Err() == nil {
+			return nil, err
+		}
+		for _, res := range got {
+			// Rebooting agents report again once back.
+			if res.State == "rebooting" {
+				continue
+			}
+			byAgent[res.Agent] = res
+		}
+		if len(cmd.Agents) > 0 && len(byAgent) >= len(cmd.Agents) {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			break poll
+		case <-tick.C:
+		}
+	}
+	results := make([]*Result, 0, len(byAgent))
+	for _, res := range byAgent {
+		results = append(results, res)
+	}
+	sort.Slice(results, func(i, j int) bool { return results[i].Agent < results[j].Agent })
+	if len(cmd.Agents) == 0 || len(results) < len(cmd.Agents) {
+		return results, ctx.Err()
+	}
+	return results, nil
+}
+
+// ListAgents lists the agents the server heard from, only those with
+// status online or offline if status is not empty.
+func (c *Client) ListAgents(ctx context.Context, status string) ([]*Agent, error) {
+	agents := make([]*Agent, 0)
+	return agents, c.get(ctx, "/agents?status="+url.QueryEscape(status), &agents)
+}
+
+// StreamLogs calls fn with the logs created after since, oldest first, and
+// with those that follow, until ctx is done or fn returns an error, which
+// it returns.
+func (c *Client) StreamLogs(ctx context.Context, since time.Time, fn func(*Log) error) error {
+	tick := time.NewTicker(c.poll())
+	defer tick.Stop()
+	for {
+		logs := make([]*Log, 0)
+		err := c.get(ctx, "/logs?since="+url.QueryEscape(since.Format(time.RFC3339Nano)), &logs)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		}
+		for _, l := range logs {
+			if err = fn(l); err != nil {
+				return err
+			}
+			since = l.Created
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-tick.C:
+		}
+	}
+}
+
+func (c *Client) poll() time.Duration {
+	if c.Poll <= 0 {
+		return time.Second
+	}
+	return c.Poll
+}
+
+func (c *Client) get(ctx context.Context, path string, v any) error {
+	resp, err := c.do(ctx, "GET", path, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// do sends a request, and returns an *Error unless the response is ok.
+func (c *Client) do(ctx context.Context, method, path string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, c.Target+path, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-Captain-Version", strconv.Itoa(ProtocolVersion))
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+	resp, err := c.HTTP.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 == 2 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	e := &Error{Status: resp.StatusCode}
+	if json.Unmarshal(data, e) != nil || e.Code == "" {
+		e.Message = strings.TrimSpace(string(data))
+	}
+	return nil, e
+}
+
+// sign signs cmd as the server verifies it. Every field the server signs
+// is written, strings framed with their length and lists with their count,
+// those the client does not send as empty. TestClientSignParity checks it
+// against the server.
+func (c *Client) sign(cmd *Command) []byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	h := c.hasher
+	h.Reset()
+	h.Write(u64(uint64(cmd.Version)))
+	h.Write(ms(cmd.Created))
+	for _, s := range []string{cmd.ID, cmd.Type, cmd.Name} {
+		h.Write(str(s))
+	}
+	for _, l := range [][]string{cmd.Args, cmd.Agents, cmd.Env} {
+		h.Write(list(l))
+	}
+	h.Write(u64(uint64(cmd.Timeout)))
+	// Signal, Ref, Container, Operator, Approver, Artifact and Digest.
+	for _, s := range []string{"", "", "", cmd.Operator, "", "", ""} {
+		h.Write(str(s))
+	}
+	h.Write(ms(cmd.NotBefore))
+	h.Write(ms(cmd.NotAfter))
+	// Trace, Channel, Promoted, and the JSON of Verify and Expect.
+	for _, s := range []string{cmd.Trace, cmd.Channel, "", "", ""} {
+		h.Write(str(s))
+	}
+	keys := make([]string, 0, len(cmd.Labels))
+	for k := range cmd.Labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	h.Write(u64(uint64(len(keys))))
+	for _, k := range keys {
+		h.Write(str(k))
+		h.Write(str(cmd.Labels[k]))
+	}
+	// The JSON of Hook, no Sealed boxes, and Template.
+	h.Write(str(""))
+	h.Write(u64(0))
+	h.Write([]byte{0})
+	if cmd.JSON {
+		h.Write([]byte{1})
+	} else {
+		h.Write([]byte{0})
+	}
+	h.Write(str(cmd.Delivery))
+	h.Write(str(cmd.LocalHours))
+	h.Write(u64(uint64(cmd.Priority)))
+	h.Write(list(cmd.After))
+	h.Write(list(cmd.Await))
+	h.Write(str(cmd.Lock))
+	return h.Sum(nil)
+}
+
+func u64(v uint64) []byte {
+	b := make([]byte, 8)
+	binary.LittleEndian.PutUint64(b, v)
+	return b
+}
+
+func ms(t time.Time) []byte {
+	return u64(uint64(t.UnixNano() / 1000000))
+}
+
+// str frames s with its length.
+func str(s string) []byte {
+	return append(u64(uint64(len(s))), s...)
+}
+
+// list frames the elements of l, after their count.
+func list(l []string) []byte {
+	b := u64(uint64(len(l)))
+	for _, s := range l {
+		b = append(b, str(s)...)
+	}
+	return b
+}
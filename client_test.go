@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	captain "github.com/intob/captain/client"
+	"lukechampine.com/blake3"
+)
+
+// TestClientSignParity submits commands with the client library, and checks
+// the server verifies what it signed.
+func TestClientSignParity(t *testing.T) {
+	window := time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC)
+	tests := []struct {
+		name string
+		c    *captain.Command
+	}{
+		{"bare", &captain.Command{Name: "uptime"}},
+		{"targeted", &captain.Command{Name: "echo", Args: []string{"a", "b"}, Agents: []string{"web-1", "web-2"}, Env: []string{"A=1"}}},
+		{"windowed", &captain.Command{Name: "ls", NotBefore: window.Add(-time.Hour), NotAfter: window, LocalHours: "22:00-06:00"}},
+		{"labelled", &captain.Command{Name: "ls", Trace: "t", Channel: "beta", Labels: map[string]string{"b": "2", "a": "1"}}},
+		{"ordered", &captain.Command{Name: "ls", Priority: -3, After: []string{"x"}, Await: []string{"y", "z"}, Lock: "db"}},
+		{"options", &captain.Command{Type: "script", Timeout: time.Minute, JSON: true, Delivery: deliveryAtLeastOnce}},
+		{"unicode and empty strings", &captain.Command{Name: "écho", Args: []string{"", "ünï", ""}, Labels: map[string]string{"": ""}, Operator: "ops"}},
+	}
+	var got *cmd
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = &cmd{}
+		if err := json.NewDecoder(r.Body).Decode(got); err != nil {
+			t.Error(err)
+		}
+	}))
+	defer srv.Close()
+	cl := captain.New(srv.URL, "mykey")
+	sum := blake3.Sum256([]byte("mykey"))
+	h := blake3.New(32, sum[:])
+	for _, tt := range tests {
+		if err := cl.SubmitCommand(context.Background(), tt.c); err != nil {
+			t.Fatalf("%s: %s", tt.name, err)
+		}
+		if err := verifyCmd(got, h, 0); err != nil {
+			t.Errorf("%s: %s", tt.name, err)
+		}
+		got.Args = append(got.Args, "extra")
+		if verifyCmd(got, h, 0) == nil {
+			t.Errorf("%s: verified with an extra arg", tt.name)
+		}
+	}
+}
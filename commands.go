@@ -0,0 +1,41 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"os"
+	"strings"
+)
+
+// readCommands reads commands to send from path, or stdin if path is "-".
+// The input is either a JSON array of argument arrays, or one command per
+// line with arguments separated by spaces. Blank lines and lines starting
+// with # are ignored.
+func readCommands(path string) ([][]string, error) {
+	var data []byte
+	var err error
+	if path == "-" {
+		data, err = io.ReadAll(os.Stdin)
+	} else {
+		data, err = os.ReadFile(path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	argvs := make([][]string, 0)
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '[' {
+		err = json.Unmarshal(trimmed, &argvs)
+		return argvs, err
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		argvs = append(argvs, strings.Fields(line))
+	}
+	return argvs, scanner.Err()
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"time"
+
+	"lukechampine.com/blake3"
+)
+
+// configHeader carries the digest of the configuration the server wants
+// an agent to run with in poll responses, and the configuration the agent
+// runs with in polls.
+const configHeader = "X-Captain-Config"
+
+// agentConfig is the configuration of an agent that the server can push:
+// its polling interval, tags describing it, and patterns of the command
+// names or types it executes, all if empty.
+type agentConfig struct {
+	Poll    time.Duration     `json:",omitempty"`
+	Tags    map[string]string `json:",omitempty"`
+	Allow   []string          `json:",omitempty"`
+	Sum     string            `json:",omitempty"`
+	Created time.Time         `json:",omitempty"`
+}
+
+// configRule configures matching agents. Later matching rules override the
+// fields they set.
+type configRule struct {
+	Agents string            `json:"agents"`
+	Poll   string            `json:"poll"`
+	Tags   map[string]string `json:"tags"`
+	Allow  []string          `json:"allow"`
+	poll   time.Duration
+}
+
+func loadConfigRules(file string) ([]*configRule, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	dec := json.NewDecoder(f)
+	dec.DisallowUnknownFields()
+	rules := make([]*configRule, 0)
+	if err = dec.Decode(&rules); err != nil {
+		return nil, fmt.Errorf("%s: %w", file, err)
+	}
+	for _, rule := range rules {
+		if _, err = path.Match(rule.Agents, ""); err != nil {
+			return nil, fmt.Errorf("%s: invalid pattern %q", file, rule.Agents)
+		}
+		if rule.Poll != "" {
+			if rule.poll, err = time.ParseDuration(rule.Poll); err != nil || rule.poll < time.Second {
+				return nil, fmt.Errorf("%s: %s: poll must be at least 1s", file, rule.Agents)
+			}
+		}
+		if err = validLabels(rule.Tags); err != nil {
+			return nil, fmt.Errorf("%s: %s: %w", file, rule.Agents, err)
+		}
+		for _, pattern := range rule.Allow {
+			if _, err = path.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("%s: %s: invalid pattern %q", file, rule.Agents, pattern)
+			}
+		}
+	}
+	return rules, nil
+}
+
+// desired returns the configuration of agent, or nil if no rule matches.
+func desired(rules []*configRule, agent string) *agentConfig {
+	var cfg *agentConfig
+	for _, rule := range rules {
+		if rule.Agents != "" && !matchAny([]string{rule.Agents}, agent) {
+			continue
+		}
+		if cfg == nil {
+			cfg = &agentConfig{}
+		}
+		if rule.poll > 0 {
+			cfg.Poll = rule.poll
+		}
+		if rule.Tags != nil {
+			cfg.Tags = rule.Tags
+		}
+		if rule.Allow != nil {
+			cfg.Allow = rule.Allow
+		}
+	}
+	return cfg
+}
+
+// digest identifies the settings of cfg.
+func (cfg *agentConfig) digest() string {
+	h := blake3.New(32, nil)
+	h.Write(vtb(int(cfg.Poll)))
+	writeLabels(h, cfg.Tags)
+	writeList(h, cfg.Allow)
+	return hex.EncodeToString(h.Sum(nil)[:16])
+}
+
+func signConfig(cfg *agentConfig, h *blake3.Hasher) []byte {
+	h.Reset()
+	h.Write(ttb(cfg.Created))
+	h.Write(stb(cfg.digest()))
+	return h.Sum(nil)
+}
+
+// allows reports whether cfg lets the agent execute c.
+func (cfg *agentConfig) allows(c *cmd) bool {
+	if len(cfg.Allow) == 0 || c.Signal != "" || c.Type == pingType {
+		return true
+	}
+	name := c.Name
+	if c.Type != "" {
+		name = c.Type
+	}
+	// The verification runs a binary of its own, which must be allowed too.
+	if c.Verify != nil && len(c.Verify.Cmd) > 0 && !matchAny(cfg.Allow, c.Verify.Cmd[0]) {
+		return false
+	}
+	return matchAny(cfg.Allow, name)
+}
+
+// reported records the configuration agent runs with, from the header of
+// its poll, flags drift from the desired one, and announces the digest of
+// the desired one in the response. The caller holds a.mu.
+func (a *app) reported(w http.ResponseWriter, agent, header string) {
+	want := desired(a.configRules, agent)
+	if want == nil {
+		return
+	}
+	cfg := &agentConfig{}
+	if data, err := base64.RawURLEncoding.DecodeString(header); err == nil {
+		json.Unmarshal(data, cfg)
+	}
+	// Agents keep their own interval unless a rule sets one.
+	if want.Poll == 0 {
+		want.Poll = cfg.Poll
+	}
+	w.Header().Set(configHeader, want.digest())
+	drift := cfg.digest() != want.digest()
+	if prev, ok := a.configs[agent]; !ok || drift != a.drifted[agent] || prev.digest() != cfg.digest() {
+		if drift {
+			fmt.Printf("%s: agent %s drifted from its configuration\n", time.Now(), agent)
+		} else {
+			fmt.Printf("%s: agent %s runs its configuration %s\n", time.Now(), agent, cfg.digest())
+		}
+	}
+	a.configs[agent] = cfg
+	a.drifted[agent] = drift
+}
+
+// desiredConfig is served to agents at /agents/<id>/config, signed with
+// the agent's credential, if it has one. The caller holds a.mu.
+func (a *app) desiredConfig(agent string) (*agentConfig, error) {
+	cfg := desired(a.configRules, agent)
+	if cfg == nil {
+		return nil, nil
+	}
+	h, err := a.agentHasher(agent)
+	if err != nil {
+		return nil, err
+	}
+	cfg.Created = time.Now()
+	cfg.Sum = hex.EncodeToString(signConfig(cfg, h))
+	return cfg, nil
+}
+
+// effective returns the configuration ag runs with.
+func (ag *agent) effective() *agentConfig {
+	ag.mu.Lock()
+	defer ag.mu.Unlock()
+	cfg := &agentConfig{Poll: ag.poll}
+	if ag.config != nil {
+		cfg.Tags, cfg.Allow = ag.config.Tags, ag.config.Allow
+	}
+	return cfg
+}
+
+// allows reports whether the pushed configuration lets ag execute c.
+func (ag *agent) allows(c *cmd) bool {
+	return ag.effective().allows(c)
+}
+
+// configHeader encodes the configuration ag runs with for its polls.
+func (ag *agent) configHeader() string {
+	data, _ := json.Marshal(ag.effective())
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// applyConfig fetches and applies the configuration the server wants ag to
+// run with, if its digest differs from the one ag runs with. It is called
+// by the polling goroutine.
+func (ag *agent) applyConfig(want string, h *blake3.Hasher) error {
+	if want == "" || want == ag.effective().digest() {
+		return nil
+	}
+	resp, err := client.Get(ag.target + "/agents/" + ag.id + "/config")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return responseError(resp)
+	}
+	cfg := &agentConfig{}
+	if err = json.NewDecoder(resp.Body).Decode(cfg); err != nil {
+		return err
+	}
+	sum, err := hex.DecodeString(cfg.Sum)
+	if err != nil || !bytes.Equal(signConfig(cfg, h), sum) {
+		return errors.New("invalid checksum")
+	}
+	if d := time.Since(cfg.Created); d > maxResponseSkew || d < -maxResponseSkew {
+		return errors.New("payload expired")
+	}
+	ag.mu.Lock()
+	if cfg.Poll > 0 {
+		ag.poll = cfg.Poll
+	}
+	ag.config = cfg
+	poll := ag.poll
+	ag.mu.Unlock()
+	fmt.Printf("applied config %s: poll %s, tags %v, allow %v\n", cfg.digest(), poll, cfg.Tags, cfg.Allow)
+	return nil
+}
@@ -0,0 +1,28 @@
+package main
+
+import "testing"
+
+func TestConfigAllows(t *testing.T) {
+	cfg := &agentConfig{Allow: []string{"uptime", "systemctl"}}
+	tests := []struct {
+		name string
+		c    cmd
+		ok   bool
+	}{
+		{"allowed", cmd{Name: "uptime"}, true},
+		{"not allowed", cmd{Name: "rm"}, false},
+		{"allowed verify", cmd{Name: "systemctl", Verify: &check{Cmd: []string{"uptime"}}}, true},
+		{"verify not allowed", cmd{Name: "uptime", Verify: &check{Cmd: []string{"sh", "-c", "rm -rf /"}}}, false},
+		{"verify by path", cmd{Name: "uptime", Verify: &check{Cmd: []string{"/usr/bin/uptime"}}}, false},
+		{"verify url", cmd{Name: "uptime", Verify: &check{URL: "http://localhost"}}, true},
+		{"signal", cmd{Signal: "stop"}, true},
+	}
+	for _, tt := range tests {
+		if got := cfg.allows(&tt.c); got != tt.ok {
+			t.Errorf("%s: got %v", tt.name, got)
+		}
+	}
+	if !(&agentConfig{}).allows(&cmd{Name: "rm"}) {
+		t.Error("empty allow list refuses")
+	}
+}
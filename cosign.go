@@ -0,0 +1,307 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"lukechampine.com/blake3"
+)
+
+const (
+	maxCosigs = 32
+	// cosignWindow is how long a cosigned command stays valid by default,
+	// for cosigners to sign it and agents to execute it.
+	cosignWindow = 24 * time.Hour
+)
+
+// cosig is an operator's ed25519 signature of a command.
+type cosig struct {
+	Signer, Sig string
+}
+
+func (s *cosig) validate() error {
+	if err := validID("signer", s.Signer); err != nil {
+		return err
+	}
+	if sig, err := hex.DecodeString(s.Sig); err != nil || len(sig) != ed25519.SignatureSize {
+		return errors.New("invalid signature")
+	}
+	return nil
+}
+
+// cosigners are the N operator keys, of which M must sign a command.
+type cosigners struct {
+	keys map[string]ed25519.PublicKey
+	m    int
+}
+
+// loadCosigners reads lines of "name hex-public-key". If m is 0, every
+// cosigner must sign.
+func loadCosigners(path string, m int) (*cosigners, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	cs := &cosigners{keys: make(map[string]ed25519.PublicKey), m: m}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s: want \"name key\", got %q", path, line)
+		}
+		key, err := hex.DecodeString(fields[1])
+		if err != nil || len(key) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("%s: invalid key of %s", path, fields[0])
+		}
+		cs.keys[fields[0]] = key
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	}
+	if cs.m == 0 {
+		cs.m = len(cs.keys)
+	}
+	if cs.m < 1 || cs.m > len(cs.keys) {
+		return nil, fmt.Errorf("cannot require %d of %d cosigners", cs.m, len(cs.keys))
+	}
+	return cs, nil
+}
+
+// cosignDigest is what cosigners sign. It leaves out the creation time, so
+// the server can date the command again once enough operators have signed,
+// but covers the close of its window, which bounds when it can run. It also
+// leaves out the operator, approver and trace, which the server records as
+// it authenticates and approves the command, whoever cosigned it; the window
+// is set before cosigning, and the server keeps it.
+func cosignDigest(c *cmd) []byte {
+	undated := *c
+	undated.Created = time.Time{}
+	undated.Operator, undated.Approver, undated.Trace = "", "", ""
+	h := blake3.New(32, nil)
+	sum := signCmd(&undated, h)
+	h.Reset()
+	h.Write(stb("cosign"))
+	h.Write(sum)
+	return h.Sum(nil)
+}
+
+// valid returns the cosignatures of c by known cosigners, one per signer.
+func (cs *cosigners) valid(c *cmd) []*cosig {
+	digest := cosignDigest(c)
+	valid := make([]*cosig, 0, len(c.Cosigs))
+	signed := make(map[string]bool)
+	for _, s := range c.Cosigs {
+		key, ok := cs.keys[s.Signer]
+		sig, err := hex.DecodeString(s.Sig)
+		if !ok || err != nil || signed[s.Signer] || !ed25519.Verify(key, digest, sig) {
+			continue
+		}
+		signed[s.Signer] = true
+		valid = append(valid, s)
+	}
+	return valid
+}
+
+// check fails unless at least m cosigners signed c, with a window.
+func (cs *cosigners) check(c *cmd) error {
+	if c.NotAfter.IsZero() {
+		return errNoCosignWindow
+	}
+	if n := len(cs.valid(c)); n < cs.m {
+		return fmt.Errorf("signed by %d of the %d required cosigners", n, cs.m)
+	}
+	return nil
+}
+
+// loadSigner reads the "name hex-seed" file of an operator's signing key.
+func loadSigner(path string) (string, ed25519.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", nil, err
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) != 2 {
+		return "", nil, fmt.Errorf("%s: want \"name seed\"", path)
+	}
+	seed, err := hex.DecodeString(fields[1])
+	if err != nil || len(seed) != ed25519.SeedSize {
+		return "", nil, fmt.Errorf("%s: invalid seed", path)
+	}
+	return fields[0], ed25519.NewKeyFromSeed(seed), nil
+}
+
+// newSigner writes a signing key for name to path, and returns the line
+// to add to the cosigners file.
+func newSigner(path, name string) (string, error) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return "", err
+	}
+	err = os.WriteFile(path, []byte(name+" "+hex.EncodeToString(priv.Seed())+"\n"), 0600)
+	return name + " " + hex.EncodeToString(pub), err
+}
+
+func cosign(c *cmd, name string, priv ed25519.PrivateKey) *cosig {
+	return &cosig{Signer: name, Sig: hex.EncodeToString(ed25519.Sign(priv, cosignDigest(c)))}
+}
+
+func getCosigning(target string) ([]*cmd, error) {
+	resp, err := client.Get(target + "/cosign")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, responseError(resp)
+	}
+	cmds := make([]*cmd, 0)
+	err = json.NewDecoder(resp.Body).Decode(&cmds)
+	return cmds, err
+}
+
+// postCosig adds a signature to a command awaiting cosigners, returning
+// the server's account of the signatures still needed.
+func postCosig(id string, s *cosig, target string) (string, error) {
+	payload, err := json.Marshal(s)
+	if err != nil {
+		return "", err
+	}
+	resp, err := client.Post(target+"/commands/"+id+"/cosign", "application/json", bytes.NewBuffer(payload))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", responseError(resp)
+	}
+	msg, err := io.ReadAll(resp.Body)
+	return string(msg), err
+}
+
+func printCosigning(c *cmd) {
+	name := c.Name
+	if c.Type != "" {
+		name = c.Type
+	}
+	signers := make([]string, 0, len(c.Cosigs))
+	for _, s := range c.Cosigs {
+		signers = append(signers, s.Signer)
+	}
+	fmt.Printf("%s: %s %s, agents %s, signed by %s\n", c.ID, name, strings.Join(c.Args, " "),
+		strings.Join(c.Agents, ","), strings.Join(signers, ","))
+}
+
+// awaitCosign holds c until enough cosigners have signed it, keeping only
+// valid signatures. It reports whether c was held.
+func (a *app) awaitCosign(w http.ResponseWriter, c *cmd, rule string) bool {
+	if a.cosigners == nil {
+		return false
+	}
+	if c.NotAfter.IsZero() {
+		a.audit("rejected", c, rule, errNoCosignWindow)
+		httpError(w, errNoCosignWindow.Error(), http.StatusBadRequest)
+		return true
+	}
+	c.Cosigs = a.cosigners.valid(c)
+	err := a.cosigners.check(c)
+	if err == nil {
+		return false
+	}
+	if len(a.cosigning) >= maxPending {
+		httpError(w, "too many commands awaiting cosigners", http.StatusServiceUnavailable)
+		return true
+	}
+	a.cosigning[c.ID] = c
+	a.audit("held", c, rule, err)
+	w.WriteHeader(http.StatusAccepted)
+	w.Write([]byte(c.ID))
+	fmt.Printf("%s: %s awaiting cosigners, %s\n", c.Created, c.ref(), err)
+	return true
+}
+
+// handleCosign adds a cosignature, and queues the command, dated and signed
+// again by the server, once enough cosigners have signed it.
+func (a *app) handleCosign(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/commands/"), "/cosign")
+	s := &cosig{}
+	if !decode(w, r, s) {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	c := a.cosigning[id]
+	if c == nil {
+		httpError(w, "not found", http.StatusNotFound)
+		return
+	}
+	signed := *c
+	signed.Cosigs = append(append(make([]*cosig, 0), c.Cosigs...), s)
+	valid := a.cosigners.valid(&signed)
+	if len(valid) == len(c.Cosigs) {
+		httpError(w, "invalid or repeated signature of "+s.Signer, http.StatusForbidden)
+		return
+	}
+	c.Cosigs = valid
+	if err := a.cosigners.check(c); err != nil {
+		w.Write([]byte(err.Error()))
+		return
+	}
+	rule, err := a.admit(c)
+	if err != nil {
+		httpError(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	delete(a.cosigning, id)
+	c.Created = time.Now()
+	c.Sum = hex.EncodeToString(signCmd(c, a.hasher))
+	if a.await(w, c, rule) {
+		return
+	}
+	if err = a.enqueue(c); err != nil {
+		httpError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	a.audit("cosigned", c, rule, nil)
+	w.Write([]byte("queued"))
+	fmt.Printf("%s: %s cosigned, queued\n", c.Created, c.ref())
+}
+
+func (a *app) handleGetCosigning(w http.ResponseWriter, r *http.Request) {
+	if !a.viewer(w, r, "commands") {
+		return
+	}
+	a.mu.Lock()
+	cmds := make([]*cmd, 0, len(a.cosigning))
+	for _, c := range a.cosigning {
+		cmds = append(cmds, c)
+	}
+	sort.Slice(cmds, func(i, j int) bool { return cmds[i].Created.Before(cmds[j].Created) })
+	payload, err := json.Marshal(cmds)
+	a.mu.Unlock()
+	if err != nil {
+		httpError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write(payload)
+}
+
+// errNoCosignWindow refuses cosigned commands that would be valid forever,
+// as the creation time is not cosigned.
+var errNoCosignWindow = errors.New("cosigned commands need a window, send with -not-after")
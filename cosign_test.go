@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"lukechampine.com/blake3"
+)
+
+func TestCosignBinding(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cs := &cosigners{keys: map[string]ed25519.PublicKey{"alice": pub}, m: 1}
+	signed := func(c *cmd) *cmd {
+		c.Cosigs = []*cosig{cosign(c, "alice", priv)}
+		return c
+	}
+	window := time.Now().Add(time.Hour)
+	tests := []struct {
+		name   string
+		c      *cmd
+		tamper func(c *cmd)
+		ok     bool
+	}{
+		{"valid", &cmd{Name: "ls", NotAfter: window}, func(c *cmd) {}, true},
+		{"redated", &cmd{Name: "ls", NotAfter: window}, func(c *cmd) { c.Created = time.Now() }, true},
+		{"agent moved into args",
+			&cmd{Name: "ls", Args: []string{"x"}, Agents: []string{"web-1"}, NotAfter: window},
+			func(c *cmd) { c.Args, c.Agents = append(c.Args, c.Agents...), nil }, false},
+		{"window extended", &cmd{Name: "ls", NotAfter: window}, func(c *cmd) { c.NotAfter = c.NotAfter.Add(time.Hour) }, false},
+		{"no window", &cmd{Name: "ls"}, func(c *cmd) {}, false},
+	}
+	for _, tt := range tests {
+		c := signed(tt.c)
+		tt.tamper(c)
+		if err := cs.check(c); (err == nil) != tt.ok {
+			t.Errorf("%s: got %v", tt.name, err)
+		}
+	}
+}
+
+// TestCosignTokenSend sends a command cosigned by its sender with a token,
+// which the server records as the operator before checking cosignatures.
+func TestCosignTokenSend(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rb, err := loadRBAC("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := blake3.Sum256([]byte("mykey"))
+	a := &app{
+		hasher:    blake3.New(32, key[:]),
+		store:     newMemoryStore(),
+		rbac:      rb,
+		held:      make(map[string]*cmd),
+		awaiting:  make(map[string]*cmd),
+		cosigners: &cosigners{keys: map[string]ed25519.PublicKey{"alice": pub}, m: 1},
+		cosigning: make(map[string]*cmd),
+		hints:     &pollHints{},
+	}
+	a.store.putToken(&apiToken{ID: "t1", Hash: tokenHash("secret"), Scopes: []string{"send"}, Expires: time.Now().Add(time.Hour)})
+	c := &cmd{ID: newID(), Name: "ls", Version: protocolVersion, Created: time.Now(), NotAfter: time.Now().Add(time.Hour)}
+	c.Cosigs = []*cosig{cosign(c, "alice", priv)}
+	body, _ := json.Marshal(c)
+	r := httptest.NewRequest("POST", "/", bytes.NewReader(body))
+	r.Header.Set("Authorization", "Bearer "+tokenPrefix+"t1_secret")
+	w := httptest.NewRecorder()
+	a.handlePostCmd(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("got %d: %s", w.Code, w.Body)
+	}
+	cmds, _ := a.store.cmds()
+	if len(cmds) != 1 || cmds[0].Operator != "token:t1" {
+		t.Fatalf("queued %v", cmds)
+	}
+}
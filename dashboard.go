@@ -0,0 +1,49 @@
+package main
+
+import (
+	"bytes"
+	"embed"
+	"io/fs"
+	"net/http"
+	"strings"
+)
+
+// The dashboard is embedded, and loads nothing from elsewhere, so serve
+// stays a single binary that works offline.
+//
+//go:embed dashboard
+var dashboardFiles embed.FS
+
+var dashboardThemes = []string{"auto", "light", "dark"}
+
+// newDashboard serves the dashboard with theme as the default, which
+// browsers may override.
+func newDashboard(theme string) (http.Handler, error) {
+	files, err := fs.Sub(dashboardFiles, "dashboard")
+	if err != nil {
+		return nil, err
+	}
+	index, err := fs.ReadFile(files, "index.html")
+	if err != nil {
+		return nil, err
+	}
+	index = bytes.ReplaceAll(index, []byte("{{theme}}"), []byte(theme))
+	fileServer := http.FileServer(http.FS(files))
+	return http.StripPrefix("/dashboard", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Security-Policy", "default-src 'self'; frame-ancestors 'none'")
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		switch {
+		case r.URL.Path == "":
+			// Relative, to stay under -base-path.
+			w.Header().Set("Location", "dashboard/")
+			w.WriteHeader(http.StatusMovedPermanently)
+		case r.URL.Path == "/" || r.URL.Path == "/index.html":
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			w.Write(index)
+		case strings.HasSuffix(r.URL.Path, "/"):
+			httpError(w, "not found", http.StatusNotFound)
+		default:
+			fileServer.ServeHTTP(w, r)
+		}
+	})), nil
+}
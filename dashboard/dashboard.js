@@ -0,0 +1,150 @@
+"use strict";
+
+// The dashboard reads the JSON API of the server it is served by, with
+// the bearer token entered, if any, kept for the session.
+
+const refreshEvery = 10000;
+const themes = ["auto", "light", "dark"];
+let selected = "";
+
+function token() {
+	return sessionStorage.getItem("captain-token") || "";
+}
+
+async function get(path) {
+	const headers = {};
+	if (token()) {
+		headers.Authorization = "Bearer " + token();
+	}
+	const resp = await fetch(path, {headers});
+	if (!resp.ok) {
+		const body = await resp.text();
+		let msg = body.trim();
+		try {
+			const e = JSON.parse(body);
+			msg = e.message + (e.request_id ? " (request " + e.request_id + ")" : "");
+		} catch {
+			// Proxies in front of the server may answer in plain text.
+		}
+		throw new Error(path + ": " + resp.status + " " + msg);
+	}
+	return resp.json();
+}
+
+function cell(row, text, className) {
+	const td = row.insertCell();
+	td.textContent = text;
+	if (className) {
+		td.className = className;
+	}
+	return td;
+}
+
+function when(t) {
+	return t ? new Date(t).toLocaleString() : "";
+}
+
+// duration formats nanoseconds, as encoded by Go.
+function duration(ns) {
+	if (!ns) {
+		return "";
+	}
+	const s = ns / 1e9;
+	return s < 1 ? Math.round(ns / 1e6) + "ms" : s.toFixed(1) + "s";
+}
+
+function fill(id, items, render) {
+	const body = document.querySelector(id + " tbody");
+	body.replaceChildren();
+	for (const item of items) {
+		render(body.insertRow(), item);
+	}
+}
+
+async function refreshAgents() {
+	fill("#agents", await get("../agents"), (row, s) => {
+		cell(row, s.Agent);
+		cell(row, s.Status + (s.Drift ? ", drifted" : ""), s.Status);
+		cell(row, when(s.LastSeen));
+		cell(row, duration(s.Poll));
+		const tags = s.Config && s.Config.Tags ? s.Config.Tags : {};
+		cell(row, Object.entries(tags).map(([k, v]) => k + "=" + v).join(" "));
+	});
+}
+
+async function refreshCommands() {
+	const cmds = await get("../commands");
+	cmds.sort((a, b) => new Date(b.Created) - new Date(a.Created));
+	fill("#commands", cmds, (row, c) => {
+		cell(row, when(c.Created));
+		cell(row, c.ID);
+		cell(row, [c.Type || c.Name, ...(c.Args || [])].join(" "));
+		cell(row, (c.Agents || []).join(" ") || "all");
+		cell(row, c.Operator || "");
+		if (c.ID === selected) {
+			row.className = "selected";
+		}
+		row.onclick = () => showResults(c.ID);
+	});
+}
+
+async function refreshResults() {
+	if (!selected) {
+		return;
+	}
+	const results = await get("../commands/" + encodeURIComponent(selected) + "/results");
+	document.getElementById("cmd").textContent = selected;
+	fill("#results", results, (row, res) => {
+		cell(row, res.Agent);
+		const outcome = res.State || (res.Error ? "failed" : "exit " + res.ExitCode);
+		cell(row, outcome + (res.Flag ? ", " + res.Flag : ""), res.State);
+		cell(row, duration(res.Duration));
+		const pre = document.createElement("pre");
+		pre.textContent = (res.Output + res.Error).trim() || (res.Data ? JSON.stringify(res.Data) : "");
+		row.insertCell().append(pre);
+	});
+	document.getElementById("results").hidden = false;
+}
+
+async function showResults(id) {
+	selected = id;
+	await refresh();
+}
+
+async function refresh() {
+	const error = document.getElementById("error");
+	try {
+		await Promise.all([refreshAgents(), refreshCommands(), refreshResults()]);
+		error.hidden = true;
+	} catch (err) {
+		error.textContent = err.message;
+		error.hidden = false;
+	}
+}
+
+// The theme chosen in the browser overrides the default of the server.
+function applyTheme(theme) {
+	const root = document.documentElement;
+	if (theme) {
+		root.dataset.theme = theme;
+	}
+	document.getElementById("theme").textContent = "theme: " + root.dataset.theme;
+}
+
+document.getElementById("theme").onclick = () => {
+	const next = themes[(themes.indexOf(document.documentElement.dataset.theme) + 1) % themes.length];
+	localStorage.setItem("captain-theme", next);
+	applyTheme(next);
+};
+
+document.getElementById("auth").onsubmit = (e) => {
+	e.preventDefault();
+	const input = document.getElementById("token");
+	sessionStorage.setItem("captain-token", input.value.trim());
+	input.value = "";
+	refresh();
+};
+
+applyTheme(localStorage.getItem("captain-theme"));
+refresh();
+setInterval(refresh, refreshEvery);
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"lukechampine.com/blake3"
+)
+
+const (
+	deadExpired = "expired"
+	deadOffline = "offline"
+	deadFailed  = "failed"
+)
+
+// deadLetter records that an agent did not execute a command in time, or
+// failed it, so the command does not vanish silently. Retry is the id of
+// the command re-dispatched in its place.
+type deadLetter struct {
+	Cmd, Agent, Reason string
+	Trace              string `json:",omitempty"`
+	Retry              string `json:",omitempty"`
+	Created            time.Time
+}
+
+func (d *deadLetter) key() string {
+	return d.Cmd + "/" + d.Agent
+}
+
+// deadLetterEvery sweeps the queue for dead letters in the background.
+func (a *app) deadLetterEvery(after time.Duration) {
+	for now := range time.Tick(pruneInterval) {
+		a.mu.Lock()
+		err := a.sweepDead(after, now.Round(0))
+		a.mu.Unlock()
+		if err != nil {
+			fmt.Println(err)
+		}
+	}
+}
+
+// sweepDead records a dead letter for each agent that has not reported a
+// result for a command after it has been queued for after, or once its
+// window has closed, and for each failed result. Commands to all agents
+// only yield dead letters for failures, as the server cannot know which
+// agents should have reported.
+func (a *app) sweepDead(after time.Duration, now time.Time) error {
+	cmds, err := a.store.cmds()
+	if err != nil {
+		return err
+	}
+	letters, err := a.store.deadLetters()
+	if err != nil {
+		return err
+	}
+	known := make(map[string]bool, len(letters))
+	for _, d := range letters {
+		known[d.key()] = true
+	}
+	for _, c := range cmds {
+		if c.Signal != "" || c.Type == pingType {
+			continue
+		}
+		deadline := c.Created.Add(after)
+		if c.NotBefore.After(c.Created) {
+			deadline = c.NotBefore.Add(after)
+		}
+		if !c.NotAfter.IsZero() {
+			deadline = c.NotAfter
+		}
+		if now.Before(deadline) {
+			continue
+		}
+		results, err := a.store.results(c.ID)
+		if err != nil {
+			return err
+		}
+		byAgent := make(map[string]*result, len(results))
+		for _, res := range results {
+			byAgent[res.Agent] = res
+		}
+		agents := c.Agents
+		if len(agents) == 0 {
+			for agent := range byAgent {
+				agents = append(agents, agent)
+			}
+			sort.Strings(agents)
+		}
+		for _, agent := range agents {
+			d := &deadLetter{Cmd: c.ID, Agent: agent, Trace: c.Trace, Created: now}
+			if known[d.key()] {
+				continue
+			}
+			res := byAgent[agent]
+			switch {
+			case res != nil:
+				if d.Reason = failure(res); d.Reason == "" {
+					continue
+				}
+			case a.lastSeen != nil && !a.lastSeen[agent].After(c.Created):
+				d.Reason = deadOffline
+			default:
+				d.Reason = deadExpired
+			}
+			if err = a.store.putDeadLetter(d); err != nil {
+				return err
+			}
+			fmt.Printf("%s: dead letter %s for %s: %s\n", now, c.ref(), agent, d.Reason)
+		}
+	}
+	return nil
+}
+
+// failure describes how res failed, or is empty if it succeeded.
+func failure(res *result) string {
+	switch {
+	case res.Assert != "":
+		if res.Assert != "passed" {
+			return deadFailed + ": assertions " + res.Assert
+		}
+	case res.Error != "":
+		return deadFailed + ": " + res.Error
+	case res.ExitCode != 0:
+		return fmt.Sprintf("%s: exit code %d", deadFailed, res.ExitCode)
+	case strings.HasPrefix(res.Check, "failed"):
+		return deadFailed + ": verification " + res.Check
+	}
+	return ""
+}
+
+func (a *app) handleDeadLetters(w http.ResponseWriter, r *http.Request) {
+	req := a.decodeAdmin(w, r, "list", "retry")
+	if req == nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	letters, err := a.store.deadLetters()
+	if err != nil {
+		httpError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	sort.Slice(letters, func(i, j int) bool { return letters[i].Created.Before(letters[j].Created) })
+	var v any = letters
+	if req.Action == "retry" {
+		retry, status, err := a.retryDead(req.ID, letters)
+		if err != nil {
+			httpError(w, err.Error(), status)
+			return
+		}
+		v = retry.ID
+	}
+	payload, err := json.Marshal(v)
+	if err != nil {
+		httpError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write(payload)
+}
+
+// retryDead re-dispatches command id, under a new id, to the agents it has
+// pending dead letters for, and marks them retried. It returns the new
+// command, or an error with a status code.
+func (a *app) retryDead(id string, letters []*deadLetter) (*cmd, int, error) {
+	pending := make([]*deadLetter, 0)
+	for _, d := range letters {
+		if d.Cmd == id && d.Retry == "" {
+			pending = append(pending, d)
+		}
+	}
+	if len(pending) == 0 {
+		return nil, http.StatusNotFound, fmt.Errorf("no dead letters to retry for %s", id)
+	}
+	cmds, err := a.store.cmds()
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+	var orig *cmd
+	for _, c := range cmds {
+		if c.ID == id {
+			orig = c
+		}
+	}
+	switch {
+	case orig == nil:
+		return nil, http.StatusGone, fmt.Errorf("%s is no longer queued, send it again", id)
+	case orig.Type == sealedType:
+		return nil, http.StatusConflict, errors.New("sealed commands are bound to their id, seal and send it again")
+	case (len(orig.Cosigs) > 0 || a.cosigners != nil) && a.delegator == nil:
+		return nil, http.StatusConflict, errors.New("cosigned commands are bound to their id, send it again for cosigning, or give the server a -delegate-key")
+	case !orig.NotAfter.IsZero() && !time.Now().Before(orig.NotAfter):
+		return nil, http.StatusConflict, fmt.Errorf("the window of %s has closed, send it again", id)
+	}
+	c := *orig
+	c.ID = newID()
+	c.Agents = make([]string, len(pending))
+	for i, d := range pending {
+		c.Agents[i] = d.Agent
+	}
+	// The retry keeps the window the operator signed.
+	c.Created = time.Now()
+	c.Sum = hex.EncodeToString(signCmd(&c, a.hasher))
+	c.Cosigs, c.Delegation = nil, nil
+	if a.delegator != nil {
+		a.delegator.delegate(&c, orig, delegateRetry, nil)
+	}
+	rule, err := a.admit(&c)
+	if err != nil {
+		return nil, http.StatusForbidden, err
+	}
+	if err = a.enqueue(&c); err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+	for _, d := range pending {
+		d.Retry = c.ID
+		if err = a.store.putDeadLetter(d); err != nil {
+			return nil, http.StatusInternalServerError, err
+		}
+	}
+	a.audit("retried", &c, rule, nil)
+	fmt.Printf("%s: retried %s as %s for %s\n", c.Created, id, c.ref(), strings.Join(c.Agents, ","))
+	return &c, http.StatusOK, nil
+}
+
+func getDeadLetters(h *blake3.Hasher, target string) ([]*deadLetter, error) {
+	letters := make([]*deadLetter, 0)
+	err := postAdmin("/deadletters", &adminRequest{Action: "list"}, h, target, &letters)
+	return letters, err
+}
+
+func retryDeadLetters(id string, h *blake3.Hasher, target string) (string, error) {
+	var retry string
+	err := postAdmin("/deadletters", &adminRequest{Action: "retry", ID: id}, h, target, &retry)
+	return retry, err
+}
+
+func printDeadLetter(d *deadLetter) {
+	fmt.Printf("%s: %s %s %s", d.Created.Format(time.RFC3339), d.Cmd, d.Agent, d.Reason)
+	if d.Retry != "" {
+		fmt.Printf(" (retried as %s)", d.Retry)
+	}
+	fmt.Println()
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"net"
+	"net/http"
+	_ "net/http/pprof"
+)
+
+// serveDebug serves /debug/pprof and /debug/vars on addr, which must be a
+// loopback address, apart from the main listener. vars are published
+// under captain in /debug/vars.
+func serveDebug(addr string, vars func() any) error {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return fmt.Errorf("debug address %s is not a loopback address", addr)
+	}
+	expvar.Publish("captain", expvar.Func(vars))
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	// The pprof and expvar handlers register themselves on the default mux.
+	go func() {
+		fmt.Println(http.Serve(ln, http.DefaultServeMux))
+	}()
+	return nil
+}
+
+func (a *app) debugVars() any {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	cmds, _ := a.store.cmds()
+	return map[string]int{
+		"queued":    len(cmds),
+		"held":      len(a.held),
+		"cosigning": len(a.cosigning),
+		"awaiting":  len(a.awaiting),
+		"agents":    len(a.lastSeen),
+	}
+}
+
+func (ag *agent) debugVars() any {
+	ag.mu.Lock()
+	defer ag.mu.Unlock()
+	return map[string]any{
+		"agent":   ag.id,
+		"running": len(ag.running),
+		"queued":  ag.queue.len(),
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+
+	"lukechampine.com/blake3"
+)
+
+// Classes of commands the server may materialize with its delegation key.
+const (
+	delegateTemplate = "template"
+	delegateRetry    = "retry"
+)
+
+// delegation is the server's signature of a command it derived from an
+// operator-signed Origin: a template resolved with Vars, or a retry of a
+// dead command. Agents trusting the delegation key for Class derive the
+// command from Origin again, so the key cannot sign anything else.
+type delegation struct {
+	Class, Signer, Sig string
+	Origin             *cmd
+	Vars               map[string]string `json:",omitempty"`
+}
+
+// delegator is the server's delegation key.
+type delegator struct {
+	name string
+	key  ed25519.PrivateKey
+}
+
+// delegates are the delegation keys agents trust, and for which classes.
+type delegates struct {
+	keys    *cosigners
+	classes map[string]bool
+}
+
+func loadDelegates(path, classes string) (*delegates, error) {
+	keys, err := loadCosigners(path, 1)
+	if err != nil {
+		return nil, err
+	}
+	d := &delegates{keys: keys, classes: make(map[string]bool)}
+	for _, class := range strings.Split(classes, ",") {
+		switch class {
+		case delegateTemplate, delegateRetry:
+			d.classes[class] = true
+		case "":
+		default:
+			return nil, fmt.Errorf("unsupported delegation class %q", class)
+		}
+	}
+	if len(d.classes) == 0 {
+		return nil, errors.New("delegates need -delegate-classes")
+	}
+	return d, nil
+}
+
+func delegationDigest(c *cmd) []byte {
+	h := blake3.New(32, nil)
+	sum := signCmd(c, h)
+	h.Reset()
+	h.Write(sum)
+	h.Write(stb(c.Delegation.Class))
+	h.Write(stb(c.Delegation.Origin.Sum))
+	writeLabels(h, c.Delegation.Vars)
+	return h.Sum(nil)
+}
+
+// delegate marks c as derived from origin, signed with the delegation key.
+func (d *delegator) delegate(c, origin *cmd, class string, vars map[string]string) {
+	c.Delegation = &delegation{Class: class, Signer: d.name, Origin: origin, Vars: vars}
+	c.Delegation.Sig = hex.EncodeToString(ed25519.Sign(d.key, delegationDigest(c)))
+}
+
+// check verifies the delegation of c, that its origin was signed with h, if
+// not nil, and by enough cosigners if cs is not nil, and that c derives
+// from it.
+func (ds *delegates) check(c *cmd, h *blake3.Hasher, cs *cosigners) error {
+	d := c.Delegation
+	if !ds.classes[d.Class] {
+		return fmt.Errorf("delegation of class %q is not trusted", d.Class)
+	}
+	key, ok := ds.keys.keys[d.Signer]
+	sig, err := hex.DecodeString(d.Sig)
+	if !ok || err != nil || d.Origin == nil || !ed25519.Verify(key, delegationDigest(c), sig) {
+		return errors.New("invalid delegation")
+	}
+	// The origin's window is checked on c, which derives it, so only its
+	// signature counts here.
+	if err = verifyCmd(d.Origin, h, 0); err != nil {
+		return fmt.Errorf("origin: %w", err)
+	}
+	// An origin may itself be derived, as a retry of a template.
+	switch {
+	case d.Origin.Delegation != nil:
+		err = ds.check(d.Origin, h, cs)
+	case cs != nil:
+		err = cs.check(d.Origin)
+	}
+	if err != nil {
+		return fmt.Errorf("origin: %w", err)
+	}
+	want, err := derive(c, d)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(signCmd(want, blake3.New(32, nil)), signCmd(c, blake3.New(32, nil))) {
+		return fmt.Errorf("does not derive from %s as a %s", d.Origin.ID, d.Class)
+	}
+	return nil
+}
+
+// derive returns the command the server may derive from the origin of d,
+// taking what it may choose from c.
+func derive(c *cmd, d *delegation) (*cmd, error) {
+	switch d.Class {
+	case delegateTemplate:
+		if !d.Origin.Template || d.Origin.ID != c.ID {
+			return nil, errors.New("origin is not this template")
+		}
+		return resolveTemplate(d.Origin, d.Vars, d.Origin.Labels[namespaceLabel], nil)
+	case delegateRetry:
+		for _, agent := range c.Agents {
+			if !d.Origin.targets(agent) {
+				return nil, fmt.Errorf("retry targets %s, which the origin does not", agent)
+			}
+		}
+		// A retry keeps the window of its origin, which the operator signed.
+		retry := *d.Origin
+		retry.ID, retry.Agents, retry.Created = c.ID, c.Agents, c.Created
+		return &retry, nil
+	}
+	return nil, fmt.Errorf("unsupported delegation class %q", d.Class)
+}
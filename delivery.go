@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// Delivery semantics a command may ask for. Without one, agents record a
+// command as executed before running it, and run commands issued before
+// they started within -catch-up.
+const (
+	// deliveryAtMostOnce runs a command only if the agent is sure it did
+	// not run it before: it must record the command before running it,
+	// and skips it if it was issued before the agent started, as a
+	// previous run may have executed it without a trace.
+	deliveryAtMostOnce = "at-most-once"
+	// deliveryAtLeastOnce records a command as pending when received, and
+	// as executed once its result is reported, so an agent that stops
+	// before then runs it again, even outside -catch-up.
+	deliveryAtLeastOnce = "at-least-once"
+)
+
+var deliveries = []string{deliveryAtMostOnce, deliveryAtLeastOnce}
+
+func validDelivery(delivery string) error {
+	if delivery != "" && !slices.Contains(deliveries, delivery) {
+		return fmt.Errorf("delivery must be %s", strings.Join(deliveries, " or "))
+	}
+	return nil
+}
+
+func (s *state) wasPending(id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return slices.Contains(s.pending, id)
+}
+
+// markPending records that command id was received, and is not executed
+// yet.
+func (s *state) markPending(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if slices.Contains(s.pending, id) {
+		return nil
+	}
+	s.pending = append(s.pending, id)
+	if len(s.pending) > maxExecuted {
+		s.pending = s.pending[len(s.pending)-maxExecuted:]
+	}
+	return s.writePending()
+}
+
+// writePending saves the pending ids. The caller holds s.mu.
+func (s *state) writePending() error {
+	return writeAtomic(filepath.Join(s.dir, "pending"), []byte(strings.Join(s.pending, "\n")+"\n"))
+}
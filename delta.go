@@ -0,0 +1,386 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"lukechampine.com/blake3"
+)
+
+const (
+	// haveHeader lists the artifacts an agent has cached, most recently
+	// used first, as bases for a delta.
+	haveHeader  = "X-Captain-Have"
+	deltaHeader = "X-Captain-Delta"
+	deltaMagic  = "CAPD1"
+	maxHave     = 32
+	maxLiteral  = 64 << 10
+	// A delta is served only if it saves a tenth of the artifact.
+	deltaWorth = 0.9
+)
+
+// Delta ops: copy blocks of the base, or literal bytes.
+const (
+	opCopy    = 'C'
+	opLiteral = 'L'
+	opEnd     = 'E'
+)
+
+// deltaBlockSize is about the square root of size, as in rsync.
+func deltaBlockSize(size int64) int {
+	bs := 1 << 10
+	for int64(bs)*int64(bs) < size && bs < 64<<10 {
+		bs <<= 1
+	}
+	return bs
+}
+
+// rolling is the rsync weak checksum of a window, updated a byte at a time.
+type rolling struct {
+	a, b uint32
+	n    uint32
+}
+
+func newRolling(window []byte) *rolling {
+	r := &rolling{n: uint32(len(window))}
+	for i, c := range window {
+		r.a += uint32(c)
+		r.b += uint32(len(window)-i) * uint32(c)
+	}
+	return r
+}
+
+func (r *rolling) roll(out, in byte) {
+	r.a += uint32(in) - uint32(out)
+	r.b += r.a - r.n*uint32(out)
+}
+
+func (r *rolling) sum() uint32 {
+	return r.a&0xffff | r.b<<16
+}
+
+func strongSum(block []byte) [16]byte {
+	var s [16]byte
+	sum := blake3.Sum256(block)
+	copy(s[:], sum[:])
+	return s
+}
+
+// deltaWriter encodes ops, merging copies of consecutive blocks.
+type deltaWriter struct {
+	w            *bufio.Writer
+	literal      []byte
+	first, count uint64
+}
+
+func (d *deltaWriter) copyBlock(i uint64) error {
+	if d.count > 0 && d.first+d.count == i {
+		d.count++
+		return nil
+	}
+	if err := d.flush(); err != nil {
+		return err
+	}
+	d.first, d.count = i, 1
+	return nil
+}
+
+func (d *deltaWriter) literalByte(c byte) error {
+	if d.count > 0 {
+		if err := d.flush(); err != nil {
+			return err
+		}
+	}
+	d.literal = append(d.literal, c)
+	if len(d.literal) >= maxLiteral {
+		return d.flush()
+	}
+	return nil
+}
+
+func (d *deltaWriter) flush() error {
+	var hdr [13]byte
+	switch {
+	case d.count > 0:
+		hdr[0] = opCopy
+		binary.LittleEndian.PutUint64(hdr[1:9], d.first)
+		binary.LittleEndian.PutUint32(hdr[9:13], uint32(d.count))
+		d.count = 0
+		_, err := d.w.Write(hdr[:])
+		return err
+	case len(d.literal) > 0:
+		hdr[0] = opLiteral
+		binary.LittleEndian.PutUint32(hdr[1:5], uint32(len(d.literal)))
+		if _, err := d.w.Write(hdr[:5]); err != nil {
+			return err
+		}
+		_, err := d.w.Write(d.literal)
+		d.literal = d.literal[:0]
+		return err
+	}
+	return nil
+}
+
+// writeDelta encodes target as copies of the blocks of base and literals.
+func writeDelta(w io.Writer, base, target *os.File, baseHash string) error {
+	info, err := target.Stat()
+	if err != nil {
+		return err
+	}
+	bs := deltaBlockSize(info.Size())
+	blocks := make(map[uint32]map[[16]byte]uint64)
+	block := make([]byte, bs)
+	br := bufio.NewReader(base)
+	for i := uint64(0); ; i++ {
+		if _, err = io.ReadFull(br, block); err != nil {
+			break
+		}
+		weak, strong := newRolling(block).sum(), strongSum(block)
+		if blocks[weak] == nil {
+			blocks[weak] = make(map[[16]byte]uint64)
+		}
+		if _, ok := blocks[weak][strong]; !ok {
+			blocks[weak][strong] = i
+		}
+	}
+	if err != io.EOF && err != io.ErrUnexpectedEOF {
+		return err
+	}
+	bw := bufio.NewWriter(w)
+	bw.WriteString(deltaMagic)
+	bw.WriteString(baseHash)
+	var size [4]byte
+	binary.LittleEndian.PutUint32(size[:], uint32(bs))
+	bw.Write(size[:])
+	d := &deltaWriter{w: bw}
+	tr := bufio.NewReaderSize(target, 4*bs)
+	// The window is buf[start:], refilled a block at a time.
+	buf := make([]byte, 0, 4*bs)
+	start := 0
+	fill := func() error {
+		for len(buf)-start < bs {
+			if start >= 2*bs {
+				buf = append(buf[:0], buf[start:]...)
+				start = 0
+			}
+			c, err := tr.ReadByte()
+			if err != nil {
+				return err
+			}
+			buf = append(buf, c)
+		}
+		return nil
+	}
+	for {
+		err = fill()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		r := newRolling(buf[start : start+bs])
+		for {
+			// The strong sum is only computed for weak matches.
+			if strong := blocks[r.sum()]; strong != nil {
+				if i, ok := strong[strongSum(buf[start:start+bs])]; ok {
+					if err = d.copyBlock(i); err != nil {
+						return err
+					}
+					start += bs
+					break
+				}
+			}
+			if err = d.literalByte(buf[start]); err != nil {
+				return err
+			}
+			out := buf[start]
+			start++
+			if err = fill(); err != nil {
+				break
+			}
+			r.roll(out, buf[start+bs-1])
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	for _, c := range buf[start:] {
+		if err = d.literalByte(c); err != nil {
+			return err
+		}
+	}
+	if err = d.flush(); err != nil {
+		return err
+	}
+	bw.WriteByte(opEnd)
+	return bw.Flush()
+}
+
+// applyDelta writes the artifact encoded by the delta in r to w, reading
+// copied blocks from base.
+func applyDelta(r io.Reader, base io.ReaderAt, baseHash string, w io.Writer) error {
+	br := bufio.NewReader(r)
+	hdr := make([]byte, len(deltaMagic)+64+4)
+	if _, err := io.ReadFull(br, hdr); err != nil {
+		return err
+	}
+	if string(hdr[:len(deltaMagic)]) != deltaMagic || string(hdr[len(deltaMagic):len(deltaMagic)+64]) != baseHash {
+		return errors.New("invalid delta header")
+	}
+	bs := int64(binary.LittleEndian.Uint32(hdr[len(deltaMagic)+64:]))
+	if bs <= 0 || bs > 64<<10 {
+		return errors.New("invalid delta block size")
+	}
+	var op [12]byte
+	for {
+		kind, err := br.ReadByte()
+		if err != nil {
+			return err
+		}
+		switch kind {
+		case opEnd:
+			return nil
+		case opCopy:
+			if _, err = io.ReadFull(br, op[:12]); err != nil {
+				return err
+			}
+			first := binary.LittleEndian.Uint64(op[:8])
+			n := int64(binary.LittleEndian.Uint32(op[8:12]))
+			if first > 1<<40/uint64(bs) {
+				return errors.New("invalid delta copy")
+			}
+			// Copies past the end of the base fail, rather than truncate.
+			if _, err = io.CopyN(w, io.NewSectionReader(base, int64(first)*bs, n*bs), n*bs); err != nil {
+				return fmt.Errorf("invalid delta copy: %w", err)
+			}
+		case opLiteral:
+			if _, err = io.ReadFull(br, op[:4]); err != nil {
+				return err
+			}
+			n := int64(binary.LittleEndian.Uint32(op[:4]))
+			if n > maxLiteral {
+				return errors.New("invalid delta literal")
+			}
+			if _, err = io.CopyN(w, br, n); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("invalid delta op %q", kind)
+		}
+	}
+}
+
+// artifactName returns the name hash was uploaded as, if any.
+func (a *app) artifactName(hash string) string {
+	name, _ := os.ReadFile(filepath.Join(a.artifactDir, hash+".name"))
+	return string(name)
+}
+
+// deltaBase picks the artifact in have uploaded under the same name as hash,
+// and still stored, to serve hash as a delta from.
+func (a *app) deltaBase(hash string, have []string) string {
+	name := a.artifactName(hash)
+	if name == "" {
+		return ""
+	}
+	for i, base := range have {
+		if i == maxHave {
+			break
+		}
+		if base == hash || validArtifact("", base) != nil || a.artifactName(base) != name {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(a.artifactDir, base)); err == nil {
+			return base
+		}
+	}
+	return ""
+}
+
+// serveDelta serves hash as a delta from base, computed once and kept
+// beside the artifacts, if it is worth it. It reports whether it served.
+func (a *app) serveDelta(w http.ResponseWriter, r *http.Request, hash, base string) bool {
+	path := filepath.Join(a.artifactDir, hash+".delta-"+base)
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		if err = a.makeDelta(path, hash, base); err == nil {
+			info, err = os.Stat(path)
+		}
+	}
+	if err != nil {
+		fmt.Printf("artifact %s: delta: %s\n", hash, err)
+		return false
+	}
+	full, err := os.Stat(filepath.Join(a.artifactDir, hash))
+	if err != nil || float64(info.Size()) > deltaWorth*float64(full.Size()) {
+		return false
+	}
+	w.Header().Set(deltaHeader, base)
+	http.ServeFile(w, r, path)
+	return true
+}
+
+func (a *app) makeDelta(path, hash, base string) error {
+	bf, err := os.Open(filepath.Join(a.artifactDir, base))
+	if err != nil {
+		return err
+	}
+	defer bf.Close()
+	tf, err := os.Open(filepath.Join(a.artifactDir, hash))
+	if err != nil {
+		return err
+	}
+	defer tf.Close()
+	f, err := os.CreateTemp(a.artifactDir, "delta-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	err = writeDelta(f, bf, tf, base)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// fetchDelta downloads the artifact with digest from the server to w, as a
+// delta from a cached artifact if the server has one.
+func (ag *agent) fetchDelta(req *http.Request, w io.Writer) error {
+	req.Header.Set(haveHeader, strings.Join(ag.cache.list(maxHave), ","))
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("artifact: %w", responseError(resp))
+	}
+	base := resp.Header.Get(deltaHeader)
+	if base == "" {
+		_, err = io.Copy(w, resp.Body)
+		return err
+	}
+	f, err := os.Open(filepath.Join(ag.cache.dir, base))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err = applyDelta(resp.Body, f, base, w); err == nil && !ag.quiet {
+		logf("artifact: applied delta from %s\n", base)
+	}
+	return err
+}
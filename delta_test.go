@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testBaseHash = "0000000000000000000000000000000000000000000000000000000000000000"
+
+// makeTestDelta encodes target as a delta from base, through files as the
+// server does.
+func makeTestDelta(t *testing.T, base, target []byte) []byte {
+	dir := t.TempDir()
+	open := func(name string, data []byte) *os.File {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, data, 0600); err != nil {
+			t.Fatal(err)
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { f.Close() })
+		return f
+	}
+	buf := &bytes.Buffer{}
+	if err := writeDelta(buf, open("base", base), open("target", target), testBaseHash); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestDeltaRoundTrip(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	random := func(n int) []byte {
+		b := make([]byte, n)
+		rnd.Read(b)
+		return b
+	}
+	base := random(200 << 10)
+	edited := append([]byte(nil), base...)
+	copy(edited[100<<10:], "patched in the middle")
+	tests := []struct {
+		name         string
+		base, target []byte
+	}{
+		{"empty", nil, nil},
+		{"empty base", nil, random(1000)},
+		{"empty target", base, nil},
+		{"identical", base, base},
+		{"edited", base, edited},
+		{"prepended", base, append([]byte("header"), base...)},
+		{"appended", base, append(append([]byte(nil), base...), "trailer"...)},
+		{"truncated", base, base[:150<<10]},
+		{"unrelated", base, random(100 << 10)},
+		{"literals over the limit", nil, random(3 * maxLiteral)},
+	}
+	for _, tt := range tests {
+		delta := makeTestDelta(t, tt.base, tt.target)
+		out := &bytes.Buffer{}
+		if err := applyDelta(bytes.NewReader(delta), bytes.NewReader(tt.base), testBaseHash, out); err != nil {
+			t.Errorf("%s: %s", tt.name, err)
+			continue
+		}
+		if !bytes.Equal(out.Bytes(), tt.target) {
+			t.Errorf("%s: got %d bytes, want %d", tt.name, out.Len(), len(tt.target))
+		}
+	}
+	if delta := makeTestDelta(t, base, edited); len(delta) > len(edited)/10 {
+		t.Errorf("delta of a small edit is %d bytes", len(delta))
+	}
+}
+
+func TestDeltaInvalid(t *testing.T) {
+	base := bytes.Repeat([]byte("0123456789abcdef"), 4096)
+	target := append(append([]byte(nil), base...), "more"...)
+	delta := makeTestDelta(t, base, target)
+	hdr := len(deltaMagic) + 64 + 4
+	op := func(kind byte, args ...uint64) []byte {
+		b := append([]byte(nil), delta[:hdr]...)
+		b = append(b, kind)
+		for i, a := range args {
+			if kind == opCopy && i == 0 {
+				b = binary.LittleEndian.AppendUint64(b, a)
+			} else {
+				b = binary.LittleEndian.AppendUint32(b, uint32(a))
+			}
+		}
+		return b
+	}
+	tests := []struct {
+		name, base, want string
+		delta            []byte
+	}{
+		{"empty", testBaseHash, "EOF", nil},
+		{"truncated header", testBaseHash, "EOF", delta[:hdr-1]},
+		{"bad magic", testBaseHash, "header", append([]byte("XXXXX"), delta[len(deltaMagic):]...)},
+		{"other base", strings.Repeat("1", 64), "header", delta},
+		{"no ops", testBaseHash, "EOF", delta[:hdr]},
+		{"no end", testBaseHash, "EOF", delta[:len(delta)-1]},
+		{"truncated op", testBaseHash, "EOF", delta[:hdr+5]},
+		{"unknown op", testBaseHash, "invalid delta op", op('X')},
+		{"copy past the base", testBaseHash, "invalid delta copy", append(op(opCopy, 1<<20, 1), opEnd)},
+		{"copy overflowing", testBaseHash, "invalid delta copy", append(op(opCopy, 1<<62, 1), opEnd)},
+		{"literal over the limit", testBaseHash, "invalid delta literal", op(opLiteral, maxLiteral+1)},
+		{"short literal", testBaseHash, "EOF", append(op(opLiteral, 10), "abc"...)},
+	}
+	zero := append([]byte(nil), delta...)
+	binary.LittleEndian.PutUint32(zero[hdr-4:], 0)
+	tests = append(tests, struct {
+		name, base, want string
+		delta            []byte
+	}{"zero block size", testBaseHash, "block size", zero})
+	for _, tt := range tests {
+		err := applyDelta(bytes.NewReader(tt.delta), bytes.NewReader(base), tt.base, &bytes.Buffer{})
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: got %v, want %q", tt.name, err, tt.want)
+		}
+	}
+}
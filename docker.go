@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+)
+
+type containerExitError struct {
+	code int
+}
+
+func (e *containerExitError) Error() string {
+	return fmt.Sprintf("exit status %d", e.code)
+}
+
+func (e *containerExitError) ExitCode() int {
+	return e.code
+}
+
+// docker talks to the Docker Engine API on the socket in DOCKER_HOST,
+// or the default socket.
+var docker = dockerClient()
+
+func dockerClient() *http.Client {
+	sock := "/var/run/docker.sock"
+	if host := os.Getenv("DOCKER_HOST"); strings.HasPrefix(host, "unix://") {
+		sock = strings.TrimPrefix(host, "unix://")
+	}
+	return &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, "unix", sock)
+			},
+		},
+	}
+}
+
+// dockerExec runs the command inside c.Container with docker exec semantics,
+// writing the container's stdout to out.
+func dockerExec(ctx context.Context, c *cmd, env []string, out io.Writer) error {
+	client := docker
+	create := map[string]any{
+		"AttachStdout": true,
+		"AttachStderr": true,
+		"Cmd":          append([]string{c.Name}, c.Args...),
+		"Env":          env,
+	}
+	exec := struct{ Id string }{}
+	err := dockerCall(ctx, client, "POST", "/containers/"+c.Container+"/exec", create, &exec)
+	if err != nil {
+		return err
+	}
+	start, err := json.Marshal(map[string]bool{"Detach": false, "Tty": false})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", "http://docker/exec/"+exec.Id+"/start", bytes.NewReader(start))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("docker: got non-ok status code: %d %s", resp.StatusCode, msg)
+	}
+	if err = demux(resp.Body, out); err != nil {
+		return err
+	}
+	state := struct{ ExitCode int }{}
+	if err = dockerCall(ctx, client, "GET", "/exec/"+exec.Id+"/json", nil, &state); err != nil {
+		return err
+	}
+	if state.ExitCode != 0 {
+		return &containerExitError{state.ExitCode}
+	}
+	return nil
+}
+
+func dockerCall(ctx context.Context, client *http.Client, method, path string, body, v any) error {
+	var r io.Reader
+	if body != nil {
+		payload, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		r = bytes.NewReader(payload)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, "http://docker"+path, r)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("docker: got non-ok status code: %d %s", resp.StatusCode, bytes.TrimSpace(msg))
+	}
+	if v == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// demux copies stdout frames of a multiplexed docker stream to out,
+// discarding stderr.
+func demux(r io.Reader, out io.Writer) error {
+	br := bufio.NewReader(r)
+	header := make([]byte, 8)
+	for {
+		if _, err := io.ReadFull(br, header); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		size := int64(binary.BigEndian.Uint32(header[4:]))
+		dst := io.Discard
+		if header[0] == 1 {
+			dst = out
+		}
+		if _, err := io.CopyN(dst, br, size); err != nil {
+			return err
+		}
+	}
+}
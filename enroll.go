@@ -0,0 +1,291 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"lukechampine.com/blake3"
+)
+
+// States of an enrollment.
+const (
+	enrollPending  = "pending"
+	enrollApproved = "approved"
+	enrollRejected = "rejected"
+	enrollRevoked  = "revoked"
+)
+
+// credentialPrefix marks the credential of an enrolled agent, instead of
+// the key, in -key-file.
+const credentialPrefix = "cac_"
+
+// enrollment is an agent's request to join, made with a one-time token.
+// Once approved, the agent fetches its credential sealed for its identity.
+type enrollment struct {
+	Agent, Key, State, Token string
+	// Credential is the hex MAC key the agent signs with instead of the
+	// key, issued on approval.
+	Credential string `json:",omitempty"`
+	Created    time.Time
+}
+
+func (e *enrollment) validate() error {
+	if err := validID("agent", e.Agent); err != nil {
+		return err
+	}
+	if key, err := hex.DecodeString(e.Key); err != nil || len(key) != 32 {
+		return errors.New("invalid identity key")
+	}
+	return nil
+}
+
+// enroll requests to join with an enrollment token, and waits until an
+// operator approves the agent. It returns the agent's credential.
+func enroll(target, agent, token string, identity *ecdh.PrivateKey, poll time.Duration) ([]byte, error) {
+	e := &enrollment{Agent: agent, Key: hex.EncodeToString(identity.PublicKey().Bytes()), Created: time.Now()}
+	payload, err := json.Marshal(e)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest("POST", target+"/enroll", bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		err = responseError(resp)
+		resp.Body.Close()
+		return nil, fmt.Errorf("enrollment failed: %w", err)
+	}
+	resp.Body.Close()
+	fmt.Printf("enrolled as %s, waiting for approval\n", agent)
+	for {
+		s, err := getEnrollment(target, agent)
+		if err != nil {
+			fmt.Println(err)
+		}
+		if s != nil {
+			return openSecret(s, identity)
+		}
+		time.Sleep(poll)
+	}
+}
+
+// getEnrollment returns the sealed key, or nil while pending.
+func getEnrollment(target, agent string) (*secret, error) {
+	resp, err := client.Get(target + "/enroll/" + agent)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		s := &secret{}
+		return s, json.NewDecoder(resp.Body).Decode(s)
+	case http.StatusAccepted:
+		return nil, nil
+	}
+	return nil, fmt.Errorf("enrollment: %w", responseError(resp))
+}
+
+func (a *app) handleEnroll(w http.ResponseWriter, r *http.Request) {
+	e := &enrollment{}
+	if !decode(w, r, e) {
+		return
+	}
+	op, err := a.operator(r)
+	if err != nil || op == nil || !a.rbac.can(op, permEnroll) {
+		httpError(w, "enrolling needs an enrollment token", http.StatusUnauthorized)
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	// Enrollment tokens are revoked on first use.
+	t, err := a.store.token(strings.TrimPrefix(op.Name, "token:"))
+	if err != nil || t == nil || t.Revoked {
+		httpError(w, "enrollment token already used", http.StatusUnauthorized)
+		return
+	}
+	prev, err := a.store.enrollment(e.Agent)
+	if err == nil && prev != nil && prev.State != enrollRejected {
+		httpError(w, e.Agent+" is already enrolled", http.StatusConflict)
+		return
+	}
+	t.Revoked = true
+	e.State, e.Token, e.Created = enrollPending, t.ID, time.Now()
+	if err == nil {
+		err = a.store.putToken(t)
+	}
+	if err == nil {
+		err = a.store.putEnrollment(e)
+	}
+	if err != nil {
+		httpError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write([]byte("ok"))
+	fmt.Printf("%s: %s %s enrolled, pending approval\n", e.Created, r.RemoteAddr, e.Agent)
+}
+
+// handleGetEnrollment serves the credential of an approved agent, sealed
+// for its identity.
+func (a *app) handleGetEnrollment(w http.ResponseWriter, r *http.Request) {
+	agent := strings.TrimPrefix(r.URL.Path, "/enroll/")
+	a.mu.Lock()
+	e, err := a.store.enrollment(agent)
+	// Agents approved before credentials were issued get one now.
+	if err == nil && e != nil && e.State == enrollApproved && e.Credential == "" {
+		e.Credential = newCredential()
+		err = a.store.putEnrollment(e)
+	}
+	a.mu.Unlock()
+	switch {
+	case err != nil:
+		httpError(w, err.Error(), http.StatusInternalServerError)
+		return
+	case e == nil:
+		httpError(w, "not found", http.StatusNotFound)
+		return
+	case e.State == enrollPending:
+		w.WriteHeader(http.StatusAccepted)
+		return
+	case e.State == enrollRejected:
+		httpError(w, "enrollment rejected", http.StatusForbidden)
+		return
+	case e.State == enrollRevoked:
+		refuseAgent(w, agent)
+		return
+	}
+	recipient, _ := hex.DecodeString(e.Key)
+	s := &secret{Agent: e.Agent, Name: "CAPTAIN_CREDENTIAL", Created: time.Now()}
+	if err = sealSecret(s, []byte(credentialPrefix+e.Credential), recipient); err != nil {
+		httpError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	payload, err := json.Marshal(s)
+	if err != nil {
+		httpError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write(payload)
+}
+
+func (a *app) handleEnrollments(w http.ResponseWriter, r *http.Request) {
+	req := a.decodeAdmin(w, r, "list", "approve", "reject", "revoke")
+	if req == nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if req.Action == "list" {
+		enrollments, err := a.store.enrollments()
+		listed := make([]*enrollment, len(enrollments))
+		for i, e := range enrollments {
+			listed[i] = &enrollment{Agent: e.Agent, Key: e.Key, State: e.State, Token: e.Token, Created: e.Created}
+		}
+		var payload []byte
+		if err == nil {
+			payload, err = json.Marshal(listed)
+		}
+		if err != nil {
+			httpError(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Write(payload)
+		return
+	}
+	if req.Action == "revoke" {
+		if err := a.revoke(req.ID); err != nil {
+			httpError(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte(`"` + enrollRevoked + `"`))
+		return
+	}
+	e, err := a.store.enrollment(req.ID)
+	if err == nil && e == nil {
+		httpError(w, "not found", http.StatusNotFound)
+		return
+	}
+	if err == nil && e.State == enrollRevoked {
+		refuseAgent(w, e.Agent)
+		return
+	}
+	if err == nil {
+		e.State = enrollApproved
+		if req.Action == "reject" {
+			e.State = enrollRejected
+		} else if e.Credential == "" {
+			e.Credential = newCredential()
+		}
+		err = a.store.putEnrollment(e)
+	}
+	if err == nil && e.State == enrollApproved {
+		// Register the agent's identity, as the agent would.
+		k := &agentKey{Agent: e.Agent, Key: e.Key, Created: time.Now()}
+		k.Sum = hex.EncodeToString(signAgentKey(k, a.hasher))
+		err = a.store.putKey(k)
+	}
+	if err != nil {
+		httpError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write([]byte(`"` + e.State + `"`))
+}
+
+func printEnrollments(enrollments []*enrollment) {
+	sort.Slice(enrollments, func(i, j int) bool { return enrollments[i].Created.Before(enrollments[j].Created) })
+	for _, e := range enrollments {
+		fmt.Printf("%s: %s since %s\n", e.Agent, e.State, e.Created.Format(time.RFC3339))
+	}
+}
+
+// newCredential returns a random MAC key for an enrolled agent, in hex.
+func newCredential() string {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(key)
+}
+
+// parseCredential returns the MAC key in s, if s is a credential.
+func parseCredential(s string) ([]byte, bool) {
+	h, ok := strings.CutPrefix(s, credentialPrefix)
+	if !ok {
+		return nil, false
+	}
+	key, err := hex.DecodeString(h)
+	return key, err == nil && len(key) == 32
+}
+
+// agentHasher returns the hasher agent signs with: its credential if it
+// enrolled, so it cannot sign for other agents, or the key. The caller
+// holds a.mu.
+func (a *app) agentHasher(agent string) (*blake3.Hasher, error) {
+	e, err := a.store.enrollment(agent)
+	if err != nil {
+		return nil, err
+	}
+	if e == nil || e.Credential == "" {
+		return a.hasher, nil
+	}
+	key, err := hex.DecodeString(e.Credential)
+	if err != nil {
+		return nil, fmt.Errorf("credential of %s: %w", agent, err)
+	}
+	return blake3.New(32, key), nil
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// maxHTTPOutput limits the response body an http command reports.
+const maxHTTPOutput = 1 << 20
+
+// executor performs the commands of one type on the agent, returning their
+// output and any structured data.
+type executor interface {
+	execute(ctx context.Context, c *cmd, env []string) ([]byte, json.RawMessage, error)
+}
+
+type executorFunc func(ctx context.Context, c *cmd, env []string) ([]byte, json.RawMessage, error)
+
+func (f executorFunc) execute(ctx context.Context, c *cmd, env []string) ([]byte, json.RawMessage, error) {
+	return f(ctx, c, env)
+}
+
+// newExecutors maps command types to the executors of ag.
+func newExecutors(ag *agent) map[string]executor {
+	return map[string]executor{
+		"":           executorFunc(ag.process),
+		artifactType: executorFunc(ag.process),
+		"service": executorFunc(func(ctx context.Context, c *cmd, _ []string) ([]byte, json.RawMessage, error) {
+			return service(ctx, c.Args)
+		}),
+		"pkg": executorFunc(func(ctx context.Context, c *cmd, _ []string) ([]byte, json.RawMessage, error) {
+			return pkg(ctx, c.Args)
+		}),
+		"http":        executorFunc(httpCall),
+		"file":        executorFunc(writeFile),
+		"docker":      executorFunc(dockerAction),
+		"script":      executorFunc(ag.script),
+		pingType:      executorFunc(ag.ping),
+		rebootType:    executorFunc(ag.reboot),
+		superviseType: executorFunc(ag.supervise),
+	}
+}
+
+// process executes a binary, or a downloaded artifact, with os/exec, or
+// inside a container with docker exec semantics.
+func (ag *agent) process(ctx context.Context, c *cmd, env []string) ([]byte, json.RawMessage, error) {
+	name := c.Name
+	if c.Type == artifactType {
+		var temp bool
+		var err error
+		if name, temp, err = ag.fetchArtifact(ctx, c); err != nil {
+			return nil, nil, err
+		}
+		if temp {
+			defer os.Remove(name)
+		}
+	}
+	out := &bytes.Buffer{}
+	if c.Container != "" {
+		err := dockerExec(ctx, c, append(c.Env, env...), out)
+		return out.Bytes(), nil, err
+	}
+	oscmd, err := command(ctx, name, c.Args)
+	if err != nil {
+		return nil, nil, &startError{err}
+	}
+	oscmd.Stdout = out
+	oscmd.Env = append(append(os.Environ(), c.Env...), env...)
+	if err := oscmd.Start(); err != nil {
+		return nil, nil, &startError{err}
+	}
+	ag.mu.Lock()
+	ag.running[c.ID] = oscmd
+	ag.mu.Unlock()
+	err = oscmd.Wait()
+	ag.mu.Lock()
+	delete(ag.running, c.ID)
+	ag.mu.Unlock()
+	if out.Len() > 0 {
+		fmt.Println(out.String())
+	}
+	return out.Bytes(), nil, err
+}
+
+// httpCall performs a request, typically to a local service, with args
+// [METHOD] URL [BODY]. Error statuses fail the command.
+func httpCall(ctx context.Context, c *cmd, _ []string) ([]byte, json.RawMessage, error) {
+	args := c.Args
+	method := "GET"
+	if len(args) > 0 && !strings.Contains(args[0], "/") {
+		method, args = strings.ToUpper(args[0]), args[1:]
+	}
+	if len(args) == 0 || len(args) > 2 {
+		return nil, nil, errors.New("usage: http [METHOD] URL [BODY]")
+	}
+	var body io.Reader
+	if len(args) == 2 {
+		body = strings.NewReader(args[1])
+	}
+	req, err := http.NewRequestWithContext(ctx, method, args[0], body)
+	if err != nil {
+		return nil, nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	out, err := io.ReadAll(io.LimitReader(resp.Body, maxHTTPOutput))
+	if err != nil {
+		return out, nil, err
+	}
+	data, _ := json.Marshal(map[string]int{"Status": resp.StatusCode})
+	if resp.StatusCode >= 400 {
+		err = fmt.Errorf("got status code %d", resp.StatusCode)
+	}
+	return out, data, err
+}
+
+// writeFile atomically writes a file, with args PATH CONTENT [MODE], the
+// mode in octal defaulting to 0644.
+func writeFile(_ context.Context, c *cmd, _ []string) ([]byte, json.RawMessage, error) {
+	if len(c.Args) < 2 || len(c.Args) > 3 {
+		return nil, nil, errors.New("usage: file PATH CONTENT [MODE]")
+	}
+	path, content := c.Args[0], []byte(c.Args[1])
+	mode := uint64(0644)
+	if len(c.Args) == 3 {
+		var err error
+		if mode, err = strconv.ParseUint(c.Args[2], 8, 32); err != nil {
+			return nil, nil, fmt.Errorf("invalid mode %q", c.Args[2])
+		}
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".captain-*")
+	if err != nil {
+		return nil, nil, err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err = tmp.Write(content); err != nil {
+		tmp.Close()
+		return nil, nil, err
+	}
+	if err = tmp.Close(); err != nil {
+		return nil, nil, err
+	}
+	if err = os.Chmod(tmp.Name(), os.FileMode(mode)); err != nil {
+		return nil, nil, err
+	}
+	if err = os.Rename(tmp.Name(), path); err != nil {
+		return nil, nil, err
+	}
+	return []byte(fmt.Sprintf("wrote %d bytes to %s\n", len(content), path)), nil, nil
+}
+
+// dockerAction changes the state of a container, with args ACTION NAME,
+// and returns the resulting container state as structured data.
+func dockerAction(ctx context.Context, c *cmd, _ []string) ([]byte, json.RawMessage, error) {
+	if len(c.Args) != 2 {
+		return nil, nil, errors.New("usage: docker start|stop|restart|kill|pause|unpause|inspect NAME")
+	}
+	action, name := c.Args[0], c.Args[1]
+	switch action {
+	case "start", "stop", "restart", "kill", "pause", "unpause":
+		if err := dockerCall(ctx, docker, "POST", "/containers/"+name+"/"+action, nil, nil); err != nil {
+			return nil, nil, err
+		}
+	case "inspect":
+	default:
+		return nil, nil, fmt.Errorf("unsupported docker action %s", action)
+	}
+	inspect := struct{ State json.RawMessage }{}
+	if err := dockerCall(ctx, docker, "GET", "/containers/"+name+"/json", nil, &inspect); err != nil {
+		return nil, nil, err
+	}
+	state := struct{ Status string }{}
+	json.Unmarshal(inspect.State, &state)
+	return []byte(fmt.Sprintf("%s: %s\n", name, state.Status)), inspect.State, nil
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// exportFlushEvery is how many records are written between flushes, so
+// large ranges stream to the client.
+const exportFlushEvery = 100
+
+var exportColumns = []string{"kind", "time", "cmd", "trace", "name", "args", "agents", "operator", "agent", "event", "outcome", "detail"}
+
+// record is a command, result or audit entry exported for compliance
+// reporting. Exactly one of its fields is set.
+type record struct {
+	Kind    string
+	Command *cmd        `json:",omitempty"`
+	Result  *result     `json:",omitempty"`
+	Audit   *auditEntry `json:",omitempty"`
+}
+
+// row flattens r into the export columns.
+func (r *record) row() []string {
+	switch {
+	case r.Command != nil:
+		c := r.Command
+		name := c.Name
+		if c.Type != "" {
+			name = c.Type
+		}
+		return []string{r.Kind, c.Created.Format(time.RFC3339Nano), c.ID, c.Trace, name, strings.Join(c.Args, " "), strings.Join(c.Agents, " "), c.Operator, "", "", "", ""}
+	case r.Result != nil:
+		res := r.Result
+		detail := strings.TrimSpace(res.Output)
+		if res.Error != "" {
+			detail = res.Error
+		}
+		return []string{r.Kind, res.Created.Format(time.RFC3339Nano), res.Cmd, res.Trace, "", "", "", "", res.Agent, "", res.outcome(), detail}
+	default:
+		e := r.Audit
+		return []string{r.Kind, e.Time.Format(time.RFC3339Nano), e.Cmd, e.Trace, e.Name, "", strings.Join(e.Agents, " "), e.Operator, "", e.Event, e.Rule, e.Reason}
+	}
+}
+
+// parseDay reads an export bound: an RFC 3339 time, or a date in UTC.
+func parseDay(s string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse(time.DateOnly, s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid time %q: want RFC 3339 or 2006-01-02", s)
+	}
+	return t, nil
+}
+
+// exportWriter writes records as CSV or JSON lines.
+type exportWriter struct {
+	csv *csv.Writer
+	enc *json.Encoder
+	rc  *http.ResponseController
+	n   int
+}
+
+func newExportWriter(w http.ResponseWriter, format string) *exportWriter {
+	ew := &exportWriter{rc: http.NewResponseController(w)}
+	// Large ranges take longer than -write-timeout to stream.
+	ew.rc.SetWriteDeadline(time.Time{})
+	if format == "csv" {
+		w.Header().Set("Content-Type", "text/csv")
+		ew.csv = csv.NewWriter(w)
+		ew.csv.Write(exportColumns)
+	} else {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		ew.enc = json.NewEncoder(w)
+	}
+	return ew
+}
+
+func (ew *exportWriter) write(r *record) error {
+	var err error
+	if ew.csv != nil {
+		err = ew.csv.Write(r.row())
+	} else {
+		err = ew.enc.Encode(r)
+	}
+	if ew.n++; ew.n%exportFlushEvery == 0 {
+		ew.flush()
+	}
+	return err
+}
+
+func (ew *exportWriter) flush() {
+	if ew.csv != nil {
+		ew.csv.Flush()
+	}
+	ew.rc.Flush()
+}
+
+// handleExport streams the stored commands created in the range from, to,
+// each followed by its results, then the audit entries in the range.
+func (a *app) handleExport(w http.ResponseWriter, r *http.Request) {
+	if !a.viewer(w, r, "history") {
+		return
+	}
+	q := r.URL.Query()
+	from, to := time.Time{}, time.Now()
+	var err error
+	if s := q.Get("from"); s != "" {
+		if from, err = parseDay(s); err != nil {
+			httpError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if s := q.Get("to"); s != "" {
+		if to, err = parseDay(s); err != nil {
+			httpError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	format := q.Get("format")
+	if format != "" && format != "csv" && format != "json" {
+		httpError(w, "format must be csv or json", http.StatusBadRequest)
+		return
+	}
+	within := func(t time.Time) bool { return !t.Before(from) && t.Before(to) }
+	a.mu.Lock()
+	cmds, err := a.store.cmds()
+	a.mu.Unlock()
+	if err != nil {
+		httpError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	sort.SliceStable(cmds, func(i, j int) bool { return cmds[i].Created.Before(cmds[j].Created) })
+	ew := newExportWriter(w, format)
+	defer ew.flush()
+	// Results are read a command at a time, so the lock is not held while
+	// writing to slow clients.
+	for _, c := range cmds {
+		if !within(c.Created) {
+			continue
+		}
+		a.mu.Lock()
+		results, err := a.store.results(c.ID)
+		a.mu.Unlock()
+		if err != nil {
+			fmt.Printf("export: %s\n", err)
+			return
+		}
+		if ew.write(&record{Kind: "command", Command: c}) != nil {
+			return
+		}
+		for _, res := range results {
+			if ew.write(&record{Kind: "result", Result: res}) != nil {
+				return
+			}
+		}
+	}
+	if a.auditFile == "" {
+		return
+	}
+	f, err := os.Open(a.auditFile)
+	if err != nil {
+		fmt.Printf("export: %s\n", err)
+		return
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64<<10), 1<<20)
+	for scanner.Scan() {
+		e := &auditEntry{}
+		if json.Unmarshal(scanner.Bytes(), e) != nil || !within(e.Time) {
+			continue
+		}
+		if ew.write(&record{Kind: "audit", Audit: e}) != nil {
+			return
+		}
+	}
+}
+
+// export streams the history in the range from, to, as format to out.
+func export(from, to, format, target string, out io.Writer) error {
+	q := url.Values{"format": {format}}
+	for k, v := range map[string]string{"from": from, "to": to} {
+		if v == "" {
+			continue
+		}
+		if _, err := parseDay(v); err != nil {
+			return err
+		}
+		q.Set(k, v)
+	}
+	resp, err := client.Get(target + "/export?" + q.Encode())
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return responseError(resp)
+	}
+	_, err = io.Copy(out, resp.Body)
+	return err
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// agentColors are the ANSI colors of agent prefixes, picked by a hash of the
+// agent id so an agent keeps its color across runs.
+var agentColors = []string{"36", "33", "32", "35", "34", "31", "96", "93", "92", "95", "94", "91"}
+
+// follower prints the output of results as agents report them, every line
+// prefixed with the agent id, in a color of its own on a terminal that
+// takes colors, as docker compose logs does for services.
+type follower struct {
+	out      io.Writer
+	patterns []string // agent globs to print, all agents if empty
+	raw      bool     // lines only, without prefixes or colors
+	color    bool
+	width    int            // of the longest agent id printed, to align lines
+	printed  map[string]int // results printed, by command id
+}
+
+func newFollower(out io.Writer, patterns []string, raw bool) (*follower, error) {
+	for _, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid agent pattern %q: %w", pattern, err)
+		}
+	}
+	f := &follower{out: out, patterns: patterns, raw: raw, printed: make(map[string]int)}
+	if file, ok := out.(*os.File); ok && !raw {
+		f.color = colorTerminal(file)
+	}
+	return f, nil
+}
+
+func (f *follower) matches(agent string) bool {
+	if len(f.patterns) == 0 {
+		return true
+	}
+	for _, pattern := range f.patterns {
+		if ok, _ := path.Match(pattern, agent); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *follower) prefix(agent string) string {
+	if f.raw {
+		return ""
+	}
+	f.width = max(f.width, len(agent))
+	p := fmt.Sprintf("%-*s | ", f.width, agent)
+	if !f.color {
+		return p
+	}
+	h := fnv.New32a()
+	h.Write([]byte(agent))
+	return "\x1b[" + agentColors[h.Sum32()%uint32(len(agentColors))] + "m" + p + "\x1b[0m"
+}
+
+// print writes the output and error of res line by line, then unless raw,
+// its outcome.
+func (f *follower) print(res *result) {
+	if !f.matches(res.Agent) {
+		return
+	}
+	prefix := f.prefix(res.Agent)
+	for _, text := range []string{res.Output, res.Error} {
+		if text = strings.TrimRight(text, "\n"); text == "" {
+			continue
+		}
+		for _, line := range strings.Split(text, "\n") {
+			fmt.Fprintln(f.out, prefix+line)
+		}
+	}
+	if !f.raw {
+		fmt.Fprintf(f.out, "%s[%s %s]\n", prefix, res.Cmd, res.outcome())
+	}
+}
+
+// follow polls target every second for the results of the commands ids, or
+// of every command created after since if there are none, and prints those
+// it did not print yet, until the deadline passes, or forever if it is zero.
+func (f *follower) follow(ids []string, since time.Time, target string, deadline time.Time) {
+	for {
+		watch := ids
+		if len(ids) == 0 {
+			cmds, err := getCommands(nil, target)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+			}
+			for _, c := range cmds {
+				if !c.Created.Before(since) {
+					watch = append(watch, c.ID)
+				}
+			}
+		}
+		for _, id := range watch {
+			results, err := getResults(id, target)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				continue
+			}
+			for _, res := range results[min(f.printed[id], len(results)):] {
+				f.print(res)
+			}
+			f.printed[id] = len(results)
+		}
+		if !deadline.IsZero() && time.Now().After(deadline) {
+			return
+		}
+		time.Sleep(time.Second)
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"lukechampine.com/blake3"
+)
+
+// gitops pulls the repository every poll interval, and applies the
+// manifests changed by new commits.
+func gitops(repo string, poll time.Duration, h *blake3.Hasher, target string) error {
+	head, err := git(repo, "rev-parse", "HEAD")
+	if err != nil {
+		return err
+	}
+	fmt.Printf("watching %s at %s\n", repo, head)
+	for {
+		time.Sleep(poll)
+		if _, err = git(repo, "pull", "--ff-only", "--quiet"); err != nil {
+			fmt.Println(err)
+			continue
+		}
+		next, err := git(repo, "rev-parse", "HEAD")
+		if err != nil {
+			fmt.Println(err)
+			continue
+		}
+		if next == head {
+			continue
+		}
+		changed, err := git(repo, "diff", "--name-only", "--diff-filter=AM", head, next, "--", "*.json")
+		if err != nil {
+			fmt.Println(err)
+			continue
+		}
+		head = next
+		for _, name := range strings.Fields(changed) {
+			applyFromRepo(repo, name, head, h, target)
+		}
+	}
+}
+
+func applyFromRepo(repo, name, sha string, h *blake3.Hasher, target string) {
+	m, err := loadManifest(filepath.Join(repo, name))
+	if err != nil {
+		fmt.Println(err)
+		postLogMsg(fmt.Sprintf("gitops %s: %s rejected: %s", sha, name, err), h, target)
+		return
+	}
+	cmds, err := m.apply(h, target, newID())
+	ids := make([]string, 0, len(cmds))
+	for _, c := range cmds {
+		ids = append(ids, c.ID)
+	}
+	msg := fmt.Sprintf("gitops %s: %s applied as %s", sha, name, strings.Join(ids, ","))
+	if err != nil {
+		msg += ": " + err.Error()
+	}
+	fmt.Println(msg)
+	if err = postLogMsg(msg, h, target); err != nil {
+		fmt.Println(err)
+	}
+}
+
+func git(repo string, args ...string) (string, error) {
+	c := exec.Command("git", append([]string{"-C", repo}, args...)...)
+	c.Stderr = os.Stderr
+	out, err := c.Output()
+	if err != nil {
+		return "", fmt.Errorf("git %s: %w", strings.Join(args, " "), err)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"time"
+)
+
+const (
+	// hintHeader carries the polling interval the server suggests. It is
+	// signed with the poll response.
+	hintHeader = "X-Captain-Poll-Hint"
+	// activeFor is how long after a command was sent the server hints
+	// agents to poll with -poll-active.
+	activeFor = 10 * time.Minute
+	// idleAfter is how long after the last command was sent the server
+	// hints agents to poll with -poll-idle.
+	idleAfter = time.Hour
+)
+
+// pollHints are the polling intervals the server suggests to agents: fast
+// during a rollout, slow when nothing happens for a while, as overnight.
+// Zero intervals are not hinted.
+type pollHints struct {
+	active, idle time.Duration
+	lastCmd      time.Time // created, of the newest command queued
+}
+
+// hint is the polling interval to suggest now, or empty for none.
+func (p *pollHints) hint(now time.Time) string {
+	switch since := now.Sub(p.lastCmd); {
+	case p.active > 0 && since < activeFor:
+		return p.active.String()
+	case p.idle > 0 && since > idleAfter:
+		return p.idle.String()
+	}
+	return ""
+}
+
+// queued notes the newest of the queued commands. The caller holds a.mu.
+func (p *pollHints) queued(cmds []*cmd) {
+	for _, c := range cmds {
+		if c.Created.After(p.lastCmd) {
+			p.lastCmd = c.Created
+		}
+	}
+}
+
+// interval is how long the agent waits between polls: the hint of the
+// server within -poll-min and -poll-max, or without one, -poll.
+func (ag *agent) interval() time.Duration {
+	ag.mu.Lock()
+	defer ag.mu.Unlock()
+	if ag.pollMax <= 0 || ag.hint <= 0 {
+		return ag.poll
+	}
+	return min(max(ag.hint, ag.pollMin), ag.pollMax)
+}
+
+// hinted records the polling interval the server suggested, if any.
+func (ag *agent) hinted(hint string) {
+	d, err := time.ParseDuration(hint)
+	if err != nil || d < 0 {
+		d = 0
+	}
+	ag.mu.Lock()
+	defer ag.mu.Unlock()
+	ag.hint = d
+}
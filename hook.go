@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+const (
+	hookHeader   = "X-Captain-Signature"
+	maxHookWait  = 24 * time.Hour
+	hookAttempts = 3
+)
+
+// hook asks the server to post a summary of the results of a command to
+// URL, once every targeted agent has reported, or after Wait.
+type hook struct {
+	URL  string
+	Wait time.Duration
+}
+
+func (hk *hook) validate() error {
+	u, err := url.Parse(hk.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid callback url %q", hk.URL)
+	}
+	if hk.Wait <= 0 || hk.Wait > maxHookWait {
+		return fmt.Errorf("callback wait must be positive and at most %s", maxHookWait)
+	}
+	return nil
+}
+
+// summary is posted to a hook. The body is signed with -hook-secret, as a
+// hex keyed BLAKE3 hash in the X-Captain-Signature header.
+type summary struct {
+	Cmd      string
+	Trace    string            `json:",omitempty"`
+	Labels   map[string]string `json:",omitempty"`
+	Complete bool
+	Missing  []string `json:",omitempty"`
+	Results  []*result
+	Created  time.Time
+}
+
+// watch fires the hook of c when its agents have reported, or after its
+// wait. It is called with the app's mutex held.
+func (a *app) watch(c *cmd) {
+	if a.hooks == nil {
+		a.hooks = make(map[string]*cmd)
+	}
+	a.hooks[c.ID] = c
+	time.AfterFunc(c.Hook.Wait, func() {
+		a.mu.Lock()
+		defer a.mu.Unlock()
+		a.fireHook(c.ID, true)
+	})
+}
+
+// hookResult fires the hook of the command of res, if any, once every
+// targeted agent has reported. It is called with the app's mutex held.
+func (a *app) hookResult(res *result) {
+	if c := a.hooks[res.Cmd]; c != nil && len(c.Agents) > 0 {
+		a.fireHook(c.ID, false)
+	}
+}
+
+// fireHook posts the summary of id, unless agents are still missing and
+// the wait is not over.
+func (a *app) fireHook(id string, due bool) {
+	c := a.hooks[id]
+	if c == nil {
+		return
+	}
+	results, err := a.store.results(id)
+	if err != nil {
+		fmt.Printf("%s: callback: %s\n", c.ref(), err)
+		return
+	}
+	s := &summary{Cmd: c.ID, Trace: c.Trace, Labels: c.Labels, Results: make([]*result, 0), Created: time.Now()}
+	reported := make(map[string]bool)
+	for _, res := range results {
+		if res.Flag == "" {
+			s.Results = append(s.Results, res)
+			reported[res.Agent] = true
+		}
+	}
+	for _, agent := range c.Agents {
+		if !reported[agent] {
+			s.Missing = append(s.Missing, agent)
+		}
+	}
+	if len(s.Missing) > 0 && !due {
+		return
+	}
+	s.Complete = len(c.Agents) > 0 && len(s.Missing) == 0
+	delete(a.hooks, id)
+	body, err := json.Marshal(s)
+	if err != nil {
+		fmt.Printf("%s: callback: %s\n", c.ref(), err)
+		return
+	}
+	sig := a.signHook(body)
+	go func() {
+		if err := postHook(c.Hook.URL, body, sig); err != nil {
+			fmt.Printf("%s: callback: %s\n", c.ref(), err)
+		}
+	}()
+}
+
+// signHook signs the body of a callback with -hook-secret, never with the
+// key, which receivers would need to verify it, and could then sign
+// commands with. Without a secret, callbacks are not signed. The caller
+// holds a.mu.
+func (a *app) signHook(body []byte) string {
+	if a.hookHasher == nil {
+		return ""
+	}
+	a.hookHasher.Reset()
+	a.hookHasher.Write(body)
+	return hex.EncodeToString(a.hookHasher.Sum(nil))
+}
+
+// postHook posts body to rawurl, retrying with backoff.
+func postHook(rawurl string, body []byte, sig string) error {
+	var err error
+	for attempt := 0; attempt < hookAttempts; attempt++ {
+		if attempt > 0 {
+			time.Sleep(time.Duration(attempt) * 5 * time.Second)
+		}
+		var req *http.Request
+		if req, err = http.NewRequest("POST", rawurl, bytes.NewReader(body)); err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		if sig != "" {
+			req.Header.Set(hookHeader, sig)
+		}
+		var resp *http.Response
+		if resp, err = sinkClient.Do(req); err != nil {
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode < 300 {
+			return nil
+		}
+		err = errors.New("got status code " + resp.Status)
+	}
+	return err
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"encoding/xml"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+)
+
+// serviceName is the name agents are installed as, for the service command
+// type and the init system.
+const serviceName = "captain"
+
+// serviceInstaller writes the service definition of an agent for an init
+// system, and the commands loading it.
+type serviceInstaller struct {
+	path string
+	mode os.FileMode
+	def  func(argv []string, dir string) string
+	load [][]string
+}
+
+var serviceInstallers = map[string]*serviceInstaller{
+	"linux": {
+		path: "/etc/systemd/system/" + serviceName + ".service",
+		mode: 0644,
+		def:  systemdUnit,
+		load: [][]string{{"systemctl", "daemon-reload"}, {"systemctl", "enable", "--now", serviceName}},
+	},
+	"darwin": {
+		path: "/Library/LaunchDaemons/" + serviceName + ".plist",
+		mode: 0644,
+		def:  launchdPlist,
+		load: [][]string{
+			{"launchctl", "bootout", "system/" + serviceName},
+			{"launchctl", "bootstrap", "system", "/Library/LaunchDaemons/" + serviceName + ".plist"},
+			{"launchctl", "enable", "system/" + serviceName},
+		},
+	},
+	"freebsd": {
+		path: "/usr/local/etc/rc.d/" + serviceName,
+		mode: 0755,
+		def:  rcdScript,
+		load: [][]string{{"sysrc", serviceName + "_enable=YES"}, {"service", serviceName, "restart"}},
+	},
+}
+
+// obeyArgv returns the command line of the installed agent: this executable
+// in obey mode, with the flags set on the command line. The service runs in
+// the current directory, so relative paths resolve as they do here.
+func obeyArgv() ([]string, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+	argv := []string{exe, "-mode=obey"}
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "mode":
+		case "key":
+			err = errors.New("pass the key with -key-file, -key would be readable in the service definition")
+		default:
+			if list, ok := f.Value.(*stringList); ok {
+				for _, v := range *list {
+					argv = append(argv, "-"+f.Name+"="+v)
+				}
+				return
+			}
+			argv = append(argv, "-"+f.Name+"="+f.Value.String())
+		}
+	})
+	return argv, err
+}
+
+// installService installs the agent as a service of the init system of
+// this platform and starts it, or only prints the definition.
+func installService(print bool) error {
+	inst := serviceInstallers[runtime.GOOS]
+	if inst == nil {
+		return fmt.Errorf("no service installer for %s", runtime.GOOS)
+	}
+	argv, err := obeyArgv()
+	if err != nil {
+		return err
+	}
+	dir, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+	def := inst.def(argv, dir)
+	if print {
+		fmt.Print(def)
+		return nil
+	}
+	if err = os.WriteFile(inst.path, []byte(def), inst.mode); err != nil {
+		return err
+	}
+	fmt.Printf("wrote %s\n", inst.path)
+	for i, step := range inst.load {
+		out, err := exec.Command(step[0], step[1:]...).CombinedOutput()
+		// launchctl bootout fails if the agent is not loaded yet.
+		if err != nil && !(runtime.GOOS == "darwin" && i == 0) {
+			return fmt.Errorf("%s: %w: %s", strings.Join(step, " "), err, strings.TrimSpace(string(out)))
+		}
+	}
+	fmt.Printf("installed and started %s\n", serviceName)
+	return nil
+}
+
+func systemdUnit(argv []string, dir string) string {
+	quoted := make([]string, len(argv))
+	for i, arg := range argv {
+		// Specifiers and variables are expanded in ExecStart.
+		arg = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "%", "%%", "$", "$$").Replace(arg)
+		quoted[i] = `"` + arg + `"`
+	}
+	return fmt.Sprintf(`[Unit]
+Description=captain agent
+Wants=network-online.target
+After=network-online.target
+
+[Service]
+ExecStart=%s
+WorkingDirectory=%s
+Restart=always
+RestartSec=5
+
+[Install]
+WantedBy=multi-user.target
+`, strings.Join(quoted, " "), dir)
+}
+
+func launchdPlist(argv []string, dir string) string {
+	b := &strings.Builder{}
+	escape := func(s string) string {
+		e := &strings.Builder{}
+		xml.EscapeText(e, []byte(s))
+		return e.String()
+	}
+	fmt.Fprintf(b, `<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+<plist version="1.0">
+<dict>
+	<key>Label</key>
+	<string>%s</string>
+	<key>ProgramArguments</key>
+	<array>
+`, serviceName)
+	for _, arg := range argv {
+		fmt.Fprintf(b, "\t\t<string>%s</string>\n", escape(arg))
+	}
+	fmt.Fprintf(b, `	</array>
+	<key>WorkingDirectory</key>
+	<string>%s</string>
+	<key>RunAtLoad</key>
+	<true/>
+	<key>KeepAlive</key>
+	<true/>
+	<key>StandardOutPath</key>
+	<string>/var/log/%s.log</string>
+	<key>StandardErrorPath</key>
+	<string>/var/log/%s.log</string>
+</dict>
+</plist>
+`, escape(dir), serviceName, serviceName)
+	return b.String()
+}
+
+func rcdScript(argv []string, dir string) string {
+	quote := func(s string) string {
+		return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+	}
+	quoted := make([]string, len(argv))
+	for i, arg := range argv {
+		quoted[i] = quote(arg)
+	}
+	// daemon(8) restarts the agent, and writes its output to the log.
+	return fmt.Sprintf(`#!/bin/sh
+
+# PROVIDE: %[1]s
+# REQUIRE: LOGIN NETWORKING
+# KEYWORD: shutdown
+
+. /etc/rc.subr
+
+name=%[1]q
+rcvar="%[1]s_enable"
+pidfile="/var/run/${name}.pid"
+command="/usr/sbin/daemon"
+command_args="-r -P ${pidfile} -o /var/log/${name}.log %[2]s"
+%[1]s_chdir=%[3]s
+
+load_rc_config $name
+: ${%[1]s_enable:="NO"}
+
+run_rc_command "$1"
+`, serviceName, strings.NewReplacer(`\`, `\\`, `"`, `\"`, "$", `\$`, "`", "\\`").Replace(strings.Join(quoted, " ")), quote(dir))
+}
@@ -0,0 +1,193 @@
+// Package httpclient is the transport captain clients and agents use to
+// reach servers. It retries transient failures with jittered exponential
+// backoff, and opens a circuit per target that keeps failing, so callers
+// fail fast instead of piling up requests on a server that is down.
+package httpclient
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ErrOpen is returned while the circuit of a target is open.
+var ErrOpen = errors.New("circuit open")
+
+// Error is a failed request, classified as retryable, or fatal.
+type Error struct {
+	Method, Target string
+	Attempts       int
+	Retryable      bool
+	Err            error
+}
+
+func (e *Error) Error() string {
+	kind := "fatal"
+	if e.Retryable {
+		kind = "retryable"
+	}
+	if e.Attempts == 0 {
+		return fmt.Sprintf("%s (%s)", e.Err, kind)
+	}
+	return fmt.Sprintf("%s (%s, %d attempts)", e.Err, kind, e.Attempts)
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Retryable reports whether err is worth retrying later.
+func Retryable(err error) bool {
+	var e *Error
+	return errors.As(err, &e) && e.Retryable
+}
+
+// Transport retries and circuit-breaks the requests of Base.
+type Transport struct {
+	Base      http.RoundTripper
+	Retries   int           // attempts after the first
+	Backoff   time.Duration // delay before the first retry, doubled for each
+	Threshold int           // consecutive failures opening the circuit
+	Cooldown  time.Duration // how long an open circuit fails fast
+
+	mu       sync.Mutex
+	circuits map[string]*circuit
+}
+
+type circuit struct {
+	failures  int
+	openUntil time.Time
+}
+
+// New returns a Transport over base with the default policy: 3 retries from
+// 200ms, and circuits opening for 10s after 5 consecutive failures.
+func New(base http.RoundTripper) *Transport {
+	return &Transport{Base: base, Retries: 3, Backoff: 200 * time.Millisecond, Threshold: 5, Cooldown: 10 * time.Second}
+}
+
+func (t *Transport) RoundTrip(r *http.Request) (*http.Response, error) {
+	target := r.URL.Host
+	if err := t.allow(target); err != nil {
+		return nil, &Error{Method: r.Method, Target: target, Retryable: true, Err: err}
+	}
+	for attempt := 0; ; attempt++ {
+		req := r
+		if attempt > 0 {
+			var err error
+			if req, err = rewind(r); err != nil {
+				return nil, &Error{Method: r.Method, Target: target, Attempts: attempt, Err: err}
+			}
+		}
+		resp, err := t.Base.RoundTrip(req)
+		retry, failed := classify(r, resp, err)
+		t.record(target, failed)
+		last := !retry || attempt >= t.Retries || (r.Body != nil && r.GetBody == nil)
+		if last {
+			if err != nil {
+				return nil, &Error{Method: r.Method, Target: target, Attempts: attempt + 1, Retryable: retry, Err: err}
+			}
+			return resp, nil
+		}
+		if resp != nil {
+			io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+			resp.Body.Close()
+		}
+		select {
+		case <-time.After(t.delay(attempt)):
+		case <-r.Context().Done():
+			return nil, &Error{Method: r.Method, Target: target, Attempts: attempt + 1, Err: r.Context().Err()}
+		}
+		if err := t.allow(target); err != nil {
+			return nil, &Error{Method: r.Method, Target: target, Attempts: attempt + 1, Retryable: true, Err: err}
+		}
+	}
+}
+
+// classify reports whether a request is worth retrying, and whether the
+// target failed. Requests that never reached the server are retried, and
+// those that may have been processed are retried only if idempotent.
+func classify(r *http.Request, resp *http.Response, err error) (retry, failed bool) {
+	idempotent := r.Method == http.MethodGet || r.Method == http.MethodHead
+	if err != nil {
+		if r.Context().Err() != nil {
+			return false, false
+		}
+		var opErr *net.OpError
+		if errors.As(err, &opErr) && opErr.Op == "dial" {
+			return true, true
+		}
+		return idempotent, true
+	}
+	switch resp.StatusCode {
+	case http.StatusTooManyRequests:
+		// The server is up, and asks for patience.
+		return resp.Header.Get("Retry-After") == "", false
+	case http.StatusServiceUnavailable:
+		return true, true
+	case http.StatusBadGateway, http.StatusGatewayTimeout:
+		return idempotent, true
+	}
+	return false, resp.StatusCode >= 500
+}
+
+// rewind returns a copy of r with a fresh body, for a retry.
+func rewind(r *http.Request) (*http.Request, error) {
+	req := r.Clone(r.Context())
+	if r.GetBody != nil {
+		body, err := r.GetBody()
+		if err != nil {
+			return nil, err
+		}
+		req.Body = body
+	}
+	return req, nil
+}
+
+// delay returns a random duration up to the exponential backoff of attempt.
+func (t *Transport) delay(attempt int) time.Duration {
+	d := t.Backoff << attempt
+	if d <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int64N(int64(d))) + time.Millisecond
+}
+
+// allow fails while the circuit of target is open. Once the cooldown
+// passed, requests are let through, and the next failure opens it again.
+func (t *Transport) allow(target string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	c := t.circuits[target]
+	if c != nil && time.Now().Before(c.openUntil) {
+		return fmt.Errorf("%w for %s", ErrOpen, time.Until(c.openUntil).Round(time.Second))
+	}
+	return nil
+}
+
+func (t *Transport) record(target string, failed bool) {
+	if t.Threshold <= 0 {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.circuits == nil {
+		t.circuits = make(map[string]*circuit)
+	}
+	c := t.circuits[target]
+	if c == nil {
+		c = &circuit{}
+		t.circuits[target] = c
+	}
+	if !failed {
+		c.failures, c.openUntil = 0, time.Time{}
+		return
+	}
+	if c.failures++; c.failures >= t.Threshold {
+		c.openUntil = time.Now().Add(t.Cooldown)
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// maxJournalOutput is how much of the output of a command the journal keeps.
+const maxJournalOutput = 4 << 10
+
+// journalEntry is a command the agent executed and its result, kept in the
+// journal in -state-dir for troubleshooting on the host, whether or not
+// the server could be reached. Sealed commands are journaled sealed.
+type journalEntry struct {
+	Cmd, Trace, Operator string
+	Command              string
+	Outcome              string
+	Error                string        `json:",omitempty"`
+	Output               string        `json:",omitempty"`
+	Duration             time.Duration `json:",omitempty"`
+	Posted               bool          // false if kept in the outbox, or lost
+	Created              time.Time
+}
+
+func newJournalEntry(c *cmd, res *result, posted bool) *journalEntry {
+	e := &journalEntry{
+		Cmd:      c.ID,
+		Trace:    c.Trace,
+		Operator: c.Operator,
+		Outcome:  res.outcome(),
+		Error:    res.Error,
+		Output:   res.Output,
+		Duration: res.Duration,
+		Posted:   posted,
+		Created:  res.Created,
+	}
+	switch {
+	case c.Signal != "":
+		e.Command = "signal " + c.Signal + " " + c.Ref
+	case c.Type == sealedType:
+		e.Command = sealedType
+	case c.Type != "":
+		e.Command = strings.Join(append([]string{c.Type}, c.Args...), " ")
+	default:
+		e.Command = strings.Join(append([]string{c.Name}, c.Args...), " ")
+	}
+	if len(e.Output) > maxJournalOutput {
+		e.Output = e.Output[:maxJournalOutput] + "..."
+	}
+	return e
+}
+
+// journal appends e to the journal. Once it holds more than half of
+// journalSize bytes, it becomes journal.1, replacing the previous one, so
+// the two hold about journalSize bytes.
+func (s *state) journal(e *journalEntry) error {
+	if s.journalSize <= 0 {
+		return nil
+	}
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	path := filepath.Join(s.dir, "journal")
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(append(data, '\n'))
+	info, serr := f.Stat()
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	if serr == nil && info.Size() > s.journalSize/2 {
+		return os.Rename(path, path+".1")
+	}
+	return nil
+}
+
+// readJournal returns the journal in dir, oldest first. It does not lock
+// dir, so it can be read while the agent runs.
+func readJournal(dir string) ([]*journalEntry, error) {
+	entries := make([]*journalEntry, 0)
+	for _, name := range []string{"journal.1", "journal"} {
+		f, err := os.Open(filepath.Join(dir, name))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(make([]byte, 0, 64<<10), 1<<20)
+		for scanner.Scan() {
+			e := &journalEntry{}
+			// A line cut by a crash is skipped.
+			if json.Unmarshal(scanner.Bytes(), e) == nil {
+				entries = append(entries, e)
+			}
+		}
+		f.Close()
+		if err = scanner.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return entries, nil
+}
+
+func printJournalEntry(e *journalEntry) {
+	fmt.Printf("%s: %s %s: %s", e.Created.Format(time.RFC3339), e.Cmd, e.Command, e.Outcome)
+	if e.Duration > 0 {
+		fmt.Printf(" in %s", e.Duration.Round(time.Millisecond))
+	}
+	if e.Operator != "" {
+		fmt.Printf(", sent by %s", e.Operator)
+	}
+	if !e.Posted {
+		fmt.Print(", not posted")
+	}
+	fmt.Println()
+	if out := strings.TrimSpace(e.Output + e.Error); out != "" {
+		fmt.Println("\t" + strings.ReplaceAll(out, "\n", "\n\t"))
+	}
+}
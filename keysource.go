@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"lukechampine.com/blake3"
+)
+
+// fetchKey reads the key from a secret store, so it need not be kept in
+// plaintext on disk or in shell history. Supported sources are
+//
+//	vault://<path>[#field]           HashiCorp Vault KV, via $VAULT_ADDR and $VAULT_TOKEN
+//	awssm://<secret-id>[#field]      AWS Secrets Manager, via the $AWS_* credentials
+//	gcpsm://projects/<p>/secrets/<s> GCP Secret Manager, via the metadata server
+//
+// A field selects a value of a JSON secret, and defaults to key for Vault.
+func fetchKey(source string) (string, error) {
+	scheme, rest, ok := strings.Cut(source, "://")
+	if !ok {
+		return "", fmt.Errorf("invalid key source %q", source)
+	}
+	path, field, _ := strings.Cut(rest, "#")
+	var key string
+	var err error
+	switch scheme {
+	case "vault":
+		key, err = vaultKey(path, field)
+	case "awssm":
+		key, err = awsKey(path, field)
+	case "gcpsm":
+		key, err = gcpKey(path)
+	default:
+		return "", fmt.Errorf("unsupported key source %s", scheme)
+	}
+	if err != nil {
+		return "", fmt.Errorf("key source %s: %w", scheme, err)
+	}
+	if key == "" {
+		return "", fmt.Errorf("key source %s: empty key", scheme)
+	}
+	return key, nil
+}
+
+func vaultKey(path, field string) (string, error) {
+	addr := os.Getenv("VAULT_ADDR")
+	if addr == "" {
+		return "", errors.New("VAULT_ADDR is not set")
+	}
+	req, err := http.NewRequest("GET", strings.TrimSuffix(addr, "/")+"/v1/"+strings.TrimPrefix(path, "/"), nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("X-Vault-Token", os.Getenv("VAULT_TOKEN"))
+	if ns := os.Getenv("VAULT_NAMESPACE"); ns != "" {
+		req.Header.Set("X-Vault-Namespace", ns)
+	}
+	resp := struct {
+		Data map[string]json.RawMessage `json:"data"`
+	}{}
+	if err = doJSON(req, &resp); err != nil {
+		return "", err
+	}
+	data := resp.Data
+	// KV version 2 nests the secret in data.data.
+	if nested, ok := data["data"]; ok && bytes.HasPrefix(bytes.TrimSpace(nested), []byte("{")) {
+		data = nil
+		if err = json.Unmarshal(nested, &data); err != nil {
+			return "", err
+		}
+	}
+	if field == "" {
+		field = "key"
+	}
+	var key string
+	if err = json.Unmarshal(data[field], &key); err != nil {
+		return "", fmt.Errorf("field %s: %w", field, err)
+	}
+	return key, nil
+}
+
+func awsKey(id, field string) (string, error) {
+	region := os.Getenv("AWS_REGION")
+	if region == "" {
+		region = os.Getenv("AWS_DEFAULT_REGION")
+	}
+	if region == "" || os.Getenv("AWS_ACCESS_KEY_ID") == "" {
+		return "", errors.New("AWS_REGION and AWS_ACCESS_KEY_ID must be set")
+	}
+	endpoint := os.Getenv("AWS_ENDPOINT_URL_SECRETS_MANAGER")
+	if endpoint == "" {
+		endpoint = "https://secretsmanager." + region + ".amazonaws.com"
+	}
+	body, err := json.Marshal(map[string]string{"SecretId": id})
+	if err != nil {
+		return "", err
+	}
+	req, err := http.NewRequest("POST", strings.TrimSuffix(endpoint, "/")+"/", bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", "secretsmanager.GetSecretValue")
+	signAWS(req, body, region, "secretsmanager", time.Now())
+	resp := struct{ SecretString string }{}
+	if err = doJSON(req, &resp); err != nil {
+		return "", err
+	}
+	if field == "" {
+		return resp.SecretString, nil
+	}
+	fields := make(map[string]string)
+	if err = json.Unmarshal([]byte(resp.SecretString), &fields); err != nil {
+		return "", fmt.Errorf("field %s: %w", field, err)
+	}
+	return fields[field], nil
+}
+
+// signAWS adds a Signature Version 4 authorization to req.
+func signAWS(req *http.Request, body []byte, region, service string, now time.Time) {
+	now = now.UTC()
+	stamp, day := now.Format("20060102T150405Z"), now.Format("20060102")
+	req.Header.Set("X-Amz-Date", stamp)
+	if t := os.Getenv("AWS_SESSION_TOKEN"); t != "" {
+		req.Header.Set("X-Amz-Security-Token", t)
+	}
+	names := []string{"content-type", "host", "x-amz-date", "x-amz-security-token", "x-amz-target"}
+	signed := make([]string, 0, len(names))
+	canonical := &strings.Builder{}
+	fmt.Fprintf(canonical, "%s\n/\n\n", req.Method)
+	for _, name := range names {
+		v := req.Header.Get(name)
+		if name == "host" {
+			v = req.URL.Host
+		}
+		if v == "" {
+			continue
+		}
+		fmt.Fprintf(canonical, "%s:%s\n", name, strings.TrimSpace(v))
+		signed = append(signed, name)
+	}
+	bodySum := sha256.Sum256(body)
+	fmt.Fprintf(canonical, "\n%s\n%s", strings.Join(signed, ";"), hex.EncodeToString(bodySum[:]))
+	scope := day + "/" + region + "/" + service + "/aws4_request"
+	canonicalSum := sha256.Sum256([]byte(canonical.String()))
+	toSign := "AWS4-HMAC-SHA256\n" + stamp + "\n" + scope + "\n" + hex.EncodeToString(canonicalSum[:])
+	k := []byte("AWS4" + os.Getenv("AWS_SECRET_ACCESS_KEY"))
+	for _, part := range []string{day, region, service, "aws4_request", toSign} {
+		mac := hmac.New(sha256.New, k)
+		mac.Write([]byte(part))
+		k = mac.Sum(nil)
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		os.Getenv("AWS_ACCESS_KEY_ID"), scope, strings.Join(signed, ";"), hex.EncodeToString(k)))
+}
+
+func gcpKey(path string) (string, error) {
+	if !strings.Contains(path, "/versions/") {
+		path += "/versions/latest"
+	}
+	token := os.Getenv("GOOGLE_OAUTH_ACCESS_TOKEN")
+	if token == "" {
+		req, err := http.NewRequest("GET", "http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/token", nil)
+		if err != nil {
+			return "", err
+		}
+		req.Header.Set("Metadata-Flavor", "Google")
+		resp := struct {
+			AccessToken string `json:"access_token"`
+		}{}
+		if err = doJSON(req, &resp); err != nil {
+			return "", fmt.Errorf("metadata token: %w", err)
+		}
+		token = resp.AccessToken
+	}
+	endpoint := os.Getenv("GCP_SECRET_MANAGER_ENDPOINT")
+	if endpoint == "" {
+		endpoint = "https://secretmanager.googleapis.com"
+	}
+	req, err := http.NewRequest("GET", strings.TrimSuffix(endpoint, "/")+"/v1/"+(&url.URL{Path: path}).EscapedPath()+":access", nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp := struct {
+		Payload struct {
+			Data string `json:"data"`
+		} `json:"payload"`
+	}{}
+	if err = doJSON(req, &resp); err != nil {
+		return "", err
+	}
+	data, err := base64.StdEncoding.DecodeString(resp.Payload.Data)
+	return strings.TrimSpace(string(data)), err
+}
+
+// doJSON sends req to an external service, and decodes the response into v.
+func doJSON(req *http.Request, v any) error {
+	resp, err := sinkClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("got status code %d: %s", resp.StatusCode, bytes.TrimSpace(msg))
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// renewKey fetches the key from source every interval, so the server picks
+// up a rotated key without a restart. Commands signed with the old key are
+// rejected once it is replaced.
+func (a *app) renewKey(source string, every time.Duration) {
+	for range time.Tick(every) {
+		key, err := fetchKey(source)
+		if err != nil {
+			fmt.Println(err)
+			continue
+		}
+		a.mu.Lock()
+		if key != string(a.key) {
+			sum := blake3.Sum256([]byte(key))
+			a.key, a.hasher = []byte(key), blake3.New(32, sum[:])
+			fmt.Printf("%s: key renewed from %s\n", time.Now(), strings.SplitN(source, "://", 2)[0])
+		}
+		a.mu.Unlock()
+	}
+}
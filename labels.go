@@ -0,0 +1,182 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"lukechampine.com/blake3"
+)
+
+const (
+	maxLabels   = 32
+	maxLabelLen = 256
+)
+
+// parseLabels reads key=value labels.
+func parseLabels(pairs []string) (map[string]string, error) {
+	labels := make(map[string]string, len(pairs))
+	for _, p := range pairs {
+		k, v, ok := strings.Cut(p, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid label %q, want key=value", p)
+		}
+		labels[k] = v
+	}
+	return labels, nil
+}
+
+func validLabels(labels map[string]string) error {
+	if len(labels) > maxLabels {
+		return fmt.Errorf("more than %d labels", maxLabels)
+	}
+	for k, v := range labels {
+		if err := validID("label", k); err != nil {
+			return err
+		}
+		if strings.ContainsAny(k, "=,") {
+			return fmt.Errorf("label %q contains = or ,", k)
+		}
+		if len(v) > maxLabelLen {
+			return fmt.Errorf("label %s is longer than %d bytes", k, maxLabelLen)
+		}
+	}
+	return nil
+}
+
+// writeLabels hashes the count of labels, then each key and value framed,
+// in key order.
+func writeLabels(h *blake3.Hasher, labels map[string]string) {
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	h.Write(vtb(len(keys)))
+	for _, k := range keys {
+		h.Write(stb(k))
+		h.Write(stb(labels[k]))
+	}
+}
+
+// hasLabels reports whether c carries every label in want.
+func (c *cmd) hasLabels(want map[string]string) bool {
+	for k, v := range want {
+		if got, ok := c.Labels[k]; !ok || got != v {
+			return false
+		}
+	}
+	return true
+}
+
+// handleGetCommands lists the stored commands, oldest first, filtered by
+// label=key=value parameters, which must all match.
+func (a *app) handleGetCommands(w http.ResponseWriter, r *http.Request) {
+	if !a.viewer(w, r, "commands") {
+		return
+	}
+	want, err := parseLabels(r.URL.Query()["label"])
+	if err != nil {
+		httpError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	ids := r.URL.Query()["id"]
+	a.mu.Lock()
+	cmds, err := a.store.cmds()
+	found := make([]*cmd, 0)
+	for _, c := range cmds {
+		if c.hasLabels(want) && (len(ids) == 0 || slices.Contains(ids, c.ID)) {
+			found = append(found, c)
+		}
+	}
+	if err == nil {
+		found, err = a.withDeliveries(found)
+	}
+	a.mu.Unlock()
+	if err != nil {
+		httpError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	payload, err := json.Marshal(found)
+	if err != nil {
+		httpError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write(payload)
+}
+
+func getCommands(labels []string, target string) ([]*cmd, error) {
+	query := make([]string, len(labels))
+	for i, l := range labels {
+		query[i] = "label=" + url.QueryEscape(l)
+	}
+	resp, err := client.Get(target + "/commands?" + strings.Join(query, "&"))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, responseError(resp)
+	}
+	cmds := make([]*cmd, 0)
+	err = json.NewDecoder(resp.Body).Decode(&cmds)
+	return cmds, err
+}
+
+func printCommand(c *cmd) {
+	fmt.Printf("%s: %s", c.Created.Format(time.RFC3339), c.ID)
+	for _, s := range append([]string{c.Type, c.Name}, c.Args...) {
+		if s != "" {
+			fmt.Print(" " + s)
+		}
+	}
+	if len(c.Agents) > 0 {
+		fmt.Printf(" [%s]", strings.Join(c.Agents, ","))
+	}
+	if c.Channel != "" {
+		fmt.Printf(" channel %s", c.Channel)
+	}
+	if c.Promoted != "" {
+		fmt.Printf(" (promoted from %s)", c.Promoted)
+	}
+	if c.Delivery != "" {
+		fmt.Printf(" %s", c.Delivery)
+	}
+	if c.LocalHours != "" {
+		fmt.Printf(" at %s local", c.LocalHours)
+	}
+	if c.Priority != 0 {
+		fmt.Printf(" priority %d", c.Priority)
+	}
+	if len(c.After) > 0 {
+		fmt.Printf(" after %s", strings.Join(c.After, ","))
+	}
+	if len(c.Await) > 0 {
+		fmt.Printf(" awaiting %s", strings.Join(c.Await, ","))
+	}
+	if c.Lock != "" {
+		fmt.Printf(" lock %s", c.Lock)
+	}
+	keys := make([]string, 0, len(c.Labels))
+	for k := range c.Labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Printf(" %s=%s", k, c.Labels[k])
+	}
+	if len(c.Delivered) > 0 {
+		agents := make([]string, 0, len(c.Delivered))
+		for agent := range c.Delivered {
+			agents = append(agents, agent)
+		}
+		sort.Strings(agents)
+		fmt.Printf(" delivered to %s", strings.Join(agents, ","))
+	}
+	fmt.Println()
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"lukechampine.com/blake3"
+)
+
+const (
+	// leaseRetry is how long agents are told to wait for a lock.
+	leaseRetry = 5 * time.Second
+	// leaseRenew is how often agents renew a lease while executing.
+	leaseRenew = time.Minute
+	// maxLeaseWait is how long agents wait for a lock, without a window.
+	maxLeaseWait = 24 * time.Hour
+	// leaseAttempts bounds the retries of a lease update that raced
+	// another server.
+	leaseAttempts = 10
+)
+
+var errLeaseNotHeld = errors.New("lease not held")
+
+// lease is held by an agent executing a command that takes a lock.
+type lease struct {
+	Lock, Cmd, Agent string
+	Since, Renewed   time.Time
+}
+
+// leases grants each lock to one agent executing one command at a time,
+// so an operation dispatched broadly, such as a database migration, runs
+// on a single agent. A lease is freed by the agent's result, or ttl after
+// the agent last renewed it. With a shared store, the leases are kept in
+// it, so servers sharing it grant each lock once.
+type leases struct {
+	ttl    time.Duration
+	held   map[string]*lease // by lock
+	shared *redisStore
+}
+
+func newLeases(ttl time.Duration, shared *redisStore) *leases {
+	return &leases{ttl: ttl, held: make(map[string]*lease), shared: shared}
+}
+
+// acquire takes lock for agent to execute id, returning the lease that
+// holds it instead, if any. An agent holding the lease already renews it.
+// With renew, a lease no longer held is not taken again.
+func (ls *leases) acquire(lock, id, agent string, renew bool, now time.Time) (*lease, error) {
+	var holder *lease
+	lost := false
+	err := ls.update(func(held map[string]*lease) []string {
+		holder, lost = nil, false
+		l := held[lock]
+		switch {
+		case l != nil && l.Cmd == id && l.Agent == agent:
+			l.Renewed = now
+		case renew:
+			lost = true
+			return nil
+		case l != nil && ls.live(l, now):
+			holder = l
+			return nil
+		default:
+			held[lock] = &lease{Lock: lock, Cmd: id, Agent: agent, Since: now, Renewed: now}
+		}
+		return []string{lock}
+	})
+	if err == nil && lost {
+		err = errLeaseNotHeld
+	}
+	return holder, err
+}
+
+// live reports whether l was renewed within the ttl.
+func (ls *leases) live(l *lease, now time.Time) bool {
+	return now.Sub(l.Renewed) <= ls.ttl
+}
+
+// release frees the lock agent holds to execute id, if any.
+func (ls *leases) release(id, agent string) error {
+	return ls.update(func(held map[string]*lease) []string {
+		var freed []string
+		for lock, l := range held {
+			if l.Cmd == id && l.Agent == agent {
+				delete(held, lock)
+				freed = append(freed, lock)
+			}
+		}
+		return freed
+	})
+}
+
+// list returns the leases held, by lock.
+func (ls *leases) list(now time.Time) ([]*lease, error) {
+	list := make([]*lease, 0)
+	err := ls.update(func(held map[string]*lease) []string {
+		for _, l := range held {
+			if ls.live(l, now) {
+				list = append(list, l)
+			}
+		}
+		return nil
+	})
+	sort.Slice(list, func(i, j int) bool { return list[i].Lock < list[j].Lock })
+	return list, err
+}
+
+// update calls f with the leases held, and stores those of the locks it
+// returns. With a shared store, it compares and sets them: the update is
+// dropped and retried if another server changed a lease meanwhile.
+func (ls *leases) update(f func(held map[string]*lease) []string) error {
+	if ls.shared == nil {
+		f(ls.held)
+		return nil
+	}
+	rs := ls.shared
+	for i := 0; i < leaseAttempts; i++ {
+		if _, err := rs.do("WATCH", "captain:leases"); err != nil {
+			return err
+		}
+		held, err := rs.leases()
+		if err != nil {
+			rs.do("UNWATCH")
+			return err
+		}
+		changed := f(held)
+		if len(changed) == 0 {
+			_, err = rs.do("UNWATCH")
+			return err
+		}
+		if _, err = rs.do("MULTI"); err != nil {
+			return err
+		}
+		for _, lock := range changed {
+			if err = rs.queueLease(lock, held[lock]); err != nil {
+				rs.do("DISCARD")
+				return err
+			}
+		}
+		reply, err := rs.do("EXEC")
+		if err != nil {
+			return err
+		}
+		// EXEC replies nil if a watched key changed.
+		if items, _ := reply.([]any); items != nil {
+			return nil
+		}
+	}
+	return errors.New("leases: too many concurrent updates")
+}
+
+// leaseRequest asks for the lock of Cmd, or to renew it while executing.
+type leaseRequest struct {
+	Lock, Cmd, Agent, Sum string
+	Renew                 bool
+	Created               time.Time
+}
+
+func (req *leaseRequest) validate() error {
+	if err := validID("lock", req.Lock); err != nil {
+		return err
+	}
+	if err := validID("cmd", req.Cmd); err != nil {
+		return err
+	}
+	if err := validID("agent", req.Agent); err != nil {
+		return err
+	}
+	return validTime(req.Created)
+}
+
+func signLeaseRequest(req *leaseRequest, h *blake3.Hasher) []byte {
+	h.Reset()
+	h.Write(ttb(req.Created))
+	h.Write(stb(req.Lock))
+	h.Write(stb(req.Cmd))
+	h.Write(stb(req.Agent))
+	h.Write(btb(req.Renew))
+	return h.Sum(nil)
+}
+
+func (a *app) handleLease(w http.ResponseWriter, r *http.Request) {
+	req := &leaseRequest{}
+	if !decode(w, r, req) {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if time.Since(req.Created) > 200*time.Millisecond {
+		httpError(w, "payload expired", http.StatusUnauthorized)
+		return
+	}
+	h, err := a.agentHasher(req.Agent)
+	sum, herr := hex.DecodeString(req.Sum)
+	if err != nil || herr != nil || !bytes.Equal(signLeaseRequest(req, h), sum) {
+		httpError(w, "invalid checksum", http.StatusUnauthorized)
+		return
+	}
+	if a.revoked(req.Agent) {
+		refuseAgent(w, req.Agent)
+		return
+	}
+	l, err := a.leases.acquire(req.Lock, req.Cmd, req.Agent, req.Renew, time.Now())
+	switch {
+	case errors.Is(err, errLeaseNotHeld):
+		httpError(w, req.Lock+" is no longer held for "+req.Cmd, http.StatusConflict)
+		return
+	case err != nil:
+		httpError(w, err.Error(), http.StatusInternalServerError)
+		return
+	case l != nil:
+		w.Header().Set("Retry-After", strconv.Itoa(int(leaseRetry.Seconds())))
+		httpError(w, fmt.Sprintf("%s is held by %s for %s", l.Lock, l.Agent, l.Cmd), http.StatusLocked)
+		return
+	}
+	w.Write([]byte("ok"))
+}
+
+func (a *app) handleGetLeases(w http.ResponseWriter, r *http.Request) {
+	if !a.viewer(w, r, "leases") {
+		return
+	}
+	a.mu.Lock()
+	list, err := a.leases.list(time.Now())
+	a.mu.Unlock()
+	var payload []byte
+	if err == nil {
+		payload, err = json.Marshal(list)
+	}
+	if err != nil {
+		httpError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write(payload)
+}
+
+// requestLease asks the server for the lock of c. It returns how long to
+// wait before asking again if another agent holds it.
+func requestLease(c *cmd, agent string, renew bool, h *blake3.Hasher, target string) (time.Duration, error) {
+	req := &leaseRequest{Lock: c.Lock, Cmd: c.ID, Agent: agent, Renew: renew, Created: time.Now()}
+	req.Sum = hex.EncodeToString(signLeaseRequest(req, h))
+	payload, err := json.Marshal(req)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := client.Post(target+"/leases", "application/json", bytes.NewBuffer(payload))
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return 0, nil
+	case http.StatusLocked:
+		wait := leaseRetry
+		if s, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && s > 0 {
+			wait = time.Duration(s) * time.Second
+		}
+		return wait, nil
+	}
+	return 0, responseError(resp)
+}
+
+// waitLease waits until the server grants the lock of c, or fails once the
+// window of c has closed, or after maxLeaseWait. Unlike slots, a lock is
+// not taken without the server, which alone knows who holds it.
+func (ag *agent) waitLease(c *cmd) error {
+	deadline := time.Now().Add(maxLeaseWait)
+	if !c.NotAfter.IsZero() {
+		deadline = c.NotAfter
+	}
+	logged := false
+	for {
+		wait, err := requestLease(c, ag.id, false, ag.hasher(), ag.target)
+		if err != nil {
+			fmt.Printf("%s: lock %s: %s\n", c.ref(), c.Lock, err)
+			wait = leaseRetry
+		} else if wait == 0 {
+			return nil
+		}
+		if time.Now().Add(wait).After(deadline) {
+			return fmt.Errorf("lock %s not acquired in time", c.Lock)
+		}
+		if !logged && !ag.quiet {
+			logf("%s: waiting for lock %s\n", c.ref(), c.Lock)
+			logged = true
+		}
+		time.Sleep(wait)
+	}
+}
+
+// renewLease renews the lease of c every leaseRenew, until the returned
+// function is called, so the lock outlives -lease-ttl while c executes.
+func (ag *agent) renewLease(c *cmd) func() {
+	done := make(chan struct{})
+	go func() {
+		t := time.NewTicker(leaseRenew)
+		defer t.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-t.C:
+			}
+			wait, err := requestLease(c, ag.id, true, ag.hasher(), ag.target)
+			if err == nil && wait > 0 {
+				err = errors.New("held by another agent")
+			}
+			if err != nil {
+				fmt.Printf("%s: renewing lock %s: %s\n", c.ref(), c.Lock, err)
+			}
+		}
+	}()
+	return func() { close(done) }
+}
+
+var errNoLockServer = errors.New("locks need a server")
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLeases(t *testing.T) {
+	now := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	ls := newLeases(time.Minute, nil)
+	steps := []struct {
+		name       string
+		lock, cmd  string
+		agent      string
+		renew      bool
+		at         time.Duration
+		held, lost bool
+	}{
+		{"take", "db", "c1", "a", false, 0, false, false},
+		{"held by another agent", "db", "c1", "b", false, 30 * time.Second, true, false},
+		{"held by another command", "db", "c2", "a", false, 30 * time.Second, true, false},
+		{"renew", "db", "c1", "a", true, 50 * time.Second, false, false},
+		{"held after the first ttl", "db", "c2", "b", false, 90 * time.Second, true, false},
+		{"renewing a lock held by another", "db", "c2", "b", true, 90 * time.Second, false, true},
+		{"taken once expired", "db", "c2", "b", false, 200 * time.Second, false, false},
+		{"renewing a lock taken over", "db", "c1", "a", true, 210 * time.Second, false, true},
+		{"other locks are free", "cache", "c1", "a", false, 210 * time.Second, false, false},
+	}
+	for _, s := range steps {
+		l, err := ls.acquire(s.lock, s.cmd, s.agent, s.renew, now.Add(s.at))
+		if (l != nil) != s.held || (err == errLeaseNotHeld) != s.lost {
+			t.Errorf("%s: got %v, %v", s.name, l, err)
+		}
+	}
+	if err := ls.release("c2", "b"); err != nil {
+		t.Fatal(err)
+	}
+	if l, _ := ls.acquire("db", "c3", "c", false, now.Add(210*time.Second)); l != nil {
+		t.Errorf("held by %s after release", l.Agent)
+	}
+}
+
+// TestSharedLeases takes one lock from many servers sharing a store at
+// once, and checks a single one grants it.
+func TestSharedLeases(t *testing.T) {
+	addr := fakeRedis(t)
+	now := time.Now()
+	granted := make(chan string, 8)
+	wg := sync.WaitGroup{}
+	for i := 0; i < cap(granted); i++ {
+		rs, err := openRedisStore("redis://" + addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		agent := fmt.Sprintf("agent-%d", i)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			l, err := newLeases(time.Minute, rs).acquire("db", "c1", agent, false, now)
+			if err != nil {
+				t.Error(err)
+			}
+			if l == nil {
+				granted <- agent
+			}
+		}()
+	}
+	wg.Wait()
+	close(granted)
+	var agents []string
+	for agent := range granted {
+		agents = append(agents, agent)
+	}
+	if len(agents) != 1 {
+		t.Fatalf("granted to %v", agents)
+	}
+	rs, _ := openRedisStore("redis://" + addr)
+	ls := newLeases(time.Minute, rs)
+	if list, err := ls.list(now); err != nil || len(list) != 1 || list[0].Agent != agents[0] {
+		t.Errorf("listed %v, %v", list, err)
+	}
+	if err := ls.release("c1", agents[0]); err != nil {
+		t.Fatal(err)
+	}
+	if list, _ := ls.list(now); len(list) != 0 {
+		t.Errorf("listed %v after release", list)
+	}
+}
+
+// fakeRedis serves the hash and transaction commands leases use, with
+// WATCH failing EXEC if the hash changed, as Redis does.
+func fakeRedis(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	mu := sync.Mutex{}
+	hash := make(map[string]string)
+	version := 0
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				watched, queued := -1, [][]string(nil)
+				inMulti := false
+				for {
+					reply, err := readReply(r)
+					if err != nil {
+						return
+					}
+					items, _ := reply.([]any)
+					args := make([]string, len(items))
+					for i, item := range items {
+						args[i] = string(item.([]byte))
+					}
+					mu.Lock()
+					out := ""
+					switch cmd := strings.ToUpper(args[0]); {
+					case inMulti && cmd != "EXEC" && cmd != "DISCARD":
+						queued = append(queued, args)
+						out = "+QUEUED\r\n"
+					case cmd == "WATCH":
+						watched, out = version, "+OK\r\n"
+					case cmd == "UNWATCH":
+						watched, out = -1, "+OK\r\n"
+					case cmd == "MULTI":
+						inMulti, queued, out = true, nil, "+OK\r\n"
+					case cmd == "DISCARD":
+						inMulti, watched, out = false, -1, "+OK\r\n"
+					case cmd == "EXEC":
+						if watched >= 0 && watched != version {
+							out = "*-1\r\n"
+						} else {
+							out = "*" + strconv.Itoa(len(queued)) + "\r\n"
+							for _, q := range queued {
+								if q[0] == "HSET" {
+									hash[q[2]] = q[3]
+								} else {
+									delete(hash, q[2])
+								}
+								version++
+								out += ":1\r\n"
+							}
+						}
+						inMulti, watched = false, -1
+					case cmd == "HVALS":
+						out = "*" + strconv.Itoa(len(hash)) + "\r\n"
+						for _, v := range hash {
+							out += "$" + strconv.Itoa(len(v)) + "\r\n" + v + "\r\n"
+						}
+					default:
+						out = "+PONG\r\n"
+					}
+					mu.Unlock()
+					if _, err = conn.Write([]byte(out)); err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// templateLabel records the command template a command was sent from.
+const templateLabel = "template"
+
+// cmdTemplate is a command line stored on the server under a name, sent
+// with -use. Its args take parameters as {{.name}}, filled with -param, and
+// variables as {{var "name"}}, resolved by the server as with -template.
+type cmdTemplate struct {
+	Name    string
+	Argv    []string
+	Updated time.Time
+}
+
+// fill returns the command line of t with params, and whether it uses
+// variables of the server.
+func (t *cmdTemplate) fill(params map[string]string) ([]string, bool, error) {
+	if params == nil {
+		params = make(map[string]string)
+	}
+	vars := false
+	argv := make([]string, len(t.Argv))
+	for i, arg := range t.Argv {
+		tmpl, err := template.New("").Funcs(template.FuncMap{"var": func(name string) string {
+			vars = true
+			return "{{var " + strconv.Quote(name) + "}}"
+		}}).Option("missingkey=error").Parse(arg)
+		if err != nil {
+			return nil, false, fmt.Errorf("template %s: %w", t.Name, err)
+		}
+		b := &strings.Builder{}
+		if err = tmpl.Execute(b, params); err != nil {
+			return nil, false, fmt.Errorf("template %s: %w", t.Name, err)
+		}
+		argv[i] = b.String()
+	}
+	return argv, vars, nil
+}
+
+// parseCmdTemplate parses the command line of template name, as sent in the
+// value of an admin request.
+func parseCmdTemplate(name, value string) (*cmdTemplate, error) {
+	if !varName.MatchString(name) {
+		return nil, fmt.Errorf("invalid template name %q", name)
+	}
+	t := &cmdTemplate{Name: name}
+	if err := json.Unmarshal([]byte(value), &t.Argv); err != nil {
+		return nil, fmt.Errorf("template %s: %w", name, err)
+	}
+	if len(t.Argv) == 0 {
+		return nil, errors.New("template " + name + " has no command")
+	}
+	for _, arg := range t.Argv {
+		if _, err := template.New("").Funcs(template.FuncMap{"var": strconv.Quote}).Parse(arg); err != nil {
+			return nil, fmt.Errorf("template %s: %w", name, err)
+		}
+	}
+	return t, nil
+}
+
+func (a *app) handleTemplates(w http.ResponseWriter, r *http.Request) {
+	req := a.decodeAdmin(w, r, "set", "delete")
+	if req == nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	var err error
+	switch req.Action {
+	case "set":
+		var t *cmdTemplate
+		if t, err = parseCmdTemplate(req.Name, req.Value); err != nil {
+			httpError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		t.Updated = time.Now()
+		if err = a.store.putTemplate(t); err == nil {
+			fmt.Printf("%s: set template %s\n", t.Updated, t.Name)
+		}
+	case "delete":
+		if err = a.store.deleteTemplate(req.Name); err == nil {
+			fmt.Printf("%s: deleted template %s\n", time.Now(), req.Name)
+		}
+	}
+	if err != nil {
+		httpError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	payload, err := json.Marshal(req.Name)
+	if err != nil {
+		httpError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write(payload)
+}
+
+// handleGetTemplates lists the command templates, for operators allowed to
+// view, as they fill them in to send them.
+func (a *app) handleGetTemplates(w http.ResponseWriter, r *http.Request) {
+	if !a.viewer(w, r, "templates") {
+		return
+	}
+	a.mu.Lock()
+	templates, err := a.store.templates()
+	a.mu.Unlock()
+	if err == nil {
+		sort.Slice(templates, func(i, j int) bool { return templates[i].Name < templates[j].Name })
+	}
+	var payload []byte
+	if err == nil {
+		payload, err = json.Marshal(templates)
+	}
+	if err != nil {
+		httpError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write(payload)
+}
+
+func getTemplates(target string) ([]*cmdTemplate, error) {
+	resp, err := client.Get(target + "/templates")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, responseError(resp)
+	}
+	templates := make([]*cmdTemplate, 0)
+	err = json.NewDecoder(resp.Body).Decode(&templates)
+	return templates, err
+}
+
+// getTemplate returns the command template name from target.
+func getTemplate(name, target string) (*cmdTemplate, error) {
+	templates, err := getTemplates(target)
+	if err != nil {
+		return nil, err
+	}
+	for _, t := range templates {
+		if t.Name == name {
+			return t, nil
+		}
+	}
+	return nil, fmt.Errorf("no template %s on %s", name, target)
+}
+
+func printTemplate(t *cmdTemplate) {
+	fmt.Printf("%s: %s (updated %s)\n", t.Name, strings.Join(t.Argv, " "), t.Updated.Format(time.RFC3339))
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	readHeaderTimeout = 10 * time.Second
+	maxHeaderBytes    = 64 << 10
+)
+
+// serverTimeouts bound how long a client may take to send a request, read
+// a response, and keep an idle connection, so slow clients cannot hold on
+// to connections. Zero disables a timeout.
+type serverTimeouts struct {
+	read, write, idle time.Duration
+}
+
+// listenAndServe serves h on addr, accepting at most maxConns connections
+// at a time, or any number if maxConns is 0.
+func listenAndServe(addr string, h http.Handler, t serverTimeouts, maxConns int) error {
+	headerTimeout := readHeaderTimeout
+	if t.read > 0 && t.read < headerTimeout {
+		headerTimeout = t.read
+	}
+	srv := &http.Server{
+		Addr:              addr,
+		Handler:           h,
+		ReadHeaderTimeout: headerTimeout,
+		ReadTimeout:       t.read,
+		WriteTimeout:      t.write,
+		IdleTimeout:       t.idle,
+		MaxHeaderBytes:    maxHeaderBytes,
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	if maxConns > 0 {
+		ln = &limitListener{Listener: ln, slots: make(chan struct{}, maxConns)}
+	}
+	return srv.Serve(ln)
+}
+
+// limitListener blocks Accept while all slots are taken by open
+// connections.
+type limitListener struct {
+	net.Listener
+	slots chan struct{}
+}
+
+func (l *limitListener) Accept() (net.Conn, error) {
+	l.slots <- struct{}{}
+	c, err := l.Listener.Accept()
+	if err != nil {
+		<-l.slots
+		return nil, err
+	}
+	return &limitConn{Conn: c, release: func() { <-l.slots }}, nil
+}
+
+type limitConn struct {
+	net.Conn
+	release func()
+	once    sync.Once
+}
+
+func (c *limitConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(c.release)
+	return err
+}
@@ -2,6 +2,8 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"crypto/rand"
 	"encoding/binary"
 	"encoding/hex"
 	"encoding/json"
@@ -12,207 +14,1775 @@ import (
 	"net/http"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"lukechampine.com/blake3"
 )
 
+const (
+	maxPending  = 100
+	defaultPoll = 10 * time.Second
+)
+
 type app struct {
 	payload, key []byte
 	hasher       *blake3.Hasher
+	dir          string
+	store        store
+	nats         *natsConn
+	oidc         *oidc
+	rbac         *rbac
+	held         map[string]*cmd // dangerous commands awaiting approval
+	cosigners    *cosigners
+	cosigning    map[string]*cmd // commands awaiting cosigners
+	awaiting     map[string]*cmd // commands awaiting others on all their agents
+	allow        []*allowRule
+	policy       *policy
+	auditLog     io.Writer
+	auditFile    string // the audit log, if it is a file
+	sinks        chan<- *entry
+	metrics      *metrics
+	lastSeen     map[string]time.Time
+	hooks        map[string]*cmd // commands awaiting their callback
+	polls        map[string]time.Duration
+	offline      map[string]bool
+	missed       int
+	offlineHook  string
+	hookHasher   *blake3.Hasher // keyed with -hook-secret
+	delegator    *delegator
+	budget       *budget
+	leases       *leases
+	artifactDir  string
+	maxArtifact  int64
+	configRules  []*configRule
+	configs      map[string]*agentConfig // reported by agents
+	drifted      map[string]bool
+	dashboard    http.Handler
+	openapi      []byte
+	reboots      map[string]*rebootWatch        // agents rebooting, by agent id
+	supervised   map[string][]*supervisedStatus // reported by agents
+	hints        *pollHints
+	pushes       map[string]*sync.Mutex // serializing chunks pushed to each file
+	mu           sync.Mutex
 }
 
 type cmd struct {
-	Name, Sum string
-	Args      []string
-	Created   time.Time
+	ID, Type, Name, Sum, Signal, Ref, Container string
+	Operator, Approver, Artifact, Digest, Trace string `json:",omitempty"`
+	Channel, Promoted                           string `json:",omitempty"`
+	Args, Agents, Env                           []string
+	Version                                     int
+	Timeout                                     time.Duration
+	NotBefore, NotAfter                         time.Time
+	Verify                                      *check               `json:",omitempty"`
+	Expect                                      *expect              `json:",omitempty"`
+	Labels                                      map[string]string    `json:",omitempty"`
+	Hook                                        *hook                `json:",omitempty"`
+	Sealed                                      []*sealed            `json:",omitempty"`
+	Template                                    bool                 `json:",omitempty"` // args and env are resolved by the server
+	JSON                                        bool                 `json:",omitempty"` // the output is the data of the result
+	Delegation                                  *delegation          `json:",omitempty"`
+	Cosigs                                      []*cosig             `json:",omitempty"`
+	Delivery                                    string               `json:",omitempty"` // at-most-once or at-least-once
+	LocalHours                                  string               `json:",omitempty"` // daily, in the agent's time zone
+	Priority                                    int                  `json:",omitempty"` // higher runs first on a busy agent
+	After                                       []string             `json:",omitempty"` // ids of commands that must succeed first on the agent
+	Await                                       []string             `json:",omitempty"` // ids of commands that must succeed first on all their agents
+	Lock                                        string               `json:",omitempty"` // held on the server while an agent runs it
+	Delivered                                   map[string]time.Time `json:",omitempty"` // set by the server, not signed
+	Created                                     time.Time
+	received                                    time.Time // by the agent
 }
 
 type log struct {
 	Msg, Sum string
+	Version  int
 	Created  time.Time
 }
 
 func main() {
 	key := flag.String("key", "", "authentication token")
-	mode := flag.String("mode", "send", "operating mode: send | serve | obey")
-	target := flag.String("target", "", "for send and obey modes")
-	poll := flag.Duration("poll", 10*time.Second, "polling interval for obey mode")
+	keySource := flag.String("key-source", "", "fetch the key at startup from vault://<path>[#field], awssm://<secret-id>[#field] or gcpsm://projects/<p>/secrets/<s> instead of -key")
+	keyRefresh := flag.Duration("key-refresh", time.Hour, "in serve mode, how often to fetch the key again from -key-source, picking up a rotated key")
+	token := flag.String("token", os.Getenv("CAPTAIN_TOKEN"), "in send, promote, result, logs, history, approve, token, enroll, agents, export, artifacts and dlq modes, a bearer token to authenticate with instead of -key, defaults to $CAPTAIN_TOKEN")
+	oidcIssuer := flag.String("oidc", "", "in serve mode, accept ID tokens from this OpenID Connect issuer")
+	oidcAudience := flag.String("oidc-audience", "", "client id the ID tokens must be issued for")
+	oidcRoles := flag.String("oidc-roles", "", "comma-separated group=role pairs granting roles (viewer, dispatcher, admin, or from -rbac) to groups or emails")
+	ttl := flag.Duration("ttl", 24*time.Hour, "in token mode, how long a created token is valid")
+	scope := flag.String("scope", "", "in token mode, comma-separated scopes of a created token: view, send or approve, optionally limited to agent ids matching a pattern, e.g. send:staging-*")
+	policyFile := flag.String("policy", "", "in serve mode, a JSON file of rules admitting or rejecting commands")
+	agentConfigFile := flag.String("agent-config", "", "in serve mode, a JSON file of rules setting the poll interval, tags and allowed commands of matching agents")
+	auditFile := flag.String("audit", "", "in serve mode, append command admission decisions to this file as JSON lines (- for stdout)")
+	rbacFile := flag.String("rbac", "", "in serve mode, a JSON file of roles, grants and dangerous commands for token-authenticated operators")
+	mode := flag.String("mode", "send", "operating mode: send | serve | obey | apply | gitops | push | pull | result | secret | approve | token | enroll | agents | cosign | simulate | ping | query | dlq | history | flush | vars | promote | export | artifacts | install-service | schema | logs | templates")
+	target := flag.String("target", "", "server url for all modes but serve, or comma-separated urls to fan out in send mode")
+	notBefore := flag.String("not-before", "", "in send mode, agents execute the command no earlier than this: an RFC 3339 time, a duration from now, or a local time of day (22:00)")
+	priority := flag.Int("priority", 0, "in send mode, agents busy with other commands run those of higher priority first")
+	after := flag.String("after", "", "in send mode, comma-separated ids of commands that must succeed on an agent before it runs this one")
+	await := flag.String("await", "", "in send mode, comma-separated ids of commands that must succeed on all their agents before the server delivers this one")
+	lock := flag.String("lock", "", "in send mode, a lock on the server that agents hold while running the command, so one runs it at a time")
+	localHours := flag.String("local-hours", "", "in send mode, agents execute the command within these daily hours of their local time, 15:04-15:04, holding it until they open")
+	notAfter := flag.String("not-after", "", "in send mode, agents execute the command no later than this, in the formats of -not-before, replacing the usual expiry")
+	trace := flag.String("trace", os.Getenv("CAPTAIN_TRACE"), "in send and apply modes, the correlation id to tag the commands with, defaults to $CAPTAIN_TRACE or a new id")
+	wait := flag.Duration("wait", 0, "in send mode, wait this long for results and exit with the remote exit code, in ping and query modes, for the agents to answer, defaults to twice -poll, or in logs mode, stop following after this long")
+	delivery := flag.String("delivery", "", "in send mode, the delivery semantics of the commands: at-most-once skips them unless the agent is sure it did not run them, at-least-once runs them again if the agent stops before reporting them")
+	jsonData := flag.Bool("json", false, "in send and query modes, agents parse the output of the command as JSON into the data of its result")
+	dataPath := flag.String("jsonpath", "", "in query and result modes, show the value at this dotted path into the data of the results, e.g. .version (implies -json)")
+	from := flag.String("from", "", "in export mode, export from this time (RFC 3339) or date (2006-01-02, UTC), or in promote mode, the namespace the command succeeded in")
+	to := flag.String("to", "", "in export mode, export until this time or date, exclusive (default: now), or in promote mode, the namespace to promote the command to")
+	format := flag.String("format", "csv", "in export mode, the format: csv | json (one JSON object per line)")
+	output := flag.String("output", "text", "output format for send, apply, result, ping, query, dlq and history modes, and obey with -show-history: text | json")
+	file := flag.String("f", "", "job manifest for apply mode, or a file of commands for send mode (- for stdin)")
+	repo := flag.String("repo", "", "git repository of job manifests for gitops mode")
+	id := flag.String("id", "", "agent id for obey mode, defaults to the id stored in -state-dir, or the hostname")
+	takeover := flag.Bool("takeover", false, "in obey mode, stop the agent holding -state-dir and take over, instead of refusing to start")
+	showHistory := flag.Bool("show-history", false, "in obey mode, print the journal of the commands the agent with -state-dir executed and their results, and exit")
+	journalSize := flag.Int64("journal-size", 10<<20, "in obey mode, the size in bytes of the journal of executed commands in -state-dir, 0 disables it")
+	stateDir := flag.String("state-dir", "/var/lib/captain", "in obey mode, the directory of the agent's id, executed commands and outbox, locked against other agents")
+	agents := flag.String("agents", "", "comma-separated agent ids to target in send mode, defaults to all, in promote mode, those of the namespace promoted to, in logs mode, agent patterns to follow, or in simulate mode, the number or ids of agents to simulate")
+	raw := flag.Bool("raw", false, "in logs mode, print the output lines only, without agent prefixes, colors or outcomes, for pipes")
+	keyFile := flag.String("key-file", "captain.key", "in obey mode without -key, the file holding the key, written on enrollment")
+	enrollToken := flag.String("enroll", "", "in obey mode, an enrollment token to get the key with, if -key-file does not exist")
+	identity := flag.String("identity", "captain.identity", "private key file for decrypting secrets in obey mode, created if missing")
+	catchUp := flag.Duration("catch-up", 0, "in obey mode, execute commands issued up to this long before startup, 0 skips them")
+	once := flag.Bool("once", false, "in obey mode, poll once immediately, execute pending commands and exit")
+	maxConcurrent := flag.Int("max-concurrent", 1, "maximum number of commands executed in parallel in obey mode")
+	secrets := flag.String("secrets", "", "file of secret values, one per line, redacted from output in obey mode")
+	expectCode := flag.Int("expect-code", -1, "in send mode, assert the exit code the agents report, 0 if another assertion is given")
+	expectMatch := flag.String("expect-match", "", "in send mode, assert that the output matches this regular expression")
+	callback := flag.String("callback", "", "in send mode, a url the server posts a signed summary of the results to, once the agents in -agents have reported or -callback-wait has passed")
+	callbackWait := flag.Duration("callback-wait", 10*time.Minute, "in send mode, how long the server waits for results before calling -callback")
+	hookSecret := flag.String("hook-secret", os.Getenv("CAPTAIN_HOOK_SECRET"), "in serve mode, the secret callbacks are signed with, for their receivers to verify, not the key, defaults to $CAPTAIN_HOOK_SECRET")
+	queue := flag.Bool("queue", false, "in send mode, sign commands valid for -queue-ttl, and keep those the server cannot be reached for in -queue-dir, to submit in flush mode")
+	queueDir := flag.String("queue-dir", "captain-queue", "in send and flush modes, the directory of commands queued offline")
+	queueTTL := flag.Duration("queue-ttl", 24*time.Hour, "in send mode with -queue, how long queued commands stay valid, unless -not-after is given")
+	var redact, sinks, allow, expectJSON, labels, params stringList
+	flag.Var(&params, "param", "in send mode, a key=value parameter filling {{.key}} in the template of -use, may be repeated")
+	flag.Var(&labels, "label", "in send mode, a key=value label stored with the command, or in history mode, a label the commands must have, may be repeated")
+	flag.Var(&expectJSON, "expect-json", "in send mode, assert that a dotted path into the structured data, or the JSON output, equals a value, as path=value, may be repeated")
+	flag.Var(&allow, "allow", "in serve mode, only allow requests to a method and path prefix from these networks, as \"[METHOD ]/path=cidr,...\", may be repeated")
+	flag.Var(&sinks, "sink", "in serve mode, forward logs and results to loki=<url>, elasticsearch=<url>/<index> or syslog=udp|tcp://<host:port>, may be repeated")
+	flag.Var(&redact, "redact", "regular expression redacted from output in obey mode, may be repeated")
+	artifact := flag.String("artifact", "", "in send mode, an http(s) url of a binary or script for the agents to download and execute with the arguments")
+	upload := flag.String("upload", "", "in send mode, a binary or script to store on the servers, for the agents to download from their server and execute with the arguments")
+	cacheDir := flag.String("artifact-cache", "", "in obey mode, the directory of downloaded artifacts, by digest (default: artifacts in -state-dir)")
+	cacheSize := flag.Int64("artifact-cache-size", 1<<30, "in obey mode, the size in bytes of the artifact cache, evicting the least recently used artifacts, 0 disables it")
+	artifactDir := flag.String("artifact-dir", "artifacts", "in serve mode, the directory of uploaded artifacts, addressed by their BLAKE3 digest")
+	basePath := flag.String("base-path", "", "in serve mode, the URL path prefix the API is served under, such as /captain behind an ingress")
+	corsOrigins := flag.String("cors-origins", "", "in serve mode, comma-separated origins browsers may call the API from, or *")
+	trustedProxies := flag.String("trusted-proxies", "", "in serve mode, comma-separated networks of reverse proxies whose X-Forwarded-For or X-Real-IP header gives the client address")
+	dashboardTheme := flag.String("dashboard-theme", "auto", "in serve mode, the default theme of the dashboard at /dashboard/: auto, following the browser, light or dark")
+	maxArtifact := flag.Int64("max-artifact", 1<<30, "in serve mode, the maximum size in bytes of an uploaded artifact, 0 is unlimited")
+	digest := flag.String("digest", "", "in send mode, the expected BLAKE3 digest of -artifact in hex, computed by downloading it if empty")
+	cmdType := flag.String("type", "", "in send mode, the command type: service (start|stop|restart|reload|status <name>), pkg (install|remove|upgrade <package>...), http ([METHOD] <url> [body]), file (<path> <content> [mode]), docker (start|stop|restart|kill|pause|unpause|inspect <container>), script (<JSON steps>), reboot ([delay]), supervise (start <name> <binary> [args...] | stop <name> | status), or empty to execute a binary")
+	delegateKey := flag.String("delegate-key", "", "in serve mode, the file of a cosigning key the server signs the templates it resolves and the retries it sends with")
+	delegatesFile := flag.String("delegates", "", "in obey mode, a file of \"name ed25519-public-key\" lines of server delegation keys, trusted for -delegate-classes")
+	delegateClasses := flag.String("delegate-classes", "", "in obey mode, the comma-separated classes of commands -delegates may derive: template, retry")
+	cosignersFile := flag.String("cosigners", "", "in serve and obey modes, a file of \"name ed25519-public-key\" lines; commands must be signed by -cosign-m of them")
+	cosignM := flag.Int("cosign-m", 0, "how many of -cosigners must sign a command, 0 for all")
+	signerKey := flag.String("signer-key", "", "in send and cosign modes, the file of this operator's cosigning key")
+	readTimeout := flag.Duration("read-timeout", time.Minute, "in serve mode, the time a client may take to send a request, 0 disables")
+	writeTimeout := flag.Duration("write-timeout", time.Minute, "in serve mode, the time a client may take to read a response, 0 disables")
+	idleTimeout := flag.Duration("idle-timeout", 2*time.Minute, "in serve mode, how long idle keep-alive connections are kept open")
+	maxRunning := flag.Int("max-running", 0, "in serve mode, how many agents may execute commands at once, 0 for no limit")
+	maxRunningCmd := flag.Int("max-running-per-cmd", 0, "in serve mode, how many agents may execute the same command at once, 0 for no limit")
+	slotTTL := flag.Duration("slot-ttl", time.Hour, "in serve mode, how long an agent holds a slot of -max-running if it does not report a result")
+	leaseTTL := flag.Duration("lease-ttl", 5*time.Minute, "in serve mode, how long an agent holds the lock of a command after it last renewed it, if it does not report a result")
+	maxConns := flag.Int("max-conns", 0, "in serve mode, the maximum number of concurrent connections, 0 for no limit")
+	debugAddr := flag.String("debug", "", "in serve and obey modes, serve /debug/pprof and /debug/vars on this loopback address, e.g. localhost:6060")
+	latency := flag.Duration("latency", 0, "in simulate mode, how long simulated agents take to execute a command")
+	channel := flag.String("channel", "", "in obey mode, the channel the agent takes commands of, stable by default, in send mode, the only channel to send to, or in promote mode, the channel to promote to, stable by default")
+	use := flag.String("use", "", "in send mode, the name of a command template stored on the server in templates mode, to send instead of the args")
+	templateCmd := flag.Bool("template", false, "in send mode, the server substitutes {{var \"name\"}} in the args with variables set in vars mode, in the namespace of the namespace label, when agents fetch the command")
+	sealCmd := flag.Bool("seal", false, "in send mode, encrypt the command for the identity keys of -agents, so the server cannot read it")
+	container := flag.String("container", "", "in send mode, execute the command inside this docker container")
+	verifyURL := flag.String("verify-url", "", "in send mode, an HTTP probe run by the agent after the command succeeds")
+	verifyCmd := flag.String("verify-cmd", "", "in send mode, a check command run by the agent after the command succeeds")
+	verifyCode := flag.Int("verify-code", 0, "expected status code of -verify-url (default 200) or exit code of -verify-cmd")
+	verifyMatch := flag.String("verify-match", "", "regular expression the verification output must match")
+	verifyWait := flag.Duration("verify-wait", 0, "how long the agent retries the verification before it fails")
+	signal := flag.String("signal", "", "in send mode, deliver a signal (TERM, KILL, HUP, INT) to the running command with the given id")
+	poll := flag.Duration("poll", defaultPoll, "polling interval for obey and gitops modes")
+	pollMin := flag.Duration("poll-min", 0, "in obey mode, the shortest polling interval the server may hint")
+	pollMax := flag.Duration("poll-max", 0, "in obey mode, the longest polling interval the server may hint, 0 ignores hints")
+	pollActive := flag.Duration("poll-active", 0, "in serve mode, hint agents to poll this often for 10 minutes after a command was sent, 0 disables")
+	pollIdle := flag.Duration("poll-idle", 0, "in serve mode, hint agents to poll this often once no command was sent for an hour, 0 disables")
+	dir := flag.String("dir", "files", "directory for pushed files in serve mode")
+	offlineAfter := flag.Int("offline-after", 0, "in serve mode, mark agents offline once they missed this many polls, 0 disables")
+	offlineHook := flag.String("offline-callback", "", "in serve mode, post a signed notification to this url when an agent goes offline or comes back")
+	metricsURL := flag.String("metrics", "", "in serve mode, push execution statistics to this InfluxDB write url, e.g. http://:token@influx:8086/api/v2/write?org=ops&bucket=captain")
+	deadAfter := flag.Duration("dead-letter-after", 15*time.Minute, "in serve mode, record a dead letter for each targeted agent that has not executed a command this long after it was queued, or that failed it, 0 disables")
+	retainAge := flag.Duration("retain", 0, "in serve mode, drop commands, logs and results older than this, 0 keeps them")
+	retainResults := flag.Int("retain-results", 0, "in serve mode, keep the results of at most this many commands, 0 is unlimited")
+	retainSize := flag.Int64("retain-size", 0, "in serve mode, keep at most this many bytes of results, 0 is unlimited")
+	natsURL := flag.String("nats", "", "nats://[user:password@]host[:port] to publish commands and collect results over NATS in serve mode, or to receive commands over NATS in obey mode")
+	storeDSN := flag.String("store", "memory", "state store for serve mode: memory, file:<path>, or redis://[:password@]host[:port][/db]")
+	chunk := flag.Int64("chunk", 1<<20, "chunk size in bytes for push and pull modes")
+	rate := flag.Int64("rate", 0, "bandwidth limit in bytes per second for push and pull modes, 0 is unlimited")
+	maxDownloadRate := flag.Int64("max-download-rate", 0, "in obey mode, bandwidth limit in bytes per second for everything the agent downloads, shared by its workers, 0 is unlimited")
+	maxUploadRate := flag.Int64("max-upload-rate", 0, "in obey mode, bandwidth limit in bytes per second for everything the agent uploads, such as results and logs, 0 is unlimited")
+	quiet := flag.Bool("q", false, "print only essential output: results, errors, and not the commands obeyed or skipped")
+	verbose := flag.Bool("v", false, "print debug detail to stderr, such as why agents skip commands")
+	veryVerbose := flag.Bool("vv", false, "as -v, and trace every HTTP request to stderr")
+	retries := flag.Int("retries", retrier.Retries, "how many times clients and agents retry transient failures to reach a server, with jittered backoff")
 	flag.Parse()
-	if len(*key) == 0 {
+	*mode = strings.ToLower(*mode)
+	retrier.Retries = max(*retries, 0)
+	switch {
+	case *quiet && (*verbose || *veryVerbose):
+		panic("q and v are mutually exclusive")
+	case *quiet:
+		verbosity = levelQuiet
+	case *veryVerbose:
+		verbosity = levelTrace
+	case *verbose:
+		verbosity = levelDebug
+	}
+	tokenAuth := *token != "" && (*mode == "send" || *mode == "promote" || *mode == "result" || *mode == "logs" || *mode == "approve" || *mode == "token" || *mode == "enroll" || *mode == "agents" || *mode == "export" || *mode == "artifacts")
+	if *keySource != "" {
+		k, err := fetchKey(*keySource)
+		if err != nil {
+			panic(err)
+		}
+		*key = k
+	}
+	// Agents may read the key from -key-file, or enroll to get it. Queued
+	// commands are already signed.
+	if len(*key) == 0 && !tokenAuth && *mode != "obey" && *mode != "install-service" && *mode != "schema" && *mode != "cosign" && *mode != "flush" {
 		fmt.Println("missing key")
 		os.Exit(1)
 	}
 	*target = strings.TrimSuffix(*target, "/")
+	if *trace == "" {
+		*trace = newID()
+	}
+	if *mode == "send" || *mode == "apply" {
+		client.Transport = traceTransport{*trace, client.Transport}
+	}
 	keySum := blake3.Sum256([]byte(*key))
 	hasher := blake3.New(32, keySum[:])
-	switch strings.ToLower(*mode) {
+	if tokenAuth {
+		// The server signs the commands of authenticated operators.
+		client.Transport = bearerTransport{*token, client.Transport}
+		if len(*key) == 0 {
+			hasher = nil
+		}
+	}
+	if len(*key) > 0 && *mode != "serve" && *mode != "obey" {
+		client.Transport = keyTransport{keySum[:], strings.Split(*target, ","), client.Transport}
+	}
+	if verbosity >= levelTrace {
+		client.Transport = verboseTransport{client.Transport}
+	}
+	switch *mode {
 	case "serve":
-		err := http.ListenAndServe(":1992", &app{
-			hasher: hasher,
-			key:    []byte(*key),
-		})
+		if err := os.MkdirAll(*dir, 0755); err != nil {
+			panic(err)
+		}
+		if err := os.MkdirAll(*artifactDir, 0700); err != nil {
+			panic(err)
+		}
+		s, err := openStore(*storeDSN)
+		if err != nil {
+			panic(err)
+		}
+		a := &app{
+			hasher:   hasher,
+			key:      []byte(*key),
+			dir:      *dir,
+			store:    s,
+			held:     make(map[string]*cmd),
+			awaiting: make(map[string]*cmd),
+
+			artifactDir: *artifactDir,
+			maxArtifact: *maxArtifact,
+			hints:       &pollHints{active: *pollActive, idle: *pollIdle},
+		}
+		if !slices.Contains(dashboardThemes, *dashboardTheme) {
+			panic("dashboard-theme must be auto, light or dark")
+		}
+		if a.dashboard, err = newDashboard(*dashboardTheme); err != nil {
+			panic(err)
+		}
+		if a.openapi, err = json.Marshal(openAPI()); err != nil {
+			panic(err)
+		}
+		if *cosignersFile != "" {
+			if a.cosigners, err = loadCosigners(*cosignersFile, *cosignM); err != nil {
+				panic(err)
+			}
+			a.cosigning = make(map[string]*cmd)
+		}
+		if *delegateKey != "" {
+			name, key, err := loadSigner(*delegateKey)
+			if err != nil {
+				panic(err)
+			}
+			a.delegator = &delegator{name: name, key: key}
+		}
+		if err = a.updatePayload(); err != nil {
+			panic(err)
+		}
+		if len(sinks) > 0 {
+			ss := make([]sink, 0, len(sinks))
+			for _, spec := range sinks {
+				s, err := newSink(spec)
+				if err != nil {
+					panic(err)
+				}
+				ss = append(ss, s)
+			}
+			a.sinks = startSinks(ss)
+		}
+		if *metricsURL != "" {
+			if a.metrics, err = newMetrics(*metricsURL); err != nil {
+				panic(err)
+			}
+			a.lastSeen = make(map[string]time.Time)
+			go a.reportHealth()
+		}
+		for _, spec := range allow {
+			rule, err := parseAllow(spec)
+			if err != nil {
+				panic(err)
+			}
+			a.allow = append(a.allow, rule)
+		}
+		if *policyFile != "" {
+			if a.policy, err = loadPolicy(*policyFile); err != nil {
+				panic(err)
+			}
+		}
+		if *agentConfigFile != "" {
+			if a.configRules, err = loadConfigRules(*agentConfigFile); err != nil {
+				panic(err)
+			}
+			a.configs, a.drifted = make(map[string]*agentConfig), make(map[string]bool)
+		}
+		if *auditFile != "" {
+			if a.auditLog, err = openAudit(*auditFile); err != nil {
+				panic(err)
+			}
+			if *auditFile != "-" {
+				a.auditFile = *auditFile
+			}
+		}
+		if a.rbac, err = loadRBAC(*rbacFile); err != nil {
+			panic(err)
+		}
+		if err = a.rbac.grant(*oidcRoles); err != nil {
+			panic(err)
+		}
+		a.rbac.restricted = *rbacFile != "" || *oidcIssuer != "" || *oidcRoles != ""
+		if *oidcIssuer != "" {
+			if a.oidc, err = newOIDC(*oidcIssuer, *oidcAudience); err != nil {
+				panic(err)
+			}
+		}
+		if *natsURL != "" {
+			go a.serveNATS(*natsURL)
+		}
+		if *keySource != "" && *keyRefresh > 0 {
+			go a.renewKey(*keySource, *keyRefresh)
+		}
+		if *maxRunning < 0 || *maxRunningCmd < 0 || *slotTTL <= 0 {
+			panic("max-running and max-running-per-cmd must not be negative, and slot-ttl must be positive")
+		}
+		if *maxRunning > 0 || *maxRunningCmd > 0 {
+			a.budget = newBudget(*maxRunningCmd, *maxRunning, *slotTTL)
+		}
+		if *leaseTTL < 2*leaseRenew {
+			panic(fmt.Sprintf("lease-ttl must be at least %s, as agents renew leases every %s", 2*leaseRenew, leaseRenew))
+		}
+		shared, _ := a.store.(*redisStore)
+		a.leases = newLeases(*leaseTTL, shared)
+		if *maxConns < 0 {
+			panic("max-conns must not be negative")
+		}
+		if *offlineAfter < 0 {
+			panic("offline-after must not be negative")
+		}
+		if *offlineHook != "" && *offlineAfter == 0 {
+			panic("offline-callback needs offline-after")
+		}
+		if *hookSecret != "" {
+			sum := blake3.Sum256([]byte(*hookSecret))
+			a.hookHasher = blake3.New(32, sum[:])
+		}
+		if *offlineAfter > 0 {
+			if a.lastSeen == nil {
+				a.lastSeen = make(map[string]time.Time)
+			}
+			a.polls, a.offline = make(map[string]time.Duration), make(map[string]bool)
+			a.missed, a.offlineHook = *offlineAfter, *offlineHook
+			go a.detectOffline()
+		}
+		if *deadAfter > 0 {
+			if a.lastSeen == nil {
+				a.lastSeen = make(map[string]time.Time)
+			}
+			go a.deadLetterEvery(*deadAfter)
+		}
+		if r := (retention{age: *retainAge, results: *retainResults, size: *retainSize}); r.enabled() {
+			go a.pruneEvery(r)
+		}
+		go a.collectArtifacts()
+		a.reboots = make(map[string]*rebootWatch)
+		a.supervised = make(map[string][]*supervisedStatus)
+		a.pushes = make(map[string]*sync.Mutex)
+		go a.watchReboots()
+		if *debugAddr != "" {
+			if err = serveDebug(*debugAddr, a.debugVars); err != nil {
+				panic(err)
+			}
+		}
+		timeouts := serverTimeouts{read: *readTimeout, write: *writeTimeout, idle: *idleTimeout}
+		p, err := newProxy(a, *basePath, *trustedProxies, *corsOrigins)
 		if err != nil {
 			panic(err)
 		}
+		if err = listenAndServe(":1992", p, timeouts, *maxConns); err != nil {
+			panic(err)
+		}
 	case "obey":
-		var lastSum []byte
-		for {
-			time.Sleep(*poll)
-			resp, err := http.Get(*target)
+		if *showHistory {
+			entries, err := readJournal(*stateDir)
 			if err != nil {
-				fmt.Println(err)
-				continue
+				panic(err)
+			}
+			if *output == "json" {
+				printJSON(entries)
+				break
+			}
+			for _, e := range entries {
+				printJournalEntry(e)
+			}
+			break
+		}
+		st, err := openState(*stateDir, *takeover)
+		if err != nil {
+			panic(err)
+		}
+		st.journalSize = *journalSize
+		if *id, err = st.agentID(*id); err != nil {
+			panic(err)
+		}
+		if *maxConcurrent < 1 {
+			panic("max-concurrent must be at least 1")
+		}
+		if *once && *natsURL != "" {
+			panic("once and nats are mutually exclusive")
+		}
+		if *maxDownloadRate > 0 || *maxUploadRate > 0 {
+			// Requests to the server, and downloads of artifact urls.
+			t := &throttleTransport{http.DefaultTransport, newThrottle(*maxDownloadRate), newThrottle(*maxUploadRate)}
+			retrier.Base, http.DefaultClient.Transport = t, t
+		}
+		r, err := newRedactor(redact, *secrets)
+		if err != nil {
+			panic(err)
+		}
+		priv, err := loadIdentity(*identity)
+		if err != nil {
+			panic(err)
+		}
+		if *key == "" {
+			data, err := os.ReadFile(*keyFile)
+			switch {
+			case err == nil:
+				*key = strings.TrimSpace(string(data))
+			case os.IsNotExist(err) && *enrollToken != "":
+				if data, err = enroll(*target, *id, *enrollToken, priv, *poll); err != nil {
+					panic(err)
+				}
+				if err = os.WriteFile(*keyFile, data, 0600); err != nil {
+					panic(err)
+				}
+				*key = string(data)
+			default:
+				panic("missing key, and no -key-file or -enroll token")
+			}
+			keySum = blake3.Sum256([]byte(*key))
+		}
+		// An enrolled agent signs with its credential, not the key.
+		agentKey, credential := parseCredential(*key)
+		if !credential {
+			agentKey = keySum[:]
+		}
+		if credential && *natsURL != "" {
+			panic("enrolled agents cannot use -nats, as its commands are signed with the key")
+		}
+		if *pollMax > 0 && *pollMin > *pollMax {
+			panic("poll-min must not exceed poll-max")
+		}
+		ag := &agent{
+			id:         *id,
+			identity:   priv,
+			target:     *target,
+			poll:       *poll,
+			pollMin:    *pollMin,
+			pollMax:    *pollMax,
+			catchUp:    *catchUp,
+			key:        agentKey,
+			credential: credential,
+			workers:    *maxConcurrent,
+			redactor:   r,
+			once:       *once,
+			natsURL:    *natsURL,
+			state:      st,
+			channel:    *channel,
+			served:     st.served,
+			running:    make(map[string]*exec.Cmd),
+			supervisor: newSupervisor(),
+		}
+		ag.executors = newExecutors(ag)
+		if *cacheSize > 0 {
+			if *cacheDir == "" {
+				*cacheDir = filepath.Join(*stateDir, "artifacts")
+			}
+			ag.cache = &artifactCache{dir: *cacheDir, size: *cacheSize}
+		}
+		if *debugAddr != "" {
+			if err = serveDebug(*debugAddr, ag.debugVars); err != nil {
+				panic(err)
+			}
+		}
+		if *cosignersFile != "" {
+			if ag.cosigners, err = loadCosigners(*cosignersFile, *cosignM); err != nil {
+				panic(err)
+			}
+		}
+		if *delegatesFile != "" {
+			if ag.delegates, err = loadDelegates(*delegatesFile, *delegateClasses); err != nil {
+				panic(err)
+			}
+		}
+		if err := ag.obey(); err != nil {
+			panic(err)
+		}
+	case "simulate":
+		ids, err := simulatedIDs(*agents)
+		if err != nil {
+			panic(err)
+		}
+		simulate(ids, *target, *natsURL, keySum[:], *poll, *latency)
+	case "send":
+		targets := strings.Split(*target, ",")
+		for i := range targets {
+			targets[i] = strings.TrimSuffix(targets[i], "/")
+		}
+		argvs := [][]string{flag.Args()}
+		if *file != "" {
+			var err error
+			if argvs, err = readCommands(*file); err != nil {
+				panic(err)
+			}
+		}
+		usesVars := false
+		if *use != "" {
+			if *file != "" || flag.NArg() > 0 {
+				panic("use sends the args of the template, not those given")
 			}
-			c := &cmd{}
-			dec := json.NewDecoder(resp.Body)
-			err = dec.Decode(c)
+			values, err := parseLabels(params)
 			if err != nil {
-				fmt.Println(err)
-				continue
+				panic(err)
 			}
-			csum, err := hex.DecodeString(c.Sum)
+			t, err := getTemplate(*use, targets[0])
 			if err != nil {
-				fmt.Println(err)
-				continue
+				panic(err)
+			}
+			argv, vars, err := t.fill(values)
+			if err != nil {
+				panic(err)
+			}
+			argvs, usesVars = [][]string{argv}, vars
+			labels = append(labels, templateLabel+"="+*use)
+		}
+		if *upload != "" {
+			if *artifact != "" {
+				panic("artifact and upload are mutually exclusive")
 			}
-			if bytes.Equal(csum, lastSum) {
+			for _, t := range targets {
+				hash, err := uploadArtifact(*upload, hasher, t)
+				if err != nil {
+					panic(fmt.Errorf("%s: %w", t, err))
+				}
+				*digest = hash
+			}
+			fmt.Fprintf(os.Stderr, "artifact digest: %s\n", *digest)
+		}
+		artifactCmd := *artifact != "" || *upload != ""
+		noArgs := artifactCmd || *cmdType == rebootType
+		if len(argvs) == 0 || (len(argvs[0]) == 0 && !noArgs) {
+			panic("too few arguments to send command")
+		}
+		if *artifact != "" && *digest == "" {
+			var err error
+			if *digest, err = downloadArtifact(context.Background(), http.DefaultClient, *artifact, io.Discard); err != nil {
+				panic(err)
+			}
+			fmt.Fprintf(os.Stderr, "artifact digest: %s\n", *digest)
+		}
+		failed := false
+		sent := make([]*cmd, 0, len(argvs))
+		for _, argv := range argvs {
+			if len(argv) == 0 && !noArgs {
+				fmt.Println("empty command")
+				failed = true
 				continue
 			}
-			if err = verifyCmd(c, hasher, *poll); err != nil {
-				fmt.Println(err)
+			c := &cmd{
+				ID:      newID(),
+				Version: protocolVersion,
+				Trace:   *trace,
+				Channel: *channel,
+				Args:    make([]string, 0),
+				Agents:  make([]string, 0),
+				Created: time.Now(),
+			}
+			if *signal != "" {
+				c.Signal = strings.ToUpper(*signal)
+				c.Ref = argv[0]
+			} else if artifactCmd {
+				c.Type, c.Artifact, c.Digest = artifactType, *artifact, *digest
+				c.Args = append(c.Args, argv...)
+			} else if *cmdType != "" {
+				c.Type = *cmdType
+				c.Args = append(c.Args, argv...)
+				if c.Type == "script" {
+					if len(argv) != 1 {
+						panic("a script is a single JSON argument")
+					}
+					if _, err := parseScript(argv[0]); err != nil {
+						panic(err)
+					}
+				}
+			} else {
+				c.Name = argv[0]
+				c.Container = *container
+				c.Args = append(c.Args, argv[1:]...)
+			}
+			if *agents != "" {
+				c.Agents = strings.Split(*agents, ",")
+			}
+			if len(labels) > 0 {
+				var err error
+				if c.Labels, err = parseLabels(labels); err != nil {
+					panic(err)
+				}
+			}
+			if *callback != "" {
+				c.Hook = &hook{URL: *callback, Wait: *callbackWait}
+				if err := c.Hook.validate(); err != nil {
+					panic(err)
+				}
+			}
+			if err := c.setWindow(*notBefore, *notAfter); err != nil {
+				panic(err)
+			}
+			if *queue && c.NotAfter.IsZero() {
+				c.NotAfter = time.Now().Add(*queueTTL)
+			}
+			c.Template = *templateCmd || usesVars
+			c.JSON = *jsonData
+			c.Delivery = *delivery
+			c.LocalHours = *localHours
+			c.Priority = *priority
+			if *after != "" {
+				c.After = strings.Split(*after, ",")
+			}
+			if *await != "" {
+				c.Await = strings.Split(*await, ",")
+			}
+			c.Lock = *lock
+			if *sealCmd {
+				if hasher == nil {
+					panic("sealing needs -key to verify the agents' identity keys")
+				}
+				if err := seal(c, hasher, targets[0]); err != nil {
+					panic(err)
+				}
+			}
+			if *verifyURL != "" || *verifyCmd != "" {
+				c.Verify = &check{
+					URL:   *verifyURL,
+					Cmd:   strings.Fields(*verifyCmd),
+					Code:  *verifyCode,
+					Match: *verifyMatch,
+					Wait:  *verifyWait,
+				}
+			}
+			if *expectCode >= 0 || *expectMatch != "" || len(expectJSON) > 0 {
+				m, err := parseExpectJSON(expectJSON)
+				if err != nil {
+					panic(err)
+				}
+				c.Expect = &expect{Code: max(*expectCode, 0), Match: *expectMatch, JSON: m}
+				if err = c.Expect.validate(); err != nil {
+					panic(err)
+				}
+			}
+			if *signerKey != "" {
+				if c.NotAfter.IsZero() {
+					c.NotAfter = time.Now().Add(cosignWindow)
+				}
+				name, priv, err := loadSigner(*signerKey)
+				if err != nil {
+					panic(err)
+				}
+				c.Cosigs = append(c.Cosigs, cosign(c, name, priv))
+			}
+			errs := fanOut(c, hasher, targets)
+			if *queue {
+				if err := queueUnreachable(*queueDir, c, targets, errs); err != nil {
+					panic(err)
+				}
+			}
+			if !printSent(c, targets, errs, *output) {
+				failed = true
 				continue
 			}
-			lastSum = csum
-			fmt.Printf("will execute: %+v\n", c)
-			oscmd := exec.Command(c.Name, c.Args...)
-			out, err := oscmd.Output()
-			if out != nil {
-				fmt.Println(string(out))
-				postLogMsg(string(out), hasher, *target)
+			sent = append(sent, c)
+		}
+		code := 0
+		if *wait > 0 {
+			deadline := time.Now().Add(*wait)
+			for _, c := range sent {
+				results := waitResults(c, targets, deadline)
+				if *output == "json" {
+					printJSON(results)
+				} else {
+					for _, res := range results {
+						printResult(res)
+					}
+					if c.Expect != nil {
+						printAssertions(c, results)
+					}
+				}
+				if rc := exitCode(c, results); code == 0 {
+					code = rc
+				}
+			}
+		}
+		if code == 0 && failed {
+			code = 1
+		}
+		os.Exit(code)
+	case "promote":
+		if flag.NArg() != 1 {
+			panic("promote mode needs a command id")
+		}
+		if *from != "" || *to != "" {
+			if *from == "" || *to == "" {
+				panic("promoting between namespaces needs -from and -to")
+			}
+			targets := strings.Split(*target, ",")
+			var ids []string
+			if *agents != "" {
+				ids = strings.Split(*agents, ",")
 			}
+			cmds, err := promoteNamespace(flag.Arg(0), *from, *to, ids, *trace, targets[0])
 			if err != nil {
-				fmt.Println(err)
-				postLogMsg(err.Error(), hasher, *target)
+				panic(err)
 			}
+			for _, c := range cmds {
+				if !printSent(c, targets, fanOut(c, hasher, targets), *output) {
+					os.Exit(1)
+				}
+			}
+			break
 		}
-	case "send":
-		if flag.NArg() == 0 {
-			panic("too few arguments to send command")
+		if *channel == "" {
+			*channel = stableChannel
+		}
+		targets := strings.Split(*target, ",")
+		c, err := promote(flag.Arg(0), *channel, *trace, targets[0])
+		if err != nil {
+			panic(err)
 		}
+		if !printSent(c, targets, fanOut(c, hasher, targets), *output) {
+			os.Exit(1)
+		}
+	case "ping":
+		targets := strings.Split(*target, ",")
 		c := &cmd{
-			Name:    flag.Arg(0),
+			ID:      newID(),
+			Type:    pingType,
+			Version: protocolVersion,
+			Trace:   *trace,
 			Args:    make([]string, 0),
+			Agents:  make([]string, 0),
 			Created: time.Now(),
 		}
-		if flag.NArg() > 1 {
-			c.Args = append(c.Args, flag.Args()[1:]...)
+		if *agents != "" {
+			c.Agents = strings.Split(*agents, ",")
+		}
+		if !printSent(c, targets, fanOut(c, hasher, targets), *output) {
+			os.Exit(1)
+		}
+		if *wait == 0 {
+			*wait = 2 * *poll
+		}
+		results := waitResults(c, targets, time.Now().Add(*wait))
+		reports := make([]*pingReport, len(results))
+		for i, res := range results {
+			reports[i] = newPingReport(c, res)
+		}
+		if *output == "json" {
+			printJSON(reports)
+		} else {
+			for _, l := range reports {
+				printPingReport(l)
+			}
+		}
+		os.Exit(exitCode(c, results))
+	case "query":
+		if flag.NArg() == 0 {
+			panic("too few arguments to query")
+		}
+		targets := strings.Split(*target, ",")
+		c := &cmd{
+			ID:      newID(),
+			Type:    *cmdType,
+			Version: protocolVersion,
+			Trace:   *trace,
+			Args:    flag.Args(),
+			Agents:  make([]string, 0),
+			Created: time.Now(),
+		}
+		if c.Type == "" {
+			c.Name, c.Args = flag.Arg(0), flag.Args()[1:]
+		}
+		if *agents != "" {
+			c.Agents = strings.Split(*agents, ",")
+		}
+		c.JSON = *jsonData || *dataPath != ""
+		errs := fanOut(c, hasher, targets)
+		for i, err := range errs {
+			if err != nil {
+				fmt.Printf("%s: %s\n", targets[i], err)
+			}
+		}
+		if *wait == 0 {
+			*wait = 2 * *poll
+		}
+		results := waitResults(c, targets, time.Now().Add(*wait))
+		answers := groupAnswers(results, *dataPath)
+		if *output == "json" {
+			printJSON(answers)
+		} else {
+			printAnswers(c, answers, len(results))
+		}
+	case "apply":
+		if *file == "" {
+			panic("apply mode needs -f")
+		}
+		m, err := loadManifest(*file)
+		if err != nil {
+			panic(err)
+		}
+		cmds, err := m.apply(hasher, *target, *trace)
+		for _, c := range cmds {
+			if *output == "json" {
+				printSent(c, []string{*target}, []error{nil}, *output)
+			} else {
+				fmt.Printf("%s: %s %s [%s]\n", c.ID, c.Name, strings.Join(c.Args, " "), strings.Join(c.Agents, ","))
+			}
+		}
+		if err != nil {
+			panic(err)
+		}
+	case "result":
+		if flag.NArg() == 0 {
+			panic("too few arguments to get result")
+		}
+		if *dataPath != "" {
+			values, err := getData(flag.Arg(0), *dataPath, *target)
+			if err != nil {
+				panic(err)
+			}
+			if *output == "json" {
+				printJSON(values)
+				break
+			}
+			for _, v := range values {
+				fmt.Printf("%s: %s\n", v.Agent, v.Value)
+			}
+			break
+		}
+		results, err := getResults(flag.Arg(0), *target)
+		if err != nil {
+			panic(err)
+		}
+		if *output == "json" {
+			printJSON(results)
+			break
+		}
+		for _, res := range results {
+			printResult(res)
+		}
+	case "logs":
+		var patterns []string
+		if *agents != "" {
+			patterns = strings.Split(*agents, ",")
+		}
+		f, err := newFollower(os.Stdout, patterns, *raw)
+		if err != nil {
+			panic(err)
+		}
+		var deadline time.Time
+		if *wait > 0 {
+			deadline = time.Now().Add(*wait)
+		}
+		f.follow(flag.Args(), time.Now(), *target, deadline)
+	case "approve":
+		if flag.NArg() == 0 {
+			panic("too few arguments to approve command")
+		}
+		for _, id := range flag.Args() {
+			if err := approve(id, *target); err != nil {
+				panic(err)
+			}
+			fmt.Printf("%s: approved\n", id)
+		}
+	case "cosign":
+		switch flag.Arg(0) {
+		case "keygen":
+			if flag.NArg() != 2 || *signerKey == "" {
+				panic("keygen needs -signer-key and a name")
+			}
+			line, err := newSigner(*signerKey, flag.Arg(1))
+			if err != nil {
+				panic(err)
+			}
+			fmt.Println(line)
+		case "list", "":
+			cmds, err := getCosigning(*target)
+			if err != nil {
+				panic(err)
+			}
+			for _, c := range cmds {
+				printCosigning(c)
+			}
+		default:
+			name, priv, err := loadSigner(*signerKey)
+			if err != nil {
+				panic(err)
+			}
+			cmds, err := getCosigning(*target)
+			if err != nil {
+				panic(err)
+			}
+			for _, id := range flag.Args() {
+				var c *cmd
+				for _, pending := range cmds {
+					if pending.ID == id {
+						c = pending
+					}
+				}
+				if c == nil {
+					panic(id + " is not awaiting cosigners")
+				}
+				printCosigning(c)
+				state, err := postCosig(id, cosign(c, name, priv), *target)
+				if err != nil {
+					panic(err)
+				}
+				fmt.Printf("%s: %s\n", id, state)
+			}
 		}
-		c.Sum = hex.EncodeToString(signCmd(c, hasher))
-		payload, err := json.Marshal(c)
+	case "history":
+		cmds, err := getCommands(labels, *target)
 		if err != nil {
 			panic(err)
 		}
-		buf := bytes.NewBuffer(payload)
-		resp, err := http.Post(*target+"/cmd", "application/json", buf)
+		if *output == "json" {
+			printJSON(cmds)
+			break
+		}
+		for _, c := range cmds {
+			printCommand(c)
+		}
+	case "artifacts":
+		switch flag.Arg(0) {
+		case "list", "":
+			artifacts, err := getArtifacts(*target)
+			if err != nil {
+				panic(err)
+			}
+			if *output == "json" {
+				printJSON(artifacts)
+				break
+			}
+			for _, art := range artifacts {
+				printArtifact(art)
+			}
+		case "upload":
+			for _, path := range flag.Args()[1:] {
+				hash, err := uploadArtifact(path, hasher, *target)
+				if err != nil {
+					panic(err)
+				}
+				fmt.Printf("%s: %s\n", path, hash)
+			}
+		default:
+			panic("artifacts takes list or upload")
+		}
+	case "install-service":
+		if flag.Arg(0) != "" && flag.Arg(0) != "print" {
+			panic("install-service takes no argument, or print")
+		}
+		if err := installService(flag.Arg(0) == "print"); err != nil {
+			panic(err)
+		}
+	case "schema":
+		doc := wireSchema()
+		switch flag.Arg(0) {
+		case "", "wire":
+		case "openapi":
+			doc = openAPI()
+		default:
+			panic("schema takes wire or openapi")
+		}
+		data, err := json.MarshalIndent(doc, "", "\t")
 		if err != nil {
 			panic(err)
 		}
-		respBody, err := io.ReadAll(resp.Body)
+		fmt.Println(string(data))
+	case "export":
+		if err := export(*from, *to, *format, *target, os.Stdout); err != nil {
+			panic(err)
+		}
+	case "flush":
+		ok, err := flush(*queueDir)
+		if err != nil {
+			panic(err)
+		}
+		if !ok {
+			os.Exit(1)
+		}
+	case "vars":
+		req := &adminRequest{Action: flag.Arg(0), Name: flag.Arg(1), Value: flag.Arg(2)}
+		switch req.Action {
+		case "list", "":
+			req.Action = "list"
+			vars := make([]*variable, 0)
+			if err := postAdmin("/vars", req, hasher, *target, &vars); err != nil {
+				panic(err)
+			}
+			if *output == "json" {
+				printJSON(vars)
+				break
+			}
+			for _, v := range vars {
+				printVar(v)
+			}
+		case "set", "delete":
+			var key string
+			if err := postAdmin("/vars", req, hasher, *target, &key); err != nil {
+				panic(err)
+			}
+			if req.Action == "delete" {
+				fmt.Printf("%s: deleted\n", key)
+			} else {
+				fmt.Printf("%s: set\n", key)
+			}
+		default:
+			panic("vars mode needs list, set or delete")
+		}
+	case "templates":
+		switch flag.Arg(0) {
+		case "list", "":
+			templates, err := getTemplates(*target)
+			if err != nil {
+				panic(err)
+			}
+			if *output == "json" {
+				printJSON(templates)
+				break
+			}
+			for _, t := range templates {
+				printTemplate(t)
+			}
+		case "create", "set":
+			if flag.NArg() < 3 {
+				panic("templates mode needs a name and a command line to create a template")
+			}
+			argv, err := json.Marshal(flag.Args()[2:])
+			if err != nil {
+				panic(err)
+			}
+			var name string
+			req := &adminRequest{Action: "set", Name: flag.Arg(1), Value: string(argv)}
+			if err = postAdmin("/templates", req, hasher, *target, &name); err != nil {
+				panic(err)
+			}
+			fmt.Printf("%s: set\n", name)
+		case "delete":
+			var name string
+			req := &adminRequest{Action: "delete", Name: flag.Arg(1)}
+			if err := postAdmin("/templates", req, hasher, *target, &name); err != nil {
+				panic(err)
+			}
+			fmt.Printf("%s: deleted\n", name)
+		default:
+			panic("templates mode needs list, create or delete")
+		}
+	case "dlq":
+		switch flag.Arg(0) {
+		case "list", "":
+			letters, err := getDeadLetters(hasher, *target)
+			if err != nil {
+				panic(err)
+			}
+			if *output == "json" {
+				printJSON(letters)
+				break
+			}
+			for _, d := range letters {
+				printDeadLetter(d)
+			}
+		case "retry":
+			for _, id := range flag.Args()[1:] {
+				retry, err := retryDeadLetters(id, hasher, *target)
+				if err != nil {
+					panic(err)
+				}
+				fmt.Printf("%s: retried as %s\n", id, retry)
+			}
+		default:
+			panic("dlq mode needs list or retry")
+		}
+	case "token":
+		req := &adminRequest{Action: flag.Arg(0)}
+		switch req.Action {
+		case "create":
+			req.Scopes, req.TTL = strings.Split(*scope, ","), *ttl
+			created := &tokenCreated{}
+			if err := postAdmin("/tokens", req, hasher, *target, created); err != nil {
+				panic(err)
+			}
+			fmt.Printf("%s: expires %s\n%s\n", created.ID, created.Expires.Format(time.RFC3339), created.Token)
+		case "list":
+			tokens := make([]*apiToken, 0)
+			if err := postAdmin("/tokens", req, hasher, *target, &tokens); err != nil {
+				panic(err)
+			}
+			printTokens(tokens)
+		case "revoke":
+			for _, id := range flag.Args()[1:] {
+				req.ID = id
+				if err := postAdmin("/tokens", req, hasher, *target, new(string)); err != nil {
+					panic(err)
+				}
+				fmt.Printf("%s: revoked\n", id)
+			}
+		default:
+			panic("token mode needs create, list or revoke")
+		}
+	case "enroll", "agents":
+		req := &adminRequest{Action: flag.Arg(0)}
+		switch req.Action {
+		case "status":
+			agents, err := getAgents(flag.Arg(1), *target)
+			if err != nil {
+				panic(err)
+			}
+			if *output == "json" {
+				printJSON(agents)
+				break
+			}
+			printAgents(agents)
+		case "list":
+			enrollments := make([]*enrollment, 0)
+			if err := postAdmin("/enrollments", req, hasher, *target, &enrollments); err != nil {
+				panic(err)
+			}
+			printEnrollments(enrollments)
+		case "approve", "reject", "revoke":
+			for _, agent := range flag.Args()[1:] {
+				req.ID = agent
+				state := ""
+				if err := postAdmin("/enrollments", req, hasher, *target, &state); err != nil {
+					panic(err)
+				}
+				fmt.Printf("%s: %s\n", agent, state)
+			}
+		default:
+			panic(*mode + " mode needs list, approve, reject, revoke or status")
+		}
+	case "secret":
+		if flag.NArg() == 0 || *agents == "" {
+			panic("secret mode needs a name and -agents")
+		}
+		value, err := io.ReadAll(os.Stdin)
 		if err != nil {
 			panic(err)
 		}
-		fmt.Println(string(respBody))
+		value = bytes.TrimRight(value, "\r\n")
+		if err = pushSecret(flag.Arg(0), value, strings.Split(*agents, ","), hasher, *target); err != nil {
+			panic(err)
+		}
+	case "gitops":
+		if *repo == "" {
+			panic("gitops mode needs -repo")
+		}
+		if err := gitops(*repo, *poll, hasher, *target); err != nil {
+			panic(err)
+		}
+	case "push":
+		if flag.NArg() == 0 {
+			panic("too few arguments to push file")
+		}
+		name := filepath.Base(flag.Arg(0))
+		if flag.NArg() > 1 {
+			name = flag.Arg(1)
+		}
+		if *chunk <= 0 || *chunk > maxChunk {
+			panic("invalid chunk size")
+		}
+		if err := push(flag.Arg(0), name, *target, *chunk, *rate, hasher); err != nil {
+			panic(err)
+		}
+	case "pull":
+		if flag.NArg() == 0 {
+			panic("too few arguments to pull file")
+		}
+		path := flag.Arg(0)
+		if flag.NArg() > 1 {
+			path = flag.Arg(1)
+		}
+		if *chunk <= 0 || *chunk > maxChunk {
+			panic("invalid chunk size")
+		}
+		if err := pull(flag.Arg(0), path, *target, *chunk, *rate, hasher); err != nil {
+			panic(err)
+		}
 	default:
 		panic("unrecognised mode " + *mode)
 	}
 }
 
+func submit(c *cmd, h *blake3.Hasher, target string) (string, error) {
+	errs := fanOut(c, h, []string{target})
+	return c.ID, errs[0]
+}
+
+// fanOut signs c once and posts it to every target in parallel, returning
+// the error for each target. Without a hasher, c is posted unsigned for
+// the server to sign.
+func fanOut(c *cmd, h *blake3.Hasher, targets []string) []error {
+	errs := make([]error, len(targets))
+	if h != nil {
+		c.Sum = hex.EncodeToString(signCmd(c, h))
+	}
+	payload, err := json.Marshal(c)
+	if err != nil {
+		for i := range errs {
+			errs[i] = err
+		}
+		return errs
+	}
+	wg := &sync.WaitGroup{}
+	for i, target := range targets {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = postCmd(payload, target)
+		}()
+	}
+	wg.Wait()
+	return errs
+}
+
+func postCmd(payload []byte, target string) error {
+	resp, err := client.Post(target+"/cmd", "application/json", bytes.NewBuffer(payload))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusAccepted {
+		fmt.Fprintf(os.Stderr, "%s: held until approved, cosigned or the commands it awaits succeed\n", target)
+		return nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return responseError(resp)
+	}
+	return nil
+}
+
 func postLogMsg(msg string, h *blake3.Hasher, target string) error {
-	l := &log{Msg: msg, Created: time.Now()}
+	l := &log{Msg: msg, Version: protocolVersion, Created: time.Now()}
 	l.Sum = hex.EncodeToString(signLog(l, h))
 	payload, err := json.Marshal(l)
 	if err != nil {
 		return err
 	}
 	buf := bytes.NewBuffer(payload)
-	resp, err := http.Post(target+"/log", "application/json", buf)
+	resp, err := client.Post(target+"/log", "application/json", buf)
 	if err != nil {
 		return err
 	}
+	defer resp.Body.Close()
 	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("got non-ok status code: %d", resp.StatusCode)
+		return responseError(resp)
 	}
 	return nil
 }
 
 func (a *app) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set(versionHeader, strconv.Itoa(protocolVersion))
+	if t := r.Header.Get(traceHeader); t != "" {
+		w.Header().Set(traceHeader, t)
+	}
+	debugf("%s %s %s\n", r.RemoteAddr, r.Method, r.URL.Path)
+	if !a.allowed(r) {
+		httpError(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	// Requests without the header come from clients that predate versioning,
+	// or from curl. Unversioned commands and logs are rejected by validation.
+	if r.Header.Get(versionHeader) != "" {
+		if err := headerVersion(r.Header); err != nil {
+			httpError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if strings.HasPrefix(r.URL.Path, "/file/") {
+		a.handleFile(w, r)
+		return
+	}
+	if r.URL.Path == "/artifacts" || strings.HasPrefix(r.URL.Path, "/artifacts/") {
+		a.handleArtifacts(w, r)
+		return
+	}
 	switch r.Method {
 	case "GET":
+		if strings.HasPrefix(r.URL.Path, "/commands/") && strings.HasSuffix(r.URL.Path, "/results") {
+			a.handleGetResults(w, r)
+			return
+		}
+		if strings.HasPrefix(r.URL.Path, "/agents/") {
+			a.handleGetAgent(w, r)
+			return
+		}
+		if strings.HasPrefix(r.URL.Path, "/enroll/") {
+			a.handleGetEnrollment(w, r)
+			return
+		}
+		if r.URL.Path == "/agents" {
+			a.handleGetAgents(w, r)
+			return
+		}
+		if r.URL.Path == "/logs" {
+			a.handleGetLogs(w, r)
+			return
+		}
+		if r.URL.Path == "/commands" {
+			a.handleGetCommands(w, r)
+			return
+		}
+		if r.URL.Path == "/export" {
+			a.handleExport(w, r)
+			return
+		}
+		if r.URL.Path == "/held" {
+			a.handleGetHeld(w, r)
+			return
+		}
+		if r.URL.Path == "/cosign" {
+			a.handleGetCosigning(w, r)
+			return
+		}
+		if r.URL.Path == "/awaiting" {
+			a.handleGetAwaiting(w, r)
+			return
+		}
+		if r.URL.Path == "/leases" {
+			a.handleGetLeases(w, r)
+			return
+		}
+		if r.URL.Path == "/templates" {
+			a.handleGetTemplates(w, r)
+			return
+		}
+		if r.URL.Path == "/dashboard" || strings.HasPrefix(r.URL.Path, "/dashboard/") {
+			a.dashboard.ServeHTTP(w, r)
+			return
+		}
+		if r.URL.Path == "/openapi.json" {
+			a.handleOpenAPI(w, r)
+			return
+		}
+		a.mu.Lock()
+		defer a.mu.Unlock()
+		agent, h, signed, err := a.pollingAgent(r)
+		switch {
+		case errors.Is(err, errUnsignedPoll):
+			httpError(w, err.Error(), http.StatusUnauthorized)
+			return
+		case err != nil:
+			httpError(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if agent != "" {
+			if a.revoked(agent) {
+				refuseAgent(w, agent)
+				return
+			}
+			a.seen(agent)
+			a.polled(agent, r.Header.Get(pollHeader))
+			a.supervising(agent, r.Header.Get(supervisedHeader))
+			a.reported(w, agent, r.Header.Get(configHeader))
+			if signed {
+				a.acked(agent, r.Header.Get(ackHeader))
+			}
+		}
+		// Other servers may have queued commands in a shared store.
+		if _, shared := a.store.(*redisStore); shared {
+			if err := a.updatePayload(); err != nil {
+				httpError(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+		// Enrolled agents verify the queue with their credential, as they
+		// do not hold the key the commands were signed with.
+		a.signPoll(w, a.hints.hint(time.Now()), h)
+		if len(a.payload) == 0 {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
 		w.Write(a.payload)
 	case "POST":
+		if strings.HasPrefix(r.URL.Path, "/commands/") && strings.HasSuffix(r.URL.Path, "/approve") {
+			a.handleApprove(w, r)
+			return
+		}
+		if strings.HasPrefix(r.URL.Path, "/commands/") && strings.HasSuffix(r.URL.Path, "/cosign") {
+			a.handleCosign(w, r)
+			return
+		}
 		switch r.URL.Path {
 		case "/cmd":
 			a.handlePostCmd(w, r)
 		case "/log":
 			a.handlePostLog(w, r)
+		case "/result":
+			a.handlePostResult(w, r)
+		case "/key":
+			a.handlePostKey(w, r)
+		case "/secret":
+			a.handlePostSecret(w, r)
+		case "/tokens":
+			a.handleTokens(w, r)
+		case "/enroll":
+			a.handleEnroll(w, r)
+		case "/enrollments":
+			a.handleEnrollments(w, r)
+		case "/deadletters":
+			a.handleDeadLetters(w, r)
+		case "/vars":
+			a.handleVars(w, r)
+		case "/templates":
+			a.handleTemplates(w, r)
+		case "/slots":
+			a.handleSlot(w, r)
+		case "/leases":
+			a.handleLease(w, r)
+		default:
+			httpError(w, "not found", http.StatusNotFound)
 		}
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		httpError(w, "method not allowed", http.StatusMethodNotAllowed)
 	}
 }
 
 func (a *app) handlePostCmd(w http.ResponseWriter, r *http.Request) {
-	dec := json.NewDecoder(r.Body)
 	c := &cmd{}
-	err := dec.Decode(c)
+	if !decode(w, r, c) {
+		return
+	}
+	op, err := a.operator(r)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		httpError(w, err.Error(), http.StatusUnauthorized)
 		return
 	}
-	err = verifyCmd(c, a.hasher, 200*time.Millisecond)
+	if op != nil {
+		if err = a.rbac.canSend(op, c); err != nil {
+			httpError(w, err.Error(), http.StatusForbidden)
+			return
+		}
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if op != nil {
+		// Only the server records who approved a command.
+		c.Operator, c.Approver = op.Name, ""
+		if c.Trace == "" {
+			c.Trace = r.Header.Get(traceHeader)
+		}
+		c.Created = time.Now()
+		if a.policy != nil && c.NotAfter.IsZero() {
+			// A window that never closes is held by agents forever.
+			def, max := a.policy.validity(c)
+			if def == 0 && (!c.NotBefore.IsZero() || c.LocalHours != "") {
+				def = max
+			}
+			if def > 0 {
+				c.NotAfter = c.Created.Add(def)
+			}
+		}
+		if a.cosigners != nil && c.NotAfter.IsZero() {
+			c.NotAfter = c.Created.Add(cosignWindow)
+		}
+		c.Sum = hex.EncodeToString(signCmd(c, a.hasher))
+	}
+	// Commands with a window may have been queued offline by the sender, so
+	// are accepted late, but only once.
+	ttl := 200 * time.Millisecond
+	if !c.NotAfter.IsZero() {
+		ttl = 0
+		if a.submitted(c.ID) {
+			httpError(w, c.ID+" was already submitted", http.StatusConflict)
+			return
+		}
+	}
+	err = verifyCmd(c, a.hasher, ttl)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusUnauthorized)
+		httpError(w, err.Error(), http.StatusUnauthorized)
 		return
 	}
-	a.payload, err = json.Marshal(c)
+	rule, err := a.admit(c)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		httpError(w, err.Error(), http.StatusForbidden)
 		return
 	}
-	w.Write([]byte("ok"))
+	if c.Template {
+		vars, err := a.store.vars()
+		if err == nil {
+			_, err = materialize(c, vars, a.hasher, nil)
+		}
+		if err != nil {
+			httpError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if op != nil && a.rbac.dangerous(c) {
+		if len(a.held) >= maxPending {
+			httpError(w, "too many commands awaiting approval", http.StatusServiceUnavailable)
+			return
+		}
+		a.held[c.ID] = c
+		a.audit("held", c, rule, nil)
+		w.WriteHeader(http.StatusAccepted)
+		w.Write([]byte(c.ID))
+		fmt.Printf("%s: %s %s held for approval\n", c.Created, op.Name, c.ref())
+		return
+	}
+	if a.awaitCosign(w, c, rule) || a.await(w, c, rule) {
+		return
+	}
+	if err = a.enqueue(c); err != nil {
+		httpError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	a.audit("accepted", c, rule, nil)
+	w.Write([]byte(c.ID))
+}
+
+// submitted reports whether a command with id is queued, held, or awaiting
+// cosigners or other commands.
+func (a *app) submitted(id string) bool {
+	if a.held[id] != nil || a.cosigning[id] != nil || a.awaiting[id] != nil {
+		return true
+	}
+	cmds, _ := a.store.cmds()
+	for _, c := range cmds {
+		if c.ID == id {
+			return true
+		}
+	}
+	return false
+}
+
+// admit refuses commands for revoked agents, and applies the policy to c,
+// auditing rejections. It returns the deciding rule.
+func (a *app) admit(c *cmd) (string, error) {
+	if err := a.refuseRevoked(c); err != nil {
+		a.audit("rejected", c, "", err)
+		return "", err
+	}
+	if a.policy == nil {
+		return "", nil
+	}
+	rule, err := a.policy.admit(c, time.Now())
+	if err != nil {
+		a.audit("rejected", c, rule, err)
+	}
+	return rule, err
+}
+
+// enqueue stores c for delivery to agents.
+func (a *app) enqueue(c *cmd) error {
+	err := a.store.addCmd(c)
+	if err == nil {
+		err = a.updatePayload()
+	}
+	if err != nil {
+		return err
+	}
+	if c.Hook != nil {
+		a.watch(c)
+	}
+	if a.nats != nil {
+		vars, err := a.store.vars()
+		if err == nil {
+			c, err = materialize(c, vars, a.hasher, a.delegator)
+		}
+		if err == nil {
+			err = a.nats.publishCmd(c)
+		}
+		if err != nil {
+			fmt.Println(err)
+		}
+	}
+	return nil
+}
+
+// updatePayload caches the queued commands served to agents, which is
+// empty if there are none.
+func (a *app) updatePayload() error {
+	cmds, err := a.store.cmds()
+	if err == nil {
+		cmds, err = a.materializeAll(cmds)
+	}
+	if err != nil || len(cmds) == 0 {
+		a.payload = nil
+		return err
+	}
+	a.hints.queued(cmds)
+	a.payload, err = json.Marshal(cmds)
+	return err
 }
 
 func (a *app) handlePostLog(w http.ResponseWriter, r *http.Request) {
-	dec := json.NewDecoder(r.Body)
 	l := &log{}
-	err := dec.Decode(l)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	if !decode(w, r, l) {
 		return
 	}
-	err = verifyLog(l, a.hasher, 200*time.Millisecond)
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	err := verifyLog(l, a.hasher, 200*time.Millisecond)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusUnauthorized)
+		httpError(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	if err = a.store.addLog(l); err != nil {
+		httpError(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 	w.Write([]byte("ok"))
 	fmt.Printf("%s: %s\n%s\n", l.Created, r.RemoteAddr, l.Msg)
+	a.forward(&entry{Kind: "log", Msg: l.Msg, Time: l.Created})
 }
 
+// handleGetLogs lists the stored logs, oldest first, created after the
+// since parameter if given, so clients can follow them.
+func (a *app) handleGetLogs(w http.ResponseWriter, r *http.Request) {
+	if !a.viewer(w, r, "logs") {
+		return
+	}
+	var since time.Time
+	if s := r.URL.Query().Get("since"); s != "" {
+		var err error
+		if since, err = time.Parse(time.RFC3339Nano, s); err != nil {
+			httpError(w, "since must be an RFC 3339 time", http.StatusBadRequest)
+			return
+		}
+	}
+	a.mu.Lock()
+	logs, err := a.store.logs()
+	a.mu.Unlock()
+	if err != nil {
+		httpError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	found := make([]*log, 0)
+	for _, l := range logs {
+		if l.Created.After(since) {
+			found = append(found, l)
+		}
+	}
+	payload, err := json.Marshal(found)
+	if err != nil {
+		httpError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write(payload)
+}
+
+// signCmd hashes the fields of c. Every field is written, strings framed
+// with their length and lists with their count, so no field can run into
+// the next: args cannot pass for agents, nor one optional field for another.
 func signCmd(c *cmd, h *blake3.Hasher) []byte {
 	h.Reset()
+	h.Write(vtb(c.Version))
 	h.Write(ttb(c.Created))
-	h.Write([]byte(c.Name))
-	for _, arg := range c.Args {
-		h.Write([]byte(arg))
+	h.Write(stb(c.ID))
+	h.Write(stb(c.Type))
+	h.Write(stb(c.Name))
+	writeList(h, c.Args)
+	writeList(h, c.Agents)
+	writeList(h, c.Env)
+	h.Write(vtb(int(c.Timeout)))
+	h.Write(stb(c.Signal))
+	h.Write(stb(c.Ref))
+	h.Write(stb(c.Container))
+	h.Write(stb(c.Operator))
+	h.Write(stb(c.Approver))
+	h.Write(stb(c.Artifact))
+	h.Write(stb(c.Digest))
+	h.Write(ttb(c.NotBefore))
+	h.Write(ttb(c.NotAfter))
+	h.Write(stb(c.Trace))
+	h.Write(stb(c.Channel))
+	h.Write(stb(c.Promoted))
+	h.Write(jtb(c.Verify))
+	h.Write(jtb(c.Expect))
+	writeLabels(h, c.Labels)
+	h.Write(jtb(c.Hook))
+	h.Write(vtb(len(c.Sealed)))
+	for _, box := range c.Sealed {
+		h.Write(stb(box.Agent))
+		h.Write(stb(box.Ephemeral))
+		h.Write(stb(box.Data))
 	}
+	h.Write(btb(c.Template))
+	h.Write(btb(c.JSON))
+	h.Write(stb(c.Delivery))
+	h.Write(stb(c.LocalHours))
+	h.Write(vtb(c.Priority))
+	writeList(h, c.After)
+	writeList(h, c.Await)
+	h.Write(stb(c.Lock))
 	return h.Sum(nil)
 }
 
+// verifyCmd checks the signature of c, if h is not nil, and its age if ttl
+// is positive.
 func verifyCmd(c *cmd, h *blake3.Hasher, ttl time.Duration) error {
-	if time.Since(c.Created) > ttl {
+	if ttl > 0 && time.Since(c.Created) > ttl {
 		return errors.New("payload expired")
 	}
+	if h == nil {
+		return nil
+	}
 	csum, err := hex.DecodeString(c.Sum)
 	if err != nil {
 		return fmt.Errorf("failed to decode sig hex: %w", err)
@@ -225,8 +1795,9 @@ func verifyCmd(c *cmd, h *blake3.Hasher, ttl time.Duration) error {
 
 func signLog(l *log, h *blake3.Hasher) []byte {
 	h.Reset()
+	h.Write(vtb(l.Version))
 	h.Write(ttb(l.Created))
-	h.Write([]byte(l.Msg))
+	h.Write(stb(l.Msg))
 	return h.Sum(nil)
 }
 
@@ -244,9 +1815,52 @@ func verifyLog(l *log, h *blake3.Hasher, ttl time.Duration) error {
 	return nil
 }
 
+func newID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
 func ttb(t time.Time) []byte {
 	milli := t.UnixNano() / 1000000
 	bytes := make([]byte, 8)
 	binary.LittleEndian.PutUint64(bytes, uint64(milli))
 	return bytes
 }
+
+func vtb(v int) []byte {
+	bytes := make([]byte, 8)
+	binary.LittleEndian.PutUint64(bytes, uint64(v))
+	return bytes
+}
+
+// stb frames s with its length.
+func stb(s string) []byte {
+	return append(vtb(len(s)), s...)
+}
+
+func btb(b bool) []byte {
+	if b {
+		return []byte{1}
+	}
+	return []byte{0}
+}
+
+// jtb frames the compact JSON of v, or nothing if v is a nil pointer.
+func jtb(v any) []byte {
+	data, _ := json.Marshal(v)
+	if string(data) == "null" {
+		data = nil
+	}
+	return stb(string(data))
+}
+
+// writeList hashes the count of list, then each of its elements framed.
+func writeList(h *blake3.Hasher, list []string) {
+	h.Write(vtb(len(list)))
+	for _, s := range list {
+		h.Write(stb(s))
+	}
+}
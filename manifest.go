@@ -0,0 +1,231 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"sort"
+	"time"
+
+	"lukechampine.com/blake3"
+)
+
+// manifest describes a job for apply mode. Manifests are written in JSON,
+// which is also valid YAML.
+type manifest struct {
+	Commands []struct {
+		ID     string            `json:"id"` // to await the command by
+		Name   string            `json:"name"`
+		Args   []string          `json:"args"`
+		Agents []string          `json:"agents"` // instead of those of the manifest
+		Tags   map[string]string `json:"tags"`   // of the agents targeted, as configured
+		Await  []string          `json:"await"`  // ids of earlier commands that must succeed on all their agents
+	} `json:"commands"`
+	Agents    []string          `json:"agents"`
+	Container string            `json:"container"`
+	Env       map[string]string `json:"env"`
+	Labels    map[string]string `json:"labels"`
+	Timeout   string            `json:"timeout"`
+	Schedule  string            `json:"schedule"`
+	Delivery  string            `json:"delivery"`
+	Priority  int               `json:"priority"`
+	Lock      string            `json:"lock"`
+	Chain     bool              `json:"chain"` // each command runs after the previous one succeeded
+	Rollout   *struct {
+		Batch int    `json:"batch"`
+		Pause string `json:"pause"`
+	} `json:"rollout"`
+}
+
+func loadManifest(path string) (*manifest, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	dec := json.NewDecoder(f)
+	dec.DisallowUnknownFields()
+	m := &manifest{}
+	if err = dec.Decode(m); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if err = m.validate(); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return m, nil
+}
+
+func (m *manifest) validate() error {
+	if len(m.Commands) == 0 {
+		return errors.New("no commands")
+	}
+	ids := make(map[string]bool)
+	for i, c := range m.Commands {
+		if c.Name == "" {
+			return fmt.Errorf("command %d has no name", i)
+		}
+		if err := validLabels(c.Tags); err != nil {
+			return err
+		}
+		if (len(c.Agents) > 0 || len(c.Tags) > 0) && m.Rollout != nil {
+			return fmt.Errorf("command %d has agents or tags of its own, which a rollout does not take", i)
+		}
+		for _, id := range c.Await {
+			if !ids[id] {
+				return fmt.Errorf("command %d awaits %q, which is not an earlier command", i, id)
+			}
+		}
+		if c.ID != "" {
+			if ids[c.ID] {
+				return fmt.Errorf("repeated command id %q", c.ID)
+			}
+			ids[c.ID] = true
+		}
+	}
+	for k := range m.Env {
+		if !envName.MatchString(k) {
+			return fmt.Errorf("invalid env name %q", k)
+		}
+	}
+	if err := validLabels(m.Labels); err != nil {
+		return err
+	}
+	if m.Timeout != "" {
+		if d, err := time.ParseDuration(m.Timeout); err != nil || d <= 0 {
+			return fmt.Errorf("invalid timeout %q", m.Timeout)
+		}
+	}
+	if err := validDelivery(m.Delivery); err != nil {
+		return err
+	}
+	if m.Schedule != "" {
+		if _, err := time.Parse(time.RFC3339, m.Schedule); err != nil {
+			return fmt.Errorf("invalid schedule: %w", err)
+		}
+	}
+	if m.Rollout != nil {
+		if m.Rollout.Batch <= 0 {
+			return errors.New("rollout batch must be positive")
+		}
+		if len(m.Agents) == 0 {
+			return errors.New("rollout needs agents")
+		}
+		if _, err := time.ParseDuration(m.Rollout.Pause); m.Rollout.Pause != "" && err != nil {
+			return fmt.Errorf("invalid rollout pause %q", m.Rollout.Pause)
+		}
+	}
+	return nil
+}
+
+// batches splits the targeted agents according to the rollout policy.
+// A nil batch targets all agents.
+func (m *manifest) batches() [][]string {
+	if m.Rollout == nil {
+		return [][]string{m.Agents}
+	}
+	batches := make([][]string, 0)
+	for i := 0; i < len(m.Agents); i += m.Rollout.Batch {
+		batches = append(batches, m.Agents[i:min(i+m.Rollout.Batch, len(m.Agents))])
+	}
+	return batches
+}
+
+// apply sends the commands of m, tagged with trace.
+func (m *manifest) apply(h *blake3.Hasher, target, trace string) ([]*cmd, error) {
+	if m.Schedule != "" {
+		at, _ := time.Parse(time.RFC3339, m.Schedule)
+		fmt.Printf("waiting until %s\n", at)
+		time.Sleep(time.Until(at))
+	}
+	timeout, _ := time.ParseDuration(m.Timeout)
+	env := make([]string, 0, len(m.Env))
+	for k, v := range m.Env {
+		env = append(env, k+"="+v)
+	}
+	sort.Strings(env)
+	var pause time.Duration
+	var agents []*agentStatus
+	cmds := make([]*cmd, 0)
+	if m.Rollout != nil {
+		pause, _ = time.ParseDuration(m.Rollout.Pause)
+	}
+	for i, batch := range m.batches() {
+		if i > 0 {
+			time.Sleep(pause)
+		}
+		prev := ""
+		sent := make(map[string]string) // command ids, by manifest id
+		for _, mc := range m.Commands {
+			targeted := batch
+			if len(mc.Agents) > 0 || len(mc.Tags) > 0 {
+				if len(mc.Tags) > 0 && agents == nil {
+					var err error
+					if agents, err = getAgents("", target); err != nil {
+						return cmds, err
+					}
+				}
+				targeted = tagged(agents, mc.Agents, mc.Tags)
+				if len(targeted) == 0 {
+					return cmds, fmt.Errorf("no agent is tagged %v", mc.Tags)
+				}
+			}
+			c := &cmd{
+				ID:        newID(),
+				Version:   protocolVersion,
+				Name:      mc.Name,
+				Args:      append(make([]string, 0), mc.Args...),
+				Agents:    append(make([]string, 0), targeted...),
+				Env:       env,
+				Timeout:   timeout,
+				Container: m.Container,
+				Trace:     trace,
+				Labels:    m.Labels,
+				Delivery:  m.Delivery,
+				Priority:  m.Priority,
+				Lock:      m.Lock,
+				Created:   time.Now(),
+			}
+			if m.Chain && prev != "" {
+				c.After = []string{prev}
+			}
+			for _, id := range mc.Await {
+				c.Await = append(c.Await, sent[id])
+			}
+			prev = c.ID
+			if mc.ID != "" {
+				sent[mc.ID] = c.ID
+			}
+			if _, err := submit(c, h, target); err != nil {
+				return cmds, err
+			}
+			cmds = append(cmds, c)
+		}
+	}
+	return cmds, nil
+}
+
+// tagged returns the given agents, and those of agents configured with all
+// the tags, if any.
+func tagged(agents []*agentStatus, ids []string, tags map[string]string) []string {
+	targeted := append(make([]string, 0), ids...)
+	if len(tags) == 0 {
+		return targeted
+	}
+	for _, s := range agents {
+		if s.Config == nil || slices.Contains(targeted, s.Agent) {
+			continue
+		}
+		match := true
+		for k, v := range tags {
+			if s.Config.Tags[k] != v {
+				match = false
+			}
+		}
+		if match {
+			targeted = append(targeted, s.Agent)
+		}
+	}
+	return targeted
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	metricsFlush  = 10 * time.Second
+	metricsHealth = time.Minute
+)
+
+// metrics pushes execution statistics to an InfluxDB write endpoint, in
+// line protocol.
+type metrics struct {
+	url, token string
+	lines      chan string
+}
+
+// newMetrics starts pushing to rawurl. A password in the url is sent as
+// an InfluxDB token instead.
+func newMetrics(rawurl string) (*metrics, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	m := &metrics{lines: make(chan string, 1000)}
+	if u.User != nil {
+		m.token, _ = u.User.Password()
+		u.User = nil
+	}
+	m.url = u.String()
+	go m.push()
+	return m, nil
+}
+
+func (m *metrics) record(line string) {
+	select {
+	case m.lines <- line:
+	default:
+	}
+}
+
+func (m *metrics) push() {
+	batch := &bytes.Buffer{}
+	flush := time.NewTicker(metricsFlush)
+	for {
+		select {
+		case line := <-m.lines:
+			batch.WriteString(line + "\n")
+			if batch.Len() < 1<<20 {
+				continue
+			}
+		case <-flush.C:
+		}
+		if batch.Len() == 0 {
+			continue
+		}
+		if err := m.write(batch.Bytes()); err != nil {
+			fmt.Println(err)
+		}
+		batch.Reset()
+	}
+}
+
+func (m *metrics) write(data []byte) error {
+	req, err := http.NewRequest("POST", m.url, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if m.token != "" {
+		req.Header.Set("Authorization", "Token "+m.token)
+	}
+	resp, err := sinkClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("metrics: got status code %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func (m *metrics) recordResult(res *result) {
+	var timings string
+	if t := res.Timing; t != nil && !t.Received.IsZero() {
+		timings = fmt.Sprintf(",delivery_ms=%di,wait_ms=%di", t.Received.Sub(t.Enqueued).Milliseconds(), t.Started.Sub(t.Received).Milliseconds())
+	}
+	m.record(fmt.Sprintf("captain_result,agent=%s cmd=%q,exit_code=%di,duration_ms=%di,failed=%t%s %d",
+		tagEscape(res.Agent), res.Cmd, res.ExitCode, res.Duration.Milliseconds(), res.Error != "", timings, res.Created.UnixNano()))
+}
+
+// reportHealth records, every minute, how long ago each agent was last
+// heard from, and how many agents are offline.
+func (a *app) reportHealth() {
+	for now := range time.Tick(metricsHealth) {
+		a.mu.Lock()
+		offline := 0
+		for agent, at := range a.lastSeen {
+			a.metrics.record(fmt.Sprintf("captain_agent,agent=%s last_seen_s=%di %d",
+				tagEscape(agent), int64(now.Sub(at).Seconds()), now.UnixNano()))
+			if a.status(agent, now).Status == statusOff {
+				offline++
+			}
+		}
+		a.metrics.record(fmt.Sprintf("captain_agents online=%di,offline=%di %d",
+			len(a.lastSeen)-offline, offline, now.UnixNano()))
+		a.mu.Unlock()
+	}
+}
+
+// seen notes that agent was heard from.
+func (a *app) seen(agent string) {
+	if a.lastSeen != nil {
+		a.lastSeen[agent] = time.Now()
+	}
+}
+
+func tagEscape(s string) string {
+	return strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `).Replace(s)
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"lukechampine.com/blake3"
+)
+
+// Subjects used by the NATS transport. Commands are published to the
+// subject of each targeted agent, or to natsAll if untargeted.
+const (
+	natsAll    = "captain.cmd.all"
+	natsAgent  = "captain.cmd."
+	natsResult = "captain.result"
+)
+
+// natsConn is a minimal client for the NATS text protocol.
+type natsConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+	subs map[string]func([]byte)
+	mu   sync.Mutex
+}
+
+// dialNATS connects to nats://[user:password@]host[:port].
+func dialNATS(rawurl string) (*natsConn, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	addr := u.Host
+	if _, _, err = net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, "4222")
+	}
+	conn, err := net.DialTimeout("tcp", addr, 5*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	nc := &natsConn{conn: conn, r: bufio.NewReader(conn), subs: make(map[string]func([]byte))}
+	opts := map[string]any{"verbose": false, "pedantic": false, "name": "captain"}
+	if u.User != nil {
+		opts["user"] = u.User.Username()
+		opts["pass"], _ = u.User.Password()
+	}
+	connect, err := json.Marshal(opts)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	defer conn.SetDeadline(time.Time{})
+	if line, err := nc.r.ReadString('\n'); err != nil || !strings.HasPrefix(line, "INFO ") {
+		conn.Close()
+		return nil, fmt.Errorf("nats: unexpected greeting %q: %v", line, err)
+	}
+	if _, err = fmt.Fprintf(conn, "CONNECT %s\r\nPING\r\n", connect); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	line, err := nc.r.ReadString('\n')
+	if err != nil || strings.TrimSpace(line) != "PONG" {
+		conn.Close()
+		return nil, fmt.Errorf("nats: connect failed: %q %v", strings.TrimSpace(line), err)
+	}
+	return nc, nil
+}
+
+func (nc *natsConn) publish(subject string, data []byte) error {
+	nc.mu.Lock()
+	defer nc.mu.Unlock()
+	_, err := fmt.Fprintf(nc.conn, "PUB %s %d\r\n%s\r\n", subject, len(data), data)
+	return err
+}
+
+// subscribe registers fn for the messages on subject. It must be called
+// before serve.
+func (nc *natsConn) subscribe(subject string, fn func([]byte)) error {
+	nc.mu.Lock()
+	defer nc.mu.Unlock()
+	sid := strconv.Itoa(len(nc.subs) + 1)
+	nc.subs[sid] = fn
+	_, err := fmt.Fprintf(nc.conn, "SUB %s %s\r\n", subject, sid)
+	return err
+}
+
+// serve dispatches messages to subscribers until the connection fails.
+func (nc *natsConn) serve() error {
+	defer nc.conn.Close()
+	for {
+		line, err := nc.r.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		switch fields[0] {
+		case "PING":
+			nc.mu.Lock()
+			_, err = fmt.Fprint(nc.conn, "PONG\r\n")
+			nc.mu.Unlock()
+			if err != nil {
+				return err
+			}
+		case "-ERR":
+			return errors.New("nats: " + strings.TrimSpace(strings.TrimPrefix(line, "-ERR")))
+		case "MSG":
+			// MSG <subject> <sid> [reply-to] <#bytes>
+			if len(fields) < 4 {
+				return fmt.Errorf("nats: malformed message %q", line)
+			}
+			n, err := strconv.Atoi(fields[len(fields)-1])
+			if err != nil {
+				return fmt.Errorf("nats: malformed message %q", line)
+			}
+			data := make([]byte, n+2)
+			if _, err = io.ReadFull(nc.r, data); err != nil {
+				return err
+			}
+			if fn := nc.subs[fields[2]]; fn != nil {
+				fn(data[:n])
+			}
+		}
+	}
+}
+
+// publishCmd forwards c to the subjects of the agents it targets.
+func (nc *natsConn) publishCmd(c *cmd) error {
+	data, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	if len(c.Agents) == 0 {
+		return nc.publish(natsAll, data)
+	}
+	for _, agent := range c.Agents {
+		if err = nc.publish(natsAgent+agent, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// serveNATS stores the results agents publish over NATS. It reconnects
+// until the process exits.
+func (a *app) serveNATS(rawurl string) {
+	for {
+		nc, err := dialNATS(rawurl)
+		if err == nil {
+			err = nc.subscribe(natsResult, a.natsResult)
+		}
+		if err == nil {
+			a.mu.Lock()
+			a.nats = nc
+			a.mu.Unlock()
+			err = nc.serve()
+			a.mu.Lock()
+			a.nats = nil
+			a.mu.Unlock()
+		}
+		fmt.Println(err)
+		time.Sleep(time.Second)
+	}
+}
+
+func (a *app) natsResult(data []byte) {
+	res := &result{}
+	err := json.Unmarshal(data, res)
+	if err == nil {
+		err = res.validate()
+	}
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	h, err := a.agentHasher(res.Agent)
+	if err == nil {
+		err = verifyResult(res, h, 200*time.Millisecond)
+	}
+	if err == nil {
+		a.flagRevoked(res)
+		err = a.store.addResult(res)
+	}
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	fmt.Printf("%s: nats %s %s %s\n%s%s\n", res.Created, res.Agent, res.ref(), res.outcome(), res.Output, res.Error)
+	a.received(res)
+}
+
+// subscribe receives commands over NATS instead of polling, and publishes
+// results back. It returns when the connection fails.
+func (ag *agent) subscribe(rawurl string, h *blake3.Hasher, started time.Time) error {
+	nc, err := dialNATS(rawurl)
+	if err != nil {
+		return err
+	}
+	// Dedupe redelivered commands within the verification window.
+	seen := make(map[string]time.Time)
+	handle := func(data []byte) {
+		c := &cmd{}
+		if err := json.Unmarshal(data, c); err != nil {
+			fmt.Println(err)
+			return
+		}
+		window := 2*ag.effective().Poll + ag.catchUp
+		for sum, at := range seen {
+			if time.Since(at) > window {
+				delete(seen, sum)
+			}
+		}
+		if _, ok := seen[c.Sum]; ok {
+			return
+		}
+		seen[c.Sum] = time.Now()
+		ag.handle(c, h, started)
+	}
+	for _, subject := range []string{natsAll, natsAgent + ag.id} {
+		if err = nc.subscribe(subject, handle); err != nil {
+			nc.conn.Close()
+			return err
+		}
+	}
+	ag.mu.Lock()
+	ag.nats = nc
+	ag.mu.Unlock()
+	err = nc.serve()
+	ag.mu.Lock()
+	ag.nats = nil
+	ag.mu.Unlock()
+	return err
+}
+
+func publishResult(nc *natsConn, res *result, h *blake3.Hasher) error {
+	if err := res.encodeData(); err != nil {
+		return err
+	}
+	res.Sum = hex.EncodeToString(signResult(res, h))
+	data, err := json.Marshal(res)
+	if err != nil {
+		return err
+	}
+	return nc.publish(natsResult, data)
+}
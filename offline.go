@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// queuedCmd is a signed command that could not be posted to some targets,
+// kept until it is flushed or its window closes.
+type queuedCmd struct {
+	Cmd     *cmd
+	Targets []string
+}
+
+// unreachable reports whether err is a failure to reach the server, or an
+// answer it hints is retryable, rather than a refusal.
+func unreachable(err error) bool {
+	var urlErr *url.Error
+	var statusErr *statusError
+	return errors.As(err, &urlErr) || errors.As(err, &statusErr) && statusErr.Retryable
+}
+
+// queueOffline keeps c in dir, to be flushed to targets later.
+func queueOffline(dir string, c *cmd, targets []string) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	data, err := json.Marshal(&queuedCmd{Cmd: c, Targets: targets})
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, c.ID+".json"), data, 0600)
+}
+
+// flush posts the commands queued in dir, oldest first. Commands are
+// removed once posted to every target, or when their window has closed.
+// It returns whether all were flushed.
+func flush(dir string) (bool, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return false, err
+	}
+	queued := make([]*queuedCmd, 0, len(paths))
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return false, err
+		}
+		q := &queuedCmd{}
+		if err = json.Unmarshal(data, q); err != nil || q.Cmd == nil {
+			return false, fmt.Errorf("%s: invalid queued command", path)
+		}
+		queued = append(queued, q)
+	}
+	sort.Slice(queued, func(i, j int) bool { return queued[i].Cmd.Created.Before(queued[j].Cmd.Created) })
+	ok := true
+	for _, q := range queued {
+		path := filepath.Join(dir, q.Cmd.ID+".json")
+		if time.Now().After(q.Cmd.NotAfter) {
+			fmt.Printf("%s: window closed at %s, dropped\n", q.Cmd.ID, q.Cmd.NotAfter.Format(time.RFC3339))
+			if err = os.Remove(path); err != nil {
+				return false, err
+			}
+			continue
+		}
+		payload, err := json.Marshal(q.Cmd)
+		if err != nil {
+			return false, err
+		}
+		pending := make([]string, 0)
+		for _, target := range q.Targets {
+			err := postCmd(payload, target)
+			switch {
+			case err == nil:
+				fmt.Printf("%s: %s: submitted\n", target, q.Cmd.ID)
+			case unreachable(err):
+				fmt.Printf("%s: %s: %s\n", target, q.Cmd.ID, err)
+				pending = append(pending, target)
+			default:
+				// Refused commands are not retried.
+				fmt.Printf("%s: %s: %s, dropped\n", target, q.Cmd.ID, err)
+			}
+		}
+		if len(pending) > 0 {
+			ok = false
+			err = queueOffline(dir, q.Cmd, pending)
+		} else {
+			err = os.Remove(path)
+		}
+		if err != nil {
+			return false, err
+		}
+	}
+	return ok, nil
+}
+
+// queueUnreachable queues c for the targets that could not be reached, and
+// clears their errors.
+func queueUnreachable(dir string, c *cmd, targets []string, errs []error) error {
+	queued := make([]string, 0)
+	for i, err := range errs {
+		if err != nil && unreachable(err) {
+			queued = append(queued, targets[i])
+		}
+	}
+	if len(queued) == 0 {
+		return nil
+	}
+	if err := queueOffline(dir, c, queued); err != nil {
+		return err
+	}
+	for i, err := range errs {
+		if err != nil && unreachable(err) {
+			errs[i] = nil
+		}
+	}
+	fmt.Fprintf(os.Stderr, "%s: queued in %s until flushed, valid until %s\n", strings.Join(queued, ","), dir, c.NotAfter.Format(time.RFC3339))
+	return nil
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"sync"
+	"time"
+)
+
+// oidc verifies ID tokens issued by an OpenID Connect provider.
+type oidc struct {
+	issuer, audience string
+	keys             map[string]crypto.PublicKey
+	fetched          time.Time
+	mu               sync.Mutex
+}
+
+func newOIDC(issuer, audience string) (*oidc, error) {
+	o := &oidc{
+		issuer:   strings.TrimSuffix(issuer, "/"),
+		audience: audience,
+	}
+	if audience == "" {
+		return nil, errors.New("oidc needs an audience")
+	}
+	return o, o.refresh()
+}
+
+// refresh fetches the provider's signing keys, at most once a minute.
+func (o *oidc) refresh() error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if time.Since(o.fetched) < time.Minute {
+		return nil
+	}
+	discovery := struct {
+		Issuer  string `json:"issuer"`
+		JWKSURI string `json:"jwks_uri"`
+	}{}
+	if err := getJSON(o.issuer+"/.well-known/openid-configuration", &discovery); err != nil {
+		return fmt.Errorf("oidc discovery: %w", err)
+	}
+	if strings.TrimSuffix(discovery.Issuer, "/") != o.issuer {
+		return fmt.Errorf("oidc discovery: issuer is %s", discovery.Issuer)
+	}
+	jwks := struct {
+		Keys []struct {
+			Kid, Kty, Crv, N, E, X, Y string
+		} `json:"keys"`
+	}{}
+	if err := getJSON(discovery.JWKSURI, &jwks); err != nil {
+		return fmt.Errorf("oidc keys: %w", err)
+	}
+	keys := make(map[string]crypto.PublicKey)
+	for _, k := range jwks.Keys {
+		switch k.Kty {
+		case "RSA":
+			n, err1 := base64.RawURLEncoding.DecodeString(k.N)
+			e, err2 := base64.RawURLEncoding.DecodeString(k.E)
+			if err1 != nil || err2 != nil {
+				continue
+			}
+			keys[k.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		case "EC":
+			x, err1 := base64.RawURLEncoding.DecodeString(k.X)
+			y, err2 := base64.RawURLEncoding.DecodeString(k.Y)
+			if err1 != nil || err2 != nil || k.Crv != "P-256" {
+				continue
+			}
+			keys[k.Kid] = &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		}
+	}
+	o.keys, o.fetched = keys, time.Now()
+	return nil
+}
+
+func (o *oidc) key(kid string) crypto.PublicKey {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.keys[kid]
+}
+
+// verify checks the signature and claims of an ID token, and returns the
+// operator it identifies.
+func (o *oidc) verify(token string) (*operator, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+	header := struct{ Alg, Kid string }{}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, err
+	}
+	key := o.key(header.Kid)
+	if key == nil {
+		// The provider may have rotated its keys.
+		if err := o.refresh(); err != nil {
+			return nil, err
+		}
+		if key = o.key(header.Kid); key == nil {
+			return nil, fmt.Errorf("unknown signing key %s", header.Kid)
+		}
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.New("malformed token signature")
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		if header.Alg != "RS256" || rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], sig) != nil {
+			return nil, errors.New("invalid token signature")
+		}
+	case *ecdsa.PublicKey:
+		if header.Alg != "ES256" || len(sig) != 64 ||
+			!ecdsa.Verify(key, digest[:], new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])) {
+			return nil, errors.New("invalid token signature")
+		}
+	}
+	claims := struct {
+		Iss, Sub, Email string
+		EmailVerified   *claimBool `json:"email_verified"`
+		Aud             audience
+		Exp, Nbf        int64
+		Groups          []string
+	}{}
+	if err = decodeSegment(parts[1], &claims); err != nil {
+		return nil, err
+	}
+	now := time.Now().Unix()
+	verified := claims.EmailVerified != nil && bool(*claims.EmailVerified)
+	switch {
+	case strings.TrimSuffix(claims.Iss, "/") != o.issuer:
+		return nil, errors.New("token from another issuer")
+	case !claims.Aud.contains(o.audience):
+		return nil, errors.New("token for another audience")
+	case claims.Exp < now:
+		return nil, errors.New("token expired")
+	case claims.Nbf > now:
+		return nil, errors.New("token not yet valid")
+	case claims.Email != "" && claims.EmailVerified != nil && !verified:
+		return nil, errors.New("token for an unverified email")
+	}
+	// Grants name emails, which anyone may claim unless verified.
+	op := &operator{Name: claims.Sub, Groups: claims.Groups}
+	if claims.Email != "" && verified {
+		op.Name = claims.Email
+	}
+	return op, nil
+}
+
+// claimBool is a boolean claim, which some providers send as a string.
+type claimBool bool
+
+func (b *claimBool) UnmarshalJSON(data []byte) error {
+	var s string
+	if json.Unmarshal(data, &s) == nil {
+		*b = s == "true"
+		return nil
+	}
+	return json.Unmarshal(data, (*bool)(b))
+}
+
+// audience is a string or an array of strings.
+type audience []string
+
+func (aud *audience) UnmarshalJSON(data []byte) error {
+	var s string
+	if json.Unmarshal(data, &s) == nil {
+		*aud = audience{s}
+		return nil
+	}
+	return json.Unmarshal(data, (*[]string)(aud))
+}
+
+func (aud audience) contains(s string) bool {
+	for _, a := range aud {
+		if a == s {
+			return true
+		}
+	}
+	return false
+}
+
+func decodeSegment(seg string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return errors.New("malformed token")
+	}
+	return json.Unmarshal(data, v)
+}
+
+func getJSON(url string, v any) error {
+	resp, err := sinkClient.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("%s: got status code %d", url, resp.StatusCode)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestOIDCEmailVerified(t *testing.T) {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	o := &oidc{issuer: "https://idp", audience: "captain", keys: map[string]crypto.PublicKey{"k": &priv.PublicKey}, fetched: time.Now()}
+	token := func(claims map[string]any) string {
+		claims["iss"], claims["aud"], claims["sub"] = "https://idp", "captain", "1234"
+		claims["exp"] = time.Now().Add(time.Hour).Unix()
+		header, _ := json.Marshal(map[string]string{"alg": "ES256", "kid": "k"})
+		payload, _ := json.Marshal(claims)
+		signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+		digest := sha256.Sum256([]byte(signed))
+		r, s, err := ecdsa.Sign(rand.Reader, priv, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		sig := append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+		return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+	}
+	tests := []struct {
+		name   string
+		claims map[string]any
+		want   string // operator name, or empty if refused
+	}{
+		{"verified", map[string]any{"email": "ops@example.com", "email_verified": true}, "ops@example.com"},
+		{"verified as a string", map[string]any{"email": "ops@example.com", "email_verified": "true"}, "ops@example.com"},
+		{"unverified", map[string]any{"email": "ops@example.com", "email_verified": false}, ""},
+		{"unverified as a string", map[string]any{"email": "ops@example.com", "email_verified": "false"}, ""},
+		{"verification unknown", map[string]any{"email": "ops@example.com"}, "1234"},
+		{"no email", map[string]any{}, "1234"},
+	}
+	for _, tt := range tests {
+		op, err := o.verify(token(tt.claims))
+		switch {
+		case tt.want == "" && err == nil:
+			t.Errorf("%s: accepted as %s", tt.name, op.Name)
+		case tt.want != "" && err != nil:
+			t.Errorf("%s: %s", tt.name, err)
+		case tt.want != "" && op.Name != tt.want:
+			t.Errorf("%s: named %s, want %s", tt.name, op.Name, tt.want)
+		}
+	}
+}
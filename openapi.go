@@ -0,0 +1,247 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// media is a body described by its content type only.
+type media string
+
+const (
+	mediaText   media = "text/plain"
+	mediaBinary media = "application/octet-stream"
+	mediaHTML   media = "text/html"
+)
+
+// contents is a body served in one of several content types.
+type contents map[string]any
+
+// alternatives is a body of one of several schemas, depending on the request.
+type alternatives []any
+
+// route documents an endpoint of the API in /openapi.json. Body and resp
+// are values of the Go types the handler decodes and encodes, so the
+// schemas follow the code.
+type route struct {
+	method, path, summary string
+	query                 []string // name: description
+	body, resp            any
+}
+
+var routes = []route{
+	{method: "GET", path: "/", summary: "Poll the signed queue of commands, as an agent identified by the X-Captain-Agent header. 204 if the queue is empty.", resp: []*cmd{}},
+	{method: "POST", path: "/cmd", summary: "Queue a command signed with the key, or a token with the send scope. 202 if held for approval, cosigners or the commands it awaits.", body: &cmd{}, resp: mediaText},
+	{method: "POST", path: "/log", summary: "Log a message signed with the key.", body: &log{}, resp: mediaText},
+	{method: "GET", path: "/logs", summary: "List the stored logs.", query: []string{"since: an RFC 3339 time the logs must be created after"}, resp: []*log{}},
+	{method: "POST", path: "/result", summary: "Report the result of a command, signed with the key, as an agent.", body: &result{}, resp: mediaText},
+	{method: "POST", path: "/key", summary: "Register the public key of an agent, to seal secrets and commands for it.", body: &agentKey{}, resp: mediaText},
+	{method: "POST", path: "/secret", summary: "Store a secret sealed for an agent.", body: &secret{}, resp: mediaText},
+	{method: "POST", path: "/tokens", summary: "Create, list or revoke operator tokens, with a request signed with the key.", body: &adminRequest{}, resp: alternatives{&tokenCreated{}, []*apiToken{}, ""}},
+	{method: "POST", path: "/enroll", summary: "Request enrollment of an agent with an enrollment token.", body: &enrollment{}, resp: mediaText},
+	{method: "GET", path: "/enroll/{agent}", summary: "Get the key sealed for an enrolled agent. 202 while the enrollment is pending.", resp: &secret{}},
+	{method: "POST", path: "/enrollments", summary: "List, approve, reject or revoke enrollments, with a request signed with the key.", body: &adminRequest{}, resp: alternatives{[]*enrollment{}, ""}},
+	{method: "POST", path: "/deadletters", summary: "List dead letters, or retry one, with a request signed with the key.", body: &adminRequest{}, resp: alternatives{[]*deadLetter{}, ""}},
+	{method: "POST", path: "/templates", summary: "Set or delete a command template, with a request signed with the key. The value is a JSON array of the command line.", body: &adminRequest{}, resp: ""},
+	{method: "GET", path: "/templates", summary: "List the command templates.", resp: []*cmdTemplate{}},
+	{method: "POST", path: "/vars", summary: "List, set or delete variables, with a request signed with the key.", body: &adminRequest{}, resp: alternatives{[]*variable{}, ""}},
+	{method: "POST", path: "/slots", summary: "Take a slot of the rollout budget of a command, as an agent.", body: &slotRequest{}, resp: mediaText},
+	{method: "POST", path: "/leases", summary: "Take or renew the lock of a command, as an agent. 423 while another agent holds it, 409 when renewing a lock no longer held.", body: &leaseRequest{}, resp: mediaText},
+	{method: "GET", path: "/leases", summary: "List the locks held, by the agent and command holding them.", resp: []*lease{}},
+	{method: "GET", path: "/agents", summary: "List the agents the server heard from.", query: []string{"status: online or offline"}, resp: []*agentStatus{}},
+	{method: "GET", path: "/agents/{agent}/key", summary: "Get the registered public key of an agent.", resp: &agentKey{}},
+	{method: "GET", path: "/agents/{agent}/secrets", summary: "Get the secrets sealed for an agent.", resp: []*secret{}},
+	{method: "GET", path: "/agents/{agent}/config", summary: "Get the configuration the server wants an agent to run with, signed with the key.", resp: &agentConfig{}},
+	{method: "GET", path: "/commands", summary: "List the stored commands.", query: []string{"label: a key=value label the commands must have, may be repeated", "id: the id of a command to get, may be repeated"}, resp: []*cmd{}},
+	{method: "GET", path: "/commands/{id}/results", summary: "Get the results of a command, or a value of their data.", query: []string{"jsonpath: a dotted path into the data of the results, answered per agent"}, resp: alternatives{[]*result{}, []*datum{}}},
+	{method: "POST", path: "/commands/{id}/approve", summary: "Approve a held command, with a token allowed to approve.", resp: mediaText},
+	{method: "POST", path: "/commands/{id}/cosign", summary: "Add a cosignature to a command awaiting cosigners.", body: &cosig{}, resp: mediaText},
+	{method: "GET", path: "/held", summary: "List the commands held for approval.", resp: []*cmd{}},
+	{method: "GET", path: "/awaiting", summary: "List the commands held until the commands they await succeed on all their agents.", resp: []*cmd{}},
+	{method: "GET", path: "/cosign", summary: "List the commands awaiting cosigners.", resp: []*cmd{}},
+	{method: "GET", path: "/export", summary: "Export commands, results and audit entries created in a range.", query: []string{"from: an RFC 3339 time or a date", "to: an RFC 3339 time or a date", "format: json (the default) or csv"}, resp: contents{"text/csv": mediaText, "application/x-ndjson": &record{}}},
+	{method: "GET", path: "/artifacts", summary: "List the stored artifacts.", resp: []*artifactInfo{}},
+	{method: "GET", path: "/artifacts/{hash}", summary: "Download an artifact by its BLAKE3 digest, as a delta from an artifact listed in X-Captain-Have if worth it.", resp: mediaBinary},
+	{method: "PUT", path: "/artifacts/{hash}", summary: "Upload an artifact, with a request signed with the key, or a token with the send scope.", query: []string{"name: the name of the uploaded file, relating versions for deltas"}, body: mediaBinary, resp: mediaText},
+	{method: "GET", path: "/file/{name}", summary: "Download a chunk of a pushed file, signed in X-Captain-Sum.", query: []string{"offset: the offset of the chunk", "size: the size of the chunk"}, resp: mediaBinary},
+	{method: "POST", path: "/file/{name}", summary: "Push a chunk of a file, signed in X-Captain-Sum. 409 if the offset is not the size of the file.", query: []string{"offset: the offset of the chunk"}, body: mediaBinary, resp: mediaText},
+	{method: "GET", path: "/dashboard/", summary: "The dashboard.", resp: mediaHTML},
+	{method: "GET", path: "/openapi.json", summary: "This document.", resp: contents{"application/json": mediaText}},
+}
+
+// openAPI builds the OpenAPI 3 document of routes.
+func openAPI() map[string]any {
+	g := &schemaGen{schemas: map[string]any{}, ref: "#/components/schemas/"}
+	paths := map[string]map[string]any{}
+	for _, rt := range routes {
+		op := map[string]any{"summary": rt.summary}
+		params := make([]any, 0)
+		for _, part := range strings.Split(rt.path, "/") {
+			if name, ok := strings.CutPrefix(part, "{"); ok {
+				params = append(params, map[string]any{"name": strings.TrimSuffix(name, "}"), "in": "path", "required": true, "schema": map[string]any{"type": "string"}})
+			}
+		}
+		for _, q := range rt.query {
+			name, desc, _ := strings.Cut(q, ": ")
+			params = append(params, map[string]any{"name": name, "in": "query", "description": desc, "schema": map[string]any{"type": "string"}})
+		}
+		if len(params) > 0 {
+			op["parameters"] = params
+		}
+		if rt.body != nil {
+			op["requestBody"] = map[string]any{"required": true, "content": g.content(rt.body)}
+		}
+		ok := map[string]any{"description": "OK"}
+		if rt.resp != nil {
+			ok["content"] = g.content(rt.resp)
+		}
+		op["responses"] = map[string]any{
+			"200": ok,
+			"default": map[string]any{
+				"description": "An error.",
+				"content":     map[string]any{"application/json": map[string]any{"schema": g.schema(reflect.TypeOf(apiError{}))}},
+			},
+		}
+		if paths[rt.path] == nil {
+			paths[rt.path] = map[string]any{}
+		}
+		paths[rt.path][strings.ToLower(rt.method)] = op
+	}
+	return map[string]any{
+		"openapi": "3.0.3",
+		"info": map[string]any{
+			"title":       "captain",
+			"version":     strconv.Itoa(protocolVersion),
+			"description": "Commands, logs, results and admin requests are signed with the shared key in their Sum field. Operators may authenticate with a bearer token instead. Requests carry the protocol version in X-Captain-Version.",
+		},
+		"servers":  []any{map[string]any{"url": "./"}},
+		"paths":    paths,
+		"security": []any{map[string]any{}, map[string]any{"bearer": []any{}}},
+		"components": map[string]any{
+			"schemas":         g.schemas,
+			"securitySchemes": map[string]any{"bearer": map[string]any{"type": "http", "scheme": "bearer"}},
+		},
+	}
+}
+
+// schemaGen derives JSON schemas from Go types, as encoding/json encodes
+// them, collecting named structs in schemas, referenced under ref.
+type schemaGen struct {
+	schemas map[string]any
+	ref     string
+}
+
+func (g *schemaGen) content(v any) map[string]any {
+	switch v := v.(type) {
+	case media:
+		s := map[string]any{"type": "string"}
+		if v == mediaBinary {
+			s["format"] = "binary"
+		}
+		return map[string]any{string(v): map[string]any{"schema": s}}
+	case contents:
+		c := map[string]any{}
+		for typ, body := range v {
+			if m, ok := body.(media); ok {
+				c[typ] = g.content(m)[string(m)]
+			} else {
+				c[typ] = map[string]any{"schema": g.schema(reflect.TypeOf(body))}
+			}
+		}
+		return c
+	case alternatives:
+		oneOf := make([]any, len(v))
+		for i, body := range v {
+			oneOf[i] = g.schema(reflect.TypeOf(body))
+		}
+		return map[string]any{"application/json": map[string]any{"schema": map[string]any{"oneOf": oneOf}}}
+	}
+	return map[string]any{"application/json": map[string]any{"schema": g.schema(reflect.TypeOf(v))}}
+}
+
+func (g *schemaGen) schema(t reflect.Type) map[string]any {
+	switch t {
+	case reflect.TypeOf(time.Time{}):
+		return map[string]any{"type": "string", "format": "date-time"}
+	case reflect.TypeOf(time.Duration(0)):
+		return map[string]any{"type": "integer", "format": "int64", "description": "nanoseconds"}
+	case reflect.TypeOf(json.RawMessage{}):
+		return map[string]any{}
+	}
+	switch t.Kind() {
+	case reflect.Pointer:
+		return g.schema(t.Elem())
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]any{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]any{"type": "string", "format": "byte"}
+		}
+		return map[string]any{"type": "array", "items": g.schema(t.Elem())}
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": g.schema(t.Elem())}
+	case reflect.Struct:
+		name := []rune(t.Name())
+		name[0] = unicode.ToUpper(name[0])
+		if _, ok := g.schemas[string(name)]; !ok {
+			// Registered first, for recursive types.
+			g.schemas[string(name)] = nil
+			g.schemas[string(name)] = g.object(t)
+		}
+		return map[string]any{"$ref": g.ref + string(name)}
+	}
+	return map[string]any{}
+}
+
+func (g *schemaGen) object(t reflect.Type) map[string]any {
+	props := map[string]any{}
+	required := make([]string, 0)
+	var fields func(t reflect.Type)
+	fields = func(t reflect.Type) {
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			tag := f.Tag.Get("json")
+			if tag == "-" {
+				continue
+			}
+			if f.Anonymous && tag == "" && f.Type.Kind() == reflect.Struct {
+				fields(f.Type)
+				continue
+			}
+			if !f.IsExported() {
+				continue
+			}
+			name, opts, _ := strings.Cut(tag, ",")
+			if name == "" {
+				name = f.Name
+			}
+			props[name] = g.schema(f.Type)
+			if !strings.Contains(opts, "omitempty") {
+				required = append(required, name)
+			}
+		}
+	}
+	fields(t)
+	obj := map[string]any{"type": "object", "properties": props}
+	if len(required) > 0 {
+		obj["required"] = required
+	}
+	return obj
+}
+
+func (a *app) handleOpenAPI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(a.openapi)
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+type sendStatus struct {
+	ID      string
+	Trace   string `json:",omitempty"`
+	Targets []targetStatus
+}
+
+type targetStatus struct {
+	Target string
+	Error  string `json:",omitempty"`
+}
+
+// printSent reports the outcome of posting c to each target, and whether
+// all posts succeeded.
+func printSent(c *cmd, targets []string, errs []error, format string) bool {
+	ok := true
+	status := &sendStatus{ID: c.ID, Trace: c.Trace, Targets: make([]targetStatus, len(targets))}
+	for i, err := range errs {
+		status.Targets[i].Target = targets[i]
+		if err != nil {
+			status.Targets[i].Error = err.Error()
+			ok = false
+		}
+	}
+	switch {
+	case format == "json":
+		printJSON(status)
+	case len(targets) == 1 && ok:
+		fmt.Println(c.ID)
+	case len(targets) == 1:
+		fmt.Println(errs[0])
+	default:
+		for _, t := range status.Targets {
+			if t.Error != "" {
+				fmt.Printf("%s: %s: %s\n", t.Target, c.ID, t.Error)
+			} else {
+				fmt.Printf("%s: %s\n", t.Target, c.ID)
+			}
+		}
+	}
+	return ok
+}
+
+func printJSON(v any) {
+	if err := json.NewEncoder(os.Stdout).Encode(v); err != nil {
+		panic(err)
+	}
+}
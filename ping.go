@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// pingType is a no-op command, whose result reports when the agent
+// received and started it, to measure latency.
+const pingType = "ping"
+
+type pong struct {
+	Received, Started time.Time
+}
+
+func (ag *agent) ping(_ context.Context, c *cmd, _ []string) ([]byte, json.RawMessage, error) {
+	p := &pong{Received: c.received, Started: time.Now()}
+	data, err := json.Marshal(p)
+	return nil, data, err
+}
+
+// pingReport splits the round trip of a ping into the time it waited to be
+// fetched, the time it waited on the agent, and its execution. Queue and
+// total time compare the sender's clock with the agent's.
+type pingReport struct {
+	Agent                             string
+	Queue, Delivery, Execution, Total time.Duration
+	Error                             string `json:",omitempty"`
+}
+
+func newPingReport(c *cmd, res *result) *pingReport {
+	l := &pingReport{Agent: res.Agent, Error: res.Error}
+	p := &pong{}
+	if err := json.Unmarshal(res.Data, p); err != nil || p.Received.IsZero() {
+		if l.Error == "" {
+			l.Error = "no ping timings in result"
+		}
+		return l
+	}
+	l.Queue = p.Received.Sub(c.Created)
+	l.Delivery = p.Started.Sub(p.Received)
+	l.Execution = res.Duration
+	l.Total = res.Created.Sub(c.Created)
+	return l
+}
+
+func printPingReport(l *pingReport) {
+	if l.Error != "" {
+		fmt.Printf("%s: %s\n", l.Agent, l.Error)
+		return
+	}
+	fmt.Printf("%s: queue %s, delivery %s, execution %s, total %s\n", l.Agent,
+		l.Queue.Round(time.Millisecond), l.Delivery.Round(time.Microsecond),
+		l.Execution.Round(time.Microsecond), l.Total.Round(time.Millisecond))
+}
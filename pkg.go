@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+type pkgManager struct {
+	name                     string
+	install, remove, upgrade []string
+	version                  func(ctx context.Context, pkg string) string
+}
+
+type pkgStatus struct {
+	Manager  string
+	Packages map[string]string
+}
+
+var pkgManagers = []*pkgManager{
+	{
+		name:    "apt-get",
+		install: []string{"apt-get", "install", "-y"},
+		remove:  []string{"apt-get", "remove", "-y"},
+		upgrade: []string{"apt-get", "install", "-y", "--only-upgrade"},
+		version: func(ctx context.Context, pkg string) string {
+			return pkgQuery(ctx, "dpkg-query", "-W", "-f=${Version}", pkg)
+		},
+	},
+	{
+		name:    "dnf",
+		install: []string{"dnf", "install", "-y"},
+		remove:  []string{"dnf", "remove", "-y"},
+		upgrade: []string{"dnf", "upgrade", "-y"},
+		version: func(ctx context.Context, pkg string) string {
+			return pkgQuery(ctx, "rpm", "-q", "--qf", "%{VERSION}-%{RELEASE}", pkg)
+		},
+	},
+	{
+		name:    "apk",
+		install: []string{"apk", "add"},
+		remove:  []string{"apk", "del"},
+		upgrade: []string{"apk", "upgrade"},
+		version: func(ctx context.Context, pkg string) string {
+			return strings.TrimPrefix(pkgQuery(ctx, "apk", "info", "-e", "-v", pkg), pkg+"-")
+		},
+	},
+	{
+		name:    "brew",
+		install: []string{"brew", "install"},
+		remove:  []string{"brew", "uninstall"},
+		upgrade: []string{"brew", "upgrade"},
+		version: func(ctx context.Context, pkg string) string {
+			return strings.TrimPrefix(pkgQuery(ctx, "brew", "list", "--versions", pkg), pkg+" ")
+		},
+	},
+	{
+		name:    "choco",
+		install: []string{"choco", "install", "-y"},
+		remove:  []string{"choco", "uninstall", "-y"},
+		upgrade: []string{"choco", "upgrade", "-y"},
+		version: func(ctx context.Context, pkg string) string {
+			out := pkgQuery(ctx, "choco", "list", "--local-only", "--exact", "--limit-output", pkg)
+			_, v, _ := strings.Cut(out, "|")
+			return v
+		},
+	},
+}
+
+func detectPkgManager() (*pkgManager, error) {
+	for _, m := range pkgManagers {
+		if _, err := exec.LookPath(m.name); err == nil {
+			return m, nil
+		}
+	}
+	return nil, errors.New("no supported package manager found")
+}
+
+// pkg maps install, remove and upgrade onto the detected package manager,
+// and returns the installed version of each package as structured data.
+func pkg(ctx context.Context, args []string) ([]byte, json.RawMessage, error) {
+	if len(args) < 2 {
+		return nil, nil, errors.New("usage: pkg install|remove|upgrade <package>...")
+	}
+	m, err := detectPkgManager()
+	if err != nil {
+		return nil, nil, err
+	}
+	var argv []string
+	switch args[0] {
+	case "install":
+		argv = m.install
+	case "remove":
+		argv = m.remove
+	case "upgrade":
+		argv = m.upgrade
+	default:
+		return nil, nil, fmt.Errorf("unsupported pkg action %s", args[0])
+	}
+	out := &bytes.Buffer{}
+	c := exec.CommandContext(ctx, argv[0], append(argv[1:], args[1:]...)...)
+	c.Env = append(os.Environ(), "DEBIAN_FRONTEND=noninteractive")
+	c.Stdout = out
+	c.Stderr = out
+	err = c.Run()
+	status := &pkgStatus{Manager: m.name, Packages: make(map[string]string)}
+	for _, p := range args[1:] {
+		status.Packages[p] = m.version(ctx, p)
+	}
+	data, jsonErr := json.Marshal(status)
+	if jsonErr != nil {
+		return out.Bytes(), nil, jsonErr
+	}
+	return out.Bytes(), data, err
+}
+
+func pkgQuery(ctx context.Context, name string, args ...string) string {
+	out, err := exec.CommandContext(ctx, name, args...).Output()
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(out))
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// policy admits or rejects commands before they are queued. The first
+// matching rule decides; commands matching no rule get the default.
+type policy struct {
+	Default  string          `json:"default"`
+	Rules    []*policyRule   `json:"rules"`
+	Validity []*validityRule `json:"validity"`
+}
+
+// policyRule matches commands. Empty fields match anything.
+type policyRule struct {
+	Name   string `json:"name"`
+	Effect string `json:"effect"`
+	// Cmd is a pattern of command names, or of the type for typed commands.
+	Cmd string `json:"cmd"`
+	// Args is a regular expression matched against the space-joined args.
+	Args string `json:"args"`
+	// Agents is a pattern of targeted agents. Allow rules match when every
+	// targeted agent does, deny rules when any does; untargeted commands
+	// only match allow rules without a pattern, and any deny rule.
+	Agents   string `json:"agents"`
+	Operator string `json:"operator"`
+	// Hours is a window of server time, as 22:00-06:00.
+	Hours string   `json:"hours"`
+	Days  []string `json:"days"`
+	args  *regexp.Regexp
+	from  time.Duration
+	to    time.Duration
+}
+
+func loadPolicy(file string) (*policy, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	dec := json.NewDecoder(f)
+	dec.DisallowUnknownFields()
+	p := &policy{}
+	if err = dec.Decode(p); err != nil {
+		return nil, fmt.Errorf("%s: %w", file, err)
+	}
+	if err = p.validate(); err != nil {
+		return nil, fmt.Errorf("%s: %w", file, err)
+	}
+	return p, nil
+}
+
+func (p *policy) validate() error {
+	if p.Default == "" {
+		p.Default = "allow"
+	}
+	if p.Default != "allow" && p.Default != "deny" {
+		return fmt.Errorf("invalid default %q", p.Default)
+	}
+	for _, v := range p.Validity {
+		if err := v.validate(); err != nil {
+			return err
+		}
+	}
+	for i, rule := range p.Rules {
+		if rule.Name == "" {
+			rule.Name = fmt.Sprintf("rule %d", i)
+		}
+		if rule.Effect != "allow" && rule.Effect != "deny" {
+			return fmt.Errorf("%s: invalid effect %q", rule.Name, rule.Effect)
+		}
+		for _, pattern := range []string{rule.Cmd, rule.Agents, rule.Operator} {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("%s: invalid pattern %q", rule.Name, pattern)
+			}
+		}
+		if rule.Args != "" {
+			var err error
+			if rule.args, err = regexp.Compile(rule.Args); err != nil {
+				return fmt.Errorf("%s: %w", rule.Name, err)
+			}
+		}
+		if rule.Hours != "" {
+			from, to, ok := strings.Cut(rule.Hours, "-")
+			var err1, err2 error
+			rule.from, err1 = parseClock(from)
+			rule.to, err2 = parseClock(to)
+			if !ok || err1 != nil || err2 != nil {
+				return fmt.Errorf("%s: invalid hours %q", rule.Name, rule.Hours)
+			}
+		}
+		for _, day := range rule.Days {
+			if _, ok := weekdays[strings.ToLower(day)]; !ok {
+				return fmt.Errorf("%s: invalid day %q", rule.Name, day)
+			}
+		}
+	}
+	return nil
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+func parseClock(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(s))
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// admit returns the name of the deciding rule, and an error if c is
+// rejected.
+func (p *policy) admit(c *cmd, now time.Time) (string, error) {
+	if err := p.checkValidity(c); err != nil {
+		return "validity", err
+	}
+	for _, rule := range p.Rules {
+		if !rule.matches(c, now) {
+			continue
+		}
+		if rule.Effect == "deny" {
+			return rule.Name, fmt.Errorf("rejected by policy: %s", rule.Name)
+		}
+		return rule.Name, nil
+	}
+	if p.Default == "deny" {
+		return "default", fmt.Errorf("rejected by policy: no rule allows it")
+	}
+	return "default", nil
+}
+
+func (rule *policyRule) matches(c *cmd, now time.Time) bool {
+	name := c.Name
+	if c.Type != "" {
+		name = c.Type
+	}
+	deny := rule.Effect == "deny"
+	// Untargeted commands reach every agent: deny rules with an agent
+	// pattern match them, allow rules do not.
+	if rule.Agents != "" && len(c.Agents) == 0 && !deny {
+		return false
+	}
+	if rule.Cmd != "" {
+		// The verification binary runs too: deny rules match either, allow
+		// rules need both.
+		names := []string{path.Base(name)}
+		if bin := c.verifyBinary(); bin != "" {
+			names = append(names, bin)
+		}
+		if !matchEach(rule.Cmd, names, deny) {
+			return false
+		}
+	}
+	if rule.args != nil && !rule.args.MatchString(strings.Join(c.Args, " ")) {
+		return false
+	}
+	if rule.Agents != "" && len(c.Agents) > 0 && !matchEach(rule.Agents, c.Agents, deny) {
+		return false
+	}
+	if rule.Operator != "" {
+		if ok, _ := path.Match(rule.Operator, c.Operator); !ok {
+			return false
+		}
+	}
+	if rule.Hours != "" {
+		clock := time.Duration(now.Hour())*time.Hour + time.Duration(now.Minute())*time.Minute
+		in := clock >= rule.from && clock < rule.to
+		if rule.from > rule.to {
+			in = clock >= rule.from || clock < rule.to
+		}
+		if !in {
+			return false
+		}
+	}
+	if len(rule.Days) > 0 {
+		matched := false
+		for _, day := range rule.Days {
+			matched = matched || weekdays[strings.ToLower(day)] == now.Weekday()
+		}
+		if !matched {
+			return false
+		}
+	}
+	return true
+}
+
+// matchEach reports whether all values match pattern, or any of them if
+// one is set.
+func matchEach(pattern string, values []string, one bool) bool {
+	for _, v := range values {
+		if ok, _ := path.Match(pattern, v); ok == one {
+			return one
+		}
+	}
+	return !one
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPolicyMatches(t *testing.T) {
+	p := &policy{Default: "deny", Rules: []*policyRule{
+		{Name: "no rm", Effect: "deny", Cmd: "rm", Agents: "prod-*"},
+		{Name: "staging", Effect: "allow", Agents: "staging-*"},
+		{Name: "uptime", Effect: "allow", Cmd: "uptime"},
+	}}
+	if err := p.validate(); err != nil {
+		t.Fatal(err)
+	}
+	rm := &check{Cmd: []string{"/bin/rm", "-rf", "/"}}
+	tests := []struct {
+		name, rule string
+		c          cmd
+		ok         bool
+	}{
+		{"all targets match", "staging", cmd{Name: "ls", Agents: []string{"staging-1", "staging-2"}}, true},
+		{"mixed targets", "default", cmd{Name: "ls", Agents: []string{"staging-1", "prod-1"}}, false},
+		{"untargeted", "default", cmd{Name: "ls"}, false},
+		{"untargeted, no agent pattern", "uptime", cmd{Name: "uptime"}, true},
+		{"denied on any target", "no rm", cmd{Name: "rm", Agents: []string{"staging-1", "prod-1"}}, false},
+		{"denied untargeted", "no rm", cmd{Name: "rm"}, false},
+		{"denied in verify", "no rm", cmd{Name: "uptime", Agents: []string{"prod-1"}, Verify: rm}, false},
+		{"allowed command, other verify", "default", cmd{Name: "uptime", Verify: &check{Cmd: []string{"sh"}}}, false},
+		{"allowed command and verify", "uptime", cmd{Name: "uptime", Verify: &check{Cmd: []string{"/usr/bin/uptime"}}}, true},
+	}
+	for _, tt := range tests {
+		rule, err := p.admit(&tt.c, time.Now())
+		if rule != tt.rule || (err == nil) != tt.ok {
+			t.Errorf("%s: got %s, %v", tt.name, rule, err)
+		}
+	}
+}
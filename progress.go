@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// maxRecentFailures is how many failures the progress of a rollout lists.
+const maxRecentFailures = 3
+
+// rollout is the progress of a command waited for with -wait on a terminal:
+// how many agents reported, failed or are running it, and when the others
+// should be done.
+type rollout struct {
+	c     *cmd
+	total int // agents expected to report, 0 if unknown
+	start time.Time
+}
+
+// newRollout expects the agents targeted by c to report, or for a command
+// targeting every agent, those online on the targets, if they track them.
+func newRollout(c *cmd, targets []string) *rollout {
+	r := &rollout{c: c, total: len(c.Agents), start: time.Now()}
+	if r.total > 0 {
+		return r
+	}
+	online := make(map[string]bool)
+	for _, target := range targets {
+		agents, err := getAgents(statusOnline, target)
+		if err != nil {
+			continue
+		}
+		for _, s := range agents {
+			online[s.Agent] = true
+		}
+	}
+	r.total = len(online)
+	return r
+}
+
+// lines describes the progress, given the results by agent and the agents
+// the command was delivered to.
+func (r *rollout) lines(byAgent map[string]*result, delivered map[string]bool) []string {
+	failures := make([]*result, 0)
+	for _, res := range byAgent {
+		if res.failed() {
+			failures = append(failures, res)
+		}
+	}
+	running := 0
+	for agent := range delivered {
+		if byAgent[agent] == nil {
+			running++
+		}
+	}
+	done := len(byAgent)
+	status := fmt.Sprintf("%s: %d done", r.c.ID, done)
+	if r.total > 0 {
+		status = fmt.Sprintf("%s: %d of %d done", r.c.ID, done, max(r.total, done))
+	}
+	status += fmt.Sprintf(", %d failed, %d running", len(failures), running)
+	if done > 0 && r.total > done {
+		eta := time.Since(r.start) * time.Duration(r.total-done) / time.Duration(done)
+		status += ", ETA " + eta.Round(time.Second).String()
+	}
+	lines := []string{status}
+	sort.Slice(failures, func(i, j int) bool { return failures[i].Created.After(failures[j].Created) })
+	for _, res := range failures[:min(len(failures), maxRecentFailures)] {
+		line := fmt.Sprintf("  failed: %s %s", res.Agent, res.outcome())
+		if msg, _, _ := strings.Cut(strings.TrimSpace(res.Error), "\n"); msg != "" {
+			line += ": " + msg
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+// getDelivered returns the agents command id was delivered to, as they
+// acknowledged it.
+func getDelivered(id, target string) (map[string]bool, error) {
+	resp, err := client.Get(target + "/commands?id=" + url.QueryEscape(id))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, responseError(resp)
+	}
+	cmds := make([]*cmd, 0)
+	if err = json.NewDecoder(resp.Body).Decode(&cmds); err != nil {
+		return nil, err
+	}
+	delivered := make(map[string]bool)
+	for _, c := range cmds {
+		for agent := range c.Delivered {
+			delivered[agent] = true
+		}
+	}
+	return delivered, nil
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+)
+
+// namespaceOf is the namespace of c, by its namespace label.
+func namespaceOf(c *cmd) string {
+	if ns := c.Labels[namespaceLabel]; ns != "" {
+		return ns
+	}
+	return defaultNamespace
+}
+
+// promoteNamespace returns the commands of ref, a command id or the trace of
+// a manifest, which succeeded in namespace from, for namespace to, under new
+// ids sharing trace, to be signed again. They target agents, or every agent
+// if the originals did. Commands that run after or await one another keep
+// doing so under their new ids.
+func promoteNamespace(ref, from, to string, agents []string, trace, target string) ([]*cmd, error) {
+	if !varName.MatchString(to) || to == from {
+		return nil, fmt.Errorf("invalid namespace %q to promote to", to)
+	}
+	stored, err := getCommands(nil, target)
+	if err != nil {
+		return nil, err
+	}
+	origs := make([]*cmd, 0)
+	for _, c := range stored {
+		if c.ID == ref || c.Trace == ref {
+			origs = append(origs, c)
+		}
+	}
+	if len(origs) == 0 {
+		return nil, fmt.Errorf("%s is no longer stored, send it again", ref)
+	}
+	ids := make(map[string]string) // promoted ids, by original id
+	cmds := make([]*cmd, 0, len(origs))
+	for _, orig := range origs {
+		switch {
+		case namespaceOf(orig) != from:
+			return nil, fmt.Errorf("%s went to namespace %s, not %s", orig.ID, namespaceOf(orig), from)
+		case orig.Type == sealedType:
+			return nil, errors.New("sealed commands are bound to their id, seal and send it again")
+		case len(orig.Agents) > 0 && len(agents) == 0:
+			return nil, fmt.Errorf("%s targeted agents of %s, give those of %s with -agents", orig.ID, from, to)
+		}
+		if err = succeeded(orig, target); err != nil {
+			return nil, err
+		}
+		c := redispatch(orig, trace)
+		c.Labels = maps.Clone(orig.Labels)
+		if c.Labels == nil {
+			c.Labels = make(map[string]string)
+		}
+		c.Labels[namespaceLabel] = to
+		if len(orig.Agents) > 0 {
+			c.Agents = append(make([]string, 0), agents...)
+		}
+		ids[orig.ID] = c.ID
+		cmds = append(cmds, c)
+	}
+	for _, c := range cmds {
+		c.After, c.Await = renamed(c.After, ids), renamed(c.Await, ids)
+	}
+	return cmds, nil
+}
+
+// succeeded checks that every agent that reported c succeeded, and that
+// every agent it targets reported.
+func succeeded(c *cmd, target string) error {
+	results, err := getResults(c.ID, target)
+	if err != nil {
+		return err
+	}
+	ok := make(map[string]bool)
+	for _, res := range results {
+		if res.Flag != "" || res.State == stateRebooting {
+			continue
+		}
+		if res.failed() {
+			return fmt.Errorf("%s failed on %s", c.ID, res.Agent)
+		}
+		ok[res.Agent] = true
+	}
+	if len(ok) == 0 {
+		return fmt.Errorf("%s has no results yet", c.ID)
+	}
+	for _, agent := range c.Agents {
+		if !ok[agent] {
+			return fmt.Errorf("%s has no result of %s yet", c.ID, agent)
+		}
+	}
+	return nil
+}
+
+// renamed returns ids, with those promoted replaced by their new ids.
+func renamed(ids []string, promoted map[string]string) []string {
+	if len(ids) == 0 {
+		return ids
+	}
+	out := make([]string, len(ids))
+	for i, id := range ids {
+		out[i] = id
+		if p, ok := promoted[id]; ok {
+			out[i] = p
+		}
+	}
+	return out
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// proxy lets the API sit behind reverse proxies and be called from
+// browsers: it takes the client address from the headers of trusted
+// proxies, answers CORS requests of allowed origins, and serves the API
+// under a base path.
+type proxy struct {
+	next    http.Handler
+	base    string
+	trusted []*net.IPNet
+	origins []string
+}
+
+func newProxy(next http.Handler, base, trusted, origins string) (*proxy, error) {
+	p := &proxy{next: next, base: strings.TrimSuffix(base, "/")}
+	if p.base != "" && !strings.HasPrefix(p.base, "/") {
+		p.base = "/" + p.base
+	}
+	if trusted != "" {
+		nets, err := parseNets(trusted)
+		if err != nil {
+			return nil, err
+		}
+		p.trusted = nets
+	}
+	for _, origin := range strings.Split(origins, ",") {
+		if origin = strings.TrimSpace(origin); origin != "" {
+			p.origins = append(p.origins, strings.TrimSuffix(origin, "/"))
+		}
+	}
+	return p, nil
+}
+
+func (p *proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set(requestIDHeader, requestID(r))
+	if len(p.trusted) > 0 {
+		if addr := p.client(r); addr != "" {
+			r.RemoteAddr = addr
+		}
+	}
+	if origin := r.Header.Get("Origin"); origin != "" && p.allowsOrigin(origin) {
+		h := w.Header()
+		h.Set("Access-Control-Allow-Origin", origin)
+		h.Add("Vary", "Origin")
+		h.Set("Access-Control-Expose-Headers", "*")
+		if r.Method == "OPTIONS" && r.Header.Get("Access-Control-Request-Method") != "" {
+			h.Set("Access-Control-Allow-Methods", "GET, HEAD, POST, PUT, DELETE")
+			h.Set("Access-Control-Allow-Headers", r.Header.Get("Access-Control-Request-Headers"))
+			h.Set("Access-Control-Max-Age", "600")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+	}
+	if p.base != "" {
+		if r.URL.Path != p.base && !strings.HasPrefix(r.URL.Path, p.base+"/") {
+			httpError(w, "not found", http.StatusNotFound)
+			return
+		}
+		http.StripPrefix(p.base, p.next).ServeHTTP(w, r)
+		return
+	}
+	p.next.ServeHTTP(w, r)
+}
+
+func (p *proxy) allowsOrigin(origin string) bool {
+	return slices.Contains(p.origins, "*") || slices.Contains(p.origins, origin)
+}
+
+// client returns the address of the client of a request relayed by trusted
+// proxies: the last address in X-Forwarded-For that is not a trusted proxy,
+// or X-Real-IP. Addresses sent by untrusted peers are ignored, as they are
+// chosen by the client.
+func (p *proxy) client(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if !containsIP(p.trusted, net.ParseIP(host)) {
+		return ""
+	}
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip := net.ParseIP(strings.TrimSpace(hops[i]))
+		if ip == nil {
+			break
+		}
+		if !containsIP(p.trusted, ip) {
+			return ip.String()
+		}
+	}
+	if ip := net.ParseIP(strings.TrimSpace(r.Header.Get("X-Real-IP"))); ip != nil {
+		return ip.String()
+	}
+	return ""
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// answer is a distinct value reported by agents to a query.
+type answer struct {
+	Value  string
+	Failed bool `json:",omitempty"`
+	Agents []string
+}
+
+// datum is the value an agent reported at a path into its result data.
+type datum struct {
+	Agent, Value string
+}
+
+// lookupData renders the value at a dotted path, which may start with a
+// dot, into the data of a result.
+func lookupData(data json.RawMessage, path string) (string, bool) {
+	var doc any
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if len(data) == 0 || dec.Decode(&doc) != nil {
+		return "", false
+	}
+	if path = strings.TrimPrefix(path, "."); path == "" {
+		return string(data), true
+	}
+	return jsonPath(doc, path)
+}
+
+// groupAnswers groups results by their trimmed output, or the value at path
+// into their data if path is set, or error, most common first.
+func groupAnswers(results []*result, path string) []*answer {
+	byValue := make(map[string]*answer)
+	answers := make([]*answer, 0)
+	for _, res := range results {
+		value, failed := strings.TrimSpace(res.Output), false
+		if path != "" {
+			var ok bool
+			if value, ok = lookupData(res.Data, path); !ok {
+				value, failed = path+" not found", true
+			}
+		}
+		if res.Error != "" {
+			value, failed = strings.TrimSpace(res.Error), true
+		}
+		key := fmt.Sprintf("%t %s", failed, value)
+		a, ok := byValue[key]
+		if !ok {
+			a = &answer{Value: value, Failed: failed}
+			byValue[key] = a
+			answers = append(answers, a)
+		}
+		a.Agents = append(a.Agents, res.Agent)
+	}
+	sort.SliceStable(answers, func(i, j int) bool {
+		if len(answers[i].Agents) != len(answers[j].Agents) {
+			return len(answers[i].Agents) > len(answers[j].Agents)
+		}
+		return answers[i].Value < answers[j].Value
+	})
+	return answers
+}
+
+func printAnswers(c *cmd, answers []*answer, reported int) {
+	for _, a := range answers {
+		value := a.Value
+		if a.Failed {
+			value = "error: " + value
+		}
+		if strings.Contains(value, "\n") {
+			value = "\n    " + strings.ReplaceAll(value, "\n", "\n    ")
+		} else {
+			value = " " + value
+		}
+		fmt.Printf("%d agents:%s\n  %s\n", len(a.Agents), value, strings.Join(a.Agents, ", "))
+	}
+	if len(c.Agents) > reported {
+		fmt.Printf("%d did not answer\n", len(c.Agents)-reported)
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	// maxQueued is how many commands an agent holds for its workers.
+	maxQueued = 1000
+	// maxAfter is how many commands a command may run after.
+	maxAfter = 100
+	// maxAfterWait is how long a command without a window waits for the
+	// commands it runs after.
+	maxAfterWait = 24 * time.Hour
+)
+
+// queue holds the commands an agent received until a worker is free to run
+// them: those with the highest priority first, then in the order received,
+// each once the commands it runs after succeeded on the agent. A command
+// runs after one the agent executed before it started, whose outcome it
+// does not know, and fails if one failed, or never came by the close of
+// its window, or within maxAfterWait without one.
+type queue struct {
+	mu       sync.Mutex
+	ready    *sync.Cond
+	waiting  []*queued
+	outcomes map[string]bool // whether commands run succeeded, by id
+	order    []string        // ids of outcomes, oldest first
+	before   map[string]bool // ids executed before the agent started
+	running  int
+	closed   bool
+}
+
+func newQueue(before map[string]bool) *queue {
+	q := &queue{outcomes: make(map[string]bool), before: before}
+	q.ready = sync.NewCond(&q.mu)
+	return q
+}
+
+// queued is a command waiting in the queue, until its deadline for the
+// commands it runs after.
+type queued struct {
+	*cmd
+	deadline time.Time
+}
+
+// push queues c, unless the queue is full.
+func (q *queue) push(c *cmd) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.waiting) >= maxQueued {
+		return errors.New("too many commands queued")
+	}
+	qc := &queued{cmd: c}
+	if len(c.After) > 0 {
+		qc.deadline = time.Now().Add(maxAfterWait)
+		if !c.NotAfter.IsZero() {
+			qc.deadline = c.NotAfter
+		}
+		// Wake the workers to fail c, if it is still waiting then.
+		time.AfterFunc(time.Until(qc.deadline), func() {
+			q.mu.Lock()
+			defer q.mu.Unlock()
+			q.ready.Broadcast()
+		})
+	}
+	q.waiting = append(q.waiting, qc)
+	q.ready.Broadcast()
+	return nil
+}
+
+// pop waits for a command to run, and returns it with an error if it must
+// not run, as a command it runs after failed. Once the queue is closed and
+// no command runs, it returns the commands left with an error, then nil.
+// Workers call done when they are done with the command.
+func (q *queue) pop() (*cmd, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for {
+		next := -1
+		var nextErr error
+		now := time.Now()
+		for i, c := range q.waiting {
+			runnable, err := q.runnable(c, now)
+			if !runnable || next >= 0 && c.Priority <= q.waiting[next].Priority {
+				continue
+			}
+			next, nextErr = i, err
+		}
+		if next < 0 && q.closed && q.running == 0 && len(q.waiting) > 0 {
+			next, nextErr = 0, errors.New("the commands it runs after did not run")
+		}
+		if next >= 0 {
+			c := q.waiting[next]
+			q.waiting = append(q.waiting[:next], q.waiting[next+1:]...)
+			q.running++
+			return c.cmd, nextErr
+		}
+		if q.closed && q.running == 0 {
+			return nil, nil
+		}
+		q.ready.Wait()
+	}
+}
+
+// runnable tells whether the commands c runs after are done, and if one
+// failed, or the deadline passed first, why c must not run. The caller
+// holds q.mu.
+func (q *queue) runnable(c *queued, now time.Time) (bool, error) {
+	for _, id := range c.After {
+		ok, done := q.outcomes[id]
+		switch {
+		case done && !ok:
+			return true, fmt.Errorf("not executed, as command %s failed", id)
+		case !done && !q.before[id] && now.Before(c.deadline):
+			return false, nil
+		case !done && !q.before[id]:
+			return true, fmt.Errorf("not executed, as command %s did not run by %s", id, c.deadline.Format(time.RFC3339))
+		}
+	}
+	return true, nil
+}
+
+// finished records the outcome of command id, for the commands that run
+// after it.
+func (q *queue) finished(id string, ok bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if _, seen := q.outcomes[id]; !seen {
+		q.order = append(q.order, id)
+	}
+	q.outcomes[id] = ok
+	if len(q.order) > maxExecuted {
+		delete(q.outcomes, q.order[0])
+		q.order = q.order[1:]
+	}
+	q.ready.Broadcast()
+}
+
+func (q *queue) done() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.running--
+	q.ready.Broadcast()
+}
+
+// close makes pop return the commands left, then nil.
+func (q *queue) close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.closed = true
+	q.ready.Broadcast()
+}
+
+func (q *queue) len() int {
+	if q == nil {
+		return 0
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.waiting)
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestQueueAfterDeadline(t *testing.T) {
+	q := newQueue(nil)
+	if err := q.push(&cmd{ID: "b", After: []string{"a"}, NotAfter: time.Now().Add(50 * time.Millisecond)}); err != nil {
+		t.Fatal(err)
+	}
+	popped := make(chan error, 1)
+	go func() {
+		c, err := q.pop()
+		if c == nil || c.ID != "b" {
+			t.Errorf("popped %v", c)
+		}
+		popped <- err
+	}()
+	select {
+	case err := <-popped:
+		if err == nil || !strings.Contains(err.Error(), "did not run by") {
+			t.Errorf("got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("still waiting for a command that never came")
+	}
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Permissions granted by roles.
+const (
+	permView    = "view"
+	permSend    = "send"
+	permApprove = "approve"
+	permAdmin   = "admin"
+	permEnroll  = "enroll"
+)
+
+// rbac grants roles to operators who authenticate with a token instead of
+// signing with the key. Holders of the key are not restricted.
+type rbac struct {
+	Roles map[string]*role `json:"roles"`
+	// Grants maps operator names, emails or groups to roles.
+	Grants map[string][]string `json:"grants"`
+	// Dangerous lists patterns of command names that are held until an
+	// operator with the approve permission approves them.
+	Dangerous []string `json:"dangerous"`
+	// restricted is set with -rbac or -oidc, so reads need a token or the
+	// key.
+	restricted bool
+}
+
+type role struct {
+	Can []string `json:"can"`
+	// Targets lists patterns of agent ids the role may send commands to.
+	// Only "*" allows commands targeting all agents.
+	Targets []string `json:"targets"`
+}
+
+var builtinRoles = map[string]*role{
+	"viewer":     {Can: []string{permView}},
+	"dispatcher": {Can: []string{permView, permSend}, Targets: []string{"*"}},
+	"admin":      {Can: []string{permView, permSend, permApprove, permAdmin}, Targets: []string{"*"}},
+}
+
+func newRBAC() *rbac {
+	return &rbac{Roles: make(map[string]*role), Grants: make(map[string][]string)}
+}
+
+func loadRBAC(file string) (*rbac, error) {
+	p := newRBAC()
+	if file != "" {
+		f, err := os.Open(file)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		dec := json.NewDecoder(f)
+		dec.DisallowUnknownFields()
+		if err = dec.Decode(p); err != nil {
+			return nil, fmt.Errorf("%s: %w", file, err)
+		}
+	}
+	if p.Roles == nil {
+		p.Roles = make(map[string]*role)
+	}
+	if p.Grants == nil {
+		p.Grants = make(map[string][]string)
+	}
+	for name, r := range builtinRoles {
+		if _, ok := p.Roles[name]; !ok {
+			p.Roles[name] = r
+		}
+	}
+	return p, nil
+}
+
+// grant parses comma-separated who=role pairs.
+func (p *rbac) grant(pairs string) error {
+	for _, pair := range strings.Split(pairs, ",") {
+		if pair == "" {
+			continue
+		}
+		who, r, ok := strings.Cut(pair, "=")
+		if !ok {
+			return fmt.Errorf("invalid grant %q", pair)
+		}
+		p.Grants[who] = append(p.Grants[who], r)
+	}
+	return p.validate()
+}
+
+func (p *rbac) validate() error {
+	for who, roles := range p.Grants {
+		for _, r := range roles {
+			if p.Roles[r] == nil {
+				return fmt.Errorf("%s is granted unknown role %s", who, r)
+			}
+		}
+	}
+	for _, pattern := range p.Dangerous {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid pattern %q", pattern)
+		}
+	}
+	return nil
+}
+
+// roles returns the roles granted to op by name or group.
+func (p *rbac) roles(op *operator) []*role {
+	roles := append(make([]*role, 0), op.scopes...)
+	for _, who := range append([]string{op.Name}, op.Groups...) {
+		for _, r := range p.Grants[who] {
+			roles = append(roles, p.Roles[r])
+		}
+	}
+	return roles
+}
+
+func (p *rbac) can(op *operator, perm string) bool {
+	for _, r := range p.roles(op) {
+		if contains(r.Can, perm) || contains(r.Can, permAdmin) {
+			return true
+		}
+	}
+	return false
+}
+
+// canSend reports whether op may send c to every agent it targets.
+func (p *rbac) canSend(op *operator, c *cmd) error {
+	agents := c.Agents
+	if len(agents) == 0 {
+		agents = []string{"*"}
+	}
+	for _, agent := range agents {
+		allowed := false
+		for _, r := range p.roles(op) {
+			if contains(r.Can, permSend) || contains(r.Can, permAdmin) {
+				allowed = allowed || matchAny(r.Targets, agent)
+			}
+		}
+		if !allowed {
+			if agent == "*" {
+				return fmt.Errorf("%s may not send commands to all agents", op.Name)
+			}
+			return fmt.Errorf("%s may not send commands to %s", op.Name, agent)
+		}
+	}
+	return nil
+}
+
+// dangerous reports whether c must be approved before it is queued. The
+// patterns match the binaries c and its verification run, or its type.
+// Commands whose binary is unknown to the server, as it is sealed,
+// downloaded or a script, and files, which may be written anywhere, are
+// dangerous as soon as any pattern is.
+func (p *rbac) dangerous(c *cmd) bool {
+	if len(p.Dangerous) == 0 {
+		return false
+	}
+	if c.Type != "" && matchAny(p.Dangerous, c.Type) {
+		return true
+	}
+	if bin := c.verifyBinary(); bin != "" && matchAny(p.Dangerous, bin) {
+		return true
+	}
+	switch c.Type {
+	case "":
+		return c.Name == "" || matchAny(p.Dangerous, path.Base(c.Name))
+	case superviseType:
+		action, _, argv, err := parseSupervise(c.Args)
+		return err != nil || action == "start" && matchAny(p.Dangerous, path.Base(argv[0]))
+	case "script", "file", artifactType, sealedType:
+		return true
+	}
+	return false
+}
+
+func matchAny(patterns []string, s string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, s); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func approve(id, target string) error {
+	resp, err := client.Post(target+"/commands/"+id+"/approve", "application/json", nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return responseError(resp)
+	}
+	return nil
+}
+
+// handleApprove queues a held command, signed again by the server with the
+// approver recorded. Operators may not approve their own commands.
+func (a *app) handleApprove(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/commands/"), "/approve")
+	op, err := a.operator(r)
+	if err != nil || op == nil {
+		httpError(w, "approving needs a token", http.StatusUnauthorized)
+		return
+	}
+	if !a.rbac.can(op, permApprove) {
+		httpError(w, op.Name+" may not approve commands", http.StatusForbidden)
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	c := a.held[id]
+	switch {
+	case c == nil:
+		httpError(w, "not found", http.StatusNotFound)
+		return
+	case c.Operator == op.Name:
+		httpError(w, op.Name+" may not approve their own command", http.StatusForbidden)
+		return
+	}
+	rule, err := a.admit(c)
+	if err != nil {
+		httpError(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	delete(a.held, id)
+	c.Approver = op.Name
+	c.Created = time.Now()
+	c.Sum = hex.EncodeToString(signCmd(c, a.hasher))
+	if a.awaitCosign(w, c, rule) || a.await(w, c, rule) {
+		return
+	}
+	if err = a.enqueue(c); err != nil {
+		httpError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	a.audit("approved", c, rule, nil)
+	w.Write([]byte(c.ID))
+	fmt.Printf("%s: %s approved %s\n", c.Created, op.Name, c.ref())
+}
+
+func (a *app) handleGetHeld(w http.ResponseWriter, r *http.Request) {
+	op, err := a.operator(r)
+	if err != nil || op == nil || !a.rbac.can(op, permView) {
+		httpError(w, "listing held commands needs a token", http.StatusUnauthorized)
+		return
+	}
+	a.mu.Lock()
+	held := make([]*cmd, 0, len(a.held))
+	for _, c := range a.held {
+		held = append(held, c)
+	}
+	a.mu.Unlock()
+	sort.Slice(held, func(i, j int) bool { return held[i].Created.Before(held[j].Created) })
+	payload, err := json.Marshal(held)
+	if err != nil {
+		httpError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write(payload)
+}
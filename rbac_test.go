@@ -0,0 +1,30 @@
+package main
+
+import "testing"
+
+func TestDangerous(t *testing.T) {
+	p := &rbac{Dangerous: []string{"rm", "reboot"}}
+	tests := []struct {
+		name string
+		c    cmd
+		want bool
+	}{
+		{"safe binary", cmd{Name: "uptime"}, false},
+		{"dangerous binary", cmd{Name: "/bin/rm"}, true},
+		{"no binary", cmd{}, true},
+		{"dangerous type", cmd{Type: rebootType}, true},
+		{"dangerous verification", cmd{Name: "uptime", Verify: &check{Cmd: []string{"/usr/bin/rm", "-rf", "/"}}}, true},
+		{"safe verification", cmd{Name: "uptime", Verify: &check{Cmd: []string{"curl"}}}, false},
+		{"url verification", cmd{Name: "uptime", Verify: &check{URL: "http://localhost"}}, false},
+		{"file", cmd{Type: "file", Args: []string{"/etc/passwd", "x"}}, true},
+		{"script", cmd{Type: "script"}, true},
+	}
+	for _, tt := range tests {
+		if got := p.dangerous(&tt.c); got != tt.want {
+			t.Errorf("%s: got %v", tt.name, got)
+		}
+	}
+	if (&rbac{}).dangerous(&cmd{Type: "file"}) {
+		t.Error("dangerous without patterns")
+	}
+}
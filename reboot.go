@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// rebootType reboots the host, after an optional delay argument. The
+	// agent reports the result in state rebooting, and once the host is
+	// back, a second result telling whether it rebooted.
+	rebootType = "reboot"
+	// defaultRebootDelay leaves the agent time to report it is rebooting.
+	defaultRebootDelay = 5 * time.Second
+	// rebootGrace is how long after its scheduled reboot a host has to
+	// report back, before the server flags it lost.
+	rebootGrace = 15 * time.Minute
+	// bootJitter is how much the boot time reported by the host may move
+	// without a reboot, as the clock is adjusted.
+	bootJitter = 5 * time.Second
+	statusLost = "lost"
+)
+
+// pendingReboot is a reboot an agent scheduled, kept in its state directory
+// to report the reboot once the host is back. Without Cmd, it is the data
+// of the result in state rebooting.
+type pendingReboot struct {
+	Cmd   *cmd      `json:",omitempty"`
+	Since time.Time // the boot time before the reboot
+	At    time.Time // when the reboot was scheduled
+}
+
+// rebootWatch is a reboot the server waits for an agent to report back
+// from.
+type rebootWatch struct {
+	Cmd      string
+	Deadline time.Time
+	Lost     bool
+}
+
+func rebootDelay(c *cmd) (time.Duration, error) {
+	switch len(c.Args) {
+	case 0:
+		return defaultRebootDelay, nil
+	case 1:
+		d, err := time.ParseDuration(c.Args[0])
+		if err != nil || d < 0 {
+			return 0, fmt.Errorf("invalid reboot delay %q", c.Args[0])
+		}
+		return d, nil
+	}
+	return 0, errors.New("reboot takes a single delay argument")
+}
+
+// reboot saves the reboot to the state directory and schedules it, so the
+// result in state rebooting is reported first.
+func (ag *agent) reboot(_ context.Context, c *cmd, _ []string) ([]byte, json.RawMessage, error) {
+	if ag.state == nil {
+		return nil, nil, errors.New("reboot needs a state dir, to report back")
+	}
+	delay, err := rebootDelay(c)
+	if err != nil {
+		return nil, nil, err
+	}
+	since, err := bootTime()
+	if err != nil {
+		return nil, nil, err
+	}
+	p := &pendingReboot{Cmd: c, Since: since, At: time.Now().Add(delay).Round(0)}
+	if err = ag.state.saveReboot(p); err != nil {
+		return nil, nil, err
+	}
+	data, err := json.Marshal(&pendingReboot{Since: p.Since, At: p.At})
+	if err != nil {
+		return nil, nil, err
+	}
+	time.AfterFunc(delay, func() { ag.rebootNow(c) })
+	out := fmt.Sprintf("rebooting at %s, up since %s", p.At.Format(time.RFC3339), since.Format(time.RFC3339))
+	return []byte(out), data, nil
+}
+
+// rebootNow reboots the host, reporting a failure to start the reboot as
+// the final result of c.
+func (ag *agent) rebootNow(c *cmd) {
+	name, args := "shutdown", []string{"-r", "now"}
+	if runtime.GOOS == "windows" {
+		args = []string{"/r", "/t", "0"}
+	}
+	fmt.Printf("%s: rebooting\n", c.ref())
+	out, err := exec.Command(name, args...).CombinedOutput()
+	if err == nil {
+		return
+	}
+	fmt.Printf("%s: reboot: %s\n", c.ref(), err)
+	if rmErr := ag.state.clearReboot(); rmErr != nil {
+		fmt.Printf("%s: %s\n", c.ref(), rmErr)
+	}
+	ag.report(c, newResult(c, ag.id, out, fmt.Errorf("reboot failed: %w", err)))
+}
+
+// reportReboot reports whether the host rebooted, if the agent scheduled a
+// reboot before it stopped.
+func (ag *agent) reportReboot() {
+	p, err := ag.state.loadReboot()
+	if err != nil || p == nil {
+		if err != nil {
+			fmt.Println(err)
+		}
+		return
+	}
+	since, err := bootTime()
+	if err == nil && !since.After(p.Since.Add(bootJitter)) {
+		err = fmt.Errorf("did not reboot, up since %s", since.Format(time.RFC3339))
+	}
+	var out []byte
+	if err == nil {
+		out = []byte("rebooted, up since " + since.Format(time.RFC3339))
+	}
+	res := newResult(p.Cmd, ag.id, out, err)
+	fmt.Printf("%s: %s%s\n", p.Cmd.ref(), res.Output, res.Error)
+	ag.report(p.Cmd, res)
+	if err = ag.state.clearReboot(); err != nil {
+		fmt.Println(err)
+	}
+}
+
+func (s *state) saveReboot(p *pendingReboot) error {
+	data, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	return writeAtomic(filepath.Join(s.dir, "reboot"), data)
+}
+
+// loadReboot returns the reboot the agent scheduled, or nil if none.
+func (s *state) loadReboot() (*pendingReboot, error) {
+	data, err := os.ReadFile(filepath.Join(s.dir, "reboot"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	p := &pendingReboot{}
+	if err = json.Unmarshal(data, p); err != nil || p.Cmd == nil {
+		return nil, fmt.Errorf("invalid reboot in %s: %v", s.dir, err)
+	}
+	return p, nil
+}
+
+func (s *state) clearReboot() error {
+	err := os.Remove(filepath.Join(s.dir, "reboot"))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// bootTime returns when the host booted.
+func bootTime() (time.Time, error) {
+	switch runtime.GOOS {
+	case "linux":
+		f, err := os.Open("/proc/stat")
+		if err != nil {
+			return time.Time{}, err
+		}
+		defer f.Close()
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			if v, ok := strings.CutPrefix(scanner.Text(), "btime "); ok {
+				sec, err := strconv.ParseInt(strings.TrimSpace(v), 10, 64)
+				return time.Unix(sec, 0), err
+			}
+		}
+		return time.Time{}, errors.New("no btime in /proc/stat")
+	case "darwin", "freebsd", "netbsd", "openbsd":
+		// Prints { sec = 1700000000, usec = 0 } and a date, or the seconds.
+		out, err := exec.Command("sysctl", "-n", "kern.boottime").Output()
+		if err != nil {
+			return time.Time{}, err
+		}
+		v := strings.TrimPrefix(strings.TrimSpace(string(out)), "{ sec = ")
+		v, _, _ = strings.Cut(v, ",")
+		sec, err := strconv.ParseInt(strings.TrimSpace(v), 10, 64)
+		return time.Unix(sec, 0), err
+	case "windows":
+		out, err := exec.Command("powershell", "-NoProfile", "-Command",
+			"(Get-CimInstance Win32_OperatingSystem).LastBootUpTime.ToUniversalTime().ToString('o')").Output()
+		if err != nil {
+			return time.Time{}, err
+		}
+		return time.Parse(time.RFC3339Nano, strings.TrimSpace(string(out)))
+	}
+	return time.Time{}, fmt.Errorf("boot time is unknown on %s", runtime.GOOS)
+}
+
+// trackReboot follows the reboots agents report: a result in state
+// rebooting starts waiting for the agent, and a later result of the same
+// command ends it. The caller holds a.mu.
+func (a *app) trackReboot(res *result) {
+	if res.State == stateRebooting {
+		p := &pendingReboot{At: res.Created}
+		if err := json.Unmarshal(res.Data, p); err != nil || p.At.IsZero() {
+			p.At = res.Created
+		}
+		a.reboots[res.Agent] = &rebootWatch{Cmd: res.Cmd, Deadline: p.At.Add(rebootGrace)}
+		fmt.Printf("%s: agent %s is rebooting\n", res.Created, res.Agent)
+		return
+	}
+	w := a.reboots[res.Agent]
+	if w == nil || w.Cmd != res.Cmd {
+		return
+	}
+	delete(a.reboots, res.Agent)
+	if w.Lost {
+		a.notifyPresence(res.Agent, statusOnline, time.Now())
+		return
+	}
+	fmt.Printf("%s: agent %s is back from reboot\n", res.Created, res.Agent)
+}
+
+// watchReboots flags the agents that did not report back from a reboot
+// within rebootGrace as lost.
+func (a *app) watchReboots() {
+	for now := range time.Tick(offlineEvery) {
+		a.mu.Lock()
+		for agent, w := range a.reboots {
+			if w.Lost || now.Before(w.Deadline) {
+				continue
+			}
+			w.Lost = true
+			a.notifyPresence(agent, statusLost, now)
+		}
+		a.mu.Unlock()
+	}
+}
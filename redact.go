@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+)
+
+const redacted = "[REDACTED]"
+
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(v string) error {
+	*l = append(*l, v)
+	return nil
+}
+
+type redactor struct {
+	patterns []*regexp.Regexp
+	secrets  []string
+	mu       sync.Mutex
+}
+
+func newRedactor(patterns []string, secretsFile string) (*redactor, error) {
+	r := &redactor{}
+	for _, p := range patterns {
+		re, err := regexp.Compile(p)
+		if err != nil {
+			return nil, err
+		}
+		r.patterns = append(r.patterns, re)
+	}
+	if secretsFile == "" {
+		return r, nil
+	}
+	f, err := os.Open(secretsFile)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if secret := strings.TrimSpace(scanner.Text()); secret != "" {
+			r.secrets = append(r.secrets, secret)
+		}
+	}
+	return r, scanner.Err()
+}
+
+// add redacts secret from then on, as when it is decrypted for a command.
+func (r *redactor) add(secret string) {
+	if secret == "" {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !slices.Contains(r.secrets, secret) {
+		r.secrets = append(r.secrets, secret)
+	}
+}
+
+func (r *redactor) redact(s string) string {
+	r.mu.Lock()
+	secrets := r.secrets
+	r.mu.Unlock()
+	for _, secret := range secrets {
+		s = strings.ReplaceAll(s, secret, redacted)
+	}
+	for _, re := range r.patterns {
+		s = re.ReplaceAllString(s, redacted)
+	}
+	return s
+}
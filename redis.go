@@ -0,0 +1,549 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// redisStore keeps state in Redis, so several servers behind a load
+// balancer share one queue and agent registry.
+type redisStore struct {
+	addr, password, db string
+	conn               net.Conn
+	r                  *bufio.Reader
+}
+
+// openRedisStore connects to redis://[:password@]host[:port][/db].
+func openRedisStore(dsn string) (*redisStore, error) {
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return nil, err
+	}
+	rs := &redisStore{addr: u.Host, db: strings.TrimPrefix(u.Path, "/")}
+	if _, _, err = net.SplitHostPort(rs.addr); err != nil {
+		rs.addr = net.JoinHostPort(rs.addr, "6379")
+	}
+	if u.User != nil {
+		rs.password, _ = u.User.Password()
+	}
+	if _, err = rs.do("PING"); err != nil {
+		return nil, err
+	}
+	return rs, nil
+}
+
+func (rs *redisStore) dial() error {
+	conn, err := net.DialTimeout("tcp", rs.addr, 5*time.Second)
+	if err != nil {
+		return err
+	}
+	rs.conn, rs.r = conn, bufio.NewReader(conn)
+	if rs.password != "" {
+		if _, err = rs.roundTrip("AUTH", rs.password); err != nil {
+			rs.close()
+			return err
+		}
+	}
+	if rs.db != "" {
+		if _, err = rs.roundTrip("SELECT", rs.db); err != nil {
+			rs.close()
+			return err
+		}
+	}
+	return nil
+}
+
+func (rs *redisStore) close() {
+	rs.conn.Close()
+	rs.conn = nil
+}
+
+// do sends a command, connecting first if needed. The connection is
+// dropped on network errors, and redialed by the next command.
+func (rs *redisStore) do(args ...string) (any, error) {
+	if rs.conn == nil {
+		if err := rs.dial(); err != nil {
+			return nil, err
+		}
+	}
+	reply, err := rs.roundTrip(args...)
+	var redisErr redisError
+	if err != nil && !errors.As(err, &redisErr) {
+		rs.close()
+	}
+	return reply, err
+}
+
+func (rs *redisStore) roundTrip(args ...string) (any, error) {
+	rs.conn.SetDeadline(time.Now().Add(10 * time.Second))
+	w := bufio.NewWriter(rs.conn)
+	fmt.Fprintf(w, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(w, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if err := w.Flush(); err != nil {
+		return nil, err
+	}
+	return readReply(rs.r)
+}
+
+type redisError string
+
+func (e redisError) Error() string {
+	return "redis: " + string(e)
+}
+
+// readReply parses a RESP reply into a string, an int64, a []byte (nil for
+// a missing value), or a []any.
+func readReply(r *bufio.Reader) (any, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, errors.New("redis: empty reply")
+	}
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return []byte(nil), err
+		}
+		data := make([]byte, n+2)
+		if _, err = io.ReadFull(r, data); err != nil {
+			return nil, err
+		}
+		return data[:n], nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return []any(nil), err
+		}
+		items := make([]any, n)
+		for i := range items {
+			if items[i], err = readReply(r); err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	}
+	return nil, fmt.Errorf("redis: unexpected reply %q", line)
+}
+
+func (rs *redisStore) push(key string, v any, keep int) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if _, err = rs.do("RPUSH", key, string(data)); err != nil {
+		return err
+	}
+	if keep > 0 {
+		_, err = rs.do("LTRIM", key, strconv.Itoa(-keep), "-1")
+	}
+	return err
+}
+
+// list decodes the JSON values in reply into a slice pointed to by v.
+func list(reply any, v any) error {
+	items, _ := reply.([]any)
+	raw := make([]json.RawMessage, 0, len(items))
+	for _, item := range items {
+		if data, ok := item.([]byte); ok {
+			raw = append(raw, data)
+		}
+	}
+	data, err := json.Marshal(raw)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+func (rs *redisStore) addCmd(c *cmd) error {
+	return rs.push("captain:cmds", c, maxPending)
+}
+
+func (rs *redisStore) cmds() ([]*cmd, error) {
+	reply, err := rs.do("LRANGE", "captain:cmds", "0", "-1")
+	if err != nil {
+		return nil, err
+	}
+	cmds := make([]*cmd, 0)
+	return cmds, list(reply, &cmds)
+}
+
+// addResult also indexes the command by the time of its latest result,
+// for pruning.
+func (rs *redisStore) addResult(res *result) error {
+	if err := rs.push("captain:results:"+res.Cmd, res, 0); err != nil {
+		return err
+	}
+	_, err := rs.do("ZADD", "captain:results", strconv.FormatInt(res.Created.UnixMilli(), 10), res.Cmd)
+	return err
+}
+
+func (rs *redisStore) results(cmd string) ([]*result, error) {
+	reply, err := rs.do("LRANGE", "captain:results:"+cmd, "0", "-1")
+	if err != nil {
+		return nil, err
+	}
+	results := make([]*result, 0)
+	return results, list(reply, &results)
+}
+
+func (rs *redisStore) addLog(l *log) error {
+	return rs.push("captain:logs", l, maxPending)
+}
+
+func (rs *redisStore) logs() ([]*log, error) {
+	reply, err := rs.do("LRANGE", "captain:logs", "0", "-1")
+	if err != nil {
+		return nil, err
+	}
+	logs := make([]*log, 0)
+	return logs, list(reply, &logs)
+}
+
+// addDelivery also indexes the command by the time of its latest delivery,
+// for pruning.
+func (rs *redisStore) addDelivery(cmd, agent string, t time.Time) error {
+	if _, err := rs.do("HSETNX", "captain:delivered:"+cmd, agent, t.Format(time.RFC3339Nano)); err != nil {
+		return err
+	}
+	_, err := rs.do("ZADD", "captain:delivered", strconv.FormatInt(t.UnixMilli(), 10), cmd)
+	return err
+}
+
+func (rs *redisStore) deliveries(cmd string) (map[string]time.Time, error) {
+	reply, err := rs.do("HGETALL", "captain:delivered:"+cmd)
+	if err != nil {
+		return nil, err
+	}
+	items, _ := reply.([]any)
+	delivered := make(map[string]time.Time, len(items)/2)
+	for i := 0; i+1 < len(items); i += 2 {
+		agent, _ := items[i].([]byte)
+		value, _ := items[i+1].([]byte)
+		t, err := time.Parse(time.RFC3339Nano, string(value))
+		if err != nil {
+			return nil, err
+		}
+		delivered[string(agent)] = t
+	}
+	return delivered, nil
+}
+
+func (rs *redisStore) putKey(k *agentKey) error {
+	data, err := json.Marshal(k)
+	if err != nil {
+		return err
+	}
+	_, err = rs.do("HSET", "captain:keys", k.Agent, string(data))
+	return err
+}
+
+func (rs *redisStore) key(agent string) (*agentKey, error) {
+	reply, err := rs.do("HGET", "captain:keys", agent)
+	data, _ := reply.([]byte)
+	if err != nil || data == nil {
+		return nil, err
+	}
+	k := &agentKey{}
+	return k, json.Unmarshal(data, k)
+}
+
+func (rs *redisStore) putSecret(s *secret) error {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	_, err = rs.do("HSET", "captain:secrets:"+s.Agent, s.Name, string(data))
+	return err
+}
+
+func (rs *redisStore) secrets(agent string) ([]*secret, error) {
+	reply, err := rs.do("HVALS", "captain:secrets:"+agent)
+	if err != nil {
+		return nil, err
+	}
+	secrets := make([]*secret, 0)
+	return secrets, list(reply, &secrets)
+}
+
+func (rs *redisStore) forget(agent string) error {
+	if _, err := rs.do("HDEL", "captain:keys", agent); err != nil {
+		return err
+	}
+	_, err := rs.do("DEL", "captain:secrets:"+agent)
+	return err
+}
+
+func (rs *redisStore) putToken(t *apiToken) error {
+	data, err := json.Marshal(t)
+	if err != nil {
+		return err
+	}
+	_, err = rs.do("HSET", "captain:tokens", t.ID, string(data))
+	return err
+}
+
+func (rs *redisStore) token(id string) (*apiToken, error) {
+	reply, err := rs.do("HGET", "captain:tokens", id)
+	data, _ := reply.([]byte)
+	if err != nil || data == nil {
+		return nil, err
+	}
+	t := &apiToken{}
+	return t, json.Unmarshal(data, t)
+}
+
+func (rs *redisStore) tokens() ([]*apiToken, error) {
+	reply, err := rs.do("HVALS", "captain:tokens")
+	if err != nil {
+		return nil, err
+	}
+	tokens := make([]*apiToken, 0)
+	return tokens, list(reply, &tokens)
+}
+
+func (rs *redisStore) putEnrollment(e *enrollment) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	_, err = rs.do("HSET", "captain:enrollments", e.Agent, string(data))
+	return err
+}
+
+func (rs *redisStore) enrollment(agent string) (*enrollment, error) {
+	reply, err := rs.do("HGET", "captain:enrollments", agent)
+	data, _ := reply.([]byte)
+	if err != nil || data == nil {
+		return nil, err
+	}
+	e := &enrollment{}
+	return e, json.Unmarshal(data, e)
+}
+
+func (rs *redisStore) enrollments() ([]*enrollment, error) {
+	reply, err := rs.do("HVALS", "captain:enrollments")
+	if err != nil {
+		return nil, err
+	}
+	enrollments := make([]*enrollment, 0)
+	return enrollments, list(reply, &enrollments)
+}
+
+func (rs *redisStore) putDeadLetter(d *deadLetter) error {
+	data, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+	_, err = rs.do("HSET", "captain:dead", d.key(), string(data))
+	return err
+}
+
+func (rs *redisStore) deadLetters() ([]*deadLetter, error) {
+	reply, err := rs.do("HVALS", "captain:dead")
+	if err != nil {
+		return nil, err
+	}
+	letters := make([]*deadLetter, 0)
+	return letters, list(reply, &letters)
+}
+
+func (rs *redisStore) putVar(v *variable) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = rs.do("HSET", "captain:vars", v.key(), string(data))
+	return err
+}
+
+func (rs *redisStore) deleteVar(key string) error {
+	_, err := rs.do("HDEL", "captain:vars", key)
+	return err
+}
+
+func (rs *redisStore) vars() ([]*variable, error) {
+	reply, err := rs.do("HVALS", "captain:vars")
+	if err != nil {
+		return nil, err
+	}
+	vars := make([]*variable, 0)
+	return vars, list(reply, &vars)
+}
+
+func (rs *redisStore) putTemplate(t *cmdTemplate) error {
+	data, err := json.Marshal(t)
+	if err != nil {
+		return err
+	}
+	_, err = rs.do("HSET", "captain:templates", t.Name, string(data))
+	return err
+}
+
+func (rs *redisStore) deleteTemplate(name string) error {
+	_, err := rs.do("HDEL", "captain:templates", name)
+	return err
+}
+
+func (rs *redisStore) templates() ([]*cmdTemplate, error) {
+	reply, err := rs.do("HVALS", "captain:templates")
+	if err != nil {
+		return nil, err
+	}
+	templates := make([]*cmdTemplate, 0)
+	return templates, list(reply, &templates)
+}
+
+func (rs *redisStore) prune(r retention) error {
+	if r.age > 0 {
+		cutoff := time.Now().Add(-r.age)
+		for _, key := range []string{"captain:cmds", "captain:logs"} {
+			if err := rs.trimBefore(key, cutoff); err != nil {
+				return err
+			}
+		}
+		reply, err := rs.do("ZRANGEBYSCORE", "captain:results", "-inf", strconv.FormatInt(cutoff.UnixMilli(), 10))
+		if err != nil {
+			return err
+		}
+		if err = rs.dropResults(reply); err != nil {
+			return err
+		}
+		reply, err = rs.do("ZRANGEBYSCORE", "captain:delivered", "-inf", strconv.FormatInt(cutoff.UnixMilli(), 10))
+		if err != nil {
+			return err
+		}
+		ids, _ := reply.([]any)
+		for _, id := range ids {
+			cmd := string(id.([]byte))
+			if _, err = rs.do("DEL", "captain:delivered:"+cmd); err != nil {
+				return err
+			}
+			if _, err = rs.do("ZREM", "captain:delivered", cmd); err != nil {
+				return err
+			}
+		}
+		letters, err := rs.deadLetters()
+		if err != nil {
+			return err
+		}
+		for _, d := range letters {
+			if d.Created.Before(cutoff) {
+				if _, err = rs.do("HDEL", "captain:dead", d.key()); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	// Newest first, as for the memory store.
+	reply, err := rs.do("ZREVRANGE", "captain:results", "0", "-1")
+	if err != nil {
+		return err
+	}
+	ids, _ := reply.([]any)
+	var size int64
+	for i, id := range ids {
+		keep := r.results <= 0 || i < r.results
+		if keep && r.size > 0 {
+			items, err := rs.do("LRANGE", "captain:results:"+string(id.([]byte)), "0", "-1")
+			if err != nil {
+				return err
+			}
+			for _, item := range items.([]any) {
+				size += int64(len(item.([]byte)))
+			}
+			keep = size <= r.size
+		}
+		if !keep {
+			return rs.dropResults(ids[i:])
+		}
+	}
+	return nil
+}
+
+// trimBefore pops the entries of a list created before cutoff.
+func (rs *redisStore) trimBefore(key string, cutoff time.Time) error {
+	for {
+		reply, err := rs.do("LINDEX", key, "0")
+		data, _ := reply.([]byte)
+		if err != nil || data == nil {
+			return err
+		}
+		v := struct{ Created time.Time }{}
+		if err = json.Unmarshal(data, &v); err != nil {
+			return err
+		}
+		if v.Created.After(cutoff) {
+			return nil
+		}
+		if _, err = rs.do("LPOP", key); err != nil {
+			return err
+		}
+	}
+}
+
+func (rs *redisStore) dropResults(reply any) error {
+	ids, _ := reply.([]any)
+	for _, id := range ids {
+		cmd := string(id.([]byte))
+		if _, err := rs.do("DEL", "captain:results:"+cmd); err != nil {
+			return err
+		}
+		if _, err := rs.do("ZREM", "captain:results", cmd); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// leases returns the leases held, by lock.
+func (rs *redisStore) leases() (map[string]*lease, error) {
+	reply, err := rs.do("HVALS", "captain:leases")
+	if err != nil {
+		return nil, err
+	}
+	var all []*lease
+	if err = list(reply, &all); err != nil {
+		return nil, err
+	}
+	held := make(map[string]*lease, len(all))
+	for _, l := range all {
+		held[l.Lock] = l
+	}
+	return held, nil
+}
+
+// queueLease stores l as the lease of lock, or deletes it if l is nil, in
+// a transaction.
+func (rs *redisStore) queueLease(lock string, l *lease) error {
+	if l == nil {
+		_, err := rs.do("HDEL", "captain:leases", lock)
+		return err
+	}
+	data, err := json.Marshal(l)
+	if err != nil {
+		return err
+	}
+	_, err = rs.do("HSET", "captain:leases", lock, string(data))
+	return err
+}
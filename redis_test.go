@@ -0,0 +1,52 @@
+package main
+
+import (
+	"bufio"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestReadReply(t *testing.T) {
+	tests := []struct {
+		name, in string
+		want     any
+		err      string
+	}{
+		{"simple string", "+OK\r\n", "OK", ""},
+		{"empty simple string", "+\r\n", "", ""},
+		{"error", "-ERR wrong type\r\n", nil, "redis: ERR wrong type"},
+		{"integer", ":42\r\n", int64(42), ""},
+		{"negative integer", ":-1\r\n", int64(-1), ""},
+		{"bulk string", "$5\r\nhello\r\n", []byte("hello"), ""},
+		{"empty bulk string", "$0\r\n\r\n", []byte{}, ""},
+		{"bulk string with a crlf", "$4\r\na\r\nb\r\n", []byte("a\r\nb"), ""},
+		{"nil bulk string", "$-1\r\n", []byte(nil), ""},
+		{"array", "*2\r\n$1\r\na\r\n:1\r\n", []any{[]byte("a"), int64(1)}, ""},
+		{"empty array", "*0\r\n", []any{}, ""},
+		{"nil array", "*-1\r\n", []any(nil), ""},
+		{"nested array", "*1\r\n*1\r\n+x\r\n", []any{[]any{"x"}}, ""},
+		{"array with nil", "*1\r\n$-1\r\n", []any{[]byte(nil)}, ""},
+		{"empty line", "\r\n", nil, "empty reply"},
+		{"unknown type", "!oops\r\n", nil, "unexpected reply"},
+		{"invalid integer", ":x\r\n", nil, "invalid syntax"},
+		{"invalid bulk length", "$x\r\n", nil, "invalid syntax"},
+		{"invalid array length", "*x\r\n", nil, "invalid syntax"},
+		{"truncated line", "+OK", nil, "EOF"},
+		{"truncated bulk string", "$5\r\nhel", nil, "EOF"},
+		{"bulk string without crlf", "$5\r\nhello", nil, "EOF"},
+		{"truncated array", "*2\r\n+a\r\n", nil, "EOF"},
+		{"error in array", "*1\r\n-ERR\r\n", nil, "redis: ERR"},
+	}
+	for _, tt := range tests {
+		got, err := readReply(bufio.NewReader(strings.NewReader(tt.in)))
+		switch {
+		case tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)):
+			t.Errorf("%s: got error %v, want %q", tt.name, err, tt.err)
+		case tt.err == "" && err != nil:
+			t.Errorf("%s: %s", tt.name, err)
+		case tt.err == "" && !reflect.DeepEqual(got, tt.want):
+			t.Errorf("%s: got %#v, want %#v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"lukechampine.com/blake3"
+)
+
+// Polls are answered with the server time, the ETag of the queue and a
+// signature over both and the body, so agents can tell the server from an
+// impostor, and a replayed or rolled back queue from the current one.
+const (
+	timeHeader      = "X-Captain-Time"
+	responseHeader  = "X-Captain-Response"
+	maxResponseSkew = 5 * time.Minute
+)
+
+// queueTag is the ETag of a queue payload.
+func queueTag(payload []byte) string {
+	sum := blake3.Sum256(payload)
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+func signResponse(stamp, etag string, body []byte, hint string, h *blake3.Hasher) []byte {
+	h.Reset()
+	h.Write(vtb(protocolVersion))
+	h.Write(stb(stamp))
+	h.Write(stb(etag))
+	h.Write(vtb(len(body)))
+	h.Write(body)
+	h.Write(stb(hint))
+	return h.Sum(nil)
+}
+
+// signPoll sets the headers agents verify a poll response with, with the
+// polling interval hinted, if any, signed with h. The caller holds a.mu.
+func (a *app) signPoll(w http.ResponseWriter, hint string, h *blake3.Hasher) {
+	stamp := time.Now().UTC().Format(time.RFC3339Nano)
+	etag := queueTag(a.payload)
+	w.Header().Set(timeHeader, stamp)
+	w.Header().Set("ETag", etag)
+	if hint != "" {
+		w.Header().Set(hintHeader, hint)
+	}
+	w.Header().Set(responseHeader, hex.EncodeToString(signResponse(stamp, etag, a.payload, hint, h)))
+}
+
+// verifyPoll checks the signature of a poll response, and that it is no
+// older than the last one accepted, nor further than maxResponseSkew from
+// the local clock. It returns the server time.
+func verifyPoll(header http.Header, body []byte, h *blake3.Hasher, last time.Time) (time.Time, error) {
+	stamp, etag := header.Get(timeHeader), header.Get("ETag")
+	sig, err := hex.DecodeString(header.Get(responseHeader))
+	if err != nil || len(sig) == 0 {
+		return time.Time{}, errors.New("unsigned response")
+	}
+	if !strings.EqualFold(etag, queueTag(body)) {
+		return time.Time{}, errors.New("etag does not match the queue")
+	}
+	if !bytes.Equal(signResponse(stamp, etag, body, header.Get(hintHeader), h), sig) {
+		return time.Time{}, errors.New("invalid response signature")
+	}
+	t, err := time.Parse(time.RFC3339Nano, stamp)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid server time %q", stamp)
+	}
+	if d := time.Since(t); d > maxResponseSkew || d < -maxResponseSkew {
+		return time.Time{}, fmt.Errorf("stale response from %s", t)
+	}
+	if t.Before(last) {
+		return time.Time{}, fmt.Errorf("response from %s is older than the last one, from %s", t, last)
+	}
+	return t, nil
+}
@@ -0,0 +1,359 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os/exec"
+	"strings"
+	"syscall"
+	"time"
+
+	"lukechampine.com/blake3"
+)
+
+// States of a result, telling a command that could not start from one
+// that exited, was killed by a signal or timed out.
+const (
+	stateSucceeded   = "succeeded"
+	stateStartFailed = "start-failed"
+	stateExited      = "exited"
+	stateSignaled    = "signaled"
+	stateTimedOut    = "timed-out"
+	stateFailed      = "failed"
+	// stateRebooting is not final: the agent reports again once the host
+	// is back from a reboot.
+	stateRebooting = "rebooting"
+)
+
+type result struct {
+	Cmd, Agent, Output, Error, Check, Sum string
+	ExitCode                              int
+	State                                 string          `json:",omitempty"`
+	Signal                                string          `json:",omitempty"`
+	Trace                                 string          `json:",omitempty"`
+	Assert                                string          `json:",omitempty"`
+	Flag                                  string          `json:",omitempty"` // set by the server, not signed
+	Duration                              time.Duration   `json:",omitempty"`
+	Data                                  json.RawMessage `json:",omitempty"`
+	Timing                                *timing         `json:",omitempty"`
+	Created                               time.Time
+}
+
+// timing tells where the time of a command went: waiting to be polled
+// between Enqueued, when it was created, and Received by the agent, waiting
+// on the agent for a window, a slot or a worker until Started, and running
+// until Finished.
+type timing struct {
+	Enqueued, Received, Started, Finished time.Time
+}
+
+func newResult(c *cmd, agent string, out []byte, err error) *result {
+	res := &result{
+		Cmd:     c.ID,
+		Trace:   c.Trace,
+		Agent:   agent,
+		Output:  string(out),
+		Created: time.Now(),
+	}
+	res.State = stateSucceeded
+	if err != nil {
+		res.Error = err.Error()
+		res.ExitCode = -1
+		res.State = stateFailed
+		var exitErr interface{ ExitCode() int }
+		if errors.As(err, &exitErr) {
+			res.ExitCode = exitErr.ExitCode()
+			res.State = stateExited
+		}
+		var procErr *exec.ExitError
+		if errors.As(err, &procErr) {
+			if ws, ok := procErr.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+				res.State, res.Signal = stateSignaled, signalName(ws.Signal())
+			}
+		}
+		var startErr *startError
+		var lookErr *exec.Error
+		if errors.As(err, &startErr) || errors.As(err, &lookErr) {
+			res.State = stateStartFailed
+		}
+	}
+	return res
+}
+
+// startError is returned by executors when the process did not start.
+type startError struct {
+	err error
+}
+
+func (e *startError) Error() string { return e.err.Error() }
+func (e *startError) Unwrap() error { return e.err }
+
+func signalName(sig syscall.Signal) string {
+	for name, s := range signals {
+		if s == sig {
+			return name
+		}
+	}
+	return sig.String()
+}
+
+// outcome describes how the command of res ended.
+func (res *result) outcome() string {
+	switch res.State {
+	case stateSignaled:
+		return "signaled " + res.Signal
+	case stateStartFailed, stateTimedOut, stateFailed, stateRebooting:
+		return res.State
+	}
+	return fmt.Sprintf("exit %d", res.ExitCode)
+}
+
+// color is the color of the outcome of res on a terminal.
+func (res *result) color() string {
+	switch {
+	case res.State == stateRebooting:
+		return colorYellow
+	case res.failed():
+		return colorRed
+	}
+	return colorGreen
+}
+
+func (res *result) failed() bool {
+	return res.Error != "" || res.ExitCode != 0
+}
+
+// captureJSON takes the output of a command sent with -json as the data of
+// its result, failing the result if the output is not JSON.
+func (res *result) captureJSON() {
+	data := &bytes.Buffer{}
+	if err := json.Compact(data, bytes.TrimSpace([]byte(res.Output))); err != nil {
+		if res.Error == "" {
+			res.Error, res.ExitCode, res.State = "output is not JSON: "+err.Error(), -1, stateFailed
+		}
+		return
+	}
+	res.Data, res.Output = data.Bytes(), ""
+}
+
+// encodeData sets Data to its JSON encoding as sent, compacted and with <,
+// > and & escaped, as the server verifies the data it receives.
+func (res *result) encodeData() error {
+	if len(res.Data) == 0 {
+		return nil
+	}
+	data, err := json.Marshal(res.Data)
+	if err == nil {
+		res.Data = data
+	}
+	return err
+}
+
+func postResult(res *result, h *blake3.Hasher, target string) error {
+	if err := res.encodeData(); err != nil {
+		return err
+	}
+	res.Sum = hex.EncodeToString(signResult(res, h))
+	payload, err := json.Marshal(res)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Post(target+"/result", "application/json", bytes.NewBuffer(payload))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return responseError(resp)
+	}
+	return nil
+}
+
+func getResults(id, target string) ([]*result, error) {
+	resp, err := client.Get(target + "/commands/" + id + "/results")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, responseError(resp)
+	}
+	results := make([]*result, 0)
+	err = json.NewDecoder(resp.Body).Decode(&results)
+	return results, err
+}
+
+// getData gets the values at path into the data of the results of id.
+func getData(id, path, target string) ([]*datum, error) {
+	resp, err := client.Get(target + "/commands/" + id + "/results?jsonpath=" + url.QueryEscape(path))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, responseError(resp)
+	}
+	values := make([]*datum, 0)
+	err = json.NewDecoder(resp.Body).Decode(&values)
+	return values, err
+}
+
+func printResult(res *result) {
+	fmt.Printf("%s: %s %s\n", res.Created, res.Agent, paint(res.color(), res.outcome()))
+	if res.Output != "" {
+		fmt.Println(res.Output)
+	}
+	if res.Error != "" {
+		fmt.Println(res.Error)
+	}
+	if len(res.Data) > 0 {
+		fmt.Println(string(res.Data))
+	}
+	if res.Check != "" {
+		fmt.Println("verification " + res.Check)
+	}
+	if res.Assert != "" {
+		fmt.Println("assertions " + res.Assert)
+	}
+	if res.Flag != "" {
+		fmt.Println("flagged: " + res.Flag)
+	}
+	if t := res.Timing; t != nil && !t.Received.IsZero() {
+		fmt.Printf("received after %s, waited %s, ran %s\n", t.Received.Sub(t.Enqueued).Round(time.Millisecond),
+			t.Started.Sub(t.Received).Round(time.Millisecond), t.Finished.Sub(t.Started).Round(time.Millisecond))
+	}
+}
+
+func (a *app) handlePostResult(w http.ResponseWriter, r *http.Request) {
+	res := &result{}
+	// Agents limiting their upload rate take a while to send large results.
+	start := time.Now()
+	if !decode(w, r, res) {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	h, err := a.agentHasher(res.Agent)
+	if err == nil {
+		err = verifyResult(res, h, 200*time.Millisecond+time.Since(start))
+	}
+	if err != nil {
+		httpError(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	a.flagRevoked(res)
+	if err = a.store.addResult(res); err != nil {
+		httpError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write([]byte("ok"))
+	fmt.Printf("%s: %s %s %s %s\n%s%s\n", res.Created, r.RemoteAddr, res.Agent, res.ref(), res.outcome(), res.Output, res.Error)
+	a.received(res)
+}
+
+// received forwards a stored result to the sinks and metrics.
+func (a *app) received(res *result) {
+	if a.budget != nil {
+		a.budget.release(res.Cmd, res.Agent)
+	}
+	if a.leases != nil && res.State != stateRebooting {
+		if err := a.leases.release(res.Cmd, res.Agent); err != nil {
+			fmt.Printf("%s: releasing lock: %s\n", res.ref(), err)
+		}
+	}
+	a.forward(res.entry())
+	if res.Flag != "" {
+		return
+	}
+	a.seen(res.Agent)
+	a.trackReboot(res)
+	if a.metrics != nil {
+		a.metrics.recordResult(res)
+	}
+	a.hookResult(res)
+	a.awaitResult(res)
+}
+
+func (res *result) entry() *entry {
+	return &entry{
+		Kind:     "result",
+		Agent:    res.Agent,
+		Cmd:      res.Cmd,
+		Trace:    res.Trace,
+		Msg:      res.Output + res.Error,
+		ExitCode: res.ExitCode,
+		Time:     res.Created,
+	}
+}
+
+func (a *app) handleGetResults(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/commands/"), "/results")
+	if !a.viewer(w, r, "results") {
+		return
+	}
+	var payload []byte
+	a.mu.Lock()
+	results, err := a.store.results(id)
+	if path := r.URL.Query().Get("jsonpath"); err == nil && path != "" {
+		values := make([]*datum, 0, len(results))
+		for _, res := range results {
+			if value, ok := lookupData(res.Data, path); ok {
+				values = append(values, &datum{Agent: res.Agent, Value: value})
+			}
+		}
+		payload, err = json.Marshal(values)
+	} else if err == nil {
+		payload, err = json.Marshal(results)
+	}
+	a.mu.Unlock()
+	if err != nil {
+		httpError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write(payload)
+}
+
+func signResult(res *result, h *blake3.Hasher) []byte {
+	h.Reset()
+	h.Write(ttb(res.Created))
+	h.Write(stb(res.Cmd))
+	h.Write(stb(res.Agent))
+	h.Write(stb(res.Output))
+	h.Write(stb(res.Error))
+	h.Write(stb(res.Check))
+	h.Write(vtb(res.ExitCode))
+	h.Write(vtb(len(res.Data)))
+	h.Write(res.Data)
+	h.Write(vtb(int(res.Duration)))
+	h.Write(stb(res.Trace))
+	h.Write(stb(res.Assert))
+	h.Write(stb(res.State))
+	h.Write(stb(res.Signal))
+	h.Write(btb(res.Timing != nil))
+	if t := res.Timing; t != nil {
+		h.Write(ttb(t.Enqueued))
+		h.Write(ttb(t.Received))
+		h.Write(ttb(t.Started))
+		h.Write(ttb(t.Finished))
+	}
+	return h.Sum(nil)
+}
+
+func verifyResult(res *result, h *blake3.Hasher, ttl time.Duration) error {
+	if time.Since(res.Created) > ttl {
+		return errors.New("payload expired")
+	}
+	sum, err := hex.DecodeString(res.Sum)
+	if err != nil {
+		return fmt.Errorf("failed to decode sig hex: %w", err)
+	}
+	if !bytes.Equal(signResult(res, h), sum) {
+		return errors.New("invalid checksum")
+	}
+	return nil
+}
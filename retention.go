@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+)
+
+const pruneInterval = time.Minute
+
+// retention limits what the server keeps. Zero values are unlimited.
+type retention struct {
+	// age is the maximum age of commands, logs and results.
+	age time.Duration
+	// results is the maximum number of commands whose results are kept.
+	results int
+	// size is the maximum size in bytes of the kept results, as JSON.
+	size int64
+}
+
+func (r retention) enabled() bool {
+	return r.age > 0 || r.results > 0 || r.size > 0
+}
+
+// pruneEvery applies r to the store in the background.
+func (a *app) pruneEvery(r retention) {
+	for range time.Tick(pruneInterval) {
+		a.mu.Lock()
+		err := a.store.prune(r)
+		if err == nil {
+			err = a.updatePayload()
+		}
+		a.mu.Unlock()
+		if err != nil {
+			fmt.Println(err)
+		}
+	}
+}
+
+func (m *memoryStore) prune(r retention) error {
+	if r.age > 0 {
+		cutoff := time.Now().Add(-r.age)
+		cmds := make([]*cmd, 0, len(m.Cmds))
+		for _, c := range m.Cmds {
+			if c.Created.After(cutoff) {
+				cmds = append(cmds, c)
+			}
+		}
+		m.Cmds = cmds
+		logs := make([]*log, 0, len(m.Logs))
+		for _, l := range m.Logs {
+			if l.Created.After(cutoff) {
+				logs = append(logs, l)
+			}
+		}
+		m.Logs = logs
+		for id, delivered := range m.Deliver {
+			old := true
+			for _, t := range delivered {
+				old = old && t.Before(cutoff)
+			}
+			if old {
+				delete(m.Deliver, id)
+			}
+		}
+		for key, d := range m.Dead {
+			if d.Created.Before(cutoff) {
+				delete(m.Dead, key)
+			}
+		}
+	}
+	// Results are kept or dropped per command, newest first.
+	ids := make([]string, 0, len(m.Results))
+	latest := make(map[string]time.Time, len(m.Results))
+	for id, results := range m.Results {
+		ids = append(ids, id)
+		for _, res := range results {
+			if res.Created.After(latest[id]) {
+				latest[id] = res.Created
+			}
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return latest[ids[i]].After(latest[ids[j]]) })
+	var size int64
+	for i, id := range ids {
+		keep := r.age <= 0 || time.Since(latest[id]) < r.age
+		keep = keep && (r.results <= 0 || i < r.results)
+		if keep && r.size > 0 {
+			data, err := json.Marshal(m.Results[id])
+			if err != nil {
+				return err
+			}
+			size += int64(len(data))
+			keep = size <= r.size
+		}
+		if !keep {
+			delete(m.Results, id)
+		}
+	}
+	return nil
+}
+
+func (fs *fileStore) prune(r retention) error {
+	if err := fs.memoryStore.prune(r); err != nil {
+		return err
+	}
+	return fs.save()
+}
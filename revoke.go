@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"lukechampine.com/blake3"
+)
+
+// agentHeader names the polling agent, so the server can refuse a revoked
+// agent its commands. Agents sign it, with the acknowledgments of the poll;
+// enrolled agents must, with their credential, so a revoked host cannot
+// poll as another agent.
+const agentHeader = "X-Captain-Agent"
+
+var errUnsignedPoll = errors.New("polls of enrolled agents must be signed with their credential")
+
+func signPollRequest(agent, acks string, t time.Time, h *blake3.Hasher) []byte {
+	h.Reset()
+	h.Write(ttb(t))
+	h.Write(stb("poll"))
+	h.Write(stb(agent))
+	h.Write(stb(acks))
+	return h.Sum(nil)
+}
+
+// signPollHeaders sets the headers the server authenticates a poll with,
+// once its acknowledgments are set.
+func (ag *agent) signPollHeaders(r *http.Request, h *blake3.Hasher) {
+	now := time.Now()
+	r.Header.Set(timeHeader, now.UTC().Format(time.RFC3339Nano))
+	r.Header.Set(sumHeader, hex.EncodeToString(signPollRequest(ag.id, r.Header.Get(ackHeader), now, h)))
+}
+
+// pollingAgent returns the agent polling with r, the hasher to sign the
+// response with, and whether the poll is signed: with its credential if it
+// enrolled, in which case the poll must be, or else with the key. The
+// caller holds a.mu.
+func (a *app) pollingAgent(r *http.Request) (string, *blake3.Hasher, bool, error) {
+	agent := r.Header.Get(agentHeader)
+	if agent == "" {
+		return "", a.hasher, false, nil
+	}
+	h, err := a.agentHasher(agent)
+	if err != nil {
+		return agent, h, false, err
+	}
+	t, sum, ok := signedHeaders(r)
+	signed := ok && bytes.Equal(signPollRequest(agent, r.Header.Get(ackHeader), t, h), sum)
+	if !signed && h != a.hasher {
+		return agent, nil, false, errUnsignedPoll
+	}
+	return agent, h, signed, nil
+}
+
+// revoked reports whether agent was revoked. The caller holds a.mu.
+func (a *app) revoked(agent string) bool {
+	e, err := a.store.enrollment(agent)
+	return err == nil && e != nil && e.State == enrollRevoked
+}
+
+// revoke cuts agent off: its identity and secrets are dropped, polls signed
+// with its credential are refused, and the results it sends afterwards are
+// flagged. The caller holds a.mu.
+func (a *app) revoke(agent string) error {
+	e, err := a.store.enrollment(agent)
+	if err != nil {
+		return err
+	}
+	if e == nil {
+		e = &enrollment{Agent: agent}
+	}
+	e.State, e.Created = enrollRevoked, time.Now()
+	if err = a.store.putEnrollment(e); err != nil {
+		return err
+	}
+	delete(a.lastSeen, agent)
+	delete(a.polls, agent)
+	delete(a.offline, agent)
+	fmt.Printf("%s: %s revoked\n", e.Created, agent)
+	return a.store.forget(agent)
+}
+
+// refuseRevoked fails if c targets a revoked agent. The caller holds a.mu.
+func (a *app) refuseRevoked(c *cmd) error {
+	for _, agent := range c.Agents {
+		if a.revoked(agent) {
+			return fmt.Errorf("%s is revoked", agent)
+		}
+	}
+	return nil
+}
+
+// flagRevoked marks a result sent by a revoked agent, which may have been
+// in flight when the agent was revoked. The caller holds a.mu.
+func (a *app) flagRevoked(res *result) {
+	res.Flag = ""
+	if a.revoked(res.Agent) {
+		res.Flag = "agent revoked"
+	}
+}
+
+// refuseAgent answers requests made by or for a revoked agent.
+func refuseAgent(w http.ResponseWriter, agent string) {
+	httpError(w, agent+" is revoked", http.StatusForbidden)
+}
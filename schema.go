@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+)
+
+//go:generate sh -c "go run . -mode schema > schema/wire.schema.json"
+
+// signatures documents the canonical encoding signed in the Sum field of
+// each signed schema, as the values written to the keyed hash, in order.
+// Every value has a fixed size or is framed with its size, so no value can
+// run into the next:
+//
+//	str(Field)    u64 of the length of a string field, then its UTF-8 bytes
+//	u64(Field)    an integer or duration as 8 bytes, little-endian
+//	ms(Field)     a time as u64 of its Unix milliseconds
+//	bool(Field)   a byte, 1 if true, else 0
+//	list(Field)   u64 of the number of elements of a list, then str of each
+//	map(Field)    u64 of the number of keys, then for each key, sorted: str
+//	              of the key, str of its value
+//	json(Field: A, B)  str of the compact JSON encoding of an object, with
+//	              the fields A, B in that order, leaving out empty optional
+//	              ones, and <, > and & escaped as \u003c, \u003e and \u0026,
+//	              or of nothing if the object is absent
+//	if(Cond): ... values written only when Cond holds
+//
+// The values must follow the sign functions of each type.
+var signatures = map[string][]string{
+	"Cmd": {
+		"u64(Version)", "ms(Created)", "str(ID)", "str(Type)", "str(Name)", "list(Args)", "list(Agents)", "list(Env)",
+		"u64(Timeout)", "str(Signal)", "str(Ref)", "str(Container)", "str(Operator)", "str(Approver)", "str(Artifact)", "str(Digest)",
+		"ms(NotBefore)", "ms(NotAfter)", "str(Trace)", "str(Channel)", "str(Promoted)",
+		"json(Verify: URL, Match, Cmd, Code, Wait)",
+		"json(Expect: Code, Match, JSON with sorted keys)",
+		"map(Labels)",
+		"json(Hook: URL, Wait)",
+		"u64 of the number of Sealed boxes, then for each: str(Agent), str(Ephemeral), str(Data)",
+		"bool(Template)", "bool(JSON)", "str(Delivery)", "str(LocalHours)", "u64(Priority)",
+		"list(After)", "list(Await)", "str(Lock)",
+	},
+	"Log": {"u64(Version)", "ms(Created)", "str(Msg)"},
+	"Result": {
+		"ms(Created)", "str(Cmd)", "str(Agent)", "str(Output)", "str(Error)", "str(Check)", "u64(ExitCode)", "str(Data), as sent",
+		"u64(Duration)", "str(Trace)", "str(Assert)", "str(State)", "str(Signal)",
+		"bool(Timing)", "if(Timing): ms(Timing.Enqueued), ms(Timing.Received), ms(Timing.Started), ms(Timing.Finished)",
+	},
+	"AgentKey":     {"ms(Created)", "str(Agent)", "str(Key)"},
+	"Secret":       {"ms(Created)", "str(Agent)", "str(Name)", "str(Ephemeral)", "str(Data)"},
+	"AdminRequest": {"ms(Created)", "str of the request path", "str(Action)", "str(ID)", "list(Scopes)", "u64(TTL)", "str(Name)", "str(Value)"},
+	"SlotRequest":  {"ms(Created)", "str(Cmd)", "str(Agent)"},
+	"LeaseRequest": {"ms(Created)", "str(Lock)", "str(Cmd)", "str(Agent)", "bool(Renew)"},
+	"AgentConfig": {
+		"ms(Created)",
+		"str of the hex of the first 16 bytes of the unkeyed BLAKE3 of: u64(Poll), map(Tags), list(Allow)",
+	},
+}
+
+// wireSchema is the JSON Schema of the bodies the server and its clients
+// exchange, with the canonical encoding of signed bodies in
+// x-captain-signature, so clients in other languages can be generated from
+// it.
+func wireSchema() map[string]any {
+	g := &schemaGen{schemas: map[string]any{}, ref: "#/$defs/"}
+	g.schema(reflect.TypeOf(apiError{}))
+	for _, rt := range routes {
+		for _, body := range []any{rt.body, rt.resp} {
+			if body != nil {
+				g.content(body)
+			}
+		}
+	}
+	for name, steps := range signatures {
+		def, ok := g.schemas[name].(map[string]any)
+		if !ok {
+			panic(fmt.Sprintf("signature of unknown schema %s", name))
+		}
+		def["x-captain-signature"] = steps
+	}
+	return map[string]any{
+		"$schema": "https://json-schema.org/draft/2020-12/schema",
+		"title":   "captain wire format",
+		"description": "Signed bodies carry in Sum the hex of the BLAKE3 hash, keyed with the BLAKE3 hash of the shared key, of the steps in their x-captain-signature. " +
+			"Times are RFC 3339, durations integer nanoseconds, and the zero time, 0001-01-01T00:00:00Z, is ms -6795364578871.",
+		"x-captain-protocol": protocolVersion,
+		"$defs":              g.schemas,
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const maxSteps = 32
+
+// step is one action of a script command. Run holds the arguments, led by
+// the binary for the default type. If selects when the step runs: ok (the
+// default) while no step has failed, failed after a failure, which a
+// successful step then recovers from, or always.
+type step struct {
+	Type  string   `json:"type"`
+	Run   []string `json:"run"`
+	If    string   `json:"if"`
+	Retry int      `json:"retry"`
+	Delay string   `json:"delay"`
+	delay time.Duration
+}
+
+// parseScript reads the JSON array of steps carried by a script command.
+func parseScript(src string) ([]*step, error) {
+	dec := json.NewDecoder(strings.NewReader(src))
+	dec.DisallowUnknownFields()
+	steps := make([]*step, 0)
+	if err := dec.Decode(&steps); err != nil {
+		return nil, fmt.Errorf("script: %w", err)
+	}
+	if len(steps) == 0 || len(steps) > maxSteps {
+		return nil, fmt.Errorf("script: want 1 to %d steps", maxSteps)
+	}
+	for i, s := range steps {
+		switch {
+		case s.Type == "script":
+			return nil, fmt.Errorf("script: step %d: scripts cannot nest", i)
+		case s.Type == "" && len(s.Run) == 0:
+			return nil, fmt.Errorf("script: step %d: nothing to run", i)
+		case s.If != "" && s.If != "ok" && s.If != "failed" && s.If != "always":
+			return nil, fmt.Errorf("script: step %d: if must be ok, failed or always", i)
+		case s.Retry < 0 || s.Retry > 100:
+			return nil, fmt.Errorf("script: step %d: retry must be 0 to 100", i)
+		}
+		if s.Delay != "" {
+			d, err := time.ParseDuration(s.Delay)
+			if err != nil || d < 0 {
+				return nil, fmt.Errorf("script: step %d: invalid delay %q", i, s.Delay)
+			}
+			s.delay = d
+		}
+	}
+	return steps, nil
+}
+
+type stepReport struct {
+	Step     int
+	Attempts int
+	Error    string `json:",omitempty"`
+}
+
+// script runs the steps in its single argument with the agent's executors,
+// reporting each step's output and attempts.
+func (ag *agent) script(ctx context.Context, c *cmd, env []string) ([]byte, json.RawMessage, error) {
+	if len(c.Args) != 1 {
+		return nil, nil, errors.New("usage: script '[{\"run\": [...]}, ...]'")
+	}
+	steps, err := parseScript(c.Args[0])
+	if err != nil {
+		return nil, nil, err
+	}
+	out := &bytes.Buffer{}
+	reports := make([]*stepReport, 0, len(steps))
+	var failure error
+	for i, s := range steps {
+		if (s.If == "" || s.If == "ok") && failure != nil || s.If == "failed" && failure == nil {
+			continue
+		}
+		ex, ok := ag.executors[s.Type]
+		if !ok {
+			return out.Bytes(), nil, fmt.Errorf("step %d: unsupported command type %s", i, s.Type)
+		}
+		sc := &cmd{ID: c.ID, Type: s.Type, Args: s.Run, Env: c.Env, Container: c.Container}
+		if s.Type == "" {
+			sc.Name, sc.Args = s.Run[0], s.Run[1:]
+		}
+		report := &stepReport{Step: i}
+		var stepErr error
+		for report.Attempts <= s.Retry {
+			if report.Attempts > 0 {
+				select {
+				case <-time.After(s.delay):
+				case <-ctx.Done():
+					return out.Bytes(), nil, ctx.Err()
+				}
+			}
+			report.Attempts++
+			fmt.Fprintf(out, "$ %s\n", strings.Join(s.Run, " "))
+			var stepOut []byte
+			stepOut, _, stepErr = ex.execute(ctx, sc, env)
+			out.Write(stepOut)
+			if stepErr == nil {
+				break
+			}
+			fmt.Fprintln(out, stepErr)
+		}
+		if stepErr != nil {
+			report.Error = stepErr.Error()
+			failure = fmt.Errorf("step %d: %w", i, stepErr)
+		} else if s.If == "failed" {
+			failure = nil
+		}
+		reports = append(reports, report)
+	}
+	data, err := json.Marshal(reports)
+	if err != nil {
+		return out.Bytes(), nil, err
+	}
+	return out.Bytes(), data, failure
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"lukechampine.com/blake3"
+)
+
+// sealedType marks a command whose body is encrypted for each targeted
+// agent's identity key. The server stores and relays it without being able
+// to read it.
+const sealedType = "sealed"
+
+// sealed is a command body encrypted for one agent, as secrets are.
+type sealed struct {
+	Agent, Ephemeral, Data string
+}
+
+type sealedBody struct {
+	Type, Name, Container, Artifact, Digest string
+	Args, Env                               []string
+}
+
+// seal encrypts the body of c for each of its agents, whose identity keys
+// are fetched from target and verified with h.
+func seal(c *cmd, h *blake3.Hasher, target string) error {
+	if len(c.Agents) == 0 {
+		return errors.New("sealing needs agents")
+	}
+	if c.Signal != "" {
+		return errors.New("signals cannot be sealed")
+	}
+	body, err := json.Marshal(&sealedBody{Type: c.Type, Name: c.Name, Container: c.Container, Artifact: c.Artifact, Digest: c.Digest, Args: c.Args, Env: c.Env})
+	if err != nil {
+		return err
+	}
+	for _, agent := range c.Agents {
+		k, err := getAgentKey(agent, target)
+		if err != nil {
+			return err
+		}
+		if err = verifyAgentKey(k, h, 0); err != nil {
+			return fmt.Errorf("key of %s: %w", agent, err)
+		}
+		recipient, err := hex.DecodeString(k.Key)
+		if err != nil {
+			return fmt.Errorf("failed to decode key hex: %w", err)
+		}
+		// Naming the box after the command binds it to the command id.
+		s := &secret{Agent: agent, Name: c.ID}
+		if err = sealSecret(s, body, recipient); err != nil {
+			return err
+		}
+		c.Sealed = append(c.Sealed, &sealed{Agent: agent, Ephemeral: s.Ephemeral, Data: s.Data})
+	}
+	c.Type, c.Name, c.Container, c.Artifact, c.Digest = sealedType, "", "", "", ""
+	c.Args, c.Env = make([]string, 0), nil
+	return nil
+}
+
+// unseal returns c with the body sealed for this agent.
+func (ag *agent) unseal(c *cmd) (*cmd, error) {
+	for _, box := range c.Sealed {
+		if box.Agent != ag.id {
+			continue
+		}
+		data, err := openSecret(&secret{Agent: ag.id, Name: c.ID, Ephemeral: box.Ephemeral, Data: box.Data}, ag.identity)
+		if err != nil {
+			return nil, fmt.Errorf("unseal: %w", err)
+		}
+		body := &sealedBody{}
+		if err = json.Unmarshal(data, body); err != nil {
+			return nil, fmt.Errorf("unseal: %w", err)
+		}
+		open := *c
+		open.Type, open.Name, open.Container = body.Type, body.Name, body.Container
+		open.Artifact, open.Digest = body.Artifact, body.Digest
+		open.Args, open.Env, open.Sealed = body.Args, body.Env, nil
+		return &open, nil
+	}
+	return nil, errors.New("not sealed for " + ag.id)
+}
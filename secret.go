@@ -0,0 +1,398 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"lukechampine.com/blake3"
+)
+
+var envName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+type agentKey struct {
+	Agent, Key, Sum string
+	Created         time.Time
+}
+
+type secret struct {
+	Agent, Name, Ephemeral, Data, Sum string
+	Created                           time.Time
+}
+
+func loadIdentity(path string) (*ecdh.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		priv, err := ecdh.X25519().GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		return priv, os.WriteFile(path, []byte(hex.EncodeToString(priv.Bytes())), 0600)
+	}
+	if err != nil {
+		return nil, err
+	}
+	raw, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode identity hex: %w", err)
+	}
+	return ecdh.X25519().NewPrivateKey(raw)
+}
+
+func pushSecret(name string, value []byte, agents []string, h *blake3.Hasher, target string) error {
+	if !envName.MatchString(name) {
+		return fmt.Errorf("invalid secret name %q", name)
+	}
+	for _, agent := range agents {
+		k, err := getAgentKey(agent, target)
+		if err != nil {
+			return err
+		}
+		if err = verifyAgentKey(k, h, 0); err != nil {
+			return fmt.Errorf("key of %s: %w", agent, err)
+		}
+		recipient, err := hex.DecodeString(k.Key)
+		if err != nil {
+			return fmt.Errorf("failed to decode key hex: %w", err)
+		}
+		s := &secret{Agent: agent, Name: name, Created: time.Now()}
+		if err = sealSecret(s, value, recipient); err != nil {
+			return err
+		}
+		s.Sum = hex.EncodeToString(signSecret(s, h))
+		if err = postJSON(target+"/secret", s); err != nil {
+			return err
+		}
+		fmt.Printf("%s: ok\n", agent)
+	}
+	return nil
+}
+
+func sealSecret(s *secret, value, recipient []byte) error {
+	pub, err := ecdh.X25519().NewPublicKey(recipient)
+	if err != nil {
+		return err
+	}
+	eph, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+	shared, err := eph.ECDH(pub)
+	if err != nil {
+		return err
+	}
+	aead, err := secretAEAD(shared, eph.PublicKey().Bytes(), recipient)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err = rand.Read(nonce); err != nil {
+		return err
+	}
+	s.Ephemeral = hex.EncodeToString(eph.PublicKey().Bytes())
+	s.Data = hex.EncodeToString(aead.Seal(nonce, nonce, value, secretAD(s)))
+	return nil
+}
+
+func openSecret(s *secret, priv *ecdh.PrivateKey) ([]byte, error) {
+	raw, err := hex.DecodeString(s.Ephemeral)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode ephemeral key hex: %w", err)
+	}
+	eph, err := ecdh.X25519().NewPublicKey(raw)
+	if err != nil {
+		return nil, err
+	}
+	shared, err := priv.ECDH(eph)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := secretAEAD(shared, raw, priv.PublicKey().Bytes())
+	if err != nil {
+		return nil, err
+	}
+	data, err := hex.DecodeString(s.Data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode secret hex: %w", err)
+	}
+	if len(data) < aead.NonceSize() {
+		return nil, errors.New("secret too short")
+	}
+	return aead.Open(nil, data[:aead.NonceSize()], data[aead.NonceSize():], secretAD(s))
+}
+
+// secretAD is the additional data binding a sealed value to its agent and
+// name, framed so that neither can borrow from the other.
+func secretAD(s *secret) []byte {
+	return append(stb(s.Agent), stb(s.Name)...)
+}
+
+func secretAEAD(shared, eph, recipient []byte) (cipher.AEAD, error) {
+	key := make([]byte, 32)
+	material := append(append(append([]byte{}, shared...), eph...), recipient...)
+	blake3.DeriveKey(key, "captain secret v1", material)
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func getAgentKey(agent, target string) (*agentKey, error) {
+	resp, err := client.Get(target + "/agents/" + agent + "/key")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("no key for %s: %w", agent, responseError(resp))
+	}
+	k := &agentKey{}
+	err = json.NewDecoder(resp.Body).Decode(k)
+	return k, err
+}
+
+func getSecrets(agent, target string) ([]*secret, error) {
+	resp, err := client.Get(target + "/agents/" + agent + "/secrets")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, responseError(resp)
+	}
+	secrets := make([]*secret, 0)
+	err = json.NewDecoder(resp.Body).Decode(&secrets)
+	return secrets, err
+}
+
+func postJSON(url string, v any) error {
+	payload, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Post(url, "application/json", bytes.NewBuffer(payload))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return responseError(resp)
+	}
+	return nil
+}
+
+// publishKey announces the public half of the agent's identity to the server.
+func (ag *agent) publishKey() error {
+	k := &agentKey{
+		Agent:   ag.id,
+		Key:     hex.EncodeToString(ag.identity.PublicKey().Bytes()),
+		Created: time.Now(),
+	}
+	k.Sum = hex.EncodeToString(signAgentKey(k, ag.hasher()))
+	return postJSON(ag.target+"/key", k)
+}
+
+// secretEnv fetches and decrypts the secrets stored for this agent.
+func (ag *agent) secretEnv() ([]string, error) {
+	secrets, err := getSecrets(ag.id, ag.target)
+	if err != nil {
+		return nil, err
+	}
+	h := ag.hasher()
+	env := make([]string, 0, len(secrets))
+	for _, s := range secrets {
+		if s.Agent != ag.id || !envName.MatchString(s.Name) {
+			continue
+		}
+		if err = verifySecret(s, h, 0); err != nil {
+			return nil, fmt.Errorf("secret %s: %w", s.Name, err)
+		}
+		value, err := openSecret(s, ag.identity)
+		if err != nil {
+			return nil, fmt.Errorf("secret %s: %w", s.Name, err)
+		}
+		ag.redactor.add(string(value))
+		env = append(env, s.Name+"="+string(value))
+	}
+	return env, nil
+}
+
+func (a *app) handlePostKey(w http.ResponseWriter, r *http.Request) {
+	k := &agentKey{}
+	if !decode(w, r, k) {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	h, err := a.agentHasher(k.Agent)
+	if err == nil {
+		err = verifyAgentKey(k, h, 200*time.Millisecond)
+	}
+	if err != nil {
+		httpError(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	if a.revoked(k.Agent) {
+		refuseAgent(w, k.Agent)
+		return
+	}
+	// Operators verify identities with the key before sealing secrets.
+	k.Sum = hex.EncodeToString(signAgentKey(k, a.hasher))
+	if err = a.store.putKey(k); err != nil {
+		httpError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	a.seen(k.Agent)
+	w.Write([]byte("ok"))
+}
+
+func (a *app) handlePostSecret(w http.ResponseWriter, r *http.Request) {
+	s := &secret{}
+	if !decode(w, r, s) {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	err := verifySecret(s, a.hasher, 200*time.Millisecond)
+	if err != nil {
+		httpError(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	if a.revoked(s.Agent) {
+		refuseAgent(w, s.Agent)
+		return
+	}
+	if err = a.store.putSecret(s); err != nil {
+		httpError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write([]byte("ok"))
+}
+
+func (a *app) handleGetAgent(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/agents/"), "/")
+	if len(parts) != 2 {
+		httpError(w, "not found", http.StatusNotFound)
+		return
+	}
+	a.mu.Lock()
+	if a.revoked(parts[0]) {
+		a.mu.Unlock()
+		refuseAgent(w, parts[0])
+		return
+	}
+	var v any
+	var err error
+	switch parts[1] {
+	case "key":
+		var k *agentKey
+		if k, err = a.store.key(parts[0]); k != nil {
+			v = k
+		}
+	case "secrets":
+		v, err = a.agentSecrets(parts[0])
+	case "config":
+		var cfg *agentConfig
+		if cfg, err = a.desiredConfig(parts[0]); cfg != nil {
+			v = cfg
+		}
+	}
+	var payload []byte
+	if err == nil {
+		payload, err = json.Marshal(v)
+	}
+	a.mu.Unlock()
+	if err != nil {
+		httpError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if v == nil {
+		httpError(w, "not found", http.StatusNotFound)
+		return
+	}
+	w.Write(payload)
+}
+
+// agentSecrets returns the secrets stored for agent. Operators sign them
+// with the key, so they are signed again for an agent with a credential.
+// The caller holds a.mu.
+func (a *app) agentSecrets(agent string) ([]*secret, error) {
+	secrets, err := a.store.secrets(agent)
+	if err != nil {
+		return nil, err
+	}
+	h, err := a.agentHasher(agent)
+	if err != nil || h == a.hasher {
+		return secrets, err
+	}
+	signed := make([]*secret, len(secrets))
+	for i, s := range secrets {
+		if err = verifySecret(s, a.hasher, 0); err != nil {
+			return nil, fmt.Errorf("secret %s: %w", s.Name, err)
+		}
+		c := *s
+		c.Sum = hex.EncodeToString(signSecret(&c, h))
+		signed[i] = &c
+	}
+	return signed, nil
+}
+
+func signAgentKey(k *agentKey, h *blake3.Hasher) []byte {
+	h.Reset()
+	h.Write(ttb(k.Created))
+	h.Write(stb(k.Agent))
+	h.Write(stb(k.Key))
+	return h.Sum(nil)
+}
+
+// verifyAgentKey checks the signature of k, and its age if ttl is positive.
+func verifyAgentKey(k *agentKey, h *blake3.Hasher, ttl time.Duration) error {
+	if ttl > 0 && time.Since(k.Created) > ttl {
+		return errors.New("payload expired")
+	}
+	sum, err := hex.DecodeString(k.Sum)
+	if err != nil {
+		return fmt.Errorf("failed to decode sig hex: %w", err)
+	}
+	if !bytes.Equal(signAgentKey(k, h), sum) {
+		return errors.New("invalid checksum")
+	}
+	return nil
+}
+
+func signSecret(s *secret, h *blake3.Hasher) []byte {
+	h.Reset()
+	h.Write(ttb(s.Created))
+	h.Write(stb(s.Agent))
+	h.Write(stb(s.Name))
+	h.Write(stb(s.Ephemeral))
+	h.Write(stb(s.Data))
+	return h.Sum(nil)
+}
+
+// verifySecret checks the signature of s, and its age if ttl is positive.
+func verifySecret(s *secret, h *blake3.Hasher, ttl time.Duration) error {
+	if ttl > 0 && time.Since(s.Created) > ttl {
+		return errors.New("payload expired")
+	}
+	sum, err := hex.DecodeString(s.Sum)
+	if err != nil {
+		return fmt.Errorf("failed to decode sig hex: %w", err)
+	}
+	if !bytes.Equal(signSecret(s, h), sum) {
+		return errors.New("invalid checksum")
+	}
+	return nil
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+type serviceStatus struct {
+	Service, State string
+	Running        bool
+	PID            int
+}
+
+// service translates a cross-platform service verb into systemctl, launchctl,
+// service(8) on FreeBSD or sc.exe, and returns the resulting status as structured data.
+func service(ctx context.Context, args []string) ([]byte, json.RawMessage, error) {
+	if len(args) != 2 {
+		return nil, nil, fmt.Errorf("usage: service start|stop|restart|reload|status <name>")
+	}
+	action, name := args[0], args[1]
+	steps := serviceArgv(action, name)
+	if action != "status" && steps == nil {
+		return nil, nil, fmt.Errorf("unsupported service action %s on %s", action, runtime.GOOS)
+	}
+	out := &bytes.Buffer{}
+	for _, argv := range steps {
+		c := exec.CommandContext(ctx, argv[0], argv[1:]...)
+		c.Stdout = out
+		c.Stderr = out
+		if err := c.Run(); err != nil {
+			return out.Bytes(), nil, err
+		}
+	}
+	status, err := queryService(ctx, name)
+	if err != nil {
+		return out.Bytes(), nil, err
+	}
+	data, err := json.Marshal(status)
+	if err != nil {
+		return out.Bytes(), nil, err
+	}
+	fmt.Fprintf(out, "%s: %s\n", name, status.State)
+	return out.Bytes(), data, nil
+}
+
+func serviceArgv(action, name string) [][]string {
+	switch runtime.GOOS {
+	case "darwin":
+		target := "system/" + name
+		switch action {
+		case "start":
+			return [][]string{{"launchctl", "kickstart", target}}
+		case "restart":
+			return [][]string{{"launchctl", "kickstart", "-k", target}}
+		case "stop":
+			return [][]string{{"launchctl", "kill", "SIGTERM", target}}
+		case "reload":
+			return [][]string{{"launchctl", "kill", "SIGHUP", target}}
+		}
+	case "freebsd":
+		switch action {
+		case "start", "stop", "restart", "reload":
+			return [][]string{{"service", name, action}}
+		}
+	case "windows":
+		switch action {
+		case "start", "stop":
+			return [][]string{{"sc.exe", action, name}}
+		case "restart":
+			return [][]string{{"sc.exe", "stop", name}, {"sc.exe", "start", name}}
+		}
+	default:
+		switch action {
+		case "start", "stop", "restart", "reload":
+			return [][]string{{"systemctl", action, name}}
+		}
+	}
+	return nil
+}
+
+func queryService(ctx context.Context, name string) (*serviceStatus, error) {
+	status := &serviceStatus{Service: name}
+	var argv []string
+	switch runtime.GOOS {
+	case "darwin":
+		argv = []string{"launchctl", "print", "system/" + name}
+	case "freebsd":
+		// Stopped services fail status, with the state in the output.
+		out, _ := exec.CommandContext(ctx, "service", name, "status").Output()
+		if _, pid, ok := strings.Cut(strings.TrimSpace(string(out)), " is running as pid "); ok {
+			status.State, status.Running = "running", true
+			status.PID, _ = strconv.Atoi(strings.TrimSuffix(pid, "."))
+		} else {
+			status.State = "stopped"
+		}
+		return status, nil
+	case "windows":
+		argv = []string{"sc.exe", "query", name}
+	default:
+		argv = []string{"systemctl", "show", name, "--property=ActiveState,SubState,MainPID"}
+	}
+	out, err := exec.CommandContext(ctx, argv[0], argv[1:]...).Output()
+	if err != nil {
+		return nil, err
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch runtime.GOOS {
+		case "darwin":
+			if v, ok := strings.CutPrefix(line, "state = "); ok {
+				status.State = v
+			} else if v, ok := strings.CutPrefix(line, "pid = "); ok {
+				status.PID, _ = strconv.Atoi(v)
+			}
+		case "windows":
+			if v, ok := strings.CutPrefix(line, "STATE"); ok {
+				if fields := strings.Fields(v); len(fields) > 0 {
+					status.State = strings.ToLower(fields[len(fields)-1])
+				}
+			}
+		default:
+			if v, ok := strings.CutPrefix(line, "ActiveState="); ok {
+				status.State = v
+			} else if v, ok := strings.CutPrefix(line, "MainPID="); ok {
+				status.PID, _ = strconv.Atoi(v)
+			}
+		}
+	}
+	status.Running = status.State == "active" || status.State == "running"
+	return status, scanner.Err()
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+
+	"lukechampine.com/blake3"
+)
+
+func TestSignCmdFraming(t *testing.T) {
+	created := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	tests := []struct {
+		name string
+		a, b cmd
+	}{
+		{"agent moved into args",
+			cmd{Args: []string{"x"}, Agents: []string{"web-1"}},
+			cmd{Args: []string{"x", "web-1"}}},
+		{"args split",
+			cmd{Args: []string{"ab"}},
+			cmd{Args: []string{"a", "b"}}},
+		{"arg moved into env",
+			cmd{Args: []string{"x"}, Env: []string{"A=1"}},
+			cmd{Args: []string{"x", "A=1"}}},
+		{"id runs into type",
+			cmd{ID: "ab"},
+			cmd{ID: "a", Type: "b"}},
+		{"name runs into args",
+			cmd{Name: "rm", Args: []string{"-rf"}},
+			cmd{Name: "rm-rf"}},
+		{"operator or approver",
+			cmd{Operator: "alice"},
+			cmd{Approver: "alice"}},
+		{"trace or channel",
+			cmd{Trace: "beta"},
+			cmd{Channel: "beta"}},
+		{"label key runs into value",
+			cmd{Labels: map[string]string{"ab": "c"}},
+			cmd{Labels: map[string]string{"a": "bc"}}},
+		{"after or await",
+			cmd{After: []string{"x"}},
+			cmd{Await: []string{"x"}}},
+		{"delivery or local hours",
+			cmd{Delivery: "at-least-once"},
+			cmd{LocalHours: "at-least-once"}},
+		{"lock or container",
+			cmd{Lock: "db"},
+			cmd{Container: "db"}},
+		{"template or json",
+			cmd{Template: true},
+			cmd{JSON: true}},
+		{"empty sealed box",
+			cmd{Sealed: []*sealed{{}}},
+			cmd{}},
+	}
+	h := blake3.New(32, nil)
+	for _, tt := range tests {
+		tt.a.Created, tt.b.Created = created, created
+		tt.a.Version, tt.b.Version = protocolVersion, protocolVersion
+		a := signCmd(&tt.a, h)
+		b := signCmd(&tt.b, h)
+		if bytes.Equal(a, b) {
+			t.Errorf("%s: same signature", tt.name)
+		}
+	}
+}
+
+func TestSignCmdStable(t *testing.T) {
+	c := &cmd{
+		Version: protocolVersion,
+		ID:      "id",
+		Name:    "echo",
+		Args:    []string{"a", "b"},
+		Agents:  []string{"web-1"},
+		Labels:  map[string]string{"b": "2", "a": "1"},
+		Created: time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC),
+	}
+	h := blake3.New(32, nil)
+	sum := signCmd(c, h)
+	d := *c
+	d.Labels = map[string]string{"a": "1", "b": "2"}
+	d.Created = d.Created.Add(time.Microsecond) // only milliseconds are signed
+	if !bytes.Equal(sum, signCmd(&d, h)) {
+		t.Error("signature depends on label order or sub-millisecond time")
+	}
+	d.Agents = nil
+	if bytes.Equal(sum, signCmd(&d, h)) {
+		t.Error("signature does not cover the agents")
+	}
+}
+
+// TestSignParity signs each signed body as its sender does, and checks the
+// receiver signs the same after decoding the JSON sent, but not after a
+// field changed.
+func TestSignParity(t *testing.T) {
+	created := time.Date(2024, 1, 2, 3, 4, 5, 678901234, time.UTC)
+	tests := []struct {
+		name   string
+		body   any
+		sign   func(v any, h *blake3.Hasher) []byte
+		tamper func(v any)
+	}{
+		{"cmd", &cmd{Version: protocolVersion, ID: "id", Name: "echo", Args: []string{"héllo", ""}, Labels: map[string]string{"a": "1"},
+			Verify: &check{URL: "http://x/<a>&", Match: "ok"}, Expect: &expect{Match: "done", JSON: map[string]string{"b": "1.5", "a": "x"}},
+			Sealed: []*sealed{{Agent: "web-1", Data: "d"}}, NotAfter: created.Add(time.Hour), Priority: -2, Created: created},
+			func(v any, h *blake3.Hasher) []byte { return signCmd(v.(*cmd), h) },
+			func(v any) { v.(*cmd).Expect.Code = 1 }},
+		{"log", &log{Version: protocolVersion, Msg: "hello\nworld", Created: created},
+			func(v any, h *blake3.Hasher) []byte { return signLog(v.(*log), h) },
+			func(v any) { v.(*log).Msg += " " }},
+		{"result", &result{Cmd: "id", Agent: "web-1", Output: "out", ExitCode: -1, Data: json.RawMessage(`{"b": "<&>", "a": [1, 2]}`),
+			Duration: time.Second, Timing: &timing{Enqueued: created, Received: created.Add(time.Second)}, Created: created},
+			func(v any, h *blake3.Hasher) []byte { return signResult(v.(*result), h) },
+			func(v any) { v.(*result).Timing = nil }},
+		{"result without timing", &result{Cmd: "id", Agent: "web-1", Error: "failed", Created: created},
+			func(v any, h *blake3.Hasher) []byte { return signResult(v.(*result), h) },
+			func(v any) { v.(*result).Timing = &timing{} }},
+		{"agent key", &agentKey{Agent: "web-1", Key: "abcd", Created: created},
+			func(v any, h *blake3.Hasher) []byte { return signAgentKey(v.(*agentKey), h) },
+			func(v any) { v.(*agentKey).Agent = "web-2" }},
+		{"secret", &secret{Agent: "web-1", Name: "TOKEN", Ephemeral: "e", Data: "d", Created: created},
+			func(v any, h *blake3.Hasher) []byte { return signSecret(v.(*secret), h) },
+			func(v any) { v.(*secret).Name = "TOKEN2" }},
+		{"admin request", &adminRequest{Action: "create", Scopes: []string{"view", "send"}, TTL: time.Hour, Created: created},
+			func(v any, h *blake3.Hasher) []byte { return signAdminRequest(v.(*adminRequest), "/tokens", h) },
+			func(v any) { v.(*adminRequest).Scopes = []string{"view,send"} }},
+		{"slot request", &slotRequest{Cmd: "id", Agent: "web-1", Created: created},
+			func(v any, h *blake3.Hasher) []byte { return signSlotRequest(v.(*slotRequest), h) },
+			func(v any) { v.(*slotRequest).Created = created.Add(time.Millisecond) }},
+		{"lease request", &leaseRequest{Lock: "db", Cmd: "id", Agent: "web-1", Renew: true, Created: created},
+			func(v any, h *blake3.Hasher) []byte { return signLeaseRequest(v.(*leaseRequest), h) },
+			func(v any) { v.(*leaseRequest).Renew = false }},
+		{"config", &agentConfig{Poll: time.Minute, Tags: map[string]string{"role": "web"}, Allow: []string{"ls"}, Created: created},
+			func(v any, h *blake3.Hasher) []byte { return signConfig(v.(*agentConfig), h) },
+			func(v any) { v.(*agentConfig).Allow = nil }},
+	}
+	key := blake3.Sum256([]byte("mykey"))
+	h := blake3.New(32, key[:])
+	for _, tt := range tests {
+		if res, ok := tt.body.(*result); ok {
+			// As agents do before signing.
+			if err := res.encodeData(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		sum := tt.sign(tt.body, h)
+		data, err := json.Marshal(tt.body)
+		if err != nil {
+			t.Fatalf("%s: %s", tt.name, err)
+		}
+		got := reflect.New(reflect.TypeOf(tt.body).Elem()).Interface()
+		if err = json.Unmarshal(data, got); err != nil {
+			t.Fatalf("%s: %s", tt.name, err)
+		}
+		if !bytes.Equal(tt.sign(got, h), sum) {
+			t.Errorf("%s: signature changed over JSON", tt.name)
+		}
+		tt.tamper(got)
+		if bytes.Equal(tt.sign(got, h), sum) {
+			t.Errorf("%s: signature does not cover the tampered field", tt.name)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// simulatedIDs reads the agents to simulate: a count, named sim-1 to
+// sim-N, or comma-separated ids.
+func simulatedIDs(agents string) ([]string, error) {
+	n, err := strconv.Atoi(agents)
+	if err != nil {
+		if agents == "" {
+			return nil, fmt.Errorf("simulate needs -agents, a count or ids")
+		}
+		return strings.Split(agents, ","), nil
+	}
+	if n < 1 {
+		return nil, fmt.Errorf("cannot simulate %d agents", n)
+	}
+	ids := make([]string, n)
+	for i := range ids {
+		ids[i] = "sim-" + strconv.Itoa(i+1)
+	}
+	return ids, nil
+}
+
+// simulate runs lightweight agents in process, which poll the server (or
+// subscribe over NATS), verify commands, and report canned results after
+// latency, so the server and rollouts can be tested without real hosts.
+// Polls are spread over the poll interval.
+func simulate(ids []string, target, natsURL string, key []byte, poll, latency time.Duration) {
+	executed := &atomic.Int64{}
+	canned := executorFunc(func(ctx context.Context, c *cmd, _ []string) ([]byte, json.RawMessage, error) {
+		select {
+		case <-time.After(latency):
+		case <-ctx.Done():
+			return nil, nil, ctx.Err()
+		}
+		executed.Add(1)
+		return []byte("simulated " + strings.TrimSpace(c.Type+" "+c.Name+" "+strings.Join(c.Args, " "))), nil, nil
+	})
+	fmt.Printf("simulating %d agents against %s\n", len(ids), target)
+	for i, id := range ids {
+		identity, err := ecdh.X25519().GenerateKey(rand.Reader)
+		if err != nil {
+			panic(err)
+		}
+		ag := &agent{
+			id:       id,
+			identity: identity,
+			target:   target,
+			poll:     poll,
+			key:      key,
+			workers:  1,
+			natsURL:  natsURL,
+			redactor: &redactor{},
+			running:  make(map[string]*exec.Cmd),
+			quiet:    true,
+		}
+		ag.executors = make(map[string]executor)
+		for t, ex := range newExecutors(ag) {
+			ag.executors[t] = canned
+			if t == pingType {
+				ag.executors[t] = ex
+			}
+		}
+		go func() {
+			time.Sleep(poll * time.Duration(i) / time.Duration(len(ids)))
+			if err := ag.obey(); err != nil {
+				fmt.Printf("%s: %s\n", ag.id, err)
+			}
+		}()
+	}
+	var last int64
+	for range time.Tick(10 * time.Second) {
+		n := executed.Load()
+		fmt.Printf("%s: %d commands executed, %d in the last 10s\n", time.Now().Format(time.RFC3339), n, n-last)
+		last = n
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// entry is a verified log or result forwarded to the log sinks.
+type entry struct {
+	Kind, Agent, Cmd, Msg string
+	Trace                 string `json:",omitempty"`
+	ExitCode              int
+	Time                  time.Time
+}
+
+type sink interface {
+	send(e *entry) error
+}
+
+var sinkClient = &http.Client{Timeout: 10 * time.Second}
+
+// newSink parses kind=url, where kind is loki, elasticsearch or syslog.
+func newSink(spec string) (sink, error) {
+	kind, rawurl, ok := strings.Cut(spec, "=")
+	if !ok {
+		return nil, fmt.Errorf("invalid sink %q, want kind=url", spec)
+	}
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	switch kind {
+	case "loki":
+		return lokiSink(strings.TrimSuffix(rawurl, "/") + "/loki/api/v1/push"), nil
+	case "elasticsearch", "es":
+		return esSink(strings.TrimSuffix(rawurl, "/") + "/_doc"), nil
+	case "syslog":
+		if u.Scheme != "udp" && u.Scheme != "tcp" {
+			return nil, fmt.Errorf("syslog sink needs a udp:// or tcp:// url")
+		}
+		return &syslogSink{network: u.Scheme, addr: u.Host}, nil
+	}
+	return nil, fmt.Errorf("unsupported sink %s", kind)
+}
+
+// startSinks forwards entries to the sinks in the background, so slow
+// sinks do not hold up agents. Entries are dropped while the buffer is full.
+func startSinks(sinks []sink) chan<- *entry {
+	entries := make(chan *entry, maxPending)
+	go func() {
+		for e := range entries {
+			for _, s := range sinks {
+				if err := s.send(e); err != nil {
+					fmt.Println(err)
+				}
+			}
+		}
+	}()
+	return entries
+}
+
+func (a *app) forward(e *entry) {
+	if a.sinks == nil {
+		return
+	}
+	select {
+	case a.sinks <- e:
+	default:
+		fmt.Println("sink buffer full, dropped " + e.Kind)
+	}
+}
+
+func postSink(url string, v any) error {
+	payload, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	resp, err := sinkClient.Post(url, "application/json", bytes.NewBuffer(payload))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s: got status code %d", url, resp.StatusCode)
+	}
+	return nil
+}
+
+type lokiSink string
+
+func (s lokiSink) send(e *entry) error {
+	labels := map[string]string{"job": "captain", "kind": e.Kind}
+	if e.Agent != "" {
+		labels["agent"] = e.Agent
+	}
+	if e.Cmd != "" {
+		labels["cmd"] = e.Cmd
+		labels["exit_code"] = strconv.Itoa(e.ExitCode)
+	}
+	return postSink(string(s), map[string]any{
+		"streams": []any{map[string]any{
+			"stream": labels,
+			"values": [][]string{{strconv.FormatInt(e.Time.UnixNano(), 10), e.Msg}},
+		}},
+	})
+}
+
+type esSink string
+
+func (s esSink) send(e *entry) error {
+	return postSink(string(s), map[string]any{
+		"@timestamp": e.Time,
+		"kind":       e.Kind,
+		"agent":      e.Agent,
+		"cmd":        e.Cmd,
+		"exit_code":  e.ExitCode,
+		"message":    e.Msg,
+	})
+}
+
+// syslogSink writes RFC 5424 messages, with the agent and command as
+// structured data.
+type syslogSink struct {
+	network, addr string
+	conn          net.Conn
+}
+
+func (s *syslogSink) send(e *entry) error {
+	if s.conn == nil {
+		conn, err := net.DialTimeout(s.network, s.addr, 5*time.Second)
+		if err != nil {
+			return err
+		}
+		s.conn = conn
+	}
+	// user-level facility, notice severity, or error for failed commands
+	pri := 1*8 + 5
+	if e.ExitCode != 0 {
+		pri = 1*8 + 3
+	}
+	hostname, _ := os.Hostname()
+	sd := fmt.Sprintf(`[captain kind="%s" agent="%s" cmd="%s" exit_code="%d"]`,
+		sdEscape(e.Kind), sdEscape(e.Agent), sdEscape(e.Cmd), e.ExitCode)
+	msg := fmt.Sprintf("<%d>1 %s %s captain - - %s %s", pri, e.Time.Format(time.RFC3339Nano), hostname, sd, e.Msg)
+	if s.network == "tcp" {
+		// octet counting framing, RFC 6587
+		msg = strconv.Itoa(len(msg)) + " " + msg
+	}
+	s.conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	if _, err := s.conn.Write([]byte(msg)); err != nil {
+		s.conn.Close()
+		s.conn = nil
+		return err
+	}
+	return nil
+}
+
+func sdEscape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, `]`, `\]`).Replace(s)
+}
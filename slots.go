@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"lukechampine.com/blake3"
+)
+
+// slotRetry is how long agents are told to wait for a slot.
+const slotRetry = 5 * time.Second
+
+// budget limits how many agents execute a command, and any command, at
+// once, so a fleet does not overwhelm the backends its commands use. A slot
+// is freed by the agent's result, or after ttl.
+type budget struct {
+	perCmd, total int
+	ttl           time.Duration
+	running       map[string]map[string]time.Time // by command, then agent
+}
+
+func newBudget(perCmd, total int, ttl time.Duration) *budget {
+	return &budget{perCmd: perCmd, total: total, ttl: ttl, running: make(map[string]map[string]time.Time)}
+}
+
+// acquire takes a slot for agent to execute id, reporting whether one was
+// free. An agent holding a slot already keeps it.
+func (b *budget) acquire(id, agent string, now time.Time) bool {
+	total := 0
+	for c, agents := range b.running {
+		for a, at := range agents {
+			if now.Sub(at) > b.ttl {
+				delete(agents, a)
+			}
+		}
+		if len(agents) == 0 {
+			delete(b.running, c)
+		}
+		total += len(agents)
+	}
+	agents := b.running[id]
+	if _, ok := agents[agent]; ok {
+		return true
+	}
+	if (b.perCmd > 0 && len(agents) >= b.perCmd) || (b.total > 0 && total >= b.total) {
+		return false
+	}
+	if agents == nil {
+		agents = make(map[string]time.Time)
+		b.running[id] = agents
+	}
+	agents[agent] = now
+	return true
+}
+
+func (b *budget) release(id, agent string) {
+	if agents := b.running[id]; agents != nil {
+		delete(agents, agent)
+		if len(agents) == 0 {
+			delete(b.running, id)
+		}
+	}
+}
+
+// slotRequest asks for a slot to execute Cmd.
+type slotRequest struct {
+	Cmd, Agent, Sum string
+	Created         time.Time
+}
+
+func (req *slotRequest) validate() error {
+	if err := validID("cmd", req.Cmd); err != nil {
+		return err
+	}
+	if err := validID("agent", req.Agent); err != nil {
+		return err
+	}
+	return validTime(req.Created)
+}
+
+func signSlotRequest(req *slotRequest, h *blake3.Hasher) []byte {
+	h.Reset()
+	h.Write(ttb(req.Created))
+	h.Write(stb(req.Cmd))
+	h.Write(stb(req.Agent))
+	return h.Sum(nil)
+}
+
+func (a *app) handleSlot(w http.ResponseWriter, r *http.Request) {
+	req := &slotRequest{}
+	if !decode(w, r, req) {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if time.Since(req.Created) > 200*time.Millisecond {
+		httpError(w, "payload expired", http.StatusUnauthorized)
+		return
+	}
+	h, err := a.agentHasher(req.Agent)
+	sum, herr := hex.DecodeString(req.Sum)
+	if err != nil || herr != nil || !bytes.Equal(signSlotRequest(req, h), sum) {
+		httpError(w, "invalid checksum", http.StatusUnauthorized)
+		return
+	}
+	if a.revoked(req.Agent) {
+		refuseAgent(w, req.Agent)
+		return
+	}
+	if a.budget != nil && !a.budget.acquire(req.Cmd, req.Agent, time.Now()) {
+		w.Header().Set("Retry-After", strconv.Itoa(int(slotRetry.Seconds())))
+		httpError(w, "no slot free", http.StatusTooManyRequests)
+		return
+	}
+	w.Write([]byte("ok"))
+}
+
+// requestSlot asks the server for a slot to execute c. It returns how long
+// to wait before asking again if none is free.
+func requestSlot(c *cmd, agent string, h *blake3.Hasher, target string) (time.Duration, error) {
+	req := &slotRequest{Cmd: c.ID, Agent: agent, Created: time.Now()}
+	req.Sum = hex.EncodeToString(signSlotRequest(req, h))
+	payload, err := json.Marshal(req)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := client.Post(target+"/slots", "application/json", bytes.NewBuffer(payload))
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return 0, nil
+	case http.StatusTooManyRequests:
+		wait := slotRetry
+		if s, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && s > 0 {
+			wait = time.Duration(s) * time.Second
+		}
+		return wait, nil
+	}
+	return 0, responseError(resp)
+}
+
+// waitSlot waits until the server grants a slot to execute c, or fails
+// once the window of c has closed. When the server cannot be reached,
+// the command runs, as the budget protects backends, not the fleet.
+func (ag *agent) waitSlot(c *cmd) error {
+	logged := false
+	for {
+		wait, err := requestSlot(c, ag.id, ag.hasher(), ag.target)
+		if err != nil {
+			fmt.Printf("%s: slot: %s\n", c.ref(), err)
+			return nil
+		}
+		if wait == 0 {
+			return nil
+		}
+		if !c.NotAfter.IsZero() && time.Now().Add(wait).After(c.NotAfter) {
+			return errors.New("no slot free before the window closed")
+		}
+		if !logged && !ag.quiet {
+			logf("%s: waiting for a slot\n", c.ref())
+			logged = true
+		}
+		time.Sleep(wait)
+	}
+}
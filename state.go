@@ -0,0 +1,246 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	// maxExecuted is how many executed command ids the agent remembers.
+	maxExecuted = 1000
+	// takeoverWait is how long an agent taking over waits for the previous
+	// one to exit.
+	takeoverWait = 30 * time.Second
+)
+
+// state is the agent's persistent state directory, holding its id, the ids
+// of the commands it executed, so they are not executed again after a
+// restart, and of those it must execute again, the time of the newest poll
+// response it accepted, an outbox of results it could not post yet, and a
+// journal of the commands it executed.
+// The directory is locked while the agent runs.
+type state struct {
+	dir         string
+	lock        *os.File
+	executed    []string  // oldest first
+	pending     []string  // received at-least-once commands, oldest first
+	served      time.Time // server time of the newest poll response accepted
+	journalSize int64     // 0 disables the journal
+	mu          sync.Mutex
+}
+
+// openState locks dir, so a second agent on the host refuses to start,
+// or with takeover, stops the agent holding it and waits for it to exit.
+func openState(dir string, takeover bool) (*state, error) {
+	if err := os.MkdirAll(filepath.Join(dir, "outbox"), 0700); err != nil {
+		return nil, err
+	}
+	lockPath, pidPath := filepath.Join(dir, "lock"), filepath.Join(dir, "pid")
+	lock, err := lockFile(lockPath)
+	if err != nil {
+		data, _ := os.ReadFile(pidPath)
+		pid, _ := strconv.Atoi(strings.TrimSpace(string(data)))
+		if !takeover || pid <= 0 {
+			return nil, fmt.Errorf("%s is in use by another agent (pid %d): %w", dir, pid, err)
+		}
+		fmt.Printf("taking over from agent pid %d\n", pid)
+		if err = terminate(pid); err != nil {
+			return nil, err
+		}
+		for deadline := time.Now().Add(takeoverWait); err != nil && time.Now().Before(deadline); {
+			time.Sleep(100 * time.Millisecond)
+			lock, err = lockFile(lockPath)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("agent pid %d did not exit: %w", pid, err)
+		}
+	}
+	if err = writeAtomic(pidPath, []byte(strconv.Itoa(os.Getpid())+"\n")); err != nil {
+		return nil, err
+	}
+	s := &state{dir: dir, lock: lock}
+	data, err := os.ReadFile(filepath.Join(dir, "executed"))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	s.executed = strings.Fields(string(data))
+	data, err = os.ReadFile(filepath.Join(dir, "pending"))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	s.pending = strings.Fields(string(data))
+	data, err = os.ReadFile(filepath.Join(dir, "served"))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if stamp := strings.TrimSpace(string(data)); stamp != "" {
+		if s.served, err = time.Parse(time.RFC3339Nano, stamp); err != nil {
+			return nil, fmt.Errorf("invalid served time in %s: %w", dir, err)
+		}
+	}
+	return s, nil
+}
+
+// agentID returns id, or the id stored by a previous run, or the hostname,
+// and stores it.
+func (s *state) agentID(id string) (string, error) {
+	path := filepath.Join(s.dir, "id")
+	if id == "" {
+		data, err := os.ReadFile(path)
+		if err != nil && !os.IsNotExist(err) {
+			return "", err
+		}
+		id = strings.TrimSpace(string(data))
+	}
+	if id == "" {
+		var err error
+		if id, err = os.Hostname(); err != nil {
+			return "", err
+		}
+	}
+	return id, writeAtomic(path, []byte(id+"\n"))
+}
+
+// executedBefore returns the ids of the commands executed so far.
+func (s *state) executedBefore() map[string]bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ids := make(map[string]bool, len(s.executed))
+	for _, id := range s.executed {
+		ids[id] = true
+	}
+	return ids
+}
+
+func (s *state) wasExecuted(id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, executed := range s.executed {
+		if executed == id {
+			return true
+		}
+	}
+	return false
+}
+
+// markExecuted records that command id is executed, and no longer pending.
+func (s *state) markExecuted(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.executed = append(s.executed, id)
+	if len(s.executed) > maxExecuted {
+		s.executed = s.executed[len(s.executed)-maxExecuted:]
+	}
+	err := writeAtomic(filepath.Join(s.dir, "executed"), []byte(strings.Join(s.executed, "\n")+"\n"))
+	if i := slices.Index(s.pending, id); i >= 0 && err == nil {
+		s.pending = slices.Delete(s.pending, i, i+1)
+		err = s.writePending()
+	}
+	return err
+}
+
+// markServed records t as the high-water mark of poll responses, so a
+// replayed older queue is refused after a restart too.
+func (s *state) markServed(t time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !t.After(s.served) {
+		return nil
+	}
+	s.served = t
+	return writeAtomic(filepath.Join(s.dir, "served"), []byte(t.Format(time.RFC3339Nano)+"\n"))
+}
+
+func (s *state) outboxPath(res *result) string {
+	return filepath.Join(s.dir, "outbox", res.Cmd+"-"+res.Agent+".json")
+}
+
+// keep puts res in the outbox.
+func (s *state) keep(res *result) error {
+	data, err := json.Marshal(res)
+	if err != nil {
+		return err
+	}
+	return writeAtomic(s.outboxPath(res), data)
+}
+
+// outbox returns the results kept in the outbox, oldest first.
+func (s *state) outbox() ([]*result, error) {
+	paths, err := filepath.Glob(filepath.Join(s.dir, "outbox", "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	results := make([]*result, 0, len(paths))
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		res := &result{}
+		if err = json.Unmarshal(data, res); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		results = append(results, res)
+	}
+	return results, nil
+}
+
+func (s *state) drop(res *result) error {
+	return os.Remove(s.outboxPath(res))
+}
+
+// flushOutbox posts the results in the outbox, signed afresh.
+func (ag *agent) flushOutbox() {
+	results, err := ag.state.outbox()
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	for _, res := range results {
+		res.Created = time.Now()
+		if err = postResult(res, ag.hasher(), ag.target); err != nil {
+			fmt.Printf("%s: outbox: %s\n", res.ref(), err)
+			return
+		}
+		if err = ag.state.drop(res); err != nil {
+			fmt.Println(err)
+		}
+	}
+}
+
+// terminate asks process pid to exit, or kills it where it cannot be asked.
+func terminate(pid int) error {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return err
+	}
+	if err = p.Signal(syscall.SIGTERM); err != nil {
+		err = p.Kill()
+	}
+	return err
+}
+
+// writeAtomic replaces the file at path with data.
+func writeAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".captain-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err = tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,388 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// store holds the server's state. Calls are serialized by the app's mutex.
+type store interface {
+	// addCmd queues c, keeping the last maxPending commands.
+	addCmd(c *cmd) error
+	cmds() ([]*cmd, error)
+	addResult(res *result) error
+	results(cmd string) ([]*result, error)
+	// addLog keeps l, along with the last maxPending logs.
+	addLog(l *log) error
+	logs() ([]*log, error)
+	// addDelivery records that agent received the command cmd at t.
+	addDelivery(cmd, agent string, t time.Time) error
+	// deliveries returns when each agent received cmd.
+	deliveries(cmd string) (map[string]time.Time, error)
+	putKey(k *agentKey) error
+	key(agent string) (*agentKey, error)
+	putSecret(s *secret) error
+	secrets(agent string) ([]*secret, error)
+	// forget drops the key and secrets of a revoked agent.
+	forget(agent string) error
+	putToken(t *apiToken) error
+	token(id string) (*apiToken, error)
+	tokens() ([]*apiToken, error)
+	putEnrollment(e *enrollment) error
+	enrollment(agent string) (*enrollment, error)
+	enrollments() ([]*enrollment, error)
+	// putDeadLetter adds or updates a dead letter, keyed by command and agent.
+	putDeadLetter(d *deadLetter) error
+	deadLetters() ([]*deadLetter, error)
+	// putVar adds or updates a variable, keyed by namespace and name.
+	putVar(v *variable) error
+	deleteVar(key string) error
+	vars() ([]*variable, error)
+	// putTemplate adds or updates a command template, keyed by name.
+	putTemplate(t *cmdTemplate) error
+	deleteTemplate(name string) error
+	templates() ([]*cmdTemplate, error)
+	// prune drops what r does not retain. Agent keys and secrets are kept.
+	prune(r retention) error
+}
+
+// openStore selects a store by dsn: memory (the default), file:<path> to
+// persist state in a JSON file, or a redis:// url to share state between
+// servers.
+func openStore(dsn string) (store, error) {
+	scheme, path, _ := strings.Cut(dsn, ":")
+	switch scheme {
+	case "", "memory":
+		return newMemoryStore(), nil
+	case "file":
+		return openFileStore(path)
+	case "redis":
+		return openRedisStore(dsn)
+	case "sqlite", "postgres", "postgresql", "bbolt":
+		// These need drivers captain does not depend on yet.
+		return nil, fmt.Errorf("%s stores are not supported yet, use file: or redis://", scheme)
+	}
+	return nil, fmt.Errorf("unsupported store %s", scheme)
+}
+
+type memoryStore struct {
+	Cmds    []*cmd
+	Results map[string][]*result
+	Logs    []*log
+	Deliver map[string]map[string]time.Time
+	Keys    map[string]*agentKey
+	Secrets map[string]map[string]*secret
+	Tokens  map[string]*apiToken
+	Enrolls map[string]*enrollment
+	Dead    map[string]*deadLetter
+	Vars    map[string]*variable
+	Tmpls   map[string]*cmdTemplate
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{
+		Cmds:    make([]*cmd, 0),
+		Results: make(map[string][]*result),
+		Logs:    make([]*log, 0),
+		Deliver: make(map[string]map[string]time.Time),
+		Keys:    make(map[string]*agentKey),
+		Secrets: make(map[string]map[string]*secret),
+		Tokens:  make(map[string]*apiToken),
+		Enrolls: make(map[string]*enrollment),
+		Dead:    make(map[string]*deadLetter),
+		Vars:    make(map[string]*variable),
+		Tmpls:   make(map[string]*cmdTemplate),
+	}
+}
+
+func (m *memoryStore) addCmd(c *cmd) error {
+	m.Cmds = append(m.Cmds, c)
+	if len(m.Cmds) > maxPending {
+		m.Cmds = m.Cmds[len(m.Cmds)-maxPending:]
+	}
+	return nil
+}
+
+func (m *memoryStore) cmds() ([]*cmd, error) {
+	return m.Cmds, nil
+}
+
+func (m *memoryStore) addResult(res *result) error {
+	m.Results[res.Cmd] = append(m.Results[res.Cmd], res)
+	return nil
+}
+
+func (m *memoryStore) results(cmd string) ([]*result, error) {
+	if m.Results[cmd] == nil {
+		return make([]*result, 0), nil
+	}
+	return m.Results[cmd], nil
+}
+
+func (m *memoryStore) addLog(l *log) error {
+	m.Logs = append(m.Logs, l)
+	if len(m.Logs) > maxPending {
+		m.Logs = m.Logs[len(m.Logs)-maxPending:]
+	}
+	return nil
+}
+
+func (m *memoryStore) logs() ([]*log, error) {
+	return m.Logs, nil
+}
+
+func (m *memoryStore) addDelivery(cmd, agent string, t time.Time) error {
+	if m.Deliver == nil {
+		// Files written by older versions have none.
+		m.Deliver = make(map[string]map[string]time.Time)
+	}
+	if m.Deliver[cmd] == nil {
+		m.Deliver[cmd] = make(map[string]time.Time)
+	}
+	if _, ok := m.Deliver[cmd][agent]; !ok {
+		m.Deliver[cmd][agent] = t
+	}
+	return nil
+}
+
+func (m *memoryStore) deliveries(cmd string) (map[string]time.Time, error) {
+	return m.Deliver[cmd], nil
+}
+
+func (m *memoryStore) putKey(k *agentKey) error {
+	m.Keys[k.Agent] = k
+	return nil
+}
+
+func (m *memoryStore) key(agent string) (*agentKey, error) {
+	return m.Keys[agent], nil
+}
+
+func (m *memoryStore) putSecret(s *secret) error {
+	if m.Secrets[s.Agent] == nil {
+		m.Secrets[s.Agent] = make(map[string]*secret)
+	}
+	m.Secrets[s.Agent][s.Name] = s
+	return nil
+}
+
+func (m *memoryStore) secrets(agent string) ([]*secret, error) {
+	secrets := make([]*secret, 0, len(m.Secrets[agent]))
+	for _, s := range m.Secrets[agent] {
+		secrets = append(secrets, s)
+	}
+	sort.Slice(secrets, func(i, j int) bool { return secrets[i].Name < secrets[j].Name })
+	return secrets, nil
+}
+
+func (m *memoryStore) forget(agent string) error {
+	delete(m.Keys, agent)
+	delete(m.Secrets, agent)
+	return nil
+}
+
+func (m *memoryStore) putToken(t *apiToken) error {
+	m.Tokens[t.ID] = t
+	return nil
+}
+
+func (m *memoryStore) token(id string) (*apiToken, error) {
+	return m.Tokens[id], nil
+}
+
+func (m *memoryStore) tokens() ([]*apiToken, error) {
+	tokens := make([]*apiToken, 0, len(m.Tokens))
+	for _, t := range m.Tokens {
+		tokens = append(tokens, t)
+	}
+	return tokens, nil
+}
+
+func (m *memoryStore) putEnrollment(e *enrollment) error {
+	m.Enrolls[e.Agent] = e
+	return nil
+}
+
+func (m *memoryStore) enrollment(agent string) (*enrollment, error) {
+	return m.Enrolls[agent], nil
+}
+
+func (m *memoryStore) enrollments() ([]*enrollment, error) {
+	enrollments := make([]*enrollment, 0, len(m.Enrolls))
+	for _, e := range m.Enrolls {
+		enrollments = append(enrollments, e)
+	}
+	return enrollments, nil
+}
+
+func (m *memoryStore) putDeadLetter(d *deadLetter) error {
+	m.Dead[d.key()] = d
+	return nil
+}
+
+func (m *memoryStore) deadLetters() ([]*deadLetter, error) {
+	letters := make([]*deadLetter, 0, len(m.Dead))
+	for _, d := range m.Dead {
+		letters = append(letters, d)
+	}
+	return letters, nil
+}
+
+func (m *memoryStore) putVar(v *variable) error {
+	m.Vars[v.key()] = v
+	return nil
+}
+
+func (m *memoryStore) deleteVar(key string) error {
+	delete(m.Vars, key)
+	return nil
+}
+
+func (m *memoryStore) putTemplate(t *cmdTemplate) error {
+	m.Tmpls[t.Name] = t
+	return nil
+}
+
+func (m *memoryStore) deleteTemplate(name string) error {
+	delete(m.Tmpls, name)
+	return nil
+}
+
+func (m *memoryStore) templates() ([]*cmdTemplate, error) {
+	templates := make([]*cmdTemplate, 0, len(m.Tmpls))
+	for _, t := range m.Tmpls {
+		templates = append(templates, t)
+	}
+	return templates, nil
+}
+
+func (m *memoryStore) vars() ([]*variable, error) {
+	vars := make([]*variable, 0, len(m.Vars))
+	for _, v := range m.Vars {
+		vars = append(vars, v)
+	}
+	return vars, nil
+}
+
+// fileStore keeps its state in memory, and rewrites the file after every
+// change, so the server can restart without losing commands or results.
+type fileStore struct {
+	*memoryStore
+	path string
+}
+
+func openFileStore(path string) (*fileStore, error) {
+	if path == "" {
+		return nil, fmt.Errorf("file store needs a path")
+	}
+	fs := &fileStore{memoryStore: newMemoryStore(), path: path}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return fs, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(data, fs.memoryStore); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return fs, nil
+}
+
+func (fs *fileStore) save() error {
+	data, err := json.Marshal(fs.memoryStore)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(fs.path), filepath.Base(fs.path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err = tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), fs.path)
+}
+
+func (fs *fileStore) addCmd(c *cmd) error {
+	fs.memoryStore.addCmd(c)
+	return fs.save()
+}
+
+func (fs *fileStore) addResult(res *result) error {
+	fs.memoryStore.addResult(res)
+	return fs.save()
+}
+
+func (fs *fileStore) addLog(l *log) error {
+	fs.memoryStore.addLog(l)
+	return fs.save()
+}
+
+func (fs *fileStore) addDelivery(cmd, agent string, t time.Time) error {
+	if _, ok := fs.memoryStore.Deliver[cmd][agent]; ok {
+		return nil
+	}
+	fs.memoryStore.addDelivery(cmd, agent, t)
+	return fs.save()
+}
+
+func (fs *fileStore) putKey(k *agentKey) error {
+	fs.memoryStore.putKey(k)
+	return fs.save()
+}
+
+func (fs *fileStore) putSecret(s *secret) error {
+	fs.memoryStore.putSecret(s)
+	return fs.save()
+}
+
+func (fs *fileStore) forget(agent string) error {
+	fs.memoryStore.forget(agent)
+	return fs.save()
+}
+
+func (fs *fileStore) putToken(t *apiToken) error {
+	fs.memoryStore.putToken(t)
+	return fs.save()
+}
+
+func (fs *fileStore) putEnrollment(e *enrollment) error {
+	fs.memoryStore.putEnrollment(e)
+	return fs.save()
+}
+
+func (fs *fileStore) putDeadLetter(d *deadLetter) error {
+	fs.memoryStore.putDeadLetter(d)
+	return fs.save()
+}
+
+func (fs *fileStore) putVar(v *variable) error {
+	fs.memoryStore.putVar(v)
+	return fs.save()
+}
+
+func (fs *fileStore) deleteVar(key string) error {
+	fs.memoryStore.deleteVar(key)
+	return fs.save()
+}
+
+func (fs *fileStore) putTemplate(t *cmdTemplate) error {
+	fs.memoryStore.putTemplate(t)
+	return fs.save()
+}
+
+func (fs *fileStore) deleteTemplate(name string) error {
+	fs.memoryStore.deleteTemplate(name)
+	return fs.save()
+}
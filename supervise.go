@@ -0,0 +1,385 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	superviseType = "supervise"
+	// supervisedHeader reports the processes an agent supervises with its
+	// polls, as name:state:restarts, comma-separated.
+	supervisedHeader = "X-Captain-Supervised"
+	maxSupervised    = 32
+	// A process that crashes is restarted after a backoff doubling from
+	// minBackoff to maxBackoff, reset once it ran for stableAfter.
+	minBackoff  = time.Second
+	maxBackoff  = time.Minute
+	stableAfter = time.Minute
+	// stopGrace is how long a process has to exit after TERM before it is
+	// killed.
+	stopGrace = 10 * time.Second
+)
+
+// States of supervised processes.
+const (
+	superviseRunning  = "running"
+	superviseBackoff  = "backoff"
+	superviseStopping = "stopping"
+)
+
+// supervised is a process the agent keeps running, restarting it when it
+// exits, until a supervise stop command stops it.
+type supervised struct {
+	Name     string
+	Argv     []string
+	Env      []string  `json:",omitempty"`
+	State    string    `json:"-"`
+	Pid      int       `json:"-"`
+	Restarts int       `json:"-"`
+	Since    time.Time `json:"-"`
+	secrets  []string  // env of the agent's secrets, which are not saved
+	proc     *os.Process
+	stop     chan struct{}
+	stopped  chan struct{}
+}
+
+// supervisedStatus is reported for each supervised process.
+type supervisedStatus struct {
+	Name, State string
+	Pid         int `json:",omitempty"`
+	Restarts    int
+	Since       time.Time `json:",omitzero"`
+}
+
+// supervisor holds the processes an agent supervises, by name.
+type supervisor struct {
+	mu    sync.Mutex
+	procs map[string]*supervised
+}
+
+// parseSupervise parses the args of a supervise command: start <name>
+// <binary> [args...], stop <name> or status.
+func parseSupervise(args []string) (action, name string, argv []string, err error) {
+	if len(args) > 0 {
+		action = args[0]
+	}
+	switch {
+	case action == "start" && len(args) >= 3:
+		name, argv = args[1], args[2:]
+	case action == "stop" && len(args) == 2:
+		name = args[1]
+	case action == "status" && len(args) == 1:
+		return action, "", nil, nil
+	default:
+		return "", "", nil, errors.New("usage: supervise start <name> <binary> [args...] | stop <name> | status")
+	}
+	if !varName.MatchString(name) {
+		return "", "", nil, fmt.Errorf("invalid process name %q", name)
+	}
+	return action, name, argv, nil
+}
+
+// supervise starts, stops or reports the processes the agent supervises.
+func (ag *agent) supervise(_ context.Context, c *cmd, env []string) ([]byte, json.RawMessage, error) {
+	action, name, argv, err := parseSupervise(c.Args)
+	if err != nil {
+		return nil, nil, err
+	}
+	switch action {
+	case "start":
+		if ag.state == nil {
+			return nil, nil, errors.New("supervising processes needs a state dir")
+		}
+		pid, err := ag.supervisor.start(&supervised{Name: name, Argv: argv, Env: c.Env, secrets: env})
+		if err != nil {
+			return nil, nil, err
+		}
+		if err = ag.state.saveSupervised(ag.supervisor.list()); err != nil {
+			return nil, nil, err
+		}
+		return []byte(fmt.Sprintf("supervising %s, pid %d", name, pid)), nil, nil
+	case "stop":
+		if err = ag.supervisor.stopProc(name); err != nil {
+			return nil, nil, err
+		}
+		if ag.state != nil {
+			if err = ag.state.saveSupervised(ag.supervisor.list()); err != nil {
+				return nil, nil, err
+			}
+		}
+		return []byte("stopped " + name), nil, nil
+	}
+	statuses := ag.supervisor.statuses()
+	data, err := json.Marshal(statuses)
+	if err != nil {
+		return nil, nil, err
+	}
+	lines := make([]string, len(statuses))
+	for i, s := range statuses {
+		lines[i] = s.String()
+	}
+	return []byte(strings.Join(lines, "\n")), data, nil
+}
+
+// restoreSupervised starts again the processes the agent supervised before
+// it stopped.
+func (ag *agent) restoreSupervised() {
+	procs, err := ag.state.loadSupervised()
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	env, err := ag.secretEnv()
+	if err != nil {
+		fmt.Println(err)
+	}
+	for _, p := range procs {
+		if _, err = ag.supervisor.start(&supervised{Name: p.Name, Argv: p.Argv, Env: p.Env, secrets: env}); err != nil {
+			fmt.Printf("supervise %s: %s\n", p.Name, err)
+			continue
+		}
+		fmt.Printf("supervising %s again\n", p.Name)
+	}
+}
+
+func newSupervisor() *supervisor {
+	return &supervisor{procs: make(map[string]*supervised)}
+}
+
+// start starts p, and keeps it running until it is stopped. It returns the
+// pid of the process.
+func (sv *supervisor) start(p *supervised) (int, error) {
+	sv.mu.Lock()
+	defer sv.mu.Unlock()
+	if sv.procs[p.Name] != nil {
+		return 0, fmt.Errorf("%s is supervised already, stop it first", p.Name)
+	}
+	if len(sv.procs) >= maxSupervised {
+		return 0, fmt.Errorf("more than %d supervised processes", maxSupervised)
+	}
+	p.stop, p.stopped = make(chan struct{}), make(chan struct{})
+	if err := sv.run(p); err != nil {
+		return 0, err
+	}
+	sv.procs[p.Name] = p
+	go sv.keep(p)
+	return p.Pid, nil
+}
+
+// run starts the process of p. The caller holds sv.mu.
+func (sv *supervisor) run(p *supervised) error {
+	oscmd, err := command(context.Background(), p.Argv[0], p.Argv[1:])
+	if err != nil {
+		return err
+	}
+	oscmd.Env = append(append(os.Environ(), p.Env...), p.secrets...)
+	oscmd.Stdout, oscmd.Stderr = os.Stdout, os.Stderr
+	stopWithAgent(oscmd)
+	if err = oscmd.Start(); err != nil {
+		return err
+	}
+	p.proc, p.Pid, p.State, p.Since = oscmd.Process, oscmd.Process.Pid, superviseRunning, time.Now()
+	return nil
+}
+
+// keep waits for the process of p to exit, and restarts it with backoff,
+// until p is stopped.
+func (sv *supervisor) keep(p *supervised) {
+	defer close(p.stopped)
+	backoff := minBackoff
+	for {
+		sv.mu.Lock()
+		proc, since := p.proc, p.Since
+		sv.mu.Unlock()
+		if proc != nil {
+			state, err := proc.Wait()
+			if err == nil {
+				err = errors.New(state.String())
+			}
+			select {
+			case <-p.stop:
+				return
+			default:
+			}
+			if time.Since(since) > stableAfter {
+				backoff = minBackoff
+			}
+			fmt.Printf("supervised %s exited: %s, restarting in %s\n", p.Name, err, backoff)
+		}
+		sv.mu.Lock()
+		p.proc, p.Pid = nil, 0
+		if p.State != superviseStopping {
+			p.State = superviseBackoff
+		}
+		sv.mu.Unlock()
+		select {
+		case <-p.stop:
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(2*backoff, maxBackoff)
+		sv.mu.Lock()
+		if p.State == superviseStopping {
+			sv.mu.Unlock()
+			return
+		}
+		p.Restarts++
+		if err := sv.run(p); err != nil {
+			fmt.Printf("supervised %s: %s\n", p.Name, err)
+		}
+		sv.mu.Unlock()
+	}
+}
+
+// stopProc stops the process name with TERM, or kills it after stopGrace,
+// and stops supervising it.
+func (sv *supervisor) stopProc(name string) error {
+	sv.mu.Lock()
+	p := sv.procs[name]
+	switch {
+	case p == nil:
+		sv.mu.Unlock()
+		return fmt.Errorf("%s is not supervised", name)
+	case p.State == superviseStopping:
+		sv.mu.Unlock()
+		return fmt.Errorf("%s is stopping already", name)
+	}
+	p.State = superviseStopping
+	close(p.stop)
+	proc := p.proc
+	sv.mu.Unlock()
+	if proc != nil {
+		if err := proc.Signal(syscall.SIGTERM); err != nil {
+			proc.Kill()
+		}
+		select {
+		case <-p.stopped:
+		case <-time.After(stopGrace):
+			proc.Kill()
+			<-p.stopped
+		}
+	}
+	<-p.stopped
+	sv.mu.Lock()
+	delete(sv.procs, name)
+	sv.mu.Unlock()
+	return nil
+}
+
+// list returns the supervised processes, to save them.
+func (sv *supervisor) list() []*supervised {
+	sv.mu.Lock()
+	defer sv.mu.Unlock()
+	procs := make([]*supervised, 0, len(sv.procs))
+	for _, p := range sv.procs {
+		if p.State != superviseStopping {
+			procs = append(procs, p)
+		}
+	}
+	sort.Slice(procs, func(i, j int) bool { return procs[i].Name < procs[j].Name })
+	return procs
+}
+
+func (sv *supervisor) statuses() []*supervisedStatus {
+	sv.mu.Lock()
+	defer sv.mu.Unlock()
+	statuses := make([]*supervisedStatus, 0, len(sv.procs))
+	for _, p := range sv.procs {
+		statuses = append(statuses, &supervisedStatus{Name: p.Name, State: p.State, Pid: p.Pid, Restarts: p.Restarts, Since: p.Since})
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Name < statuses[j].Name })
+	return statuses
+}
+
+// header encodes the states of the supervised processes for polls.
+func (sv *supervisor) header() string {
+	if sv == nil {
+		return ""
+	}
+	statuses := sv.statuses()
+	parts := make([]string, len(statuses))
+	for i, s := range statuses {
+		parts[i] = s.Name + ":" + s.State + ":" + strconv.Itoa(s.Restarts)
+	}
+	return strings.Join(parts, ",")
+}
+
+// parseSupervisedHeader decodes the header of a poll, skipping malformed
+// entries.
+func parseSupervisedHeader(header string) []*supervisedStatus {
+	if header == "" {
+		return nil
+	}
+	statuses := make([]*supervisedStatus, 0)
+	for _, part := range strings.Split(header, ",") {
+		fields := strings.Split(part, ":")
+		if len(fields) != 3 || !varName.MatchString(fields[0]) || len(statuses) >= maxSupervised {
+			continue
+		}
+		restarts, err := strconv.Atoi(fields[2])
+		if err != nil {
+			continue
+		}
+		switch fields[1] {
+		case superviseRunning, superviseBackoff, superviseStopping:
+			statuses = append(statuses, &supervisedStatus{Name: fields[0], State: fields[1], Restarts: restarts})
+		}
+	}
+	return statuses
+}
+
+// supervising records the supervised processes agent reported with a poll.
+// The caller holds a.mu.
+func (a *app) supervising(agent, header string) {
+	if statuses := parseSupervisedHeader(header); len(statuses) > 0 {
+		a.supervised[agent] = statuses
+	} else {
+		delete(a.supervised, agent)
+	}
+}
+
+func (s *supervisedStatus) String() string {
+	str := s.Name + " " + s.State
+	if s.Pid > 0 {
+		str += fmt.Sprintf(", pid %d", s.Pid)
+	}
+	if s.Restarts > 0 {
+		str += fmt.Sprintf(", %d restarts", s.Restarts)
+	}
+	return str
+}
+
+func (s *state) saveSupervised(procs []*supervised) error {
+	data, err := json.Marshal(procs)
+	if err != nil {
+		return err
+	}
+	return writeAtomic(filepath.Join(s.dir, "supervised"), data)
+}
+
+// loadSupervised returns the processes the agent supervised, if any.
+func (s *state) loadSupervised() ([]*supervised, error) {
+	data, err := os.ReadFile(filepath.Join(s.dir, "supervised"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	procs := make([]*supervised, 0)
+	if err = json.Unmarshal(data, &procs); err != nil {
+		return nil, fmt.Errorf("supervised: %w", err)
+	}
+	return procs, nil
+}
@@ -0,0 +1,15 @@
+package main
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// stopWithAgent has the kernel stop the supervised process oscmd when the
+// agent exits, so an agent restarted does not supervise it twice.
+func stopWithAgent(oscmd *exec.Cmd) {
+	if oscmd.SysProcAttr == nil {
+		oscmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	oscmd.SysProcAttr.Pdeathsig = syscall.SIGTERM
+}
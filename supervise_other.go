@@ -0,0 +1,8 @@
+//go:build !linux
+
+package main
+
+import "os/exec"
+
+// stopWithAgent does nothing: only Linux stops children with their parent.
+func stopWithAgent(*exec.Cmd) {}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// ANSI colors of terminal output.
+const (
+	colorRed    = "31"
+	colorGreen  = "32"
+	colorYellow = "33"
+)
+
+// stdoutTerminal is whether stdout is a terminal, where output is aligned
+// in columns, and colorStdout whether it is colored too.
+var (
+	stdoutTerminal = isTerminal(os.Stdout)
+	colorStdout    = colorTerminal(os.Stdout)
+)
+
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+// colorTerminal is whether f is a terminal that takes colors, which users
+// disable by setting NO_COLOR (https://no-color.org).
+func colorTerminal(f *os.File) bool {
+	return isTerminal(f) && os.Getenv("NO_COLOR") == "" && os.Getenv("TERM") != "dumb"
+}
+
+// paint colors s for stdout, if it takes colors.
+func paint(color, s string) string {
+	if !colorStdout || color == "" || s == "" {
+		return s
+	}
+	return "\x1b[" + color + "m" + s + "\x1b[0m"
+}
+
+// printTable prints rows under header in aligned columns, with the cells
+// painted in the colors that color returns for them, if any.
+func printTable(header []string, rows [][]string, color func(row, col int) string) {
+	widths := make([]int, len(header))
+	for _, row := range append([][]string{header}, rows...) {
+		for i, cell := range row {
+			widths[i] = max(widths[i], utf8.RuneCountInString(cell))
+		}
+	}
+	printRow := func(r int, row []string) {
+		b := &strings.Builder{}
+		for i, cell := range row {
+			pad := 0
+			if i < len(row)-1 {
+				pad = widths[i] - utf8.RuneCountInString(cell) + 2
+			}
+			if r >= 0 {
+				cell = paint(color(r, i), cell)
+			}
+			b.WriteString(cell + strings.Repeat(" ", pad))
+		}
+		fmt.Println(strings.TrimRight(b.String(), " "))
+	}
+	printRow(-1, header)
+	for r, row := range rows {
+		printRow(r, row)
+	}
+}
+
+var spinnerFrames = []string{"⠋", "⠙", "⠹", "⠸", "⠼", "⠴", "⠦", "⠧", "⠇", "⠏"}
+
+// spinner shows that a client is waiting, redrawing status lines in place
+// on stderr. It draws nothing unless stderr is a terminal, so piped and
+// logged output stays plain.
+type spinner struct {
+	w     io.Writer
+	on    bool
+	frame int
+	drawn int // lines drawn
+	start time.Time
+}
+
+func newSpinner() *spinner {
+	return &spinner{w: os.Stderr, on: isTerminal(os.Stderr), start: time.Now()}
+}
+
+// update redraws the status lines, the first with the time waited. Lines
+// are cut to the width of the terminal, as wrapped lines could not be
+// redrawn.
+func (s *spinner) update(lines ...string) {
+	if !s.on || len(lines) == 0 {
+		return
+	}
+	s.erase()
+	width := termWidth()
+	lines[0] = fmt.Sprintf("%s %s (%s)", spinnerFrames[s.frame%len(spinnerFrames)], lines[0], time.Since(s.start).Round(time.Second))
+	for i, line := range lines {
+		if r := []rune(line); len(r) >= width {
+			lines[i] = string(r[:width-1])
+		}
+	}
+	fmt.Fprint(s.w, strings.Join(lines, "\n"))
+	s.drawn = len(lines)
+	s.frame++
+}
+
+// clear erases the status lines, before printing anything else.
+func (s *spinner) clear() {
+	if s.on {
+		s.erase()
+	}
+}
+
+func (s *spinner) erase() {
+	if s.drawn > 1 {
+		fmt.Fprintf(s.w, "\x1b[%dA", s.drawn-1)
+	}
+	fmt.Fprint(s.w, "\r\x1b[J")
+	s.drawn = 0
+}
+
+// termWidth is the width of the terminal, as exported by shells in
+// COLUMNS, or 80.
+func termWidth() int {
+	if n, err := strconv.Atoi(os.Getenv("COLUMNS")); err == nil && n > 1 {
+		return n
+	}
+	return 80
+}
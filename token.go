@@ -0,0 +1,285 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"lukechampine.com/blake3"
+)
+
+const tokenPrefix = "cpt_"
+
+// apiToken is a server-managed bearer token. The server only keeps the
+// hash of its secret.
+type apiToken struct {
+	ID, Hash         string
+	Scopes           []string
+	Created, Expires time.Time
+	Revoked          bool `json:",omitempty"`
+}
+
+// adminRequest manages tokens and enrollments. It is signed with the key,
+// or sent by an operator with the admin permission.
+type adminRequest struct {
+	Action, ID, Sum string
+	Name, Value     string `json:",omitempty"`
+	Scopes          []string
+	TTL             time.Duration
+	Created         time.Time
+}
+
+type tokenCreated struct {
+	ID, Token string
+	Expires   time.Time
+}
+
+// parseScope parses perm[:targets], where targets is a pattern of agent
+// ids, and defaults to all agents. Tokens scoped to enroll are single-use.
+func parseScope(scope string) (*role, error) {
+	perm, targets, ok := strings.Cut(scope, ":")
+	if !ok {
+		targets = "*"
+	}
+	switch perm {
+	case permView, permSend, permApprove, permEnroll:
+	default:
+		return nil, fmt.Errorf("invalid scope %q", scope)
+	}
+	if _, err := path.Match(targets, ""); err != nil {
+		return nil, fmt.Errorf("invalid scope %q", scope)
+	}
+	return &role{Can: []string{perm}, Targets: []string{targets}}, nil
+}
+
+func tokenHash(secret string) string {
+	sum := blake3.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// tokenOperator authenticates a token of the form cpt_<id>_<secret>.
+func (a *app) tokenOperator(token string) (*operator, error) {
+	id, secret, ok := strings.Cut(strings.TrimPrefix(token, tokenPrefix), "_")
+	if !ok {
+		return nil, errors.New("malformed token")
+	}
+	a.mu.Lock()
+	t, err := a.store.token(id)
+	a.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	if t == nil || subtle.ConstantTimeCompare([]byte(tokenHash(secret)), []byte(t.Hash)) != 1 {
+		return nil, errors.New("unknown token")
+	}
+	if t.Revoked {
+		return nil, errors.New("token revoked")
+	}
+	if time.Now().After(t.Expires) {
+		return nil, errors.New("token expired")
+	}
+	op := &operator{Name: "token:" + t.ID}
+	for _, scope := range t.Scopes {
+		r, err := parseScope(scope)
+		if err != nil {
+			return nil, err
+		}
+		op.scopes = append(op.scopes, r)
+	}
+	return op, nil
+}
+
+// decodeAdmin decodes and authorizes an admin request. It responds and
+// returns nil if the request is not allowed.
+func (a *app) decodeAdmin(w http.ResponseWriter, r *http.Request, actions ...string) *adminRequest {
+	req := &adminRequest{}
+	if !decode(w, r, req) {
+		return nil
+	}
+	if !contains(actions, req.Action) {
+		httpError(w, fmt.Sprintf("unsupported action %q", req.Action), http.StatusBadRequest)
+		return nil
+	}
+	op, err := a.operator(r)
+	if err != nil {
+		httpError(w, err.Error(), http.StatusUnauthorized)
+		return nil
+	}
+	if op != nil {
+		if !a.rbac.can(op, permAdmin) {
+			httpError(w, op.Name+" may not "+req.Action, http.StatusForbidden)
+			return nil
+		}
+		return req
+	}
+	a.mu.Lock()
+	err = verifyAdminRequest(req, r.URL.Path, a.hasher, 200*time.Millisecond)
+	a.mu.Unlock()
+	if err != nil {
+		httpError(w, err.Error(), http.StatusUnauthorized)
+		return nil
+	}
+	return req
+}
+
+func (a *app) handleTokens(w http.ResponseWriter, r *http.Request) {
+	req := a.decodeAdmin(w, r, "create", "list", "revoke")
+	if req == nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	var v any
+	var err error
+	switch req.Action {
+	case "create":
+		secret := make([]byte, 32)
+		if _, err = rand.Read(secret); err != nil {
+			break
+		}
+		t := &apiToken{
+			ID:      newID(),
+			Hash:    tokenHash(hex.EncodeToString(secret)),
+			Scopes:  req.Scopes,
+			Created: time.Now(),
+			Expires: time.Now().Add(req.TTL),
+		}
+		if err = a.store.putToken(t); err == nil {
+			v = &tokenCreated{ID: t.ID, Token: tokenPrefix + t.ID + "_" + hex.EncodeToString(secret), Expires: t.Expires}
+		}
+	case "list":
+		var tokens []*apiToken
+		if tokens, err = a.store.tokens(); err == nil {
+			list := make([]apiToken, 0, len(tokens))
+			for _, t := range tokens {
+				listed := *t
+				listed.Hash = ""
+				list = append(list, listed)
+			}
+			v = list
+		}
+	case "revoke":
+		var t *apiToken
+		if t, err = a.store.token(req.ID); err == nil && t == nil {
+			httpError(w, "not found", http.StatusNotFound)
+			return
+		}
+		if err == nil {
+			t.Revoked = true
+			err = a.store.putToken(t)
+			v = t.ID
+		}
+	}
+	var payload []byte
+	if err == nil {
+		payload, err = json.Marshal(v)
+	}
+	if err != nil {
+		httpError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write(payload)
+}
+
+func (req *adminRequest) validate() error {
+	switch req.Action {
+	case "create":
+		if req.TTL <= 0 {
+			return errors.New("token needs a positive ttl")
+		}
+		if len(req.Scopes) == 0 {
+			return errors.New("token needs a scope")
+		}
+		for _, scope := range req.Scopes {
+			if _, err := parseScope(scope); err != nil {
+				return err
+			}
+		}
+	case "list":
+	case "set", "delete":
+		if err := validVar(req.Name, req.Value); err != nil {
+			return err
+		}
+	case "revoke", "approve", "reject", "retry":
+		if err := validID("id", req.ID); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unsupported action %q", req.Action)
+	}
+	return validTime(req.Created)
+}
+
+// postAdmin sends an admin request to path, signed if h is not nil, and
+// decodes the response into v.
+func postAdmin(path string, req *adminRequest, h *blake3.Hasher, target string, v any) error {
+	req.Created = time.Now()
+	if h != nil {
+		req.Sum = hex.EncodeToString(signAdminRequest(req, path, h))
+	}
+	payload, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Post(target+path, "application/json", bytes.NewBuffer(payload))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return responseError(resp)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+func printTokens(tokens []*apiToken) {
+	sort.Slice(tokens, func(i, j int) bool { return tokens[i].Created.Before(tokens[j].Created) })
+	for _, t := range tokens {
+		state := "expires " + t.Expires.Format(time.RFC3339)
+		switch {
+		case t.Revoked:
+			state = "revoked"
+		case time.Now().After(t.Expires):
+			state = "expired"
+		}
+		fmt.Printf("%s: %s %s\n", t.ID, strings.Join(t.Scopes, ","), state)
+	}
+}
+
+// signAdminRequest signs req as sent to path, so it cannot be replayed to
+// another endpoint sharing its action.
+func signAdminRequest(req *adminRequest, path string, h *blake3.Hasher) []byte {
+	h.Reset()
+	h.Write(ttb(req.Created))
+	h.Write(stb(path))
+	h.Write(stb(req.Action))
+	h.Write(stb(req.ID))
+	writeList(h, req.Scopes)
+	h.Write(vtb(int(req.TTL)))
+	h.Write(stb(req.Name))
+	h.Write(stb(req.Value))
+	return h.Sum(nil)
+}
+
+func verifyAdminRequest(req *adminRequest, path string, h *blake3.Hasher, ttl time.Duration) error {
+	if time.Since(req.Created) > ttl {
+		return errors.New("payload expired")
+	}
+	sum, err := hex.DecodeString(req.Sum)
+	if err != nil {
+		return fmt.Errorf("failed to decode sig hex: %w", err)
+	}
+	if !bytes.Equal(signAdminRequest(req, path, h), sum) {
+		return errors.New("invalid checksum")
+	}
+	return nil
+}
@@ -0,0 +1,35 @@
+package main
+
+import "net/http"
+
+// traceHeader carries the correlation id of a dispatch. A sender tags every
+// command it sends with one id, which agents copy into their results, and
+// the server echoes on responses and records in logs and the audit trail.
+const traceHeader = "X-Captain-Trace"
+
+type traceTransport struct {
+	trace string
+	http.RoundTripper
+}
+
+func (t traceTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	r = r.Clone(r.Context())
+	r.Header.Set(traceHeader, t.trace)
+	return t.RoundTripper.RoundTrip(r)
+}
+
+// ref names c in log lines, with its trace if any.
+func (c *cmd) ref() string {
+	if c.Trace == "" {
+		return c.ID
+	}
+	return c.ID + " (trace " + c.Trace + ")"
+}
+
+// ref names the command of res in log lines, with its trace if any.
+func (res *result) ref() string {
+	if res.Trace == "" {
+		return res.Cmd
+	}
+	return res.Cmd + " (trace " + res.Trace + ")"
+}
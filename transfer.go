@@ -0,0 +1,376 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"lukechampine.com/blake3"
+)
+
+const (
+	maxRetries = 10
+	maxChunk   = 16 << 20
+)
+
+var errConflict = errors.New("offset conflict")
+
+type throttle struct {
+	rate  int64
+	n     int64
+	start time.Time
+	mu    sync.Mutex
+}
+
+func newThrottle(rate int64) *throttle {
+	return &throttle{rate: rate, start: time.Now()}
+}
+
+// wait blocks until n more bytes may be transferred without exceeding the
+// rate. Concurrent transfers share the rate. After a second idle, the count
+// restarts, so idle time does not allow a burst.
+func (t *throttle) wait(n int) {
+	if t.rate <= 0 {
+		return
+	}
+	t.mu.Lock()
+	if now := time.Now(); now.Sub(t.due()) > time.Second {
+		t.start, t.n = now, 0
+	}
+	t.n += int64(n)
+	due := t.due()
+	t.mu.Unlock()
+	time.Sleep(time.Until(due))
+}
+
+func (t *throttle) due() time.Time {
+	return t.start.Add(time.Duration(t.n * int64(time.Second) / t.rate))
+}
+
+// throttledReader waits on its throttle for the bytes read.
+type throttledReader struct {
+	io.ReadCloser
+	t *throttle
+}
+
+func (r *throttledReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.t.wait(n)
+	return n, err
+}
+
+// throttleTransport limits the bandwidth of the request bodies a transport
+// sends and the response bodies it receives.
+type throttleTransport struct {
+	http.RoundTripper
+	download, upload *throttle
+}
+
+func (t *throttleTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	if r.Body != nil && r.Body != http.NoBody && t.upload.rate > 0 {
+		r = r.Clone(r.Context())
+		r.Body = &throttledReader{r.Body, t.upload}
+	}
+	resp, err := t.RoundTripper.RoundTrip(r)
+	if err == nil && t.download.rate > 0 {
+		resp.Body = &throttledReader{resp.Body, t.download}
+	}
+	return resp, err
+}
+
+func push(path, name, target string, chunk, rate int64, h *blake3.Hasher) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	offset, err := retry(func() (int64, error) { return statRemote(target, name) })
+	if err != nil {
+		return err
+	}
+	if offset > info.Size() {
+		return fmt.Errorf("remote file is larger than %s", path)
+	}
+	buf := make([]byte, chunk)
+	thr := newThrottle(rate)
+	for offset < info.Size() {
+		n, err := f.ReadAt(buf, offset)
+		if err != nil && err != io.EOF {
+			return err
+		}
+		data := buf[:n]
+		sum := hex.EncodeToString(signChunk(name, offset, data, h))
+		_, err = retry(func() (int64, error) { return 0, postChunk(target, name, offset, data, sum) })
+		if errors.Is(err, errConflict) {
+			offset, err = retry(func() (int64, error) { return statRemote(target, name) })
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		offset += int64(n)
+		thr.wait(n)
+		fmt.Printf("\r%s: %d/%d bytes", name, offset, info.Size())
+	}
+	fmt.Println()
+	return nil
+}
+
+func pull(name, path, target string, chunk, rate int64, h *blake3.Hasher) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	offset := info.Size()
+	size, err := retry(func() (int64, error) { return statRemote(target, name) })
+	if err != nil {
+		return err
+	}
+	if offset > size {
+		return fmt.Errorf("%s is larger than remote file", path)
+	}
+	thr := newThrottle(rate)
+	for offset < size {
+		var data []byte
+		_, err := retry(func() (int64, error) {
+			var err error
+			data, err = getChunk(target, name, offset, chunk, h)
+			return 0, err
+		})
+		if err != nil {
+			return err
+		}
+		if _, err = f.Write(data); err != nil {
+			return err
+		}
+		offset += int64(len(data))
+		thr.wait(len(data))
+		fmt.Printf("\r%s: %d/%d bytes", name, offset, size)
+	}
+	fmt.Println()
+	return nil
+}
+
+// retry calls fn until it succeeds, returns errConflict, or maxRetries is reached.
+func retry(fn func() (int64, error)) (int64, error) {
+	var err error
+	for i := 0; i < maxRetries; i++ {
+		var v int64
+		v, err = fn()
+		if err == nil || errors.Is(err, errConflict) {
+			return v, err
+		}
+		fmt.Printf("\nattempt %d failed: %s\n", i+1, err)
+		time.Sleep(time.Duration(i+1) * time.Second)
+	}
+	return 0, err
+}
+
+func statRemote(target, name string) (int64, error) {
+	resp, err := client.Head(target + "/file/" + name)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return 0, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return 0, responseError(resp)
+	}
+	return strconv.ParseInt(resp.Header.Get("X-Captain-Size"), 10, 64)
+}
+
+func postChunk(target, name string, offset int64, data []byte, sum string) error {
+	url := fmt.Sprintf("%s/file/%s?offset=%d", target, name, offset)
+	req, err := http.NewRequest("POST", url, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Captain-Sum", sum)
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusConflict {
+		return errConflict
+	}
+	if resp.StatusCode != http.StatusOK {
+		return responseError(resp)
+	}
+	return nil
+}
+
+func getChunk(target, name string, offset, size int64, h *blake3.Hasher) ([]byte, error) {
+	url := fmt.Sprintf("%s/file/%s?offset=%d&size=%d", target, name, offset, size)
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, responseError(resp)
+	}
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	sum, err := hex.DecodeString(resp.Header.Get("X-Captain-Sum"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode sig hex: %w", err)
+	}
+	if !bytes.Equal(signChunk(name, offset, data, h), sum) {
+		return nil, errors.New("invalid checksum")
+	}
+	return data, nil
+}
+
+func (a *app) handleFile(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/file/")
+	if name == "" || name == "." || name == ".." || name != filepath.Base(name) {
+		httpError(w, "invalid file name", http.StatusBadRequest)
+		return
+	}
+	if r.Method != "POST" && !a.viewer(w, r, "files") {
+		return
+	}
+	if r.Method == "POST" {
+		// Chunks are appended at the size checked here, so pushes to a
+		// file are serialized from the stat through the write.
+		push := a.pushLock(name)
+		push.Lock()
+		defer push.Unlock()
+	}
+	path := filepath.Join(a.dir, name)
+	var size int64
+	info, err := os.Stat(path)
+	if err == nil {
+		size = info.Size()
+	} else if !os.IsNotExist(err) {
+		httpError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("X-Captain-Size", strconv.FormatInt(size, 10))
+	switch r.Method {
+	case "HEAD":
+		if info == nil {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	case "GET":
+		a.handleGetChunk(w, r, name, path)
+	case "POST":
+		a.handlePostChunk(w, r, name, path, size)
+	}
+}
+
+// pushLock returns the mutex serializing pushes to the file name.
+func (a *app) pushLock(name string) *sync.Mutex {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	m, ok := a.pushes[name]
+	if !ok {
+		m = &sync.Mutex{}
+		a.pushes[name] = m
+	}
+	return m
+}
+
+func (a *app) handleGetChunk(w http.ResponseWriter, r *http.Request, name, path string) {
+	offset, err := strconv.ParseInt(r.URL.Query().Get("offset"), 10, 64)
+	if err != nil || offset < 0 {
+		httpError(w, "invalid offset", http.StatusBadRequest)
+		return
+	}
+	size, err := strconv.ParseInt(r.URL.Query().Get("size"), 10, 64)
+	if err != nil || size <= 0 || size > maxChunk {
+		httpError(w, "invalid size", http.StatusBadRequest)
+		return
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		httpError(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	defer f.Close()
+	data := make([]byte, size)
+	n, err := f.ReadAt(data, offset)
+	if err != nil && err != io.EOF {
+		httpError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	data = data[:n]
+	a.mu.Lock()
+	sum := signChunk(name, offset, data, a.hasher)
+	a.mu.Unlock()
+	w.Header().Set("X-Captain-Sum", hex.EncodeToString(sum))
+	w.Write(data)
+}
+
+func (a *app) handlePostChunk(w http.ResponseWriter, r *http.Request, name, path string, size int64) {
+	offset, err := strconv.ParseInt(r.URL.Query().Get("offset"), 10, 64)
+	if err != nil {
+		httpError(w, "invalid offset", http.StatusBadRequest)
+		return
+	}
+	if offset != size {
+		httpError(w, "offset does not match file size", http.StatusConflict)
+		return
+	}
+	data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxChunk))
+	if err != nil {
+		httpError(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+	sum, err := hex.DecodeString(r.Header.Get("X-Captain-Sum"))
+	a.mu.Lock()
+	valid := err == nil && bytes.Equal(signChunk(name, offset, data, a.hasher), sum)
+	a.mu.Unlock()
+	if !valid {
+		httpError(w, "invalid checksum", http.StatusUnauthorized)
+		return
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		httpError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+	if _, err = f.Write(data); err != nil {
+		httpError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write([]byte("ok"))
+}
+
+func signChunk(name string, offset int64, data []byte, h *blake3.Hasher) []byte {
+	h.Reset()
+	h.Write(stb(name))
+	off := make([]byte, 8)
+	binary.LittleEndian.PutUint64(off, uint64(offset))
+	h.Write(off)
+	h.Write(data)
+	return h.Sum(nil)
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	maxBody    = 4 << 20
+	maxArgs    = 1024
+	maxArgLen  = 64 << 10
+	maxAgents  = 1024
+	maxIDLen   = 64
+	clockSkew  = time.Minute
+	maxNameLen = 255
+)
+
+type validator interface {
+	validate() error
+}
+
+// decode reads a JSON request body of limited size into v, rejecting
+// unknown fields and invalid values with 400.
+func decode(w http.ResponseWriter, r *http.Request, v validator) bool {
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBody))
+	dec.DisallowUnknownFields()
+	err := dec.Decode(v)
+	if err == nil {
+		err = v.validate()
+	}
+	if err != nil {
+		httpError(w, err.Error(), http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+func validTime(t time.Time) error {
+	if t.IsZero() {
+		return errors.New("missing timestamp")
+	}
+	if time.Until(t) > clockSkew {
+		return errors.New("timestamp is in the future")
+	}
+	return nil
+}
+
+func validID(field, id string) error {
+	if id == "" {
+		return fmt.Errorf("missing %s", field)
+	}
+	if len(id) > maxIDLen {
+		return fmt.Errorf("%s is too long", field)
+	}
+	return nil
+}
+
+func (c *cmd) validate() error {
+	if err := checkVersion(c.Version); err != nil {
+		return err
+	}
+	if err := validID("id", c.ID); err != nil {
+		return err
+	}
+	switch {
+	case c.Signal != "":
+		if _, ok := signals[strings.ToUpper(c.Signal)]; !ok {
+			return fmt.Errorf("unsupported signal %s", c.Signal)
+		}
+		if err := validID("ref", c.Ref); err != nil {
+			return err
+		}
+	case c.Type == "" && c.Name == "":
+		return errors.New("missing name")
+	case c.Type == artifactType:
+		if err := validArtifact(c.Artifact, c.Digest); err != nil {
+			return err
+		}
+		if c.Container != "" {
+			return errors.New("artifacts cannot run in containers")
+		}
+	case c.Type == rebootType:
+		if _, err := rebootDelay(c); err != nil {
+			return err
+		}
+		if c.Name != "" || c.Container != "" {
+			return errors.New("reboot takes no name or container")
+		}
+	case c.Type == superviseType:
+		if _, _, _, err := parseSupervise(c.Args); err != nil {
+			return err
+		}
+		if c.Name != "" || c.Container != "" {
+			return errors.New("supervise takes no name or container")
+		}
+	case c.Type == sealedType:
+		if c.Name != "" || c.Container != "" || c.Artifact != "" || len(c.Args) > 0 || len(c.Env) > 0 {
+			return errors.New("sealed command has a plaintext body")
+		}
+		if len(c.Sealed) == 0 {
+			return errors.New("sealed command has no recipients")
+		}
+		for _, box := range c.Sealed {
+			if !c.targets(box.Agent) || len(c.Agents) == 0 {
+				return fmt.Errorf("sealed for %s, which is not targeted", box.Agent)
+			}
+		}
+	}
+	if err := validDelivery(c.Delivery); err != nil {
+		return err
+	}
+	if c.LocalHours != "" {
+		if _, _, err := parseHours(c.LocalHours); err != nil {
+			return err
+		}
+	}
+	if c.Delivered != nil {
+		return errors.New("unexpected deliveries")
+	}
+	if c.Type != sealedType && len(c.Sealed) > 0 {
+		return errors.New("unexpected sealed body")
+	}
+	if c.Type != artifactType && (c.Artifact != "" || c.Digest != "") {
+		return errors.New("unexpected artifact")
+	}
+	if len(c.Name) > maxNameLen {
+		return errors.New("name is too long")
+	}
+	if len(c.Args) > maxArgs {
+		return fmt.Errorf("more than %d args", maxArgs)
+	}
+	for _, arg := range c.Args {
+		if len(arg) > maxArgLen {
+			return fmt.Errorf("arg longer than %d bytes", maxArgLen)
+		}
+	}
+	if len(c.Agents) > maxAgents {
+		return fmt.Errorf("more than %d agents", maxAgents)
+	}
+	for _, agent := range c.Agents {
+		if err := validID("agent", agent); err != nil {
+			return err
+		}
+	}
+	if err := validLabels(c.Labels); err != nil {
+		return err
+	}
+	if c.Hook != nil {
+		if err := c.Hook.validate(); err != nil {
+			return err
+		}
+	}
+	if c.Template {
+		if err := c.validTemplate(); err != nil {
+			return err
+		}
+	}
+	if c.Expect != nil {
+		if err := c.Expect.validate(); err != nil {
+			return err
+		}
+	}
+	if c.Timeout < 0 {
+		return errors.New("negative timeout")
+	}
+	if len(c.After) > maxAfter {
+		return fmt.Errorf("runs after more than %d commands", maxAfter)
+	}
+	for _, id := range c.After {
+		if err := validID("after", id); err != nil {
+			return err
+		}
+		if id == c.ID {
+			return errors.New("runs after itself")
+		}
+	}
+	if c.Lock != "" {
+		if err := validID("lock", c.Lock); err != nil {
+			return err
+		}
+	}
+	if len(c.Await) > maxAfter {
+		return fmt.Errorf("awaits more than %d commands", maxAfter)
+	}
+	for _, id := range c.Await {
+		if err := validID("await", id); err != nil {
+			return err
+		}
+		if id == c.ID {
+			return errors.New("awaits itself")
+		}
+	}
+	if !c.NotAfter.IsZero() {
+		if !c.NotAfter.After(c.NotBefore) {
+			return errors.New("window closes before it opens")
+		}
+		if time.Now().After(c.NotAfter) {
+			return errors.New("window already closed")
+		}
+	}
+	if c.Trace != "" {
+		if err := validID("trace", c.Trace); err != nil {
+			return err
+		}
+	}
+	if c.Channel != "" && !varName.MatchString(c.Channel) {
+		return fmt.Errorf("invalid channel %q", c.Channel)
+	}
+	if c.Promoted != "" {
+		if err := validID("promoted", c.Promoted); err != nil {
+			return err
+		}
+	}
+	if len(c.Cosigs) > maxCosigs {
+		return fmt.Errorf("more than %d cosignatures", maxCosigs)
+	}
+	for _, s := range c.Cosigs {
+		if err := s.validate(); err != nil {
+			return err
+		}
+	}
+	return validTime(c.Created)
+}
+
+func (l *log) validate() error {
+	if err := checkVersion(l.Version); err != nil {
+		return err
+	}
+	return validTime(l.Created)
+}
+
+func (res *result) validate() error {
+	if err := validID("cmd", res.Cmd); err != nil {
+		return err
+	}
+	if err := validID("agent", res.Agent); err != nil {
+		return err
+	}
+	if res.Trace != "" {
+		if err := validID("trace", res.Trace); err != nil {
+			return err
+		}
+	}
+	return validTime(res.Created)
+}
+
+func (k *agentKey) validate() error {
+	if err := validID("agent", k.Agent); err != nil {
+		return err
+	}
+	return validTime(k.Created)
+}
+
+func (s *secret) validate() error {
+	if err := validID("agent", s.Agent); err != nil {
+		return err
+	}
+	if !envName.MatchString(s.Name) {
+		return fmt.Errorf("invalid secret name %q", s.Name)
+	}
+	return validTime(s.Created)
+}
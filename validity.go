@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"time"
+)
+
+// validityRule limits how long commands to matching agents stay valid, from
+// their creation to the close of their window. Commands without a window
+// that the server signs get the Default window; windows longer than Max
+// are rejected.
+type validityRule struct {
+	Agents  string `json:"agents"`
+	Default string `json:"default"`
+	Max     string `json:"max"`
+	def     time.Duration
+	max     time.Duration
+}
+
+func (v *validityRule) validate() error {
+	if _, err := path.Match(v.Agents, ""); err != nil {
+		return fmt.Errorf("validity: invalid pattern %q", v.Agents)
+	}
+	for _, d := range []struct {
+		s string
+		d *time.Duration
+	}{{v.Default, &v.def}, {v.Max, &v.max}} {
+		if d.s == "" {
+			continue
+		}
+		var err error
+		if *d.d, err = time.ParseDuration(d.s); err != nil || *d.d <= 0 {
+			return fmt.Errorf("validity %s: invalid duration %q", v.Agents, d.s)
+		}
+	}
+	if v.max > 0 && v.def > v.max {
+		return fmt.Errorf("validity %s: default exceeds max", v.Agents)
+	}
+	return nil
+}
+
+// validity returns the default and maximum validity of c, the strictest
+// of the first rule matching each targeted agent. Untargeted commands reach
+// every agent, so get the strictest of all rules. Zero is unlimited.
+func (p *policy) validity(c *cmd) (def, max time.Duration) {
+	strictest := func(v *validityRule) {
+		if v.def > 0 && (def == 0 || v.def < def) {
+			def = v.def
+		}
+		if v.max > 0 && (max == 0 || v.max < max) {
+			max = v.max
+		}
+	}
+	if len(c.Agents) == 0 {
+		for _, v := range p.Validity {
+			strictest(v)
+		}
+		return def, max
+	}
+	for _, agent := range c.Agents {
+		for _, v := range p.Validity {
+			if v.Agents == "" || matchAny([]string{v.Agents}, agent) {
+				strictest(v)
+				break
+			}
+		}
+	}
+	return def, max
+}
+
+// checkValidity rejects c if its window closes too long after its creation,
+// or never closes while a maximum applies. Agents hold a command opening
+// later or within local hours as long as its window, instead of expiring it.
+func (p *policy) checkValidity(c *cmd) error {
+	_, max := p.validity(c)
+	if c.NotAfter.IsZero() {
+		if max > 0 && (!c.NotBefore.IsZero() || c.LocalHours != "") {
+			return fmt.Errorf("rejected by policy: a window without -not-after stays valid longer than the %s allowed", max)
+		}
+		return nil
+	}
+	if max > 0 && c.NotAfter.Sub(c.Created) > max {
+		return fmt.Errorf("rejected by policy: valid for %s, longer than the %s allowed", c.NotAfter.Sub(c.Created).Round(time.Second), max)
+	}
+	return nil
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCheckValidity(t *testing.T) {
+	v := &validityRule{Max: "1h"}
+	if err := v.validate(); err != nil {
+		t.Fatal(err)
+	}
+	p := &policy{Validity: []*validityRule{v}}
+	now := time.Now()
+	tests := []struct {
+		name string
+		c    cmd
+		ok   bool
+	}{
+		{"no window", cmd{}, true},
+		{"within max", cmd{NotAfter: now.Add(time.Minute)}, true},
+		{"beyond max", cmd{NotAfter: now.Add(2 * time.Hour)}, false},
+		{"opens later, never closes", cmd{NotBefore: now.Add(time.Minute)}, false},
+		{"local hours, never closes", cmd{LocalHours: "22:00-06:00"}, false},
+		{"local hours within max", cmd{LocalHours: "22:00-06:00", NotAfter: now.Add(time.Minute)}, true},
+	}
+	for _, tt := range tests {
+		tt.c.Created = now
+		if err := p.checkValidity(&tt.c); (err == nil) != tt.ok {
+			t.Errorf("%s: got %v", tt.name, err)
+		}
+	}
+	if err := (&policy{}).checkValidity(&cmd{Created: now, NotBefore: now.Add(time.Minute)}); err != nil {
+		t.Errorf("no max: %s", err)
+	}
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+
+	"lukechampine.com/blake3"
+)
+
+const (
+	defaultNamespace = "default"
+	// namespaceLabel selects the namespace the variables of a template are
+	// resolved in, falling back to the default namespace.
+	namespaceLabel = "namespace"
+	maxVarValue    = 64 << 10
+)
+
+var varName = regexp.MustCompile(`^[A-Za-z0-9_.-]{1,128}$`)
+
+// variable is a value stored on the server, substituted into templated
+// commands as {{var "name"}} when they are delivered to agents.
+type variable struct {
+	Namespace, Name, Value string
+	Updated                time.Time
+}
+
+func (v *variable) key() string {
+	return v.Namespace + "/" + v.Name
+}
+
+// parseVar parses [namespace/]name.
+func parseVar(s string) (*variable, error) {
+	ns, name, ok := strings.Cut(s, "/")
+	if !ok {
+		ns, name = defaultNamespace, s
+	}
+	if !varName.MatchString(ns) || !varName.MatchString(name) {
+		return nil, fmt.Errorf("invalid variable %q, want [namespace/]name", s)
+	}
+	return &variable{Namespace: ns, Name: name}, nil
+}
+
+func parseTemplate(s string, lookup func(string) (string, error)) (*template.Template, error) {
+	return template.New("").Funcs(template.FuncMap{"var": lookup}).Option("missingkey=error").Parse(s)
+}
+
+// validTemplate checks the args and env of a templated command parse.
+func (c *cmd) validTemplate() error {
+	switch {
+	case c.Type == sealedType:
+		return errors.New("sealed commands cannot be templates")
+	case c.Signal != "":
+		return errors.New("signals cannot be templates")
+	}
+	for _, s := range append(append([]string{}, c.Args...), c.Env...) {
+		if _, err := parseTemplate(s, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// materialize returns c with its args and env resolved against vars, and
+// signed by the server, and with d if it is not nil, or c itself if it is
+// not a template.
+func materialize(c *cmd, vars []*variable, h *blake3.Hasher, d *delegator) (*cmd, error) {
+	if !c.Template {
+		return c, nil
+	}
+	ns := c.Labels[namespaceLabel]
+	if ns == "" {
+		ns = defaultNamespace
+	}
+	values := make(map[string]string)
+	for _, v := range vars {
+		if v.Namespace == defaultNamespace {
+			values[v.Name] = v.Value
+		}
+	}
+	for _, v := range vars {
+		if v.Namespace == ns {
+			values[v.Name] = v.Value
+		}
+	}
+	used := make(map[string]string)
+	m, err := resolveTemplate(c, values, ns, used)
+	if err != nil {
+		return nil, err
+	}
+	m.Delegation = nil
+	m.Sum = hex.EncodeToString(signCmd(m, h))
+	if d != nil {
+		d.delegate(m, c, delegateTemplate, used)
+	}
+	return m, nil
+}
+
+// resolveTemplate returns c with its args and env resolved against values,
+// recording the values used in used, if it is not nil.
+func resolveTemplate(c *cmd, values map[string]string, ns string, used map[string]string) (*cmd, error) {
+	resolve := func(s string) (string, error) {
+		t, err := parseTemplate(s, func(name string) (string, error) {
+			value, ok := values[name]
+			if !ok {
+				return "", fmt.Errorf("variable %s/%s is not set", ns, name)
+			}
+			if used != nil {
+				used[name] = value
+			}
+			return value, nil
+		})
+		if err != nil {
+			return "", err
+		}
+		b := &strings.Builder{}
+		err = t.Execute(b, nil)
+		return b.String(), err
+	}
+	m := *c
+	m.Args = make([]string, len(c.Args))
+	m.Env = make([]string, len(c.Env))
+	var err error
+	for i, arg := range c.Args {
+		if m.Args[i], err = resolve(arg); err != nil {
+			return nil, err
+		}
+	}
+	for i, env := range c.Env {
+		if m.Env[i], err = resolve(env); err != nil {
+			return nil, err
+		}
+	}
+	return &m, nil
+}
+
+// materializeAll materializes the templated commands in cmds, dropping
+// those that cannot be resolved. The caller holds a.mu.
+func (a *app) materializeAll(cmds []*cmd) ([]*cmd, error) {
+	vars, err := a.store.vars()
+	if err != nil {
+		return nil, err
+	}
+	out := make([]*cmd, 0, len(cmds))
+	for _, c := range cmds {
+		m, err := materialize(c, vars, a.hasher, a.delegator)
+		if err != nil {
+			fmt.Printf("%s: %s\n", c.ref(), err)
+			continue
+		}
+		out = append(out, m)
+	}
+	return out, nil
+}
+
+func (a *app) handleVars(w http.ResponseWriter, r *http.Request) {
+	req := a.decodeAdmin(w, r, "list", "set", "delete")
+	if req == nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	var v any
+	var err error
+	switch req.Action {
+	case "list":
+		var vars []*variable
+		if vars, err = a.store.vars(); err == nil {
+			sort.Slice(vars, func(i, j int) bool { return vars[i].key() < vars[j].key() })
+			v = vars
+		}
+	case "set":
+		nv, _ := parseVar(req.Name)
+		nv.Value, nv.Updated = req.Value, time.Now()
+		if err = a.store.putVar(nv); err == nil {
+			fmt.Printf("%s: set variable %s\n", nv.Updated, nv.key())
+			v, err = nv.key(), a.updatePayload()
+		}
+	case "delete":
+		nv, _ := parseVar(req.Name)
+		if err = a.store.deleteVar(nv.key()); err == nil {
+			fmt.Printf("%s: deleted variable %s\n", time.Now(), nv.key())
+			v, err = nv.key(), a.updatePayload()
+		}
+	}
+	if err != nil {
+		httpError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	payload, err := json.Marshal(v)
+	if err != nil {
+		httpError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write(payload)
+}
+
+func validVar(name, value string) error {
+	if _, err := parseVar(name); err != nil {
+		return err
+	}
+	if len(value) > maxVarValue {
+		return errors.New("variable value is too long")
+	}
+	return nil
+}
+
+func printVar(v *variable) {
+	fmt.Printf("%s=%s (updated %s)\n", v.key(), v.Value, v.Updated.Format(time.RFC3339))
+}
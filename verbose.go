@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// verbosity is how much is printed: levelQuiet with -q, levelDebug with
+// -v, levelTrace with -vv, and 0 by default.
+var verbosity int
+
+const (
+	levelQuiet = -1
+	levelDebug = 1
+	levelTrace = 2
+)
+
+// logf prints output the user can do without, unless -q.
+func logf(format string, args ...any) {
+	if verbosity > levelQuiet {
+		fmt.Printf(format, args...)
+	}
+}
+
+// debugf prints detail to stderr with -v, so it does not mix with JSON
+// output.
+func debugf(format string, args ...any) {
+	if verbosity >= levelDebug {
+		fmt.Fprintf(os.Stderr, "debug: "+format, args...)
+	}
+}
+
+// verboseTransport traces requests to stderr with -vv: the method, url,
+// status and duration of each, and the headers sent and received, except
+// for credentials.
+type verboseTransport struct {
+	http.RoundTripper
+}
+
+func (t verboseTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	start := time.Now()
+	resp, err := t.RoundTripper.RoundTrip(r)
+	elapsed := time.Since(start).Round(time.Millisecond)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "http: %s %s: %s in %s\n", r.Method, r.URL, err, elapsed)
+		return nil, err
+	}
+	fmt.Fprintf(os.Stderr, "http: %s %s: %s in %s\n", r.Method, r.URL, resp.Status, elapsed)
+	printHeaders("> ", r.Header)
+	printHeaders("< ", resp.Header)
+	return resp, nil
+}
+
+func printHeaders(prefix string, h http.Header) {
+	names := make([]string, 0, len(h))
+	for name := range h {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		value := strings.Join(h[name], ", ")
+		if name == "Authorization" || name == "Cookie" {
+			value = "[redacted]"
+		}
+		fmt.Fprintf(os.Stderr, "http: %s%s: %s\n", prefix, name, value)
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os/exec"
+	"path"
+	"regexp"
+	"time"
+)
+
+// check is a verification step run by the agent after a successful command.
+// A check probes URL, or runs Cmd, expecting status or exit Code (default 200
+// for URL, 0 for Cmd) and output matching Match. It is retried until it
+// passes or Wait has elapsed.
+type check struct {
+	URL, Match string
+	Cmd        []string
+	Code       int
+	Wait       time.Duration
+}
+
+// verifyBinary returns the base name of the binary the verification of c
+// runs, if any: a command in its own right for rbac and policy.
+func (c *cmd) verifyBinary() string {
+	if c.Verify == nil || len(c.Verify.Cmd) == 0 {
+		return ""
+	}
+	return path.Base(c.Verify.Cmd[0])
+}
+
+func (ck *check) run() string {
+	deadline := time.Now().Add(ck.Wait)
+	for {
+		err := ck.probe()
+		if err == nil {
+			return "passed"
+		}
+		if time.Now().After(deadline) {
+			return "failed: " + err.Error()
+		}
+		time.Sleep(time.Second)
+	}
+}
+
+func (ck *check) probe() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	var code int
+	var out []byte
+	switch {
+	case ck.URL != "":
+		req, err := http.NewRequestWithContext(ctx, "GET", ck.URL, nil)
+		if err != nil {
+			return err
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if out, err = io.ReadAll(io.LimitReader(resp.Body, 1<<20)); err != nil {
+			return err
+		}
+		code = resp.StatusCode
+	case len(ck.Cmd) > 0:
+		var err error
+		out, err = exec.CommandContext(ctx, ck.Cmd[0], ck.Cmd[1:]...).Output()
+		if err != nil {
+			if exitErr, ok := err.(*exec.ExitError); ok {
+				code = exitErr.ExitCode()
+			} else {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("check has no url or cmd")
+	}
+	want := ck.Code
+	if want == 0 && ck.URL != "" {
+		want = http.StatusOK
+	}
+	if code != want {
+		return fmt.Errorf("got code %d, want %d", code, want)
+	}
+	if ck.Match != "" {
+		re, err := regexp.Compile(ck.Match)
+		if err != nil {
+			return err
+		}
+		if !re.Match(bytes.TrimSpace(out)) {
+			return fmt.Errorf("output does not match %q", ck.Match)
+		}
+	}
+	return nil
+}
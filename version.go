@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/intob/captain/internal/httpclient"
+)
+
+// protocolVersion is the version of the wire format. It is signed with
+// every command and log, and announced in the X-Captain-Version header, so
+// incompatible peers fail explicitly rather than with invalid checksums.
+const (
+	protocolVersion = 2
+	versionHeader   = "X-Captain-Version"
+)
+
+// retrier retries requests to servers, and stops calling those that are
+// down for a while.
+var retrier = httpclient.New(http.DefaultTransport)
+
+// client sends the protocol version with every request to a server.
+var client = &http.Client{Transport: versionTransport{retrier}}
+
+type versionTransport struct {
+	http.RoundTripper
+}
+
+func (t versionTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	r = r.Clone(r.Context())
+	r.Header.Set(versionHeader, strconv.Itoa(protocolVersion))
+	return t.RoundTripper.RoundTrip(r)
+}
+
+func checkVersion(v int) error {
+	if v != protocolVersion {
+		return fmt.Errorf("unsupported protocol version %d, want %d", v, protocolVersion)
+	}
+	return nil
+}
+
+// headerVersion checks the version announced by a peer. Peers that predate
+// versioning send no header, and are reported as version 0.
+func headerVersion(h http.Header) error {
+	s := h.Get(versionHeader)
+	if s == "" {
+		return checkVersion(0)
+	}
+	v, err := strconv.Atoi(s)
+	if err != nil {
+		return fmt.Errorf("invalid protocol version %q", s)
+	}
+	return checkVersion(v)
+}
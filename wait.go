@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"sort"
+	"strings"
+	"time"
+)
+
+// exitTimeout is the exit code of send when a targeted agent did not report
+// before -wait elapsed, as in timeout(1).
+const exitTimeout = 124
+
+// waitResults polls the targets for results of c until every agent it
+// targets has reported, or the deadline passes. A command targeting all
+// agents waits until the deadline.
+func waitResults(c *cmd, targets []string, deadline time.Time) []*result {
+	byAgent := make(map[string]*result)
+	sp := newSpinner()
+	defer sp.clear()
+	var progress *rollout
+	if sp.on {
+		progress = newRollout(c, targets)
+	}
+	for {
+		delivered := make(map[string]bool)
+		for _, target := range targets {
+			results, err := getResults(c.ID, target)
+			if err != nil {
+				sp.clear()
+				fmt.Println(err)
+				continue
+			}
+			if progress != nil {
+				if d, err := getDelivered(c.ID, target); err == nil {
+					maps.Copy(delivered, d)
+				}
+			}
+			for _, res := range results {
+				if res.State == stateRebooting {
+					continue
+				}
+				byAgent[res.Agent] = res
+			}
+		}
+		if len(c.Agents) > 0 && len(byAgent) >= len(c.Agents) || time.Now().After(deadline) {
+			break
+		}
+		for i := 0; i < 10 && time.Now().Before(deadline); i++ {
+			if progress != nil {
+				sp.update(progress.lines(byAgent, delivered)...)
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+	}
+	results := make([]*result, 0, len(byAgent))
+	for _, res := range byAgent {
+		results = append(results, res)
+	}
+	sort.Slice(results, func(i, j int) bool { return results[i].Agent < results[j].Agent })
+	return results
+}
+
+// exitCode aggregates the results of c into a process exit code: the exit
+// code of the first failed agent (by agent id), 1 if it failed without an
+// exit code or its verification failed, exitTimeout if an agent did not
+// report, and 0 otherwise. With assertions, only failed assertions count.
+func exitCode(c *cmd, results []*result) int {
+	for _, res := range results {
+		switch {
+		case res.Assert != "":
+			if res.Assert != "passed" {
+				return 1
+			}
+		case res.ExitCode > 0:
+			return res.ExitCode
+		case res.ExitCode < 0, res.Error != "", strings.HasPrefix(res.Check, "failed"):
+			return 1
+		}
+	}
+	if len(results) == 0 || len(results) < len(c.Agents) {
+		return exitTimeout
+	}
+	return 0
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// parseWhen reads a window bound: an RFC 3339 time, a duration from now,
+// or a local time of day (15:04), meaning its next occurrence after after.
+func parseWhen(s string, now, after time.Time) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	if d, err := time.ParseDuration(s); err == nil {
+		return now.Add(d), nil
+	}
+	clock, err := time.ParseInLocation("15:04", s, time.Local)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid time %q: want RFC 3339, a duration or 15:04", s)
+	}
+	t := time.Date(after.Year(), after.Month(), after.Day(), clock.Hour(), clock.Minute(), 0, 0, time.Local)
+	if !t.After(after) {
+		t = t.AddDate(0, 0, 1)
+	}
+	return t, nil
+}
+
+// setWindow limits execution of c to a window. A time of day for the end
+// means its next occurrence after the start.
+func (c *cmd) setWindow(notBefore, notAfter string) error {
+	var err error
+	if notBefore != "" {
+		if c.NotBefore, err = parseWhen(notBefore, c.Created, c.Created); err != nil {
+			return err
+		}
+	}
+	if notAfter != "" {
+		start := c.Created
+		if !c.NotBefore.IsZero() {
+			start = c.NotBefore
+		}
+		if c.NotAfter, err = parseWhen(notAfter, c.Created, start); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseHours reads daily local hours, 15:04-15:04, which wrap past
+// midnight if the end is earlier than the start, as minutes of the day.
+func parseHours(s string) (from, to int, err error) {
+	start, end, ok := strings.Cut(s, "-")
+	a, aerr := time.Parse("15:04", start)
+	b, berr := time.Parse("15:04", end)
+	if !ok || aerr != nil || berr != nil || start == end {
+		return 0, 0, fmt.Errorf("invalid local hours %q: want 15:04-15:04", s)
+	}
+	return a.Hour()*60 + a.Minute(), b.Hour()*60 + b.Minute(), nil
+}
+
+// nextOpen returns t if the daily hours include it, or when they next open
+// after it, in the location of t.
+func nextOpen(hours string, t time.Time) time.Time {
+	from, to, err := parseHours(hours)
+	if err != nil {
+		return t
+	}
+	m := t.Hour()*60 + t.Minute()
+	if from < to && m >= from && m < to || from > to && (m >= from || m < to) {
+		return t
+	}
+	open := time.Date(t.Year(), t.Month(), t.Day(), from/60, from%60, 0, 0, t.Location())
+	if !open.After(t) {
+		open = open.AddDate(0, 0, 1)
+	}
+	return open
+}
+
+// opensAfter reports whether the window of c opens after t, at the agent's
+// local hours if it has them.
+func (c *cmd) opensAfter(t time.Time) bool {
+	if c.NotBefore.After(t) {
+		return true
+	}
+	if c.LocalHours == "" {
+		return false
+	}
+	start := c.Created
+	if c.NotBefore.After(start) {
+		start = c.NotBefore
+	}
+	return nextOpen(c.LocalHours, start.Local()).After(t)
+}